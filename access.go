@@ -0,0 +1,41 @@
+package agx
+
+// This file contains access control of requests from the master agent
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+// AccessHook decides whether a request may access a variable. It is called
+// before dispatch with the type of the request PDU, the context of the request
+// ("" for the default context) and the oid requested, and returns
+// ResponseNoError to allow the access or the error to refuse it with, usually
+// ResponseNoAccess or ResponseNotWritable.
+type AccessHook func(pdu PDUType, context string, oid Subtree) int16
+
+// WithAccessControl consults h for every varbind of get, getnext and test-set
+// requests. A refused request is answered with the error returned by h and
+// the index of the refused varbind, without any of its varbinds reaching the
+// handlers. This allows views to be enforced by the agent itself, in addition
+// to the access control of the master agent.
+func WithAccessControl(h AccessHook) Option {
+	return func(c *Connection) {
+		c.access = h
+	}
+}
+
+// checkAccess consults the access hook for each of oids, returning the error
+// and 1 based index of the first refused oid, or ResponseNoError
+func (c *Connection) checkAccess(pdu PDUType, context *OctetString,
+	oids []Subtree) (int16, int16) {
+
+	if c.access == nil {
+		return ResponseNoError, 0
+	}
+	ctx := string(ContextOf(context))
+	for i, oid := range oids {
+		if code := c.access(pdu, ctx, oid); code != ResponseNoError {
+			return code, int16(i + 1)
+		}
+	}
+	return ResponseNoError, 0
+}
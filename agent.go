@@ -0,0 +1,278 @@
+package agx
+
+// This file contains agents, which serve one set of handlers to several
+// master agents at once
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * Agents
+ *----------------------------------------------------------------------------*/
+
+// Agent serves the same handlers and registrations to several master agents,
+// e.g. a primary and a backup snmpd. The embedded Dispatcher holds the
+// handlers, which are installed on the connection to each master as it is
+// added and as they are set. Each connection dispatches and keeps statistics
+// on its own, see Masters.
+type Agent struct {
+	Dispatcher
+
+	id, descr string
+
+	mtx      sync.Mutex
+	masters  []*master
+	subtrees []string
+}
+
+type master struct {
+	name string
+	conn *Connection
+}
+
+// MasterStatus is the health of the session with a master agent
+type MasterStatus struct {
+	Name         string
+	Connected    bool
+	LastActivity time.Time
+	LastPingRTT  time.Duration
+	CloseReason  CloseReason
+	Stats        []HandlerStats
+}
+
+// NewAgent returns an agent that opens its sessions with the provided id and
+// description
+func NewAgent(id, descr string) *Agent {
+	return &Agent{id: id, descr: descr}
+}
+
+// AddMaster connects to a master agent, configured by opts as for Connect,
+// and serves it the handlers and registrations of the agent. Masters are
+// known by name, adding a master again under the name of one whose session
+// has closed replaces it.
+func (a *Agent) AddMaster(name string, opts ...Option) (*Connection, error) {
+	a.mtx.Lock()
+	for _, m := range a.masters {
+		if m.name == name && m.conn.IsConnected() {
+			a.mtx.Unlock()
+			return nil, fmt.Errorf("master %s is already connected", name)
+		}
+	}
+	a.mtx.Unlock()
+
+	opts = append([]Option{WithDescription(a.descr)}, opts...)
+	c, err := Connect(a.id, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to master %s: %v", name, err)
+	}
+	//handlers set from here on are installed on the new master too
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	err = c.Install(a.Handlers())
+	if err != nil {
+		c.Disconnect()
+		return nil, err
+	}
+	for _, x := range a.declaredSyntaxes() {
+		c.declareSyntax(x)
+	}
+	for _, oid := range a.subtrees {
+		if err := c.Register(oid); err != nil {
+			log.Printf("[agent] error registering %s with %s: %v", oid, name, err)
+		}
+	}
+	for i, m := range a.masters {
+		if m.name == name {
+			a.masters = append(a.masters[:i], a.masters[i+1:]...)
+			break
+		}
+	}
+	a.masters = append(a.masters, &master{name: name, conn: c})
+	return c, nil
+}
+
+// Master returns the connection to the named master, nil if there is none
+func (a *Agent) Master(name string) *Connection {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for _, m := range a.masters {
+		if m.name == name {
+			return m.conn
+		}
+	}
+	return nil
+}
+
+// Masters returns the health of the sessions with each master, in the order
+// they were added
+func (a *Agent) Masters() []MasterStatus {
+	a.mtx.Lock()
+	masters := append([]*master{}, a.masters...)
+	a.mtx.Unlock()
+
+	var ss []MasterStatus
+	for _, m := range masters {
+		ss = append(ss, MasterStatus{
+			Name:         m.name,
+			Connected:    m.conn.IsConnected(),
+			LastActivity: m.conn.LastActivity(),
+			LastPingRTT:  m.conn.LastPingRTT(),
+			CloseReason:  m.conn.CloseReason(),
+			Stats:        m.conn.Stats(),
+		})
+	}
+	return ss
+}
+
+// Register registers oid with every master, and with those added later. The
+// first error is returned, the other masters are registered with regardless.
+func (a *Agent) Register(oid string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.subtrees = append(a.subtrees, oid)
+	var err error
+	for _, m := range a.connected() {
+		if rerr := m.conn.Register(oid); rerr != nil && err == nil {
+			err = fmt.Errorf("error registering %s with %s: %v", oid, m.name, rerr)
+		}
+	}
+	return err
+}
+
+// Unregister undoes the registration of oid with every master
+func (a *Agent) Unregister(oid string) error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	for i, x := range a.subtrees {
+		if x == oid {
+			a.subtrees = append(a.subtrees[:i], a.subtrees[i+1:]...)
+			break
+		}
+	}
+	var err error
+	for _, m := range a.connected() {
+		if uerr := m.conn.Unregister(oid); uerr != nil && err == nil {
+			err = fmt.Errorf("error unregistering %s with %s: %v", oid, m.name,
+				uerr)
+		}
+	}
+	return err
+}
+
+// Shutdown shuts down the sessions with every master as Connection.Shutdown
+// does, returning the first error
+func (a *Agent) Shutdown(ctx context.Context) error {
+	a.mtx.Lock()
+	masters := a.connected()
+	a.mtx.Unlock()
+
+	errs := make(chan error, len(masters))
+	for _, m := range masters {
+		go func(c *Connection) { errs <- c.Shutdown(ctx) }(m.conn)
+	}
+	var err error
+	for range masters {
+		if serr := <-errs; serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// connected returns the masters whose sessions are open, a.mtx must be held
+func (a *Agent) connected() []*master {
+	var ms []*master
+	for _, m := range a.masters {
+		if m.conn.IsConnected() {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// handlers ...................................................................
+
+// each applies f to the connection to every master
+func (a *Agent) each(f func(c *Connection)) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for _, m := range a.masters {
+		f(m.conn)
+	}
+}
+
+func (a *Agent) OnGet(oid string, f GetHandler) {
+	a.Dispatcher.OnGet(oid, f)
+	a.each(func(c *Connection) { c.OnGet(oid, f) })
+}
+
+func (a *Agent) OnGetSubtree(oid string, f GetSubtreeHandler) {
+	a.Dispatcher.OnGetSubtree(oid, f)
+	a.each(func(c *Connection) { c.OnGetSubtree(oid, f) })
+}
+
+func (a *Agent) OnGetBatch(oid string, f GetBatchHandler) {
+	a.Dispatcher.OnGetBatch(oid, f)
+	a.each(func(c *Connection) { c.OnGetBatch(oid, f) })
+}
+
+func (a *Agent) OnTestSet(oid string, f TestSetHandler) {
+	a.Dispatcher.OnTestSet(oid, f)
+	a.each(func(c *Connection) { c.OnTestSet(oid, f) })
+}
+
+func (a *Agent) RemoveGet(oid string) {
+	a.Dispatcher.RemoveGet(oid)
+	a.each(func(c *Connection) { c.RemoveGet(oid) })
+}
+
+func (a *Agent) RemoveGetSubtree(oid string) {
+	a.Dispatcher.RemoveGetSubtree(oid)
+	a.each(func(c *Connection) { c.RemoveGetSubtree(oid) })
+}
+
+func (a *Agent) RemoveGetBatch(oid string) {
+	a.Dispatcher.RemoveGetBatch(oid)
+	a.each(func(c *Connection) { c.RemoveGetBatch(oid) })
+}
+
+func (a *Agent) RemoveTestSet(oid string) {
+	a.Dispatcher.RemoveTestSet(oid)
+	a.each(func(c *Connection) { c.RemoveTestSet(oid) })
+}
+
+func (a *Agent) RemoveHandlers(oid string) error {
+	if err := a.Dispatcher.RemoveHandlers(oid); err != nil {
+		return err
+	}
+	a.each(func(c *Connection) { c.RemoveHandlers(oid) })
+	return nil
+}
+
+func (a *Agent) DeclareSyntax(oid string, s Syntax) error {
+	if err := a.Dispatcher.DeclareSyntax(oid, s); err != nil {
+		return err
+	}
+	a.each(func(c *Connection) { c.DeclareSyntax(oid, s) })
+	return nil
+}
+
+func (a *Agent) OnCommitSet(f CommitSetHandler) {
+	a.Dispatcher.OnCommitSet(f)
+	a.each(func(c *Connection) { c.OnCommitSet(f) })
+}
+
+func (a *Agent) OnCleanupSet(f CleanupSetHandler) {
+	a.Dispatcher.OnCleanupSet(f)
+	a.each(func(c *Connection) { c.OnCleanupSet(f) })
+}
@@ -0,0 +1,134 @@
+package agx_test
+
+import (
+	"context"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/agxtest"
+	"testing"
+	"time"
+)
+
+func TestAgentMasters(t *testing.T) {
+	primary, err := agxtest.NewMockMaster()
+	if err != nil {
+		t.Fatalf("mock master failed %v", err)
+	}
+	defer primary.Close()
+	backup, err := agxtest.NewMockMaster()
+	if err != nil {
+		t.Fatalf("mock master failed %v", err)
+	}
+	defer backup.Close()
+
+	a := agx.NewAgent("1.2.3.4.7", "muffin man")
+	a.OnGet(egress+".1", func(oid agx.Subtree) agx.VarBind {
+		return agx.IntegerVarBind(oid, 1)
+	})
+	if err := a.Register(qbridge); err != nil {
+		t.Fatalf("error registering %v", err)
+	}
+	if _, err := a.AddMaster("primary", agx.WithSocketPath(primary.Path)); err != nil {
+		t.Fatalf("error adding primary %v", err)
+	}
+	if _, err := a.AddMaster("backup", agx.WithSocketPath(backup.Path)); err != nil {
+		t.Fatalf("error adding backup %v", err)
+	}
+	if _, err := a.AddMaster("backup", agx.WithSocketPath(backup.Path)); err == nil {
+		t.Errorf("expected error adding a connected master again")
+	}
+
+	//handlers set after the masters were added are served by both
+	a.OnGet(egress+".2", func(oid agx.Subtree) agx.VarBind {
+		return agx.IntegerVarBind(oid, 2)
+	})
+
+	for _, m := range []*agxtest.MockMaster{primary, backup} {
+		if err := m.WaitRegistration(qbridge); err != nil {
+			t.Fatalf("master did not see registration %v", err)
+		}
+		vbs, err := m.Get(egress+".1", egress+".2")
+		if err != nil {
+			t.Fatalf("get failed %v", err)
+		}
+		if vbs[0].Data != agx.Integer(1) || vbs[1].Data != agx.Integer(2) {
+			t.Errorf("unexpected varbinds %v", vbs)
+		}
+	}
+	primary.Get(egress + ".1")
+
+	ms := a.Masters()
+	if len(ms) != 2 || ms[0].Name != "primary" || ms[1].Name != "backup" {
+		t.Fatalf("unexpected masters %+v", ms)
+	}
+	calls := func(s agx.MasterStatus) uint64 {
+		for _, x := range s.Stats {
+			if x.Oid == egress+".1" {
+				return x.Calls
+			}
+		}
+		return 0
+	}
+	if !ms[0].Connected || calls(ms[0]) != 2 || calls(ms[1]) != 1 {
+		t.Errorf("unexpected master status %+v", ms)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown failed %v", err)
+	}
+}
+
+func TestAgentBatch(t *testing.T) {
+	m, err := agxtest.NewMockMaster()
+	if err != nil {
+		t.Fatalf("mock master failed %v", err)
+	}
+	defer m.Close()
+
+	a := agx.NewAgent("1.2.3.4.7", "muffin man")
+	if err := a.Register(qbridge); err != nil {
+		t.Fatalf("error registering %v", err)
+	}
+	if _, err := a.AddMaster("primary", agx.WithSocketPath(m.Path)); err != nil {
+		t.Fatalf("error adding primary %v", err)
+	}
+	if err := m.WaitRegistration(qbridge); err != nil {
+		t.Fatalf("master did not see registration %v", err)
+	}
+
+	//a batch handler set after the master was added is served by it
+	calls := 0
+	a.OnGetBatch(egress, func(oids []agx.Subtree, next bool) []agx.VarBind {
+		calls++
+		var vbs []agx.VarBind
+		for i, oid := range oids {
+			vbs = append(vbs, agx.IntegerVarBind(oid, int32(i+1)))
+		}
+		return vbs
+	})
+	vbs, err := m.Get(egress+".1", egress+".2")
+	if err != nil {
+		t.Fatalf("get failed %v", err)
+	}
+	if vbs[0].Data != agx.Integer(1) || vbs[1].Data != agx.Integer(2) ||
+		calls != 1 {
+		t.Errorf("unexpected varbinds %v after %d calls", vbs, calls)
+	}
+
+	//and removed from it
+	a.RemoveGetBatch(egress)
+	vbs, err = m.Get(egress + ".1")
+	if err != nil {
+		t.Fatalf("get failed %v", err)
+	}
+	if calls != 1 || vbs[0].Data == agx.Integer(1) {
+		t.Errorf("removed batch handler answered %v", vbs[0])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != nil {
+		t.Errorf("shutdown failed %v", err)
+	}
+}
@@ -7,78 +7,484 @@ package agx
 // GPLv3
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net"
-	"sort"
-	"strings"
+	"sync"
+	"time"
 )
 
 /*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
  * Connections
  *----------------------------------------------------------------------------*/
 type Connection struct {
+	//the handlers requests from the master are answered with
+	Dispatcher
+
 	//private members
-	conn               net.Conn
-	sessionId          int32
-	registrations      []string
-	closed             bool
-	getHandlers        map[string]GetHandler
-	getSubtreeHandlers map[string]GetSubtreeHandler
-	testSetHandlers    map[string]TestSetHandler
-	commitSetHandler   CommitSetHandler
-	cleanupSetHandler  CleanupSetHandler
+	sessionId uint32
+
+	//the client the session exchanges pdus with the master agent over, which
+	//routes those for the session to it. A client dialed for the session alone
+	//is closed along with it.
+	client     *Client
+	route      *route
+	ownsClient bool
+
+	//health tracking, guarded by mtx
+	mtx          sync.Mutex
+	lastActivity time.Time
+	lastPingRTT  time.Duration
+	closeReason  CloseReason
+
+	//requests sent to the master awaiting a response by packet id, guarded
+	//by mtx
+	pending map[uint32]*request
+
+	//closed once the session has ended, err says why, guarded by mtx
+	done chan struct{}
+	err  error
+
+	//limits, guarded by mtx
+	maxPayloadLength  int
+	maxResponseLength int
+
+	//wire tracing, nil unless enabled with WithTrace
+	tracer *tracer
+
+	//recording of the session, nil unless enabled with WithRecorder
+	recorder *Recorder
+
+	//set auditing, nil unless enabled with WithAudit
+	audit AuditHook
+
+	//access control, nil unless enabled with WithAccessControl
+	access AccessHook
+
+	//handlers that take over pdu types, guarded by mtx
+	raw map[PDUType]RawPDUHandler
+
+	//observers of received pdus, guarded by mtx
+	subscribers map[chan Message]struct{}
+
+	//write ahead journal of sets, nil unless enabled with WithJournal
+	journal *Journal
+
+	//request spans, nil unless enabled with WithSpanTracer
+	spans SpanTracer
+
+	//rate limits of get requests, guarded by mtx
+	rate   *bucket
+	limits []subtreeLimit
+
+	//queue of outgoing pdus, nil unless enabled with WithSendQueue
+	queue *sendQueue
+
+	//workers requests are handled on, nil unless enabled with WithWorkers
+	workers *pool
+
+	//where time is taken from, when the session was opened and how often
+	//the master is pinged
+	clock             Clock
+	opened            time.Time
+	keepaliveInterval time.Duration
+
+	//how the subagent opens its session, and where it logs to
+	descr   *string
+	timeout *byte
+	logger  Logger
+
+	//how and where the master agent is dialed
+	dialer    Dialer
+	network   string
+	address   string
+	socketErr error
+
+	//how long Disconnect waits for unregistrations to be acknowledged, zero
+	//unless enabled with WithUnregisterOnDisconnect
+	unregisterTimeout time.Duration
+
+	//how much of the timeout handlers are denied, when deadlines are
+	//enabled with WithHandlerDeadline
+	deadlines      bool
+	deadlineMargin time.Duration
+
+	//shutdown tracking, guarded by mtx
+	subtrees     []Registration
+	draining     bool
+	busy         int
+	transactions map[uint32]transaction
+	idle         chan struct{}
 
 	//public members
+
+	//Closed is closed once the session has ended.
+	//
+	//Deprecated: use Done and Err.
 	Closed chan bool
 }
 
+var (
+	//ErrDisconnected is the error of a session ended by Disconnect
+	ErrDisconnected = errors.New("session disconnected")
+
+	//ErrClosedByMaster is the error of a session closed by the master agent,
+	//the reason the master gave is available through CloseReason
+	ErrClosedByMaster = errors.New("session closed by master agent")
+
+	//ErrConnectionLost is the error of a session whose connection went away
+	//without the session being closed
+	ErrConnectionLost = errors.New("connection to master agent lost")
+)
+
+// MasterError is an error the master agent answered a request of the
+// subagent with (RFC2741~6.2.16)
+type MasterError int16
+
+func (e MasterError) Error() string {
+	return fmt.Sprintf("master agent answered %s", errorName(int16(e)))
+}
+
+// errors the master agent answers requests with
+const (
+	//ErrNotOpen is the answer to a request on a session the master does not
+	//know to be open
+	ErrNotOpen = MasterError(ResponseNotOpen)
+
+	//ErrUnsupportedContext is the answer to a registration in a context the
+	//master does not support
+	ErrUnsupportedContext = MasterError(ResponseUnsupportedContext)
+
+	//ErrDuplicateRegistration is the answer to a registration of a region
+	//registered at the same priority and in the same context already
+	ErrDuplicateRegistration = MasterError(ResponseDuplicateRegistration)
+
+	//ErrUnknownRegistration is the answer to an unregistration of a region
+	//that is not registered
+	ErrUnknownRegistration = MasterError(ResponseUnknownRegistration)
+
+	//ErrRequestDenied is the answer to a request the master will not carry
+	//out, e.g. as the subagent may not register the region
+	ErrRequestDenied = MasterError(ResponseRequestDenied)
+
+	//ErrProcessingError is the answer to a request the master failed to
+	//carry out
+	ErrProcessingError = MasterError(ResponseProcessingError)
+)
+
+// transaction tracks a set transaction from test-set until cleanup-set
+type transaction struct {
+	//the span of the transaction and the context it was started in
+	ctx  context.Context
+	span Span
+
+	//audit records of the varbinds that passed test-set
+	tested []AuditRecord
+}
+
 const (
 	ConnectionTimeout = 10 //only wait 10 seconds the master agent to reply
 	BasePriority      = 47 //the default priprity that is given to registrations
+	OpenTimeout       = 5  //the session timeout sessions are opened with
+)
+
+const (
+	MasterSocket        = "/var/agentx/master"
+	RetryInitialBackoff = 100 * time.Millisecond
+	RetryMaxBackoff     = 10 * time.Second
 )
 
-// Connect to an master agent using the provided id and description. The
+const (
+	DefaultMaxPayloadLength  = 64 * 1024 //largest payload accepted from master
+	DefaultMaxResponseLength = 64 * 1024 //largest payload sent to master
+)
+
+// Option configures a Connection as it is established
+type Option func(*Connection)
+
+// Connect to a master agent, identifying the subagent by the oid id. The
 // connection object that is returned holds the session information for the
 // connection. This connection pointer is the basis for using most other
 // functions in the agx API.
-func Connect(id, descr *string) (*Connection, error) {
-	log.Printf("connecting")
+func Connect(id string, opts ...Option) (*Connection, error) {
+	c := newConnection(opts)
+	c.logf("connecting")
 
-	//use the well known agentx unix socket (RFC2741~8.2)
-	c := &Connection{}
-	conn, err := net.Dial("unix", "/var/agentx/master")
+	conn, err := c.dial()
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to agentx: %v", err)
 	}
-	c.conn = conn
+	return open(c, conn, oidOf(id), nil)
+}
+
+// oidOf returns the id a session is opened with, nil for the null oid
+func oidOf(id string) *string {
+	if id == "" {
+		return nil
+	}
+	return &id
+}
+
+// ConnectLegacy connects to a master agent using the provided id and
+// description, either of which may be nil.
+//
+// Deprecated: use Connect, with WithDescription for the description.
+func ConnectLegacy(id, descr *string, opts ...Option) (*Connection, error) {
+	if descr != nil {
+		opts = append(opts, WithDescription(*descr))
+	}
+	if id == nil {
+		return Connect("", opts...)
+	}
+	return Connect(*id, opts...)
+}
+
+// WithDescription describes the subagent to the master agent
+func WithDescription(descr string) Option {
+	return func(c *Connection) {
+		c.descr = &descr
+	}
+}
+
+// WithTimeout asks the master agent to wait up to d for the subagent to
+// answer a request before it regards the subagent as not responding
+// (RFC2741~6.2.1), OpenTimeout seconds unless set otherwise. The timeout is
+// sent in whole seconds, rounded up, and is capped at 255 seconds. A timeout
+// of zero opens the session without a timeout of its own, leaving the master
+// to apply its default.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Connection) {
+		secs := (d + time.Second - 1) / time.Second
+		if secs < 0 {
+			secs = 0
+		}
+		if secs > 255 {
+			secs = 255
+		}
+		timeout := byte(secs)
+		c.timeout = &timeout
+	}
+}
+
+// Logger is where a Connection logs to, a *log.Logger satisfies it
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// WithLogger logs to l rather than to the standard logger
+func WithLogger(l Logger) Option {
+	return func(c *Connection) {
+		c.logger = l
+	}
+}
+
+// logf logs to the logger of c
+func (c *Connection) logf(format string, v ...interface{}) {
+	if c.logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	c.logger.Printf(format, v...)
+}
+
+// NewConnection opens a session with the master agent over an already
+// established conn, such as one set up through a proxy. Options that concern
+// dialing have no effect.
+func NewConnection(conn net.Conn, id, descr *string, opts ...Option) (
+	*Connection, error) {
+
+	return open(newConnection(opts), conn, id, descr)
+}
+
+// Dialer establishes the transport to a master agent, net.Dialer satisfies it
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// WithDialer dials the master agent with d rather than a net.Dialer
+func WithDialer(d Dialer) Option {
+	return func(c *Connection) {
+		c.dialer = d
+	}
+}
+
+// WithSocketPath connects to a master agent listening on the unix socket at
+// path rather than at MasterSocket
+func WithSocketPath(path string) Option {
+	return WithAddress("unix", path)
+}
+
+// WithAddress connects to a master agent at address on the named network,
+// e.g. WithAddress("tcp", "localhost:705") (RFC2741~8.1)
+func WithAddress(network, address string) Option {
+	return func(c *Connection) {
+		c.network = network
+		c.address = address
+		c.socketErr = nil
+	}
+}
+
+// ConnectWithRetry is like Connect, except that when the master agent socket
+// cannot be dialed (e.g. snmpd has not started yet) dialing is retried with
+// exponential backoff and jitter until it succeeds or the provided context is
+// done.
+func ConnectWithRetry(ctx context.Context, id string, opts ...Option) (
+	*Connection, error) {
+
+	c := newConnection(opts)
+	c.logf("connecting")
+
+	backoff := RetryInitialBackoff
+	for {
+		conn, err := c.dial()
+		if err == nil {
+			return open(c, conn, oidOf(id), nil)
+		}
+
+		//wait somewhere between half of and the full backoff interval
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		c.logf("master agent unavailable, retrying in %v: %v", wait, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("error connecting to agentx: %v: %v",
+				ctx.Err(), err)
+		case <-c.clock.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > RetryMaxBackoff {
+			backoff = RetryMaxBackoff
+		}
+	}
+}
+
+// ConnectWithRetryLegacy retries connecting as ConnectWithRetry does, using
+// the provided id and description, either of which may be nil.
+//
+// Deprecated: use ConnectWithRetry, with WithDescription for the description.
+func ConnectWithRetryLegacy(ctx context.Context, id, descr *string,
+	opts ...Option) (*Connection, error) {
+
+	if descr != nil {
+		opts = append(opts, WithDescription(*descr))
+	}
+	if id == nil {
+		return ConnectWithRetry(ctx, "", opts...)
+	}
+	return ConnectWithRetry(ctx, *id, opts...)
+}
+
+// dial connects to the master agent, by default at the socket named by
+// SocketEnv or else over the well known agentx unix socket (RFC2741~8.2)
+func (c *Connection) dial() (net.Conn, error) {
+	if c.socketErr != nil {
+		return nil, c.socketErr
+	}
+	return c.dialer.Dial(c.network, c.address)
+}
+
+// newConnection returns a connection that has yet to be opened, configured by
+// opts
+func newConnection(opts []Option) *Connection {
+	c := &Connection{}
 	c.Closed = make(chan bool)
-	c.getHandlers = make(map[string]GetHandler)
-	c.getSubtreeHandlers = make(map[string]GetSubtreeHandler)
-	c.testSetHandlers = make(map[string]TestSetHandler)
+	c.done = make(chan struct{})
+	c.transactions = make(map[uint32]transaction)
+	c.idle = make(chan struct{}, 1)
+	c.maxPayloadLength = DefaultMaxPayloadLength
+	c.maxResponseLength = DefaultMaxResponseLength
+	c.dialer = &net.Dialer{}
+	c.clock = RealClock
+	c.defaultSocket()
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.Dispatcher.clock, c.Dispatcher.logger = c.clock, c.logger
+	if c.deadlines {
+		//the master's default is unknown without a timeout of the session,
+		//so that of NewOpenMessage is assumed
+		timeout := OpenTimeout * time.Second
+		if c.timeout != nil && *c.timeout != 0 {
+			timeout = time.Duration(*c.timeout) * time.Second
+		}
+		c.SetHandlerDeadline(timeout-c.deadlineMargin, c.deadlineMargin)
+	}
+	return c
+}
+
+// open establishes a new AgentX session with the master over conn, which the
+// session has to itself
+func open(c *Connection, conn net.Conn, id, descr *string) (*Connection, error) {
+	cl := NewClient(conn)
+	cl.logger = c.logger
+	c.ownsClient = true
+	if err := c.open(cl, id, descr); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// open establishes a new AgentX session with the master over the client cl
+// and starts the root message handler for it
+func (c *Connection) open(cl *Client, id, descr *string) error {
+	cl.opening.Lock()
+	defer cl.opening.Unlock()
+
+	c.client = cl
+	c.route = newRoute()
+	if c.queue != nil {
+		go c.queue.write(c, c.writer())
+	}
+	fail := func(err error) error {
+		c.hangUp()
+		c.stopQueue()
+		return err
+	}
 
 	//try to open a new AgentX session with the master
+	if descr == nil {
+		descr = c.descr
+	}
 	m, err := NewOpenMessage(id, descr)
 	if err != nil {
-		return nil, fmt.Errorf("error creating open message: %v", err)
+		return fail(fmt.Errorf("error creating open message: %v", err))
+	}
+	if c.timeout != nil {
+		m.Timeout = *c.timeout
+	}
+	m.Header.PacketId = cl.nextPacketId()
+	err = cl.expect(c, m.Header.PacketId)
+	if err != nil {
+		return fail(fmt.Errorf("error opening agentx session: %v", err))
 	}
 	hdr, buf, err := sendrecvMsg(m, c)
+	if err != nil {
+		return fail(fmt.Errorf("error opening agentx session: %v", err))
+	}
 
 	//grab the response payload, extract and save the sessionId
 	p := &ResponsePayload{}
 	_, err = p.UnmarshalBinary(buf[HeaderSize:])
 	if err != nil {
-		log.Printf("error reading open response playload: %v", err)
-		return nil, err
+		c.logf("error reading open response playload: %v", err)
+		return fail(err)
 	}
 	c.sessionId = hdr.SessionId
+	c.opened = c.clock.Now()
 
-	log.Printf("agent entering read loop")
+	c.logf("agent entering read loop")
 
 	go rootMessageHandler(c)
+	if c.keepaliveInterval > 0 {
+		go c.keepalive(c.keepaliveInterval)
+	}
 
-	return c, nil
+	return nil
 }
 
 // Disconnect from the master agent. Sends a close PDU to the master agent
@@ -86,7 +492,14 @@ func Connect(id, descr *string) (*Connection, error) {
 // connection object pointer. The passed in connection will be useless after
 // this call.
 func (c *Connection) Disconnect() {
-	log.Printf("disconnecting session %d", c.sessionId)
+	c.logf("disconnecting session %d", c.sessionId)
+
+	c.mtx.Lock()
+	timeout := c.unregisterTimeout
+	c.mtx.Unlock()
+	if timeout > 0 {
+		c.unregisterAll(timeout)
+	}
 
 	//send the close PDU to the master
 	msg := NewCloseMessage(CloseReasonShutdown, c.sessionId)
@@ -95,106 +508,564 @@ func (c *Connection) Disconnect() {
 		if err == io.EOF {
 			//ok connection is aleady closed
 		} else {
-			log.Printf("error closing connection %v", err)
+			c.logf("error closing connection %v", err)
 		}
 	}
 }
 
+// IsConnected reports whether the session with the master agent is still
+// open.
+func (c *Connection) IsConnected() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.err == nil
+}
+
+// Done returns a channel that is closed once the session with the master agent
+// has ended, after which Err says why.
+func (c *Connection) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns nil while the session with the master agent is open, and why
+// it ended once Done is closed.
+func (c *Connection) Err() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.err
+}
+
+// LastActivity returns the last time a PDU was sent to or received from the
+// master agent.
+func (c *Connection) LastActivity() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.lastActivity
+}
+
+// LastPingRTT returns the round trip time of the most recent ping answered by
+// the master agent, or zero if no ping has been answered yet.
+func (c *Connection) LastPingRTT() time.Duration {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.lastPingRTT
+}
+
+// the varbinds every notification starts with (RFC3418)
+const (
+	sysUpTimeInstance   = "1.3.6.1.2.1.1.3.0"
+	snmpTrapOIDInstance = "1.3.6.1.6.3.1.1.4.1.0"
+)
+
+// Notify sends the notification trap to the master agent, which forwards it
+// to managers as a trap or inform. The notification carries the uptime of the
+// session and trap ahead of vbs. The answer of the master is logged rather
+// than waited for.
+func (c *Connection) Notify(trap string, vbs ...VarBind) error {
+	return c.NotifyIn(DefaultContext, trap, vbs...)
+}
+
+// NotifyIn sends the notification trap in the context cx, see Notify
+func (c *Connection) NotifyIn(cx Context, trap string,
+	vbs ...VarBind) error {
+
+	oid, err := NewSubtree(trap)
+	if err != nil {
+		return fmt.Errorf("failed creating notification %v", err)
+	}
+	uptime, _ := NewSubtree(sysUpTimeInstance)
+	trapOID, _ := NewSubtree(snmpTrapOIDInstance)
+
+	list := []VarBind{
+		NewVarBind(*uptime, c.SysUpTime()),
+		NewVarBind(*trapOID, Oid{*oid}),
+	}
+	m := NewNotifyMessage(c.sessionId, cx, append(list, vbs...))
+	_, err = c.send(m, &m.Header, "notification "+oid.String())
+	return err
+}
+
+// Registration describes a region of the mib registered with the master agent
+// (RFC2741~6.2.3). When RangeSubid is non-zero the sub-identifier at that
+// position of Subtree ranges up to UpperBound.
+type Registration struct {
+	Subtree    string
+	Context    Context
+	Priority   byte
+	Timeout    byte
+	RangeSubid byte
+	UpperBound uint32
+}
+
+// same reports whether r and x register the same region with the same
+// priority in the same context
+func (r Registration) same(x Registration) bool {
+	a, err := NewSubtree(r.Subtree)
+	if err != nil {
+		return false
+	}
+	b, err := NewSubtree(x.Subtree)
+	if err != nil {
+		return false
+	}
+	return a.Compare(*b) == 0 &&
+		r.Context == x.Context &&
+		r.Priority == x.Priority &&
+		r.RangeSubid == x.RangeSubid &&
+		(r.RangeSubid == 0 || r.UpperBound == x.UpperBound)
+}
+
+// Register registers oid with the default priority and context
 func (c *Connection) Register(oid string) error {
-	return c.doRegister(oid, false)
+	return c.RegisterWith(Registration{
+		Subtree:  oid,
+		Priority: BasePriority,
+		Timeout:  ConnectionTimeout,
+	})
+}
+
+// RegisterWith registers r with the master agent. An identical registration
+// that is already active on the session is an error, as the master agent
+// would refuse it with a duplicateRegistration response.
+func (c *Connection) RegisterWith(r Registration) error {
+	_, err := c.register(r)
+	return err
+}
+
+// RegisterContext registers r with the master agent as RegisterWith does, and
+// waits until the master has answered or the context is done. A registration
+// the master refuses is forgotten and the MasterError it answered with, e.g.
+// ErrDuplicateRegistration, is returned.
+func (c *Connection) RegisterContext(ctx context.Context, r Registration) error {
+	answer, err := c.register(r)
+	if err != nil {
+		return err
+	}
+	err = c.await(ctx, answer)
+	if _, ok := err.(MasterError); ok {
+		c.forgetRegistration(r)
+	}
+	return err
+}
+
+// register keeps track of r, so that it can be undone on shutdown, and sends
+// it to the master agent
+func (c *Connection) register(r Registration) (<-chan *Response, error) {
+	if _, err := NewSubtree(r.Subtree); err != nil {
+		return nil, fmt.Errorf("failed creating registration message %v", err)
+	}
+
+	c.mtx.Lock()
+	for _, x := range c.subtrees {
+		if x.same(r) {
+			c.mtx.Unlock()
+			return nil, fmt.Errorf("%s is already registered", r.Subtree)
+		}
+	}
+	c.subtrees = append(c.subtrees, r)
+	c.mtx.Unlock()
+
+	return c.doRegister(r, false)
 }
 
+// forgetRegistration stops keeping track of a registration the master agent
+// refused
+func (c *Connection) forgetRegistration(r Registration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for i, x := range c.subtrees {
+		if x.same(r) {
+			c.subtrees = append(c.subtrees[:i], c.subtrees[i+1:]...)
+			if s, err := NewSubtree(r.Subtree); err == nil {
+				c.regions.remove(*s)
+			}
+			return
+		}
+	}
+}
+
+// Unregister undoes the registration of oid. The master only removes a
+// registration that matches it in priority, context and range
+// (RFC2741~7.1.5.1), so the parameters it was registered with are mirrored.
+// When oid is registered more than once the earliest registration is undone.
 func (c *Connection) Unregister(oid string) error {
-	return c.doRegister(oid, true)
+	s, err := NewSubtree(oid)
+	if err != nil {
+		return fmt.Errorf("failed creating registration message %v", err)
+	}
+	_, err = c.unregister(oid, func(x Registration) bool {
+		y, err := NewSubtree(x.Subtree)
+		return err == nil && y.Compare(*s) == 0
+	})
+	return err
+}
+
+// Retire unregisters oid and removes every handler installed at or beneath
+// it, so that nothing is left to answer for the region
+func (c *Connection) Retire(oid string) error {
+	err := c.Unregister(oid)
+	if rerr := c.RemoveHandlers(oid); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// UnregisterWith undoes the registration identical to r
+func (c *Connection) UnregisterWith(r Registration) error {
+	_, err := c.unregister(r.Subtree, r.same)
+	return err
 }
 
-func (c *Connection) doRegister(oid string, unregister bool) error {
+// UnregisterContext undoes the registration identical to r as UnregisterWith
+// does, and waits until the master has answered or the context is done. The
+// MasterError the master answered with, e.g. ErrUnknownRegistration, is
+// returned.
+func (c *Connection) UnregisterContext(ctx context.Context,
+	r Registration) error {
+
+	answer, err := c.unregister(r.Subtree, r.same)
+	if err != nil {
+		return err
+	}
+	return c.await(ctx, answer)
+}
+
+// unregister undoes the first active registration matching match
+func (c *Connection) unregister(oid string,
+	match func(Registration) bool) (<-chan *Response, error) {
+
+	c.mtx.Lock()
+	for i, x := range c.subtrees {
+		if match(x) {
+			c.subtrees = append(c.subtrees[:i], c.subtrees[i+1:]...)
+			c.mtx.Unlock()
+			return c.doRegister(x, true)
+		}
+	}
+	c.mtx.Unlock()
+
+	return nil, fmt.Errorf("%s is not registered", oid)
+}
+
+// doRegister sends the (un)registration r, returning the channel the answer
+// of the master is delivered on
+func (c *Connection) doRegister(r Registration, unregister bool) (
+	<-chan *Response, error) {
 
 	var m *RegisterMessage
 	var err error
-	var context = ""
+	var upperBound *int32
+	if r.RangeSubid != 0 {
+		ub := int32(r.UpperBound)
+		upperBound = &ub
+	}
 	if unregister {
-		m, err = NewUnregisterMessage(oid, &context, nil)
+		m, err = NewUnregisterMessage(r.Subtree, r.Context, upperBound)
 	} else {
-		m, err = NewRegisterMessage(oid, &context, nil)
+		m, err = NewRegisterMessage(r.Subtree, r.Context, upperBound)
 	}
-	m.Header.PacketId = int32(len(c.registrations))
-	c.registrations = append(c.registrations, oid)
-
-	m.Header.SessionId = c.sessionId
 	if err != nil {
-		return fmt.Errorf("failed creating registration message %v", err)
+		return nil, fmt.Errorf("failed creating registration message %v", err)
+	}
+	if !unregister {
+		m.Timeout = r.Timeout
+	}
+	m.Priority = r.Priority
+	m.RangeSubid = r.RangeSubid
+	//handlers beneath a registered subtree are run one at a time
+	if unregister {
+		c.regions.remove(m.Subtree)
+	} else {
+		c.regions.add(m.Subtree, time.Duration(m.Timeout)*time.Second)
 	}
 
-	sendMsg(m, c)
+	return c.send(m, &m.Header, r.Subtree)
+}
 
-	return nil
+// WithUnregisterOnDisconnect unregisters every active registration before the
+// session is closed by Disconnect, waiting up to timeout for the master to
+// acknowledge them. Masters that hold on to registrations across subagent
+// sessions then do not go on serving regions of a subagent that has gone.
+func WithUnregisterOnDisconnect(timeout time.Duration) Option {
+	return func(c *Connection) {
+		c.unregisterTimeout = timeout
+	}
 }
 
-/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
- * Agents
- *----------------------------------------------------------------------------*/
-type GetHandler func(oid Subtree) VarBind
-type GetSubtreeHandler func(oid Subtree, next bool) VarBind
-type TestSetHandler func(vars VarBind, sessionId int) TestSetResult
-type CommitSetHandler func(sessionId int) CommitSetResult
-type CleanupSetHandler func(sessionId int)
+// unregisterAll unregisters every active registration and waits until the
+// master has acknowledged them or timeout has passed
+func (c *Connection) unregisterAll(timeout time.Duration) {
+	c.mtx.Lock()
+	regs := c.subtrees
+	c.subtrees = nil
+	c.mtx.Unlock()
+
+	var acks []<-chan *Response
+	for _, r := range regs {
+		ack, err := c.doRegister(r, true)
+		if err != nil {
+			c.logf("error unregistering %s: %v", r.Subtree, err)
+			continue
+		}
+		acks = append(acks, ack)
+	}
 
-func (c *Connection) OnGet(oid string, f GetHandler) {
-	c.getHandlers[oid] = f
+	expired := c.clock.After(timeout)
+	for i, ack := range acks {
+		select {
+		case <-ack:
+		case <-expired:
+			c.logf("%d unregistrations unacknowledged after %v",
+				len(acks)-i, timeout)
+			return
+		}
+	}
 }
 
-func (c *Connection) OnGetSubtree(oid string, f GetSubtreeHandler) {
-	c.getSubtreeHandlers[oid] = f
+// Shutdown gracefully ends the session with the master agent. New get and
+// test-set requests are refused with a processing error while handlers that
+// are already running and set transactions that are already underway are
+// allowed to finish. Once the connection is idle, or the provided context is
+// done, all active registrations are unregistered and the session is closed.
+// If the context expired before the connection went idle, its error is
+// returned.
+func (c *Connection) Shutdown(ctx context.Context) error {
+	c.logf("shutting down session %d", c.sessionId)
+
+	c.mtx.Lock()
+	c.draining = true
+	c.mtx.Unlock()
+
+	err := c.waitIdle(ctx)
+	if err != nil {
+		c.logf("shutdown proceeding with work in flight: %v", err)
+	}
+
+	c.mtx.Lock()
+	subtrees := make([]Registration, len(c.subtrees))
+	copy(subtrees, c.subtrees)
+	c.mtx.Unlock()
+
+	for _, r := range subtrees {
+		if uerr := c.UnregisterWith(r); uerr != nil {
+			c.logf("error unregistering %s: %v", r.Subtree, uerr)
+		}
+	}
+	c.Disconnect()
+
+	return err
 }
 
-func (c *Connection) OnTestSet(oid string, f TestSetHandler) {
-	c.testSetHandlers[oid] = f
+// waitIdle blocks until no handlers are executing and no set transactions are
+// open, or the context is done
+func (c *Connection) waitIdle(ctx context.Context) error {
+	for {
+		c.mtx.Lock()
+		idle := c.busy == 0 && len(c.transactions) == 0
+		c.mtx.Unlock()
+		if idle {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.idle:
+		}
+	}
 }
 
-func (c *Connection) OnCommitSet(f CommitSetHandler) {
-	c.commitSetHandler = f
+// begin marks the start of handler execution, returning false if the
+// connection is draining and new work should be refused
+func (c *Connection) begin(h *Header) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.draining {
+		//a test-set opens a new transaction, the later phases of transactions
+		//that are already underway may run to completion
+		switch h.Type {
+		case GetPDU, GetNextPDU, GetBulkPDU, TestSetPDU:
+			return false
+		}
+	}
+	c.busy++
+	return true
 }
 
-func (c *Connection) OnCleanupSet(f CleanupSetHandler) {
-	c.cleanupSetHandler = f
+// end marks the end of handler execution
+func (c *Connection) end() {
+	c.mtx.Lock()
+	c.busy--
+	c.mtx.Unlock()
+	c.signalIdle()
+}
+
+func (c *Connection) signalIdle() {
+	select {
+	case c.idle <- struct{}{}:
+	default:
+	}
 }
 
 // helper functions ===========================================================
 
 func sendMsg(m Message, c *Connection) error {
-	if c.closed {
+	if !c.IsConnected() {
 		return io.EOF
 	}
-	buf, err := m.MarshalBinary()
-	if err != nil {
-		return fmt.Errorf("error marshalling message: %v", err)
+
+	if c.queue != nil {
+		buf, err := m.AppendBinary(nil)
+		if err == nil {
+			err = frame(buf)
+		}
+		if err != nil {
+			return fmt.Errorf("error marshalling message: %v", err)
+		}
+		//a close is written out before the connection is torn down
+		t := PDUType(buf[1])
+		return c.queue.send(c, t, buf, t == ClosePDU)
 	}
 
-	_, err = c.conn.Write(buf)
+	_, err := WriteMessage(c.writer(), m)
 	if err != nil {
 		return fmt.Errorf("error sending message: %v", err)
 	}
+	c.touch()
 	return nil
 }
 
+// writer returns the writer PDUs are sent to the master agent through
+func (c *Connection) writer() io.Writer {
+	var w io.Writer = routeWriter{c.client, c.route}
+	if c.tracer != nil {
+		w = traceWriter{c.tracer, w}
+	}
+	if c.recorder != nil {
+		w = recordWriter{c, w}
+	}
+	return w
+}
+
+// recvMsg reads the next PDU from the master agent, as routed to the session
+// by its client. The returned buffer comes from the buffer pool and may be
+// handed back with releaseBuffer once nothing refers to it anymore.
 func recvMsg(c *Connection) (*Header, []byte, error) {
-	buf := make([]byte, 1024)
-	n, err := c.conn.Read(buf)
-	if err != nil {
-		if err == io.EOF {
-			return nil, nil, err
+	//pdus routed before the client went away are still read
+	var f inbound
+	select {
+	case f = <-c.route.in:
+	case <-c.route.done:
+		select {
+		case f = <-c.route.in:
+		default:
+			return nil, nil, io.EOF
 		}
-		return nil, nil, fmt.Errorf("error getting message response: %v", err)
 	}
+	if f.err != nil {
+		return f.hdr, nil, f.err
+	}
+	c.touch()
+	if c.tracer != nil {
+		c.tracer.trace(traceRecv, f.buf)
+	}
+	if c.recorder != nil {
+		c.recorder.record(recordRecv, c.clock.Now(), f.buf)
+	}
+
+	return f.hdr, f.buf, nil
+}
+
+// maxPayload returns the largest payload the session accepts from the master
+func (c *Connection) maxPayload() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.maxPayloadLength
+}
+
+// hangUp stops the session exchanging PDUs with the master agent. A client of
+// the session's own is closed along with it.
+func (c *Connection) hangUp() {
+	c.client.drop(c)
+	if c.ownsClient {
+		c.client.Close()
+	}
+}
+
+func isClosedErr(err error) bool {
+	return err == io.EOF || err == io.ErrUnexpectedEOF ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// checkHeader validates an incoming header against the session, returning
+// the error code the PDU should be answered with or ResponseNoError
+func (c *Connection) checkHeader(h *Header) int16 {
+	if h.Version != 1 {
+		c.logf("[rootMH] bad header version %d", h.Version)
+		return ResponseParseError
+	}
+	if h.SessionId != c.sessionId {
+		c.logf("[rootMH] bad session id %d", h.SessionId)
+		return ResponseNotOpen
+	}
+	return ResponseNoError
+}
+
+// SetMaxPayloadLength sets the largest PDU payload that will be accepted from
+// the master agent. Receiving a larger PDU causes the session to be closed
+// with a parse error.
+func (c *Connection) SetMaxPayloadLength(n int) {
+	c.mtx.Lock()
+	c.maxPayloadLength = n
+	c.mtx.Unlock()
+}
 
-	hdr := &Header{}
-	_, err = hdr.UnmarshalBinary(buf[:n])
+// SetMaxResponseLength sets the largest response payload that will be sent to
+// the master agent. GetBulk responses are cut short to fit, other responses
+// that do not fit are answered with tooBig.
+func (c *Connection) SetMaxResponseLength(n int) {
+	c.mtx.Lock()
+	c.maxResponseLength = n
+	c.mtx.Unlock()
+}
+
+// responseSpace returns the room there is for varbinds in a response
+func (c *Connection) responseSpace() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.maxResponseLength - 8
+}
+
+// touch records activity on the connection
+func (c *Connection) touch() {
+	c.mtx.Lock()
+	c.lastActivity = c.clock.Now()
+	c.mtx.Unlock()
+}
+
+// ping sends a ping PDU to the master agent, the round trip time is recorded
+// when the response comes through the root message handler
+func (c *Connection) ping() (<-chan *Response, error) {
+	m := NewPingMessage(c.sessionId)
+	return c.send(m, &m.Header, "ping")
+}
+
+// Ping pings the master agent and waits until it has answered or the context
+// is done, returning the round trip time. Should the master answer with an
+// error, e.g. ErrNotOpen, it is returned as a MasterError along with the round
+// trip time. The pings sent by keepalives go on regardless.
+func (c *Connection) Ping(ctx context.Context) (time.Duration, error) {
+	start := c.clock.Now()
+	answer, err := c.ping()
 	if err != nil {
-		log.Printf("failure reading response header: %v", err)
-		return nil, nil, fmt.Errorf("failure reading response header: %v", err)
+		return 0, err
+	}
+	err = c.await(ctx, answer)
+	if _, ok := err.(MasterError); err != nil && !ok {
+		return 0, err
 	}
-	return hdr, buf, nil
+	return c.clock.Now().Sub(start), err
 }
 
 func sendrecvMsg(m Message, c *Connection) (*Header, []byte, error) {
@@ -206,287 +1077,560 @@ func sendrecvMsg(m Message, c *Connection) (*Header, []byte, error) {
 }
 
 func rootMessageHandler(c *Connection) {
-	log.Printf("[rootMH] waiting for messages")
+	c.logf("[rootMH] waiting for messages")
+	if c.workers != nil {
+		defer c.workers.stop()
+	}
+	defer c.stopQueue()
 
 	for {
 		hdr, buf, err := recvMsg(c)
 		if err != nil {
 			if err == io.EOF {
-				log.Printf("[rootMH] master agent has closed connection")
-				c.Closed <- true
-				c.closed = true
+				c.logf("[rootMH] master agent has closed connection")
+				c.setClosed(ErrConnectionLost)
 				return
 			}
-			log.Printf("[rootMH] failure reading incommig message: %v", err)
+			if _, ok := err.(frameError); ok {
+				c.logf("[rootMH] %v, closing session", err)
+				c.abort(CloseReasonParseError)
+				return
+			}
+			c.logf("[rootMH] failure reading incommig message: %v", err)
+			continue
+		}
+		c.publish(buf)
+
+		if code := c.checkHeader(hdr); code != ResponseNoError {
+			//responses are never answered
+			if hdr.Type != ResponsePDU {
+				sendResponse(c, hdr, code)
+			}
+			releaseBuffer(buf)
+			continue
+		}
+
+		ok := true
+		if hdr.Type != ResponsePDU {
+			if !c.begin(hdr) {
+				c.logf("[rootMH] draining, refusing %v", hdr)
+				sendResponse(c, hdr, ResponseProcessingError)
+				releaseBuffer(buf)
+				continue
+			}
+		}
+
+		if f := c.rawHandler(hdr.Type); f != nil {
+			handleRaw(c, hdr, buf, f)
+			c.end()
+			releaseBuffer(buf)
 			continue
 		}
 
 		switch hdr.Type {
 		case ResponsePDU:
+			//responses to requests are handed to whoever awaits them
+			req := c.deliver(hdr, buf)
 			switch hdr.TransactionId {
 			case CloseTransactionId:
 				handleCloseResponse(c, hdr, buf)
+				ok = false
 			case RegisterTransactionId:
-				handleRegisterResponse(c, hdr, buf)
+				handleRegisterResponse(c, req, buf)
 			case UnregisterTransactionId:
-				handleUnregisterResponse(c, hdr, buf)
+				handleUnregisterResponse(c, req)
+			case PingTransactionId:
+				handlePingResponse(c, req)
+			case NotifyTransactionId:
+				handleNotifyResponse(c, req, buf)
+			}
+		case GetPDU, GetNextPDU, GetBulkPDU,
+			TestSetPDU, CommitSetPDU, CleanupSetPDU:
+			if c.workers != nil {
+				hdr, buf := hdr, buf
+				c.workers.dispatch(hdr, func() {
+					handleRequest(c, hdr, buf)
+					c.end()
+					releaseBuffer(buf)
+				})
+				continue
 			}
-		case GetPDU:
-			handleGet(c, hdr, buf)
-		case GetNextPDU:
-			handleGetNext(c, hdr, buf)
-		case TestSetPDU:
-			handleTestSet(c, hdr, buf)
-		case CommitSetPDU:
-			handleCommitSet(c, hdr, buf)
-		case CleanupSetPDU:
-			handleCleanupSet(c, hdr, buf)
+			handleRequest(c, hdr, buf)
+		case ClosePDU:
+			handleClose(c, hdr, buf)
+			ok = false
 		default:
-			log.Printf("[roogMH] unknown message type %d", hdr.Type)
+			ok = handleUnsupported(c, hdr)
+		}
+
+		if hdr.Type != ResponsePDU {
+			c.end()
+		}
+		//decoded messages do not alias the receive buffer
+		releaseBuffer(buf)
+		if !ok {
+			return
 		}
 	}
 }
 
+// handleRequest answers a get or set phase request from the master agent
+func handleRequest(c *Connection, hdr *Header, buf []byte) {
+	ctx, span := c.pduSpan(hdr)
+	switch hdr.Type {
+	case GetPDU:
+		handleGet(ctx, c, hdr, buf)
+	case GetNextPDU:
+		handleGetNext(ctx, c, hdr, buf)
+	case GetBulkPDU:
+		handleGetBulk(ctx, c, hdr, buf)
+	case TestSetPDU:
+		handleTestSet(ctx, c, hdr, buf)
+	case CommitSetPDU:
+		handleCommitSet(ctx, c, hdr, buf)
+	case CleanupSetPDU:
+		handleCleanupSet(ctx, c, hdr, buf)
+	}
+	span.End()
+
+	if hdr.Type == CleanupSetPDU {
+		//the transaction span outlives the spans of its phases
+		c.endTransaction(hdr.TransactionId)
+		if err := c.journal.done(hdr.SessionId, hdr.TransactionId); err != nil {
+			c.logf("[rootMH] %v", err)
+		}
+	}
+}
+
+// handleUnsupported answers PDUs the agent does not implement with a
+// processing error so the master is not left waiting for a response. Traffic
+// that is not AgentX at all results in the session being closed with a
+// protocol error, returning false.
+func handleUnsupported(c *Connection, h *Header) bool {
+	if h.Type < OpenPDU || h.Type > ResponsePDU {
+		c.logf("[rootMH] unknown message type %d, closing session", h.Type)
+		c.abort(CloseReasonProtocolError)
+		return false
+	}
+
+	c.logf("[rootMH] unsupported %v", h)
+	err := sendResponse(c, h, ResponseProcessingError)
+	if err != nil {
+		c.logf("[rootMH] error responding to %v: %v", h, err)
+	}
+	return true
+}
+
+// abort closes the session from the subagent side for the provided reason and
+// tears down the connection
+func (c *Connection) abort(reason CloseReason) {
+	err := sendMsg(NewCloseMessage(reason, c.sessionId), c)
+	if err != nil {
+		c.logf("error sending close: %v", err)
+	}
+	c.hangUp()
+	c.setClosed(fmt.Errorf("session aborted: %v", reason))
+}
+
+// sendResponse answers the request described by h with an empty response
+// carrying the provided error code
+func sendResponse(c *Connection, h *Header, code int16) error {
+	r := NewResponse(*h).SetError(code, 0)
+	r.Header.SessionId = c.sessionId
+	return sendMsg(r, c)
+}
+
 func handleCloseResponse(c *Connection, h *Header, buf []byte) {
-	log.Printf("[rootMH] recieved close response from server, ... exiting\n")
+	c.logf("[rootMH] recieved close response from server, ... exiting\n")
 	//grab the response payload and check for errors
 	p := &ResponsePayload{}
 	_, err := p.UnmarshalBinary(buf[HeaderSize:])
 	if err != nil {
-		log.Printf("error reading close response playload: %v", err)
-		c.conn.Close()
+		c.logf("error reading close response playload: %v", err)
+		c.hangUp()
+		c.setClosed(ErrDisconnected)
 		return
 	}
 	if p.Error != 0 {
-		log.Printf("Master agent reporeted error on close %d", p.Error)
+		c.logf("Master agent reporeted error on close %d", p.Error)
 	}
 
 	//close the unix domain socket
-	c.conn.Close()
-	c.Closed <- true
-	c.closed = true
+	c.hangUp()
+	c.setClosed(ErrDisconnected)
+}
+
+// handleClose tears down the session after the master agent has closed it,
+// the reason given by the master is available through CloseReason
+func handleClose(c *Connection, h *Header, buf []byte) {
+	m := &CloseMessage{}
+	_, err := m.UnmarshalBinary(buf)
+	if err != nil {
+		c.logf("[rootMH] error reading close message: %v", err)
+		m.Reason = CloseReasonOther
+	}
+	c.logf("[rootMH] master agent closed session, reason=%d", m.Reason)
+
+	c.mtx.Lock()
+	c.closeReason = m.Reason
+	c.mtx.Unlock()
+
+	err = sendResponse(c, h, ResponseNoError)
+	if err != nil {
+		c.logf("[rootMH] error responding to close: %v", err)
+	}
+
+	c.hangUp()
+	c.setClosed(fmt.Errorf("%w: %v", ErrClosedByMaster, m.Reason))
+}
+
+// CloseReason returns the reason the master agent gave for closing the
+// session, or zero if the master agent has not closed the session.
+func (c *Connection) CloseReason() CloseReason {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.closeReason
+}
+
+// setClosed ends the session for the reason err, only the first reason given
+// is kept
+func (c *Connection) setClosed(err error) {
+	c.mtx.Lock()
+	if c.err != nil {
+		c.mtx.Unlock()
+		return
+	}
+	c.err = err
+	close(c.done)
+	close(c.Closed)
+	var open []Span
+	for tid, t := range c.transactions {
+		if t.span != nil {
+			open = append(open, t.span)
+			t.span = nil
+			c.transactions[tid] = t
+		}
+	}
+	c.mtx.Unlock()
+	c.abandon()
+
+	//transactions the master never cleaned up end with the session
+	for _, s := range open {
+		s.End()
+	}
 }
 
-func handleRegisterResponse(c *Connection, h *Header, buf []byte) {
+func handleRegisterResponse(c *Connection, r *request, buf []byte) {
 	p := &ResponsePayload{}
 	_, err := p.UnmarshalBinary(buf[HeaderSize:])
 	if err != nil {
-		log.Printf("error reading response playload: %v", err)
+		c.logf("error reading response playload: %v", err)
 		return
 	}
 
 	if p.Error == 0 {
-		log.Printf(
+		c.logf(
 			"[rootMH] received registration confrimation for %s\n",
-			c.registrations[h.PacketId])
+			r.subject())
 	} else {
-		log.Printf(
-			"[rootMH] received registration failure for %s\n",
-			c.registrations[h.PacketId])
+		c.logf(
+			"[rootMH] received registration failure for %s: %v\n",
+			r.subject(), MasterError(p.Error))
 	}
 }
 
-func handleUnregisterResponse(c *Connection, h *Header, buf []byte) {
-	log.Printf("[rootMH] received unregistration confrimation for %s\n",
-		c.registrations[h.PacketId])
-}
-
-// get handling ...............................................................
-
-func handleGet(c *Connection, h *Header, buf []byte) {
-	doHandleGet(c, h, buf, false)
+// subject returns what the request was about, for a request that is nil
+// because nothing awaited its response that it is unknown
+func (r *request) subject() string {
+	if r == nil {
+		return "unknown request"
+	}
+	return r.what
 }
 
-func handleGetNext(c *Connection, h *Header, buf []byte) {
-	doHandleGet(c, h, buf, true)
+func handleUnregisterResponse(c *Connection, r *request) {
+	c.logf("[rootMH] received unregistration confrimation for %s\n",
+		r.subject())
 }
 
-func doHandleGet(c *Connection, h *Header, buf []byte, next bool) {
-	g := &GetNextMessage{}
-	_, err := g.UnmarshalBinary(buf)
+func handleNotifyResponse(c *Connection, r *request, buf []byte) {
+	p := &ResponsePayload{}
+	_, err := p.UnmarshalBinary(buf[HeaderSize:])
 	if err != nil {
-		log.Printf("[getnext] error unmarshalling GetNextPDU %v\n", err)
+		c.logf("error reading response playload: %v", err)
+		return
 	}
 
-	var r Response
-	r.Header.Version = 1
-	r.Header.Type = ResponsePDU
-	r.Header.Flags = h.Flags & NetworkByteOrder
-	r.Header.SessionId = c.sessionId
-	r.Header.TransactionId = h.TransactionId
-	r.Header.PacketId = h.PacketId
-	r.Header.PayloadLength = 8
-
-	for _, x := range g.SearchRangeList {
-		vb := c.getNextVarBind(x.String(), next)
-		//log.Printf("out: %s", vb.Name.String())
-		r.VarBindList = append(r.VarBindList, vb)
-		r.Header.PayloadLength += int32(vb.WireSize())
+	if p.Error != 0 {
+		c.logf("[rootMH] %s refused with error %d\n", r.subject(), p.Error)
 	}
-	sendMsg(&r, c)
 }
 
-type HandlerType int
+func handlePingResponse(c *Connection, r *request) {
+	if r == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.lastPingRTT = c.clock.Now().Sub(r.sent)
+}
 
-const (
-	GetHandlerType        = 1
-	GetSubtreeHandlerType = 2
-	TestSetHandlerType    = 3
-)
+// get handling ...............................................................
 
-type HandlerBundle struct {
-	Oid     string
-	Type    HandlerType
-	Handler interface{}
+func handleGet(ctx context.Context, c *Connection, h *Header, buf []byte) {
+	doHandleGet(ctx, c, h, buf, false)
 }
 
-type HandlerBundles []HandlerBundle
+func handleGetNext(ctx context.Context, c *Connection, h *Header, buf []byte) {
+	doHandleGet(ctx, c, h, buf, true)
+}
 
-func (hs HandlerBundles) Len() int           { return len(hs) }
-func (hs HandlerBundles) Swap(i, j int)      { hs[i], hs[j] = hs[j], hs[i] }
-func (hs HandlerBundles) Less(i, j int) bool { return hs[i].Oid < hs[j].Oid }
+func doHandleGet(ctx context.Context, c *Connection, h *Header, buf []byte,
+	next bool) {
 
-//TODO it's probably inefficient to sort every time maybehapps this information
-//     should be cached somewhere
-func (c *Connection) getNextVarBind(oid string, next bool) VarBind {
+	g := &GetNextMessage{}
+	_, err := g.UnmarshalBinary(buf)
+	if err != nil {
+		c.logf("[getnext] error unmarshalling GetNextPDU %v\n", err)
+	}
 
-	//log.Printf("[get-next-vb] oid=%s next=%v", oid, next)
+	var oids []Subtree
+	for _, x := range g.SearchRanges {
+		oids = append(oids, x.Start)
+	}
+	r := NewResponse(*h)
+	if code, index := c.checkAccess(h.Type, g.Context, oids); code != ResponseNoError {
+		r.Refuse(code, int(index), oids)
+		recordResponse(ctx, r)
+		sendMsg(r, c)
+		return
+	}
+	if code, index := c.checkRate(oids); code != ResponseNoError {
+		r.Refuse(code, int(index), oids)
+		recordResponse(ctx, r)
+		sendMsg(r, c)
+		return
+	}
 
-	//make the array to hold the handlers that has a size equal to the sum of
-	//the two handler maps
-	allHandlers := make(HandlerBundles, 0,
-		len(c.getSubtreeHandlers)+len(c.getHandlers))
+	//the variables of get-batch handlers are bound up front, each handler
+	//being called once
+	batched := make([]*VarBind, len(oids))
+	if !next {
+		var index int
+		batched, index, err = c.bindBatches(oids)
+		if err != nil {
+			r.Refuse(ResponseProcessingError, index, oids)
+			recordResponse(ctx, r)
+			sendMsg(r, c)
+			return
+		}
+	}
 
-	//if the list of handlers does not contain what we are looking for exactly
-	//then the 'next' entry is actually the first entry found by the recursive
-	//search algorithm
-	if _, ok := c.getHandlers[oid]; !ok {
-		if _, ok := c.getSubtreeHandlers[oid]; !ok {
-			//next = false
+	for i, x := range g.SearchRanges {
+		_, span := c.startSpan(ctx, spanVarBind)
+		var vb VarBind
+		var err error
+		if batched[i] != nil {
+			vb = *batched[i]
+		} else {
+			vb, err = c.Bind(x.Start, next)
+		}
+		span.SetAttribute(attrOid, x.Start.String())
+		if err != nil {
+			span.SetAttribute(attrError, errorName(ResponseProcessingError))
+			span.End()
+			r.Refuse(ResponseProcessingError, i+1, oids)
+			recordResponse(ctx, r)
+			sendMsg(r, c)
+			return
 		}
+		span.SetAttribute(attrBound, vb.Name.String())
+		span.SetAttribute(attrType, varBindTypeName(vb.Type))
+		span.End()
+		r.Add(vb)
 	}
 
-	//bundle up the handlers in to one list and sort it according to oid
-	for k, v := range c.getSubtreeHandlers {
-		allHandlers = append(allHandlers,
-			HandlerBundle{Oid: k, Type: GetSubtreeHandlerType, Handler: v})
+	space := c.responseSpace()
+	if n := fitting(r.VarBindList, space); n < len(r.VarBindList) {
+		r.Refuse(ResponseTooBig, n+1, oids)
 	}
-	for k, v := range c.getHandlers {
-		allHandlers = append(allHandlers,
-			HandlerBundle{Oid: k, Type: GetHandlerType, Handler: v})
+	recordResponse(ctx, r)
+	sendMsg(r, c)
+}
+
+func handleGetBulk(ctx context.Context, c *Connection, h *Header,
+	buf []byte) {
+
+	g := &GetBulkMessage{}
+	_, err := g.UnmarshalBinary(buf)
+	if err != nil {
+		c.logf("[getbulk] error unmarshalling GetBulkPDU %v\n", err)
 	}
-	sort.Sort(allHandlers)
 
-	//return whatever var search comes up with
-	return varSearch(oid, allHandlers, next)
-}
+	var oids []Subtree
+	for _, x := range g.SearchRanges {
+		oids = append(oids, x.Start)
+	}
+	r := NewResponse(*h)
+	if code, index := c.checkAccess(h.Type, g.Context, oids); code != ResponseNoError {
+		r.Refuse(code, int(index), oids)
+		recordResponse(ctx, r)
+		sendMsg(r, c)
+		return
+	}
+	if code, index := c.checkRate(oids); code != ResponseNoError {
+		r.Refuse(code, int(index), oids)
+		recordResponse(ctx, r)
+		sendMsg(r, c)
+		return
+	}
 
-// varSearch is a recursive algorithm for binding ain input oid to a variable
-// instance. In the case that next is false, it binds to the first matching oid
-// it finds, otherwise it binds to the following oid.
-func varSearch(oid string, handlers []HandlerBundle, next bool) VarBind {
-	//log.Printf("[var-search] oid=%s next=%v", oid, next)
-	subtree, _ := NewSubtree(oid)
-	if len(handlers) == 0 {
-		return EndOfMibViewVarBind(*subtree)
+	nonRepeaters := int(g.NonRepeaters)
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
 	}
-	h := handlers[0]
-	h_subtree, _ := NewSubtree(h.Oid)
-	if h.Type == GetSubtreeHandlerType {
-		//truncate the target oid to the prefix length of the handler, if the
-		//handler comes at or after the truncation it should be executed
-		if len(oid) >= len(h.Oid) && h.Oid >= oid[:len(h.Oid)] {
-			vb := h.Handler.(GetSubtreeHandler)(*subtree, next)
-			//if the subtree does not have the target oid we fall through to continue
-			//searching
-			if vb.Type != EndOfMibViewT {
-				return vb
-			}
+	if nonRepeaters > len(oids) {
+		nonRepeaters = len(oids)
+	}
+	repeaters := len(oids) - nonRepeaters
+	vbs, index, err := c.getBulk(nonRepeaters, int(g.MaxRepetitions), oids)
+	if err != nil {
+		r.Refuse(ResponseProcessingError, index, oids)
+		recordResponse(ctx, r)
+		sendMsg(r, c)
+		return
+	}
+
+	//repetitions that do not fit are left for the master to ask for again,
+	//the response is only too big if the non-repeaters or a single
+	//repetition do not fit (RFC3416~4.2.3)
+	fit := fitting(vbs, c.responseSpace())
+	n := fit
+	if n < len(vbs) && n > nonRepeaters {
+		n -= (n - nonRepeaters) % repeaters
+	}
+	if n < len(vbs) && n <= nonRepeaters {
+		if fit >= nonRepeaters {
+			fit = nonRepeaters + (fit-nonRepeaters)%repeaters
 		}
+		r.Refuse(ResponseTooBig, fit+1, oids)
 	} else {
-		if h.Oid >= oid {
-			if next {
-				next = false
-			} else {
-				return h.Handler.(GetHandler)(*h_subtree)
-			}
+		r.Add(vbs[:n]...)
+	}
+	recordResponse(ctx, r)
+	sendMsg(r, c)
+}
+
+// fitting returns how many of vbs fit in space bytes
+func fitting(vbs []VarBind, space int) int {
+	for i, vb := range vbs {
+		space -= vb.WireSize()
+		if space < 0 {
+			return i
 		}
 	}
-	//recursive continuation
-	return varSearch(oid, handlers[1:], next)
+	return len(vbs)
 }
 
 // set handling ...............................................................
-func handleTestSet(c *Connection, h *Header, buf []byte) {
+func handleTestSet(ctx context.Context, c *Connection, h *Header, buf []byte) {
+
+	//the transaction stays open until the master cleans it up, its span may
+	//already have been started
+	c.mtx.Lock()
+	if _, ok := c.transactions[h.TransactionId]; !ok {
+		c.transactions[h.TransactionId] = transaction{}
+	}
+	c.mtx.Unlock()
 
 	var m SetMessage
 	m.UnmarshalBinary(buf)
 
-	r := Response{
-		Header: Header{
-			Version:       1,
-			Type:          ResponsePDU,
-			Flags:         h.Flags & NetworkByteOrder,
-			SessionId:     c.sessionId,
-			TransactionId: h.TransactionId,
-			PacketId:      h.PacketId,
-			PayloadLength: 8,
-		},
-		ResponsePayload: ResponsePayload{
-			Error: int16(TestSetResourceUnavailable),
-		},
-	}
-
-	hbs := make(HandlerBundles, 0, len(c.testSetHandlers))
-	for name, h := range c.testSetHandlers {
-		hbs = append(hbs, HandlerBundle{
-			Oid:     name,
-			Type:    TestSetHandlerType,
-			Handler: h,
-		})
-	}
-	sort.Sort(hbs)
-
+	var oids []Subtree
 	for _, v := range m.VarBindList {
-
-		for _, h := range hbs {
-			if strings.HasPrefix(v.Name.String(), h.Oid) {
-				r.ResponsePayload.Error =
-					int16(h.Handler.(TestSetHandler)(v, int(c.sessionId)))
-			}
+		oids = append(oids, v.Name)
+	}
+	code, index := c.checkAccess(h.Type, m.Context, oids)
+	if code == ResponseNoError {
+		//every varbind is checked against its syntax before any is tested
+		result, i := c.CheckSyntax(m.VarBindList)
+		code, index = int16(result), int16(i)
+	}
+	r := NewResponse(*h).SetError(code, int(index))
+
+	//varbinds are tested one at a time so each gets a span, testing stops at
+	//the first failure just as it does within TestSet
+	var olds []VarBind
+	for i, v := range m.VarBindList {
+		if code != ResponseNoError {
+			break
 		}
+		_, span := c.startSpan(ctx, spanVarBind)
+		var old VarBind
+		if c.audit != nil || c.journal != nil {
+			old = c.currentValue(v.Name)
+			olds = append(olds, old)
+		}
+		result, _, err := c.testSet(m.VarBindList[i:i+1], c.sessionId)
+		if c.audit != nil {
+			c.auditTestSet(h, old, v, result)
+		}
+		span.SetAttribute(attrOid, v.Name.String())
+		span.SetAttribute(attrType, varBindTypeName(v.Type))
+		if err != nil {
+			span.SetAttribute(attrError, errorName(ResponseProcessingError))
+			span.End()
+			r.SetError(ResponseProcessingError, i+1)
+			break
+		}
+		if result != TestSetNoError {
+			span.SetAttribute(attrError, errorName(int16(result)))
+			span.End()
+			r.SetError(int16(result), i+1)
+			break
+		}
+		span.End()
+	}
 
+	//the transaction is journaled before the master is told it may commit
+	if c.journal != nil && r.Error == ResponseNoError {
+		err := c.journal.prepare(h.SessionId, h.TransactionId, m.VarBindList,
+			olds)
+		if err != nil {
+			c.logf("[test-set] %v", err)
+			r.SetError(int16(TestSetResourceUnavailable), 0)
+		}
 	}
 
-	sendMsg(&r, c)
+	recordResponse(ctx, r)
+	sendMsg(r, c)
 
 }
 
-func handleCommitSet(c *Connection, h *Header, buf []byte) {
-
-	result := c.commitSetHandler(int(h.SessionId))
+func handleCommitSet(ctx context.Context, c *Connection, h *Header,
+	buf []byte) {
 
-	r := Response{
-		Header: Header{
-			Version:       1,
-			Type:          ResponsePDU,
-			Flags:         h.Flags & NetworkByteOrder,
-			SessionId:     c.sessionId,
-			TransactionId: h.TransactionId,
-			PacketId:      h.PacketId,
-			PayloadLength: 8,
-		},
-		ResponsePayload: ResponsePayload{
-			Error: int16(result),
-		},
+	var result CommitSetResult
+	err := c.journal.commit(h.SessionId, h.TransactionId)
+	if err != nil {
+		c.logf("[commit-set] %v", err)
+		result = CommitSetCommitFailed
+	} else {
+		result = c.CommitSet(h.SessionId)
+	}
+	if c.audit != nil {
+		c.auditCommitSet(h, result)
 	}
 
-	sendMsg(&r, c)
+	r := NewResponse(*h).SetError(int16(result), 0)
+	recordResponse(ctx, r)
+	sendMsg(r, c)
 
 }
 
-func handleCleanupSet(c *Connection, h *Header, buf []byte) {
+func handleCleanupSet(ctx context.Context, c *Connection, h *Header,
+	buf []byte) {
 
-	c.cleanupSetHandler(int(h.SessionId))
+	c.CleanupSet(h.SessionId)
 
 }
@@ -1,9 +1,20 @@
 package agx_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/agxtest"
 	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -14,23 +25,18 @@ const (
 
 func TestConnect(t *testing.T) {
 
-	id, descr := "1.2.3.4.7", "muffin man"
-	c, err := agx.Connect(&id, &descr)
+	m, err := agxtest.NewMockMaster()
 	if err != nil {
-		t.Fatalf("connection failed %v", err)
+		t.Fatalf("mock master failed %v", err)
 	}
-	defer c.Disconnect()
+	defer m.Close()
 
-	err = c.Register(qbridge)
+	id, descr := "1.2.3.4.7", "muffin man"
+	c, err := agx.Connect(id, agx.WithDescription(descr),
+		agx.WithSocketPath(m.Path))
 	if err != nil {
-		t.Fatalf("agent registration failed %v", err)
+		t.Fatalf("connection failed %v", err)
 	}
-	defer func() {
-		err = c.Unregister(qbridge)
-		if err != nil {
-			t.Fatalf("agent registration failed %v", err)
-		}
-	}()
 
 	c.OnGet(qbridge, func(oid agx.Subtree) agx.VarBind {
 
@@ -45,9 +51,378 @@ func TestConnect(t *testing.T) {
 
 	})
 
+	err = c.Register(qbridge)
+	if err != nil {
+		t.Fatalf("agent registration failed %v", err)
+	}
+	err = m.WaitRegistration(qbridge)
+	if err != nil {
+		t.Fatalf("master did not see registration %v", err)
+	}
+
+	vbs, err := m.Get(qbridge)
+	if err != nil {
+		t.Fatalf("get failed %v", err)
+	}
+	expect := *agx.OctetStringVarBind(subtree(t, qbridge), []byte{0xcc, 0x33})
+	if !reflect.DeepEqual(vbs[0], expect) {
+		t.Errorf("got %v, expected %v", vbs[0], expect)
+	}
+
+	err = c.Unregister(qbridge)
+	if err != nil {
+		t.Fatalf("agent unregistration failed %v", err)
+	}
+	c.Disconnect()
+
 	//wait for connection to close
 	log.Printf("waiting for close event")
-	<-c.Closed
+	select {
+	case <-c.Done():
+	case <-time.After(agxtest.DefaultTimeout):
+		t.Fatalf("timed out waiting for close")
+	}
+	if c.Err() != agx.ErrDisconnected {
+		t.Errorf("session ended with %v", c.Err())
+	}
+	if regs := m.Registrations(); len(regs) != 0 {
+		t.Errorf("registrations remain after close %v", regs)
+	}
 	log.Printf("test finished")
 
 }
+
+func TestSet(t *testing.T) {
+	m, err := agxtest.NewMockMaster()
+	if err != nil {
+		t.Fatalf("mock master failed %v", err)
+	}
+	defer m.Close()
+
+	id, descr := "1.2.3.4.7", "muffin man"
+	c, err := agx.Connect(id, agx.WithDescription(descr),
+		agx.WithSocketPath(m.Path))
+	if err != nil {
+		t.Fatalf("connection failed %v", err)
+	}
+
+	var tested []agx.VarBind
+	committed, cleaned := 0, 0
+	c.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+		tested = append(tested, vb)
+		return agx.TestSetNoError
+	})
+	c.OnCommitSet(func(sessionId uint32) agx.CommitSetResult {
+		committed++
+		return agx.CommitSetNoError
+	})
+	c.OnCleanupSet(func(sessionId uint32) {
+		cleaned++
+	})
+	c.Register(qbridge)
+	if err := m.WaitRegistration(qbridge); err != nil {
+		t.Fatalf("master did not see registration %v", err)
+	}
+
+	vb := agx.IntegerVarBind(subtree(t, access+".47"), 1)
+	status, _, err := m.Set(vb)
+	if err != nil {
+		t.Fatalf("set failed %v", err)
+	}
+	if status != agx.ResponseNoError {
+		t.Errorf("set returned status %d", status)
+	}
+
+	//the subagent may still be cleaning up, closing the session waits on it
+	if err := m.CloseSessions(agx.CloseReasonShutdown); err != nil {
+		t.Fatalf("close failed %v", err)
+	}
+	<-c.Done()
+	if !reflect.DeepEqual(tested, []agx.VarBind{vb}) || committed != 1 ||
+		cleaned != 1 {
+		t.Errorf("tested %v, committed %d, cleaned %d", tested, committed, cleaned)
+	}
+	if c.CloseReason() != agx.CloseReasonShutdown {
+		t.Errorf("close reason %v", c.CloseReason())
+	}
+	if !errors.Is(c.Err(), agx.ErrClosedByMaster) {
+		t.Errorf("session ended with %v", c.Err())
+	}
+}
+
+// pipeDialer hands out in-memory connections to a mock master
+type pipeDialer struct {
+	m     *agxtest.MockMaster
+	dials int
+}
+
+func (d *pipeDialer) Dial(network, address string) (net.Conn, error) {
+	d.dials++
+	return d.m.Pipe(), nil
+}
+
+// openDialer answers the open of each session dialed through it, handing the
+// open message to the test
+type openDialer chan *agx.OpenMessage
+
+func (d openDialer) Dial(network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go func() {
+		m, err := agx.ReadMessage(server)
+		if err != nil {
+			return
+		}
+		open := m.(*agx.OpenMessage)
+		agx.WriteMessage(server, agx.NewResponse(open.Header))
+		d <- open
+	}()
+	return client, nil
+}
+
+// lockedBuffer is a buffer that may be logged to while it is read
+type lockedBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+func TestConnectOptions(t *testing.T) {
+	d := make(openDialer, 1)
+	var logged lockedBuffer
+	_, err := agx.Connect("1.2.3.4.7", agx.WithDialer(d),
+		agx.WithDescription("muffin man"),
+		agx.WithTimeout(30*time.Second),
+		agx.WithLogger(log.New(&logged, "", 0)))
+	if err != nil {
+		t.Fatalf("connection failed %v", err)
+	}
+	open := <-d
+	descr := string(open.Desc.Octets[:open.Desc.OctetStringLength])
+	if open.Timeout != 30 || descr != "muffin man" || open.Id.NSubid != 5 {
+		t.Errorf("unexpected open %v", open)
+	}
+	if !strings.Contains(logged.String(), "connecting") {
+		t.Errorf("nothing logged to logger, got %q", logged.String())
+	}
+
+	//the deprecated form still opens sessions
+	_, err = agx.ConnectLegacy(nil, &descr, agx.WithDialer(d))
+	if err != nil {
+		t.Fatalf("legacy connection failed %v", err)
+	}
+	open = <-d
+	if open.Timeout != agx.OpenTimeout || open.Id.NSubid != 0 {
+		t.Errorf("unexpected open %v", open)
+	}
+
+	//a zero timeout leaves the master to its default, and parts of a second
+	//are not rounded down to it
+	for d0, secs := range map[time.Duration]byte{0: 0, time.Millisecond: 1,
+		1500 * time.Millisecond: 2, time.Hour: 255} {
+		_, err = agx.Connect("1.2.3.4.7", agx.WithDialer(d),
+			agx.WithTimeout(d0))
+		if err != nil {
+			t.Fatalf("connection failed %v", err)
+		}
+		if open = <-d; open.Timeout != secs {
+			t.Errorf("timeout %v opened with %d, expected %d", d0,
+				open.Timeout, secs)
+		}
+	}
+}
+
+// flakyDialer fails its first dials, then dials through d
+type flakyDialer struct {
+	fails int
+	dials int
+	d     openDialer
+}
+
+func (f *flakyDialer) Dial(network, address string) (net.Conn, error) {
+	f.dials++
+	if f.dials <= f.fails {
+		return nil, fmt.Errorf("master agent is not up yet")
+	}
+	return f.d.Dial(network, address)
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	clk := &fakeClock{now: time.Unix(47, 0)}
+	d := &flakyDialer{fails: 2, d: make(openDialer, 1)}
+
+	type result struct {
+		c   *agx.Connection
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := agx.ConnectWithRetry(context.Background(), "1.2.3.4.7",
+			agx.WithDescription("muffin man"), agx.WithDialer(d),
+			agx.WithClock(clk))
+		done <- result{c, err}
+	}()
+
+	//each failed dial waits out a backoff of at most twice the last
+	clk.advance(t, 1, agx.RetryInitialBackoff)
+	clk.advance(t, 1, 2*agx.RetryInitialBackoff)
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("connection failed %v", r.err)
+	}
+	open := <-d.d
+	descr := string(open.Desc.Octets[:open.Desc.OctetStringLength])
+	if open.Id.NSubid != 5 || descr != "muffin man" {
+		t.Errorf("unexpected open %v", open)
+	}
+	if d.dials != 3 {
+		t.Errorf("dialed %d times, expected 3", d.dials)
+	}
+
+	//giving up is up to the context
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, err := agx.ConnectWithRetryLegacy(ctx, nil, nil,
+			agx.WithDialer(&flakyDialer{fails: 1000}), agx.WithClock(clk))
+		done <- result{nil, err}
+	}()
+	clk.advance(t, 1, agx.RetryInitialBackoff)
+	cancel()
+	if r = <-done; r.err == nil {
+		t.Errorf("connecting succeeded after the context was cancelled")
+	}
+}
+
+func TestNewConnection(t *testing.T) {
+	m, err := agxtest.NewMockMaster()
+	if err != nil {
+		t.Fatalf("mock master failed %v", err)
+	}
+	defer m.Close()
+
+	id, descr := "1.2.3.4.7", "muffin man"
+	d := &pipeDialer{m: m}
+	dialed, err := agx.Connect(id, agx.WithDescription(descr),
+		agx.WithDialer(d))
+	if err != nil {
+		t.Fatalf("connection through dialer failed %v", err)
+	}
+	if d.dials != 1 {
+		t.Errorf("dialer used %d times", d.dials)
+	}
+	given, err := agx.NewConnection(m.Pipe(), &id, &descr)
+	if err != nil {
+		t.Fatalf("connection over pipe failed %v", err)
+	}
+
+	for i, c := range []*agx.Connection{dialed, given} {
+		oid := fmt.Sprintf("%s.%d", qbridge, i)
+		c.OnGet(oid, func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, 47)
+		})
+		c.Register(oid)
+		if err := m.WaitRegistration(oid); err != nil {
+			t.Fatalf("master did not see registration %v", err)
+		}
+		vbs, err := m.Get(oid)
+		if err != nil {
+			t.Fatalf("get failed %v", err)
+		}
+		if vbs[0].Data != agx.Integer(47) {
+			t.Errorf("got %v from %s", vbs[0], oid)
+		}
+		c.Disconnect()
+		<-c.Done()
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	m, err := agxtest.NewMockMaster()
+	if err != nil {
+		t.Fatalf("mock master failed %v", err)
+	}
+	defer m.Close()
+
+	id, descr := "1.2.3.4.7", "muffin man"
+	c, err := agx.Connect(id, agx.WithDescription(descr),
+		agx.WithSocketPath(m.Path))
+	if err != nil {
+		t.Fatalf("connection failed %v", err)
+	}
+	c.OnGet(egress+".1", func(oid agx.Subtree) agx.VarBind {
+		return agx.IntegerVarBind(oid, 47)
+	})
+	c.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+		return agx.TestSetNoError
+	})
+	c.OnCommitSet(func(sessionId uint32) agx.CommitSetResult {
+		return agx.CommitSetNoError
+	})
+	c.Register(egress)
+	c.Register(access)
+	if err := m.WaitRegistration(access); err != nil {
+		t.Fatalf("master did not see registration %v", err)
+	}
+
+	snap := c.Snapshot()
+	c.Disconnect()
+	<-c.Done()
+
+	//only oids survive serialization
+	buf, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatalf("error serializing snapshot %v", err)
+	}
+	expect := `{"registrations":["` + egress + `","` + access + `"],` +
+		`"handlers":[{"oid":"` + egress + `.1","type":1},` +
+		`{"oid":"` + access + `","type":3},{"type":4}]}`
+	if string(buf) != expect {
+		t.Errorf("snapshot serialized as %s", buf)
+	}
+	var restored agx.Snapshot
+	if err := json.Unmarshal(buf, &restored); err != nil {
+		t.Fatalf("error deserializing snapshot %v", err)
+	}
+	fresh, _ := agx.Connect(id, agx.WithDescription(descr),
+		agx.WithSocketPath(m.Path))
+	if err := fresh.Restore(&restored); err == nil {
+		t.Errorf("restored handlers from a serialized snapshot")
+	}
+	fresh.Disconnect()
+	<-fresh.Done()
+
+	//a new session comes back with the same registrations and handlers
+	c, err = agx.Connect(id, agx.WithDescription(descr),
+		agx.WithSocketPath(m.Path))
+	if err != nil {
+		t.Fatalf("reconnection failed %v", err)
+	}
+	if err := c.Restore(snap); err != nil {
+		t.Fatalf("error restoring snapshot %v", err)
+	}
+	for _, oid := range []string{egress, access} {
+		if err := m.WaitRegistration(oid); err != nil {
+			t.Fatalf("master did not see registration %v", err)
+		}
+	}
+	vbs, err := m.Get(egress + ".1")
+	if err != nil || vbs[0].Data != agx.Integer(47) {
+		t.Errorf("get after restore returned %v, %v", vbs, err)
+	}
+	status, _, err := m.Set(agx.IntegerVarBind(subtree(t, access+".1"), 1))
+	if err != nil || status != agx.ResponseNoError {
+		t.Errorf("set after restore returned %d, %v", status, err)
+	}
+	c.Disconnect()
+	<-c.Done()
+}
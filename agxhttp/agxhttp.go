@@ -0,0 +1,128 @@
+// Package agxhttp serves a debugging view of an agent over HTTP, so operators
+// can see what a subagent would answer without going through the master
+// agent.
+package agxhttp
+
+// This file contains the debug handler
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"encoding/json"
+	"github.com/rcgoodfellow/agx"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Handler answers debugging requests from the handlers of a Dispatcher. All
+// responses are JSON.
+//
+//	GET handlers             the registrations and installed handlers
+//	GET get?oid=...          binds each oid as a get request would
+//	GET getnext?oid=...      binds each oid as a getnext request would
+//
+// Handler only reads, sets are not exposed. Paths are matched on their last
+// element, so the handler may be mounted under any prefix.
+type Handler struct {
+	Dispatcher *agx.Dispatcher
+	//Registrations, when set, returns the registered subtrees
+	Registrations func() []string
+}
+
+// New returns a handler serving the handlers of d
+func New(d *agx.Dispatcher) *Handler {
+	return &Handler{Dispatcher: d}
+}
+
+// ForConnection returns a handler serving the handlers and registrations of c
+func ForConnection(c *agx.Connection) *Handler {
+	return &Handler{
+		Dispatcher:    &c.Dispatcher,
+		Registrations: func() []string { return c.Snapshot().Registrations },
+	}
+}
+
+// handlerInfo describes an installed handler
+type handlerInfo struct {
+	Oid   string `json:"oid,omitempty"`
+	Type  string `json:"type"`
+	Calls uint64 `json:"calls"`
+}
+
+type handlersResponse struct {
+	Registrations []string      `json:"registrations"`
+	Handlers      []handlerInfo `json:"handlers"`
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch path[strings.LastIndex(path, "/")+1:] {
+	case "handlers":
+		h.handlers(w)
+	case "get":
+		h.bind(w, r, h.Dispatcher.Get)
+	case "getnext":
+		h.bind(w, r, h.Dispatcher.GetNext)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) handlers(w http.ResponseWriter) {
+	calls := make(map[string]uint64)
+	for _, s := range h.Dispatcher.Stats() {
+		calls[s.Type.String()+" "+s.Oid] = s.Calls
+	}
+
+	resp := handlersResponse{Registrations: []string{}, Handlers: []handlerInfo{}}
+	if h.Registrations != nil {
+		resp.Registrations = append(resp.Registrations, h.Registrations()...)
+	}
+	for _, x := range h.Dispatcher.Handlers() {
+		resp.Handlers = append(resp.Handlers, handlerInfo{
+			Oid:   x.Oid,
+			Type:  x.Type.String(),
+			Calls: calls[x.Type.String()+" "+x.Oid],
+		})
+	}
+	respond(w, resp)
+}
+
+func (h *Handler) bind(w http.ResponseWriter, r *http.Request,
+	f func(agx.Subtree) agx.VarBind) {
+
+	oids := r.URL.Query()["oid"]
+	if len(oids) == 0 {
+		http.Error(w, "no oid given", http.StatusBadRequest)
+		return
+	}
+
+	vbs := []agx.VarBind{}
+	for _, oid := range oids {
+		s, err := agx.NewSubtree(oid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		vbs = append(vbs, f(*s))
+	}
+	respond(w, vbs)
+}
+
+func respond(w http.ResponseWriter, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[agxhttp] error encoding response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
@@ -0,0 +1,79 @@
+package agxhttp_test
+
+import (
+	"encoding/json"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/agxhttp"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+const sysName = "1.3.6.1.2.1.1.5.0"
+
+func TestHandler(t *testing.T) {
+	d := &agx.Dispatcher{}
+	d.OnGet(sysName, func(oid agx.Subtree) agx.VarBind {
+		return *agx.OctetStringVarBind(oid, []byte("muffin"))
+	})
+	h := agxhttp.New(d)
+	h.Registrations = func() []string { return []string{"1.3.6.1.2.1.1"} }
+	s := httptest.NewServer(http.StripPrefix("/debug", h))
+	defer s.Close()
+
+	var vbs []agx.VarBind
+	get(t, s.URL+"/debug/getnext?oid=1.3.6.1.2.1.1&oid=.1.3.6.1.2.1.1.5.0", &vbs)
+	name, _ := agx.NewSubtree(sysName)
+	expect := []agx.VarBind{
+		*agx.OctetStringVarBind(*name, []byte("muffin")),
+		agx.EndOfMibViewVarBind(*name),
+	}
+	if !reflect.DeepEqual(vbs, expect) {
+		t.Errorf("getnext returned %v", vbs)
+	}
+
+	var handlers struct {
+		Registrations []string
+		Handlers      []struct {
+			Oid, Type string
+			Calls     uint64
+		}
+	}
+	get(t, s.URL+"/debug/handlers", &handlers)
+	if !reflect.DeepEqual(handlers.Registrations, []string{"1.3.6.1.2.1.1"}) ||
+		len(handlers.Handlers) != 1 || handlers.Handlers[0].Oid != sysName ||
+		handlers.Handlers[0].Type != "get" || handlers.Handlers[0].Calls != 1 {
+		t.Errorf("handlers returned %+v", handlers)
+	}
+
+	for path, code := range map[string]int{
+		"/debug/get":           http.StatusBadRequest,
+		"/debug/get?oid=1..3":  http.StatusBadRequest,
+		"/debug/set?oid=1.3.6": http.StatusNotFound,
+	} {
+		r, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatalf("error requesting %s: %v", path, err)
+		}
+		r.Body.Close()
+		if r.StatusCode != code {
+			t.Errorf("%s returned %d, expected %d", path, r.StatusCode, code)
+		}
+	}
+}
+
+func get(t *testing.T, url string, v interface{}) {
+	t.Helper()
+	r, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error requesting %s: %v", url, err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		t.Fatalf("%s returned %s", url, r.Status)
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		t.Fatalf("error decoding %s: %v", url, err)
+	}
+}
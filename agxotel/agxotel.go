@@ -0,0 +1,73 @@
+// Package agxotel records the handling of AgentX requests in OpenTelemetry
+// spans.
+//
+//	tracer := otel.Tracer("github.com/rcgoodfellow/agx")
+//	c, err := agx.Connect(id, agx.WithSpanTracer(agxotel.New(tracer)))
+package agxotel
+
+// This file contains the OpenTelemetry span tracer
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"context"
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// New returns a span tracer that starts its spans with t
+func New(t trace.Tracer) agx.SpanTracer {
+	return tracer{t}
+}
+
+type tracer struct {
+	t trace.Tracer
+}
+
+func (t tracer) Start(ctx context.Context, name string) (
+	context.Context, agx.Span) {
+
+	ctx, s := t.t.Start(ctx, name)
+	return ctx, span{s}
+}
+
+type span struct {
+	s trace.Span
+}
+
+func (s span) SetAttribute(key string, value interface{}) {
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		kv = attribute.String(key, v)
+	case int:
+		kv = attribute.Int(key, v)
+	case int64:
+		kv = attribute.Int64(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	case float64:
+		kv = attribute.Float64(key, v)
+	default:
+		kv = attribute.String(key, fmt.Sprint(v))
+	}
+	s.s.SetAttributes(kv)
+
+	//request errors fail the span so they stand out in trace views
+	if key == "agentx.error" {
+		s.s.SetStatus(codes.Error, fmt.Sprint(value))
+	}
+}
+
+func (s span) SetError(err error) {
+	s.s.RecordError(err)
+	s.s.SetStatus(codes.Error, err.Error())
+}
+
+func (s span) End() {
+	s.s.End()
+}
@@ -0,0 +1,256 @@
+// Package agxprom exposes Prometheus metrics over SNMP. Metric families are
+// mapped to tables under a registered subtree, with the label sets of their
+// metrics as table indices, so an instrumented service can be made available
+// to SNMP managers without re-instrumenting it.
+package agxprom
+
+// This file contains the prometheus to snmp bridge
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rcgoodfellow/agx"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTime is how long gathered metrics are served for before the
+// gatherer is asked again, so a walk of the tables sees a single snapshot
+const DefaultCacheTime = time.Second
+
+// Bridge serves the metric families of a gatherer as tables. A family mapped
+// to arc with labels l1..ln is the table
+//
+//	root.arc.1.c.index
+//
+// where columns 1..n hold the label values as strings and column n+1 holds
+// the value of the metric. The index is the label values in order, each
+// encoded as a length prefixed string (RFC2578~7.7). A family mapped without
+// labels is the scalar root.arc.0. Counters are served as Counter64 and gauges
+// as Integer, rounded and clamped to 32 bits.
+type Bridge struct {
+	Root      agx.Subtree
+	Gatherer  prometheus.Gatherer
+	CacheTime time.Duration
+
+	mtx      sync.Mutex
+	mappings map[string]mapping
+	table    []agx.VarBind
+	gathered time.Time
+}
+
+type mapping struct {
+	arc    uint32
+	labels []string
+}
+
+// New returns a bridge serving metrics from g under root. Pass
+// prometheus.DefaultGatherer for metrics registered the usual way, or a
+// prometheus.Registry holding the collectors to expose.
+func New(root string, g prometheus.Gatherer) (*Bridge, error) {
+	s, err := agx.NewSubtree(root)
+	if err != nil {
+		return nil, err
+	}
+	return &Bridge{
+		Root:      *s,
+		Gatherer:  g,
+		CacheTime: DefaultCacheTime,
+		mappings:  make(map[string]mapping),
+	}, nil
+}
+
+// Map exposes the metric family name as the table at arc under the root,
+// indexed by the values of labels. Metrics whose values for labels are the
+// same as an earlier metric of the family are not served.
+func (b *Bridge) Map(name string, arc uint32, labels ...string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for n, m := range b.mappings {
+		if m.arc == arc && n != name {
+			return fmt.Errorf("arc %d is already mapped to %s", arc, n)
+		}
+	}
+	b.mappings[name] = mapping{arc: arc, labels: labels}
+	b.table = nil
+	return nil
+}
+
+// Attach installs the handler for the root subtree in d, the root must still
+// be registered with the master agent, e.g.
+//
+//	b.Attach(&c.Dispatcher)
+//	c.Register(root)
+func (b *Bridge) Attach(d *agx.Dispatcher) {
+	d.OnGetSubtree(b.Root.String(), b.handle)
+}
+
+// handle binds oid from a snapshot of the mapped metrics
+func (b *Bridge) handle(oid agx.Subtree, next bool) agx.VarBind {
+	table := b.snapshot()
+
+	i := sort.Search(len(table), func(i int) bool {
+		return table[i].Name.GreaterThanEq(oid)
+	})
+	if i < len(table) && table[i].Name.Eq(oid) {
+		if !next {
+			return table[i]
+		}
+		i++
+	} else if !next {
+		return agx.EndOfMibViewVarBind(oid)
+	}
+	if i >= len(table) {
+		return agx.EndOfMibViewVarBind(oid)
+	}
+	return table[i]
+}
+
+// snapshot returns the varbinds of the mapped metrics sorted by name,
+// gathering them again once the cache time has passed
+func (b *Bridge) snapshot() []agx.VarBind {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.table != nil && time.Since(b.gathered) < b.CacheTime {
+		return b.table
+	}
+
+	families, err := b.Gatherer.Gather()
+	if err != nil {
+		//gatherers return what they could collect along with the error
+		log.Printf("[agxprom] error gathering metrics: %v", err)
+	}
+
+	table := []agx.VarBind{}
+	for _, f := range families {
+		m, ok := b.mappings[f.GetName()]
+		if !ok {
+			continue
+		}
+		table = append(table, b.family(f, m)...)
+	}
+	sort.Slice(table, func(i, j int) bool {
+		return table[i].Name.LessThan(table[j].Name)
+	})
+
+	b.table = table
+	b.gathered = time.Now()
+	return table
+}
+
+// family returns the varbinds of the table a metric family is mapped to
+func (b *Bridge) family(f *dto.MetricFamily, m mapping) []agx.VarBind {
+	prefix := append(b.Root.Identifiers(), m.arc)
+
+	var vbs []agx.VarBind
+	seen := make(map[string]bool)
+	for _, metric := range f.GetMetric() {
+		value, ok := metricValue(f.GetType(), metric)
+		if !ok {
+			continue
+		}
+
+		if len(m.labels) == 0 {
+			vbs = append(vbs, bind(append(prefix, 0), value))
+			break
+		}
+
+		values := labelValues(metric, m.labels)
+		index := encodeIndex(values)
+		key := fmt.Sprint(index)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		entry := append(prefix[:len(prefix):len(prefix)], 1)
+		for i, v := range values {
+			column := append(entry[:len(entry):len(entry)], uint32(i+1))
+			vbs = append(vbs, bind(append(column, index...),
+				agx.VarBind{Type: agx.OctetStringT, Data: *agx.NewOctetString([]byte(v))}))
+		}
+		column := append(entry[:len(entry):len(entry)], uint32(len(values)+1))
+		vbs = append(vbs, bind(append(column, index...), value))
+	}
+	return vbs
+}
+
+// helpers ====================================================================
+
+// metricValue returns an unnamed varbind holding the value of a counter or
+// gauge, summaries and histograms are not served
+func metricValue(t dto.MetricType, m *dto.Metric) (agx.VarBind, bool) {
+	switch t {
+	case dto.MetricType_COUNTER:
+		x := m.GetCounter().GetValue()
+		if x < 0 || math.IsNaN(x) {
+			x = 0
+		}
+		if x >= math.MaxUint64 {
+			return agx.VarBind{Type: agx.Counter64T, Data: agx.Counter64(math.MaxUint64)}, true
+		}
+		return agx.VarBind{Type: agx.Counter64T, Data: agx.Counter64(x)}, true
+	case dto.MetricType_GAUGE:
+		return agx.VarBind{Type: agx.IntegerT, Data: agx.Integer(clamp(m.GetGauge().GetValue()))}, true
+	case dto.MetricType_UNTYPED:
+		return agx.VarBind{Type: agx.IntegerT, Data: agx.Integer(clamp(m.GetUntyped().GetValue()))}, true
+	}
+	return agx.VarBind{}, false
+}
+
+func clamp(x float64) int32 {
+	switch {
+	case math.IsNaN(x):
+		return 0
+	case x >= math.MaxInt32:
+		return math.MaxInt32
+	case x <= math.MinInt32:
+		return math.MinInt32
+	}
+	return int32(math.Round(x))
+}
+
+// labelValues returns the values m has for labels, missing labels are empty
+func labelValues(m *dto.Metric, labels []string) []string {
+	values := make([]string, len(labels))
+	for _, lp := range m.GetLabel() {
+		for i, l := range labels {
+			if lp.GetName() == l {
+				values[i] = lp.GetValue()
+			}
+		}
+	}
+	return values
+}
+
+// encodeIndex encodes strings as a table index (RFC2578~7.7)
+func encodeIndex(values []string) []uint32 {
+	var index []uint32
+	for _, v := range values {
+		index = append(index, uint32(len(v)))
+		for _, c := range []byte(v) {
+			index = append(index, uint32(c))
+		}
+	}
+	return index
+}
+
+// bind names the varbind vb with ids
+func bind(ids []uint32, vb agx.VarBind) agx.VarBind {
+	name, err := agx.NewSubtreeFromIdentifiers(ids)
+	if err != nil {
+		log.Printf("[agxprom] bad oid %v: %v", ids, err)
+		return vb
+	}
+	vb.Name = *name
+	return vb
+}
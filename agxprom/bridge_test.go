@@ -0,0 +1,104 @@
+package agxprom_test
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/agxprom"
+	"testing"
+)
+
+const root = "1.3.6.1.4.1.47"
+
+func TestBridge(t *testing.T) {
+	gathered := 0
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		gathered++
+		return []*dto.MetricFamily{
+			family("requests_total", dto.MetricType_COUNTER,
+				metric(1200, "method", "get", "code", "200"),
+				metric(3, "method", "put", "code", "500"),
+			),
+			family("temperature", dto.MetricType_GAUGE, metric(-4.6)),
+			family("unmapped", dto.MetricType_GAUGE, metric(1)),
+		}, nil
+	})
+
+	b, err := agxprom.New(root, g)
+	if err != nil {
+		t.Fatalf("error creating bridge %v", err)
+	}
+	if err := b.Map("requests_total", 1, "method"); err != nil {
+		t.Fatalf("error mapping %v", err)
+	}
+	if err := b.Map("temperature", 2); err != nil {
+		t.Fatalf("error mapping %v", err)
+	}
+	if err := b.Map("other", 2); err == nil {
+		t.Errorf("mapped two families to the same arc")
+	}
+
+	d := &agx.Dispatcher{}
+	b.Attach(d)
+
+	//walk everything under the root
+	var walk []string
+	oid := subtree(t, root)
+	for {
+		vb := d.GetNext(oid)
+		if vb.Type == agx.EndOfMibViewT {
+			break
+		}
+		walk = append(walk, vb.String())
+		oid = vb.Name
+	}
+	expect := []string{
+		root + ".1.1.1.3.103.101.116 = STRING: \"get\"",
+		root + ".1.1.1.3.112.117.116 = STRING: \"put\"",
+		root + ".1.1.2.3.103.101.116 = Counter64: 1200",
+		root + ".1.1.2.3.112.117.116 = Counter64: 3",
+		root + ".2.0 = INTEGER: -5",
+	}
+	if len(walk) != len(expect) {
+		t.Fatalf("walked %v, expected %v", walk, expect)
+	}
+	for i := range expect {
+		if walk[i] != expect[i] {
+			t.Errorf("walked %s, expected %s", walk[i], expect[i])
+		}
+	}
+	if gathered != 1 {
+		t.Errorf("gathered %d times during a walk", gathered)
+	}
+
+	if vb := d.Get(subtree(t, root+".2.0")); vb.Data != agx.Integer(-5) {
+		t.Errorf("get returned %v", vb)
+	}
+	if vb := d.Get(subtree(t, root+".2.1")); vb.Type != agx.EndOfMibViewT {
+		t.Errorf("get of missing oid returned %v", vb)
+	}
+}
+
+func family(name string, t dto.MetricType, ms ...*dto.Metric) *dto.MetricFamily {
+	return &dto.MetricFamily{Name: &name, Type: t.Enum(), Metric: ms}
+}
+
+func metric(v float64, labels ...string) *dto.Metric {
+	m := &dto.Metric{
+		Gauge:   &dto.Gauge{Value: &v},
+		Counter: &dto.Counter{Value: &v},
+	}
+	for i := 0; i+1 < len(labels); i += 2 {
+		m.Label = append(m.Label, &dto.LabelPair{Name: &labels[i], Value: &labels[i+1]})
+	}
+	return m
+}
+
+func subtree(t *testing.T, oid string) agx.Subtree {
+	t.Helper()
+	s, err := agx.NewSubtree(oid)
+	if err != nil {
+		t.Fatalf("bad oid %s: %v", oid, err)
+	}
+	return *s
+}
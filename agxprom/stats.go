@@ -0,0 +1,50 @@
+package agxprom
+
+// This file contains the collector of handler statistics
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rcgoodfellow/agx"
+)
+
+var handlerDuration = prometheus.NewDesc(
+	"agx_handler_duration_seconds",
+	"Latency of calls to agx handlers, by registered oid and handler type.",
+	[]string{"oid", "type"}, nil,
+)
+
+// StatsCollector exports the handler statistics of a Dispatcher to
+// Prometheus, e.g.
+//
+//	prometheus.MustRegister(agxprom.NewStatsCollector(&c.Dispatcher))
+type StatsCollector struct {
+	d *agx.Dispatcher
+}
+
+// NewStatsCollector returns a collector for the handler statistics of d
+func NewStatsCollector(d *agx.Dispatcher) *StatsCollector {
+	return &StatsCollector{d: d}
+}
+
+func (c *StatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- handlerDuration
+}
+
+func (c *StatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.d.Stats() {
+		//prometheus buckets are cumulative
+		buckets := make(map[float64]uint64)
+		var n uint64
+		for i, b := range agx.LatencyBuckets {
+			if i < len(s.Buckets) {
+				n += s.Buckets[i]
+			}
+			buckets[b.Seconds()] = n
+		}
+		ch <- prometheus.MustNewConstHistogram(handlerDuration,
+			s.Calls, s.Total.Seconds(), buckets, s.Oid, s.Type.String())
+	}
+}
@@ -0,0 +1,107 @@
+// Package agxtest provides an in-process master agent for testing subagents
+// built with agx.
+package agxtest
+
+// This file contains a mock master agent that speaks enough AgentX to drive
+// an agx.Connection through open, registration, get, set and close
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/master"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// DefaultTimeout is how long the mock master waits on a subagent by default
+const DefaultTimeout = master.DefaultTimeout
+
+// MockMaster is a master agent listening on a unix socket in a temporary
+// directory. Subagents connect to it with agx.WithSocketPath(m.Path).
+//
+// Registration is asynchronous on the subagent side, so tests should use
+// WaitRegistration before issuing requests for a subtree.
+type MockMaster struct {
+	*master.Master
+	//Path is the unix socket the master listens on
+	Path string
+
+	dir string
+}
+
+// NewMockMaster starts a mock master agent listening on a fresh unix socket
+func NewMockMaster() (*MockMaster, error) {
+	dir, err := ioutil.TempDir("", "agxtest")
+	if err != nil {
+		return nil, fmt.Errorf("error creating socket directory: %v", err)
+	}
+	path := filepath.Join(dir, "master")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("error listening on %s: %v", path, err)
+	}
+
+	m := &MockMaster{
+		Master: master.New(),
+		Path:   path,
+		dir:    dir,
+	}
+	go m.Serve(ln)
+	return m, nil
+}
+
+// Close shuts down the master, dropping all sessions without sending close
+// PDUs. Use CloseSessions first to close them cleanly.
+func (m *MockMaster) Close() error {
+	err := m.Master.Close()
+	os.RemoveAll(m.dir)
+	return err
+}
+
+// Registrations returns the subtrees currently registered by subagents
+func (m *MockMaster) Registrations() []string {
+	var oids []string
+	for _, r := range m.Table.Registrations() {
+		oids = append(oids, r.Subtree.String())
+	}
+	return oids
+}
+
+// Get requests the provided oids from the subagents they are registered to.
+// Variables that are not registered at all are reported as noSuchObject.
+func (m *MockMaster) Get(oids ...string) ([]agx.VarBind, error) {
+	st, err := subtrees(oids)
+	if err != nil {
+		return nil, err
+	}
+	return m.Master.Get(st...)
+}
+
+// GetNext requests the variables following the provided oids from the
+// subagents registered at or after them. Variables past every registration
+// are reported as endOfMibView.
+func (m *MockMaster) GetNext(oids ...string) ([]agx.VarBind, error) {
+	st, err := subtrees(oids)
+	if err != nil {
+		return nil, err
+	}
+	return m.Master.GetNext(st...)
+}
+
+func subtrees(oids []string) ([]agx.Subtree, error) {
+	var result []agx.Subtree
+	for _, oid := range oids {
+		st, err := agx.NewSubtree(oid)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *st)
+	}
+	return result, nil
+}
@@ -0,0 +1,39 @@
+package agxtest
+
+// This file contains a helper for testing the tables of subagents without a
+// master agent
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"testing"
+)
+
+// BindTable returns the value of the instance oid in the table of entry whose
+// rows are loaded by load. The table is bound through a dispatcher as a get
+// from the master agent would be, and the test fails if the instance cannot be
+// bound.
+func BindTable(t testing.TB, entry string, load func() []agx.TableRow,
+	oid string) agx.Value {
+
+	t.Helper()
+	table, err := agx.NewTable(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.Load = load
+	var d agx.Dispatcher
+	table.Attach(&d)
+
+	s, err := agx.NewSubtree(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vb, err := d.Bind(*s, false)
+	if err != nil {
+		t.Fatalf("error binding %s: %v", oid, err)
+	}
+	return vb.Data
+}
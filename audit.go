@@ -0,0 +1,107 @@
+package agx
+
+// This file contains auditing of set operations, so that changes made through
+// the agent to the state it manages can be traced back to the requests that
+// made them
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"time"
+)
+
+// AuditRecord describes the outcome of one phase of a set operation on one
+// variable
+type AuditRecord struct {
+	Time          time.Time
+	Phase         PDUType //TestSetPDU or CommitSetPDU
+	SessionId     uint32
+	TransactionId uint32
+	Oid           Subtree
+	//Old is the value of the variable before the set as bound by the get
+	//handlers, noSuchInstance when there is none
+	Old VarBind
+	New VarBind
+	//Result is the TestSetResult or CommitSetResult of the phase
+	Result int16
+}
+
+func (r AuditRecord) String() string {
+	return fmt.Sprintf("%s %s sid=%d tid=%d %v: %s -> %s %s",
+		r.Time.Format(time.RFC3339), r.Phase, r.SessionId,
+		r.TransactionId, r.Oid, valueString(r.Old), valueString(r.New),
+		errorName(r.Result))
+}
+
+// AuditHook receives audit records as set operations are processed. Hooks are
+// called from the goroutine handling requests, so they should not block.
+type AuditHook func(AuditRecord)
+
+// WithAudit passes a record to h for each variable tested by a test-set, and
+// for each variable of a transaction when it is committed
+func WithAudit(h AuditHook) Option {
+	return func(c *Connection) {
+		c.audit = h
+	}
+}
+
+// currentValue returns the value of the variable named oid before it is set
+func (c *Connection) currentValue(oid Subtree) VarBind {
+	vb := c.Get(oid)
+	if vb.Type == EndOfMibViewT || vb.Name.Compare(oid) != 0 {
+		return VarBind{Type: NoSuchInstanceT, Name: oid}
+	}
+	return vb
+}
+
+// auditTestSet records the test of v, variables that pass are recorded again
+// when their transaction is committed
+func (c *Connection) auditTestSet(h *Header, old, v VarBind,
+	result TestSetResult) {
+
+	r := AuditRecord{
+		Time:          c.clock.Now(),
+		Phase:         TestSetPDU,
+		SessionId:     h.SessionId,
+		TransactionId: h.TransactionId,
+		Oid:           v.Name,
+		Old:           old,
+		New:           v,
+		Result:        int16(result),
+	}
+	c.audit(r)
+
+	if result == TestSetNoError {
+		c.mtx.Lock()
+		t := c.transactions[h.TransactionId]
+		t.tested = append(t.tested, r)
+		c.transactions[h.TransactionId] = t
+		c.mtx.Unlock()
+	}
+}
+
+// auditCommitSet records the commit of each variable of a transaction
+func (c *Connection) auditCommitSet(h *Header, result CommitSetResult) {
+	c.mtx.Lock()
+	tested := c.transactions[h.TransactionId].tested
+	c.mtx.Unlock()
+
+	now := c.clock.Now()
+	for _, r := range tested {
+		r.Time = now
+		r.Phase = CommitSetPDU
+		r.Result = int16(result)
+		c.audit(r)
+	}
+}
+
+// valueString formats the value of a varbind without its name
+func valueString(v VarBind) string {
+	switch v.Type {
+	case NullT, NoSuchObjectT, NoSuchInstanceT, EndOfMibViewT:
+		return varBindTypeName(v.Type)
+	}
+	return fmt.Sprintf("%s: %s", varBindTypeName(v.Type), formatData(v.Data))
+}
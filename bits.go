@@ -0,0 +1,159 @@
+package agx
+
+// This file contains the BITS construct (RFC2578~7.1.4)
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Bits is the value of a BITS construct, carried as an octet string in which
+// bit 0 is the most significant bit of the first octet (RFC3417~8)
+type Bits []byte
+
+// NewBits returns Bits with the listed bits set, as long as it needs to be
+// to hold the highest of them
+func NewBits(bits ...int) Bits {
+	var b Bits
+	for _, x := range bits {
+		b.Set(x)
+	}
+	return b
+}
+
+// Test reports whether bit is set
+func (b Bits) Test(bit int) bool {
+	if bit < 0 || bit/8 >= len(b) {
+		return false
+	}
+	return b[bit/8]&(0x80>>uint(bit%8)) != 0
+}
+
+// Set sets bit, growing b as needed
+func (b *Bits) Set(bit int) {
+	if bit < 0 {
+		return
+	}
+	for bit/8 >= len(*b) {
+		*b = append(*b, 0)
+	}
+	(*b)[bit/8] |= 0x80 >> uint(bit%8)
+}
+
+// Clear clears bit, b keeps its length
+func (b Bits) Clear(bit int) {
+	if bit < 0 || bit/8 >= len(b) {
+		return
+	}
+	b[bit/8] &^= 0x80 >> uint(bit%8)
+}
+
+// Positions returns the set bits in order
+func (b Bits) Positions() []int {
+	var ps []int
+	for i := 0; i < 8*len(b); i++ {
+		if b.Test(i) {
+			ps = append(ps, i)
+		}
+	}
+	return ps
+}
+
+func (b Bits) String() string {
+	var ps []string
+	for _, p := range b.Positions() {
+		ps = append(ps, strconv.Itoa(p))
+	}
+	return "{" + strings.Join(ps, " ") + "}"
+}
+
+// BitsVarBind binds oid to b
+func BitsVarBind(oid Subtree, b Bits) VarBind {
+	return NewVarBind(oid, *NewOctetString(b))
+}
+
+// Bits returns the value of an OctetString variable as BITS
+func (v VarBind) Bits() (Bits, bool) {
+	x, ok := v.Data.(OctetString)
+	if !ok {
+		return nil, false
+	}
+	return Bits(x.Bytes()), true
+}
+
+// BitNames are the named bits of a BITS type, e.g. for
+// SYNTAX BITS { up(0), down(1) } BitNames{"up": 0, "down": 1}
+type BitNames map[string]int
+
+// bit returns the position of the named bit
+func (n BitNames) bit(name string) (int, error) {
+	bit, ok := n[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown bit %s", name)
+	}
+	return bit, nil
+}
+
+// Bits returns Bits with the named bits set, as long as it needs to be to
+// hold the highest named bit of the type
+func (n BitNames) Bits(names ...string) (Bits, error) {
+	var b Bits
+	for _, x := range n {
+		if len(b) <= x/8 {
+			b = append(b, make(Bits, x/8+1-len(b))...)
+		}
+	}
+	for _, name := range names {
+		if err := n.Set(&b, name); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Set sets the named bit of b
+func (n BitNames) Set(b *Bits, name string) error {
+	bit, err := n.bit(name)
+	if err != nil {
+		return err
+	}
+	b.Set(bit)
+	return nil
+}
+
+// Clear clears the named bit of b
+func (n BitNames) Clear(b Bits, name string) error {
+	bit, err := n.bit(name)
+	if err != nil {
+		return err
+	}
+	b.Clear(bit)
+	return nil
+}
+
+// Test reports whether the named bit of b is set
+func (n BitNames) Test(b Bits, name string) (bool, error) {
+	bit, err := n.bit(name)
+	if err != nil {
+		return false, err
+	}
+	return b.Test(bit), nil
+}
+
+// Names returns the names of the set bits of b in bit order, set bits without
+// a name are left out
+func (n BitNames) Names(b Bits) []string {
+	var names []string
+	for name, bit := range n {
+		if b.Test(bit) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return n[names[i]] < n[names[j]] })
+	return names
+}
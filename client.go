@@ -0,0 +1,334 @@
+package agx
+
+// This file contains clients, transport connections to a master agent that
+// several sessions are opened over
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * Clients
+ *----------------------------------------------------------------------------*/
+
+// Client is a transport connection to a master agent that any number of
+// sessions can be opened over (RFC2741~7.1.1). The client frames the PDUs of
+// its sessions onto the transport one at a time, numbers their requests from
+// a single packet id space, and routes the PDUs from the master agent to
+// sessions by their session id. A Connection is a session over a client of
+// its own.
+type Client struct {
+	conn   net.Conn
+	logger Logger
+
+	//packet id of the last request sent by any of the sessions
+	packetId uint32
+
+	//sessions open one at a time, as the response to an open is the first
+	//the client hears of a session id
+	opening sync.Mutex
+
+	//writes of whole PDUs to conn
+	wmtx sync.Mutex
+
+	mtx      sync.Mutex
+	sessions map[uint32]*Connection
+	pending  *Connection
+	openId   uint32 //packet id of the open of the pending session
+	closed   bool
+}
+
+// Session is a session opened over a Client. It is served just as a
+// Connection is, with its own session id, handlers and registrations, and
+// closing it leaves the other sessions of the client open.
+type Session struct {
+	*Connection
+	client *Client
+}
+
+// route carries the PDUs the client reads for a session to the session
+type route struct {
+	in   chan inbound
+	done chan struct{}
+	once sync.Once
+}
+
+// inbound is a PDU read for a session, or the error reading its header
+type inbound struct {
+	hdr *Header
+	buf []byte
+	err error
+}
+
+func newRoute() *route {
+	return &route{
+		in:   make(chan inbound, 64),
+		done: make(chan struct{}),
+	}
+}
+
+// Dial connects to a master agent as Connect would, without opening a
+// session. Only the options that concern dialing and logging are used.
+func Dial(opts ...Option) (*Client, error) {
+	c := newConnection(opts)
+	conn, err := c.dial()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to agentx: %v", err)
+	}
+	cl := NewClient(conn)
+	cl.logger = c.logger
+	return cl, nil
+}
+
+// NewClient returns a client of the master agent over an already established
+// conn
+func NewClient(conn net.Conn) *Client {
+	cl := &Client{
+		conn:     conn,
+		sessions: make(map[uint32]*Connection),
+	}
+	go cl.read()
+	return cl
+}
+
+// Open opens a new session with the master agent, as NewConnection does for
+// a connection of its own. Options that concern dialing have no effect.
+func (cl *Client) Open(id, descr *string, opts ...Option) (*Session, error) {
+	c := newConnection(opts)
+	if err := c.open(cl, id, descr); err != nil {
+		return nil, err
+	}
+	return &Session{Connection: c, client: cl}, nil
+}
+
+// Client returns the client the session was opened over
+func (s *Session) Client() *Client {
+	return s.client
+}
+
+// Close closes the session, leaving the client and its other sessions open.
+// Close waits until the master agent has acknowledged the close or the
+// context is done, in which case the session is abandoned.
+func (s *Session) Close(ctx context.Context) error {
+	s.Disconnect()
+	select {
+	case <-s.Done():
+		return nil
+	case <-ctx.Done():
+		s.hangUp()
+		s.setClosed(ErrDisconnected)
+		return ctx.Err()
+	}
+}
+
+// Close closes the transport, ending every session opened over it
+func (cl *Client) Close() error {
+	cl.mtx.Lock()
+	if cl.closed {
+		cl.mtx.Unlock()
+		return nil
+	}
+	cl.closed = true
+	var sessions []*Connection
+	for _, c := range cl.sessions {
+		sessions = append(sessions, c)
+	}
+	if cl.pending != nil {
+		sessions = append(sessions, cl.pending)
+	}
+	cl.mtx.Unlock()
+
+	err := cl.conn.Close()
+	for _, c := range sessions {
+		cl.drop(c)
+	}
+	return err
+}
+
+// Sessions returns the number of sessions open over the client
+func (cl *Client) Sessions() int {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	return len(cl.sessions)
+}
+
+// logf logs to the logger of cl
+func (cl *Client) logf(format string, v ...interface{}) {
+	if cl.logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	cl.logger.Printf(format, v...)
+}
+
+// nextPacketId returns the packet id of the next request sent over the client
+func (cl *Client) nextPacketId() uint32 {
+	return atomic.AddUint32(&cl.packetId, 1)
+}
+
+// expect readies the client for the response to the open of c, which has the
+// packet id pid. Opens are serialized by the opening lock.
+func (cl *Client) expect(c *Connection, pid uint32) error {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+	if cl.closed {
+		return fmt.Errorf("client closed")
+	}
+	cl.pending = c
+	cl.openId = pid
+	return nil
+}
+
+// session returns the session the PDU with header h is for, nil if there is
+// none. The response to an open is the first the client hears of the id of
+// the session opened.
+func (cl *Client) session(h *Header) *Connection {
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+
+	c, ok := cl.sessions[h.SessionId]
+	if !ok && h.Type == ResponsePDU && cl.pending != nil &&
+		h.PacketId == cl.openId {
+		c = cl.pending
+		cl.sessions[h.SessionId] = c
+		cl.pending = nil
+	}
+	return c
+}
+
+// read routes the PDUs from the master agent to their sessions, reading each
+// PDU within the maximum payload length of the session it is for
+func (cl *Client) read() {
+	for {
+		hdr, buf, err := readHeader(cl.conn, *getBuffer())
+		if err != nil {
+			if !isClosedErr(err) {
+				cl.logf("[client] %v, closing", err)
+			}
+			cl.Close()
+			return
+		}
+
+		max := DefaultMaxPayloadLength
+		c := cl.session(hdr)
+		if c != nil {
+			max = c.maxPayload()
+		}
+		p, err := readPayload(cl.conn, buf, hdr, max)
+		if err != nil {
+			releaseBuffer(buf)
+		}
+		if ferr, ok := err.(frameError); ok {
+			//the session gives up on the master, the other sessions only
+			//do when the stream cannot be followed past the pdu
+			if c != nil {
+				cl.deliver(c, inbound{hdr: hdr, err: ferr})
+			}
+			if !cl.skip(hdr) {
+				cl.logf("[client] %v, closing", err)
+				cl.Close()
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if !isClosedErr(err) {
+				cl.logf("[client] %v, closing", err)
+			}
+			cl.Close()
+			return
+		}
+
+		if c == nil {
+			releaseBuffer(p)
+			cl.refuse(hdr)
+			continue
+		}
+		cl.deliver(c, inbound{hdr: hdr, buf: p})
+	}
+}
+
+// deliver hands f to the session c. A busy session only holds up the others
+// once its queue is full.
+func (cl *Client) deliver(c *Connection, f inbound) {
+	select {
+	case c.route.in <- f:
+	case <-c.route.done:
+		if f.buf != nil {
+			releaseBuffer(f.buf)
+		}
+	}
+}
+
+// refuse answers a request for a session that is not open over the client
+// with notOpen, responses for such sessions are dropped
+func (cl *Client) refuse(h *Header) {
+	if h.Type == ResponsePDU {
+		cl.logf("[client] dropping %v for unknown session", h)
+		return
+	}
+	cl.logf("[client] refusing %v for unknown session", h)
+	cl.wmtx.Lock()
+	defer cl.wmtx.Unlock()
+	_, err := WriteMessage(cl.conn, NewResponse(*h).SetError(ResponseNotOpen, 0))
+	if err != nil {
+		cl.logf("[client] error refusing %v: %v", h, err)
+	}
+}
+
+// skip reads past the payload of a PDU that was not read, returning false if
+// its header gives no sane payload length to skip
+func (cl *Client) skip(h *Header) bool {
+	if h.PayloadLength < 0 || h.PayloadLength%4 != 0 {
+		return false
+	}
+	_, err := io.CopyN(io.Discard, cl.conn, int64(h.PayloadLength))
+	return err == nil
+}
+
+// write writes the whole PDU p of the session whose route is r to the
+// transport, once the session has gone nothing more is written for it
+func (cl *Client) write(r *route, p []byte) (int, error) {
+	select {
+	case <-r.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	cl.wmtx.Lock()
+	defer cl.wmtx.Unlock()
+	return cl.conn.Write(p)
+}
+
+// drop forgets the session c, which reads nothing more from the client
+func (cl *Client) drop(c *Connection) {
+	cl.mtx.Lock()
+	for id, x := range cl.sessions {
+		if x == c {
+			delete(cl.sessions, id)
+		}
+	}
+	if cl.pending == c {
+		cl.pending = nil
+	}
+	cl.mtx.Unlock()
+	c.route.once.Do(func() { close(c.route.done) })
+}
+
+// routeWriter writes the PDUs of a session to its client
+type routeWriter struct {
+	cl *Client
+	r  *route
+}
+
+func (w routeWriter) Write(p []byte) (int, error) {
+	return w.cl.write(w.r, p)
+}
@@ -0,0 +1,147 @@
+package agx_test
+
+import (
+	"context"
+	"github.com/rcgoodfellow/agx"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientSessions(t *testing.T) {
+	client, server := net.Pipe()
+	cl := agx.NewClient(client)
+	defer cl.Close()
+
+	in := make(chan agx.Message, 16)
+	go func() {
+		for {
+			m, err := agx.ReadMessage(server)
+			if err != nil {
+				close(in)
+				return
+			}
+			in <- m
+		}
+	}()
+	next := func() agx.Message {
+		t.Helper()
+		select {
+		case m := <-in:
+			return m
+		case <-time.After(harnessTimeout):
+			t.Fatalf("timed out waiting for a pdu")
+		}
+		return nil
+	}
+	send := func(m agx.Message) {
+		t.Helper()
+		if _, err := agx.WriteMessage(server, m); err != nil {
+			t.Fatalf("error sending %v: %v", m, err)
+		}
+	}
+
+	//each session is given its own id by the master
+	var sessions []*agx.Session
+	for sid := uint32(1); sid <= 3; sid++ {
+		done := make(chan *agx.Session)
+		go func() {
+			id, descr := "1.2.3.4.7", "muffin man"
+			s, err := cl.Open(&id, &descr)
+			if err != nil {
+				t.Errorf("error opening session %v", err)
+			}
+			done <- s
+		}()
+		open := next().(*agx.OpenMessage)
+		r := agx.NewResponse(open.Header)
+		r.Header.SessionId = sid
+		send(r)
+		s := <-done
+		if s == nil {
+			t.FailNow()
+		}
+		v := int32(sid)
+		s.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, v)
+		})
+		sessions = append(sessions, s)
+	}
+	if cl.Sessions() != 3 {
+		t.Fatalf("expected 3 sessions, got %d", cl.Sessions())
+	}
+
+	get := func(sid uint32, n int) agx.Message {
+		t.Helper()
+		var ranges []agx.SearchRange
+		for i := 0; i < n; i++ {
+			ranges = append(ranges,
+				agx.SearchRange{Start: subtree(t, access+".1")})
+		}
+		send(&agx.GetMessage{
+			Header: agx.Header{Version: 1, Type: agx.GetPDU,
+				Flags: agx.NetworkByteOrder, SessionId: sid, PacketId: sid},
+			SearchRanges: ranges,
+		})
+		return next()
+	}
+	waitSessions := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(harnessTimeout)
+		for cl.Sessions() != n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if cl.Sessions() != n {
+			t.Fatalf("expected %d sessions, got %d", n, cl.Sessions())
+		}
+	}
+
+	//requests are served by the session they are for
+	for _, sid := range []uint32{2, 1} {
+		r := get(sid, 1).(*agx.Response)
+		if r.Header.SessionId != sid || len(r.VarBindList) != 1 ||
+			r.VarBindList[0].Data != agx.Integer(sid) {
+			t.Errorf("get for session %d returned %v", sid, r)
+		}
+	}
+
+	//closing one session leaves the other open
+	closed := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), harnessTimeout)
+		defer cancel()
+		closed <- sessions[0].Close(ctx)
+	}()
+	c := next().(*agx.CloseMessage)
+	if c.Header.SessionId != 1 {
+		t.Fatalf("expected close of session 1, got %v", c)
+	}
+	send(agx.NewResponse(c.Header))
+	if err := <-closed; err != nil {
+		t.Errorf("error closing session 1 %v", err)
+	}
+	waitSessions(2)
+	r := get(2, 1).(*agx.Response)
+	if r.VarBindList[0].Data != agx.Integer(2) {
+		t.Errorf("get for session 2 returned %v", r)
+	}
+
+	//requests for sessions that are not open are refused by the client
+	r = get(1, 1).(*agx.Response)
+	if r.Error != agx.ResponseNotOpen {
+		t.Errorf("get for closed session 1 returned %v", r)
+	}
+
+	//a pdu over the maximum payload length of a session closes that session
+	//alone, the client reads past it
+	sessions[2].SetMaxPayloadLength(64)
+	c = get(3, 5).(*agx.CloseMessage)
+	if c.Header.SessionId != 3 || c.Reason != agx.CloseReasonParseError {
+		t.Errorf("expected parse error close of session 3, got %v", c)
+	}
+	waitSessions(1)
+	r = get(2, 5).(*agx.Response)
+	if len(r.VarBindList) != 5 {
+		t.Errorf("get for session 2 returned %v", r)
+	}
+}
@@ -0,0 +1,68 @@
+package agx
+
+// This file contains the source of time of a connection
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"time"
+)
+
+// Clock is where a Connection takes the time from, for its uptime, its
+// keepalives, the timeouts it waits on and the times it records. Tests may
+// drive a Connection with a clock of their own to simulate the passing of
+// time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is the system clock, the clock of a Connection unless set
+// otherwise
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// WithClock takes the time from clk rather than from RealClock
+func WithClock(clk Clock) Option {
+	return func(c *Connection) {
+		c.clock = clk
+	}
+}
+
+// WithKeepalive pings the master agent every interval while the session is
+// open, keeping LastPingRTT current and idle connections in use
+func WithKeepalive(interval time.Duration) Option {
+	return func(c *Connection) {
+		c.keepaliveInterval = interval
+	}
+}
+
+// keepalive pings the master agent every interval until the session ends
+func (c *Connection) keepalive(interval time.Duration) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.clock.After(interval):
+		}
+		if _, err := c.ping(); err != nil {
+			c.logf("[keepalive] error sending ping: %v", err)
+		}
+	}
+}
+
+// Uptime returns how long the session with the master agent has been open
+func (c *Connection) Uptime() time.Duration {
+	return c.clock.Now().Sub(c.opened)
+}
+
+// SysUpTime returns the uptime of the session in hundredths of a second, as
+// sysUpTime is counted
+func (c *Connection) SysUpTime() TimeTicks {
+	return TimeTicks(c.Uptime() / (10 * time.Millisecond))
+}
@@ -0,0 +1,473 @@
+package main
+
+// This file contains the code generator
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rcgoodfellow/agx/smi"
+	"go/format"
+	"strings"
+	"unicode"
+)
+
+// goType describes how values of an SMI base type are held in Go
+type goType struct {
+	Go       string //the Go type
+	VarType  string //the agx varbind type
+	Zero     string //the zero value
+	Accessor string //the VarBind method returning values of the type
+	Value    string //converts a value of the type to an agx.Value
+}
+
+var goTypes = map[string]goType{
+	"INTEGER":           {"int32", "agx.IntegerT", "0", "Int32", "agx.Integer(%s)"},
+	"Integer32":         {"int32", "agx.IntegerT", "0", "Int32", "agx.Integer(%s)"},
+	"Unsigned32":        {"uint32", "agx.Gauge32T", "0", "Uint32", "agx.Gauge32(%s)"},
+	"Gauge32":           {"uint32", "agx.Gauge32T", "0", "Uint32", "agx.Gauge32(%s)"},
+	"Counter32":         {"uint32", "agx.Counter32T", "0", "Uint32", "agx.Counter32(%s)"},
+	"TimeTicks":         {"uint32", "agx.TimeTicksT", "0", "Uint32", "agx.TimeTicks(%s)"},
+	"Counter64":         {"uint64", "agx.Counter64T", "0", "Uint64", "agx.Counter64(%s)"},
+	"OCTET STRING":      {"[]byte", "agx.OctetStringT", "nil", "OctetString", "*agx.NewOctetString(%s)"},
+	"BITS":              {"[]byte", "agx.OctetStringT", "nil", "OctetString", "*agx.NewOctetString(%s)"},
+	"Opaque":            {"[]byte", "agx.OpaqueT", "nil", "OctetString", "agx.NewOpaque(%s)"},
+	"OBJECT IDENTIFIER": {"agx.Subtree", "agx.ObjectIdentifierT", "agx.Subtree{}", "OID", "agx.Oid{Subtree: %s}"},
+	"IpAddress":         {"net.IP", "agx.IpAddressT", "net.IPv4zero", "IP", "agx.IpAddress(%s)"},
+}
+
+// rawType holds values of syntaxes that could not be resolved
+var rawType = goType{"agx.VarBind", "", "agx.VarBind{Type: agx.NullT}", "", ""}
+
+func typeOf(n *smi.Node) goType {
+	if n.Syntax != nil {
+		if t, ok := goTypes[n.Syntax.Base]; ok {
+			return t
+		}
+	}
+	return rawType
+}
+
+func readable(n *smi.Node) bool {
+	switch n.Access {
+	case "read-only", "read-write", "read-create":
+		return true
+	}
+	return false
+}
+
+func writable(n *smi.Node) bool {
+	switch n.Access {
+	case "read-write", "read-create", "write-only":
+		return true
+	}
+	return false
+}
+
+// table is a table of the module with its entry and columns
+type table struct {
+	node    *smi.Node
+	entry   *smi.Node
+	columns []*smi.Node
+	//index holds the objects the rows are indexed by, which may be columns
+	//of other tables
+	index   []*smi.Node
+	implied bool
+}
+
+type generator struct {
+	p   *smi.Parser
+	m   *smi.Module
+	buf bytes.Buffer
+
+	scalars []*smi.Node
+	tables  []*table
+	usesNet bool
+}
+
+// generate returns the formatted Go source of the scaffolding of m
+func generate(p *smi.Parser, m *smi.Module, pkg, source string) ([]byte, error) {
+	g := &generator{p: p, m: m}
+	if err := g.collect(); err != nil {
+		return nil, err
+	}
+
+	g.printf("// Code generated by agx-gen from %s. DO NOT EDIT.\n\n", source)
+	g.printf("package %s\n\n", pkg)
+	g.printf("import (\n\"github.com/rcgoodfellow/agx\"\n")
+	if g.usesNet {
+		g.printf("\"net\"\n")
+	}
+	g.printf(")\n\n")
+
+	g.constants()
+	g.enums()
+	g.rows()
+	g.agent()
+	g.stubs()
+	g.install()
+
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error formatting generated code: %v", err)
+	}
+	return out, nil
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// collect sorts the objects of the module into scalars and tables
+func (g *generator) collect() error {
+	for _, n := range g.m.Nodes {
+		if n.Oid == nil {
+			return fmt.Errorf("the oid of %s is unresolved", n.Name)
+		}
+		switch n.Kind {
+		case smi.KindScalar:
+			if readable(n) || writable(n) {
+				g.scalars = append(g.scalars, n)
+				g.useType(n)
+			}
+		case smi.KindTable:
+			t, err := g.table(n)
+			if err != nil {
+				return err
+			}
+			g.tables = append(g.tables, t)
+		}
+	}
+	return nil
+}
+
+func (g *generator) useType(n *smi.Node) {
+	if typeOf(n).Go == "net.IP" {
+		g.usesNet = true
+	}
+}
+
+func (g *generator) table(n *smi.Node) (*table, error) {
+	t := &table{node: n}
+	entry := g.p.Node(n.Syntax.Entry)
+	if entry == nil {
+		//the entry type is named in capitals, the entry object is not
+		for _, x := range g.m.Nodes {
+			if x.Kind == smi.KindEntry && len(x.Oid) == len(n.Oid)+1 &&
+				hasPrefix(x.Oid, n.Oid) {
+				entry = x
+			}
+		}
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("table %s has no entry", n.Name)
+	}
+	t.entry = entry
+
+	for _, x := range g.m.Nodes {
+		if x.Kind == smi.KindColumn && len(x.Oid) == len(entry.Oid)+1 &&
+			hasPrefix(x.Oid, entry.Oid) {
+			t.columns = append(t.columns, x)
+			g.useType(x)
+		}
+	}
+
+	indexed := entry
+	if entry.Augments != "" {
+		if indexed = g.p.Node(entry.Augments); indexed == nil {
+			return nil, fmt.Errorf("%s augments unknown entry %s",
+				entry.Name, entry.Augments)
+		}
+	}
+	t.implied = indexed.Implied
+	for _, name := range indexed.Index {
+		x := g.p.Node(name)
+		if x == nil {
+			return nil, fmt.Errorf("%s is indexed by unknown object %s",
+				entry.Name, name)
+		}
+		t.index = append(t.index, x)
+		g.useType(x)
+	}
+	return t, nil
+}
+
+func hasPrefix(oid, prefix []uint32) bool {
+	if len(oid) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if oid[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// constants ..................................................................
+
+func (g *generator) constants() {
+	g.printf("// Object identifiers of %s\nconst (\n", g.m.Name)
+	for _, n := range g.m.Nodes {
+		g.printf("%sOid = \"%s\"\n", exported(n.Name), n.OidString())
+	}
+	g.printf(")\n\n")
+}
+
+// enums returns constants for the named numbers of enumerated objects
+func (g *generator) enums() {
+	for _, n := range g.m.Nodes {
+		if n.Syntax == nil || len(n.Syntax.Enums) == 0 ||
+			typeOf(n).Go != "int32" {
+			continue
+		}
+		g.printf("// Values of %s\nconst (\n", n.Name)
+		for _, e := range n.Syntax.Enums {
+			g.printf("%s%s = %d\n", exported(n.Name), exported(e.Name), e.Value)
+		}
+		g.printf(")\n\n")
+	}
+}
+
+// rows .......................................................................
+
+// fields returns the fields of the row struct of t, the index objects
+// followed by the remaining columns
+func (t *table) fields() []*smi.Node {
+	fs := append([]*smi.Node{}, t.index...)
+	for _, c := range t.columns {
+		if !t.isIndex(c) {
+			fs = append(fs, c)
+		}
+	}
+	return fs
+}
+
+func (t *table) isIndex(n *smi.Node) bool {
+	for _, x := range t.index {
+		if x == n {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldName strips the common prefix of the columns of t from n, unless that
+// leaves the name of a method of the row
+func (t *table) fieldName(n *smi.Node) string {
+	prefix := strings.TrimSuffix(t.entry.Name, "Entry")
+	if strings.HasPrefix(n.Name, prefix) && len(n.Name) > len(prefix) {
+		name := exported(n.Name[len(prefix):])
+		if name != "Index" && name != "Row" {
+			return name
+		}
+	}
+	return exported(n.Name)
+}
+
+func (t *table) typeName() string {
+	return exported(t.entry.Name)
+}
+
+func (g *generator) rows() {
+	for _, t := range g.tables {
+		name := t.typeName()
+		g.printf("// %s is a row of %s\ntype %s struct {\n",
+			name, t.node.Name, name)
+		for _, f := range t.fields() {
+			g.printf("%s %s\n", t.fieldName(f), typeOf(f).Go)
+		}
+		g.printf("}\n\n")
+
+		g.printf("// Index returns the instance identifier of the row\n")
+		g.printf("func (r %s) Index() []uint32 {\nvar index []uint32\n", name)
+		for i, x := range t.index {
+			implied := t.implied && i == len(t.index)-1
+			g.printf("index = append(index, %s...)\n",
+				indexExpr(x, "r."+t.fieldName(x), implied))
+		}
+		g.printf("return index\n}\n\n")
+
+		g.printf("// Row returns the row as served by the table engine\n")
+		g.printf("func (r %s) Row() agx.TableRow {\n", name)
+		g.printf("return agx.TableRow{\nIndex: r.Index(),\n")
+		g.printf("Columns: map[uint32]agx.VarBind{\n")
+		for _, c := range t.columns {
+			if readable(c) {
+				g.printf("%d: %s,\n", c.Oid[len(c.Oid)-1],
+					varBindExpr(c, "r."+t.fieldName(c)))
+			}
+		}
+		g.printf("},\n}\n}\n\n")
+	}
+}
+
+// indexExpr returns an expression encoding the index object n held in v
+func indexExpr(n *smi.Node, v string, implied bool) string {
+	switch typeOf(n).Go {
+	case "int32", "uint32", "uint64":
+		return fmt.Sprintf("agx.IntegerIndex(uint32(%s))", v)
+	case "[]byte":
+		if n.Syntax != nil && fixedSize(n.Syntax) {
+			implied = true
+		}
+		return fmt.Sprintf("agx.StringIndex(%s, %v)", v, implied)
+	case "agx.Subtree":
+		return fmt.Sprintf("agx.OidIndex(%s, %v)", v, implied)
+	case "net.IP":
+		return fmt.Sprintf("agx.IpAddressIndex(%s)", v)
+	}
+	return fmt.Sprintf("agx.OidIndex(%s.Name, %v)", v, implied)
+}
+
+// fixedSize tells whether strings of syntax s have a single length, which
+// are encoded in indices without their length (RFC2578~7.7)
+func fixedSize(s *smi.Syntax) bool {
+	return s.Size && len(s.Ranges) == 1 && s.Ranges[0].Min == s.Ranges[0].Max
+}
+
+// varBindExpr returns an expression binding the value v of object n
+func varBindExpr(n *smi.Node, v string) string {
+	t := typeOf(n)
+	if t.Value == "" {
+		return v
+	}
+	return fmt.Sprintf("{Type: %s, Data: %s}", t.VarType, fmt.Sprintf(t.Value, v))
+}
+
+// agent ......................................................................
+
+func (g *generator) agent() {
+	g.printf("// Agent serves the objects of %s. Set methods are called by\n", g.m.Name)
+	g.printf("// test-set handlers and should only check that a value can be\n")
+	g.printf("// set, applying it when the transaction commits.\n")
+	g.printf("type Agent interface {\n")
+	for _, n := range g.scalars {
+		if readable(n) {
+			g.printf("%s() %s\n", exported(n.Name), typeOf(n).Go)
+		}
+		if writable(n) {
+			g.printf("Set%s(v %s) agx.TestSetResult\n",
+				exported(n.Name), typeOf(n).Go)
+		}
+	}
+	for _, t := range g.tables {
+		g.printf("%s() []%s\n", exported(t.node.Name), t.typeName())
+		for _, c := range t.columns {
+			if writable(c) {
+				g.printf("Set%s(index []uint32, v %s) agx.TestSetResult\n",
+					exported(c.Name), typeOf(c).Go)
+			}
+		}
+	}
+	g.printf("}\n\n")
+}
+
+func (g *generator) stubs() {
+	g.printf("// AgentStubs implements Agent with empty objects that cannot be\n")
+	g.printf("// set, it may be embedded to implement Agent a piece at a time.\n")
+	g.printf("type AgentStubs struct{}\n\n")
+	for _, n := range g.scalars {
+		t := typeOf(n)
+		if readable(n) {
+			g.printf("func (AgentStubs) %s() %s { return %s }\n\n",
+				exported(n.Name), t.Go, t.Zero)
+		}
+		if writable(n) {
+			g.printf("func (AgentStubs) Set%s(v %s) agx.TestSetResult {\n"+
+				"return agx.TestSetNotWritable\n}\n\n", exported(n.Name), t.Go)
+		}
+	}
+	for _, t := range g.tables {
+		g.printf("func (AgentStubs) %s() []%s { return nil }\n\n",
+			exported(t.node.Name), t.typeName())
+		for _, c := range t.columns {
+			if writable(c) {
+				g.printf("func (AgentStubs) Set%s(index []uint32, v %s) "+
+					"agx.TestSetResult {\nreturn agx.TestSetNotWritable\n}\n\n",
+					exported(c.Name), typeOf(c).Go)
+			}
+		}
+	}
+}
+
+// install ....................................................................
+
+func (g *generator) install() {
+	g.printf("// Install serves a from d. The subtrees of the module must still\n")
+	g.printf("// be registered with the master agent.\n")
+	g.printf("func Install(d *agx.Dispatcher, a Agent) error {\n")
+
+	for _, n := range g.scalars {
+		oid := exported(n.Name) + "Oid"
+		if readable(n) {
+			g.printf("d.OnGet(%s+\".0\", func(oid agx.Subtree) agx.VarBind {\n", oid)
+			g.printf("vb := agx.VarBind%s\n", varBindExpr(n, "a."+exported(n.Name)+"()"))
+			g.printf("vb.Name = oid\nreturn vb\n})\n")
+		}
+		if writable(n) {
+			g.printf("d.OnTestSet(%s, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {\n", oid)
+			g.printf("if ids := vb.Name.Identifiers(); len(ids) != %d || ids[%d] != 0 {\n",
+				len(n.Oid)+1, len(n.Oid))
+			g.printf("return agx.TestSetNotWritable\n}\n")
+			g.setValue(n, "a.Set"+exported(n.Name)+"(%s)")
+			g.printf("})\n")
+		}
+	}
+
+	for i, t := range g.tables {
+		g.printf("t%d, err := agx.NewTable(%sOid)\n", i, exported(t.entry.Name))
+		g.printf("if err != nil {\nreturn err\n}\n")
+		g.printf("t%d.Load = func() []agx.TableRow {\nvar rows []agx.TableRow\n", i)
+		g.printf("for _, r := range a.%s() {\nrows = append(rows, r.Row())\n}\n",
+			exported(t.node.Name))
+		g.printf("return rows\n}\nt%d.Attach(d)\n", i)
+
+		for _, c := range t.columns {
+			if !writable(c) {
+				continue
+			}
+			g.printf("d.OnTestSet(%sOid, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {\n",
+				exported(c.Name))
+			g.printf("index := vb.Name.Identifiers()[%d:]\n", len(c.Oid))
+			g.setValue(c, "a.Set"+exported(c.Name)+"(index, %s)")
+			g.printf("})\n")
+		}
+	}
+	g.printf("return nil\n}\n")
+}
+
+// setValue prints the body of a test-set handler of n, checking the type of
+// the value before passing it to call
+func (g *generator) setValue(n *smi.Node, call string) {
+	t := typeOf(n)
+	if t.Accessor == "" {
+		g.printf("return %s\n", fmt.Sprintf(call, "vb"))
+		return
+	}
+	g.printf("v, ok := vb.%s()\n", t.Accessor)
+	g.printf("if vb.Type != %s || !ok {\nreturn agx.TestSetWrongType\n}\n", t.VarType)
+	g.printf("return %s\n", fmt.Sprintf(call, "v"))
+}
+
+// helpers ====================================================================
+
+// exported turns a MIB descriptor into an exported Go identifier
+func exported(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, r := range name {
+		if r == '-' || r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
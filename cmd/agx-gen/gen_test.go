@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/rcgoodfellow/agx/smi"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	p := smi.NewParser()
+	ms, err := p.ParseFile("../../smi/testdata/AGX-TEST-MIB.txt")
+	if err != nil {
+		t.Fatalf("error parsing module %v", err)
+	}
+	if err := p.Resolve(); err != nil {
+		t.Fatalf("error resolving module %v", err)
+	}
+
+	out, err := generate(p, ms[0], "agxtest", "AGX-TEST-MIB.txt")
+	if err != nil {
+		t.Fatalf("error generating code %v", err)
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "gen.go", out, 0)
+	if err != nil {
+		t.Fatalf("generated code does not parse: %v\n%s", err, out)
+	}
+
+	decls := make(map[string]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.ValueSpec:
+			for _, name := range x.Names {
+				decls[name.Name] = true
+			}
+		case *ast.TypeSpec:
+			decls[x.Name.Name] = true
+		case *ast.FuncDecl:
+			decls[x.Name.Name] = true
+		case *ast.Field:
+			for _, name := range x.Names {
+				decls[name.Name] = true
+			}
+		}
+		return true
+	})
+	for _, name := range []string{
+		"AgxTestPortEntryOid", "AgxTestNameOid", "AgxTestPortStateUp",
+		"AgxTestPortEntry", "AgxTestPortIndex", "Speed", "Address", "Index",
+		"Row", "Agent", "AgentStubs", "AgxTestName", "SetAgxTestName",
+		"AgxTestPortTable", "SetAgxTestPortSpeed", "Install",
+	} {
+		if !decls[name] {
+			t.Errorf("%s not generated", name)
+		}
+	}
+	//read only objects cannot be set
+	for _, name := range []string{"SetAgxTestEnabled", "SetAgxTestPortOctets"} {
+		if decls[name] {
+			t.Errorf("%s generated", name)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// agx-gen generates the Go scaffolding of an agent from a MIB module.
+//
+// Usage:
+//
+//	agx-gen [-o file] [-pkg name] [-module name] mib...
+//
+// The mib files are parsed together, so a module may be given along with the
+// modules it imports from. Code is generated for the module named by -module,
+// or the last module parsed. The generated code holds a constant for the oid
+// of each node of the module, a struct for the rows of each table, an Agent
+// interface with a method for each object the module defines, AgentStubs
+// implementing it, and an Install function that serves an Agent from a
+// Dispatcher through the agx table engine.
+package main
+
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"flag"
+	"fmt"
+	"github.com/rcgoodfellow/agx/smi"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var (
+	output  = flag.String("o", "", "output file, stdout when empty")
+	pkg     = flag.String("pkg", "mib", "package name of the generated code")
+	modname = flag.String("module", "", "module to generate, the last parsed when empty")
+)
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: agx-gen [-o file] [-pkg name] [-module name] mib...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	p := smi.NewParser()
+	var m *smi.Module
+	var source string
+	for _, path := range flag.Args() {
+		ms, err := p.ParseFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, x := range ms {
+			if *modname == "" || x.Name == *modname {
+				m, source = x, filepath.Base(path)
+			}
+		}
+	}
+	if m == nil {
+		log.Fatalf("module %s not found", *modname)
+	}
+	if err := p.Resolve(); err != nil {
+		//nodes of other modules may hang off modules that were not given
+		log.Printf("warning: %v", err)
+	}
+
+	out, err := generate(p, m, *pkg, source)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *output == "" {
+		os.Stdout.Write(out)
+		return
+	}
+	if err := os.WriteFile(*output, out, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
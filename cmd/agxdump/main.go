@@ -0,0 +1,143 @@
+// agxdump decodes captured AgentX traffic, printing one line per PDU.
+//
+// Usage:
+//
+//	agxdump [-x] [-port n] [file]
+//
+// The input is either a pcap capture of AgentX over TCP or a hex stream of raw
+// PDUs, such as the hex dumps written by agx.WithTrace or copied out of
+// wireshark. The input format is detected from the pcap magic number. With no
+// file, or a file of "-", stdin is read.
+package main
+
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	hexDump = flag.Bool("x", false, "hex dump each pdu after decoding it")
+	port    = flag.Int("port", 705, "tcp port agentx traffic is on in captures")
+
+	//out is where decoded pdus are printed
+	out io.Writer = os.Stdout
+)
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: agxdump [-x] [-port n] [file]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var in io.Reader = os.Stdin
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if flag.NArg() == 1 && flag.Arg(0) != "-" {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	r := bufio.NewReader(in)
+	magic, _ := r.Peek(4)
+	var err error
+	if isPcap(magic) {
+		err = dumpPcap(r, uint16(*port))
+	} else {
+		err = dumpHex(r)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// dumpHex decodes a stream of PDUs written as hex. Whitespace is ignored, as
+// are the offset and text columns of `hexdump -C` style dumps.
+func dumpHex(r io.Reader) error {
+	var raw []byte
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		b, err := hexLine(s.Text())
+		if err != nil {
+			return err
+		}
+		raw = append(raw, b...)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	return dumpStream("", bytes.NewReader(raw))
+}
+
+func hexLine(line string) ([]byte, error) {
+	//drop the text column of a hex dump
+	if i := strings.Index(line, "|"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	//lines that do not start with hex, such as the summaries WithTrace writes
+	//ahead of its hex dumps, are annotations
+	if _, err := hex.DecodeString(fields[0]); err != nil {
+		return nil, nil
+	}
+	//drop the offset column of a hex dump
+	if len(fields[0]) == 8 && len(fields) > 1 && isByteColumns(fields[1:]) {
+		fields = fields[1:]
+	}
+	b, err := hex.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		return nil, fmt.Errorf("bad hex %q: %v", line, err)
+	}
+	return b, nil
+}
+
+func isByteColumns(fields []string) bool {
+	for _, f := range fields {
+		if len(f) != 2 {
+			return false
+		}
+	}
+	return true
+}
+
+// dumpStream decodes and prints PDUs from r until it runs out, prefixing each
+// line with prefix
+func dumpStream(prefix string, r io.Reader) error {
+	for {
+		var raw bytes.Buffer
+		m, err := agx.ReadMessage(io.TeeReader(r, &raw))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%serror decoding pdu: %v", prefix, err)
+		}
+		fmt.Fprintf(out, "%s%v\n", prefix, m)
+		if *hexDump {
+			fmt.Fprint(out, hex.Dump(raw.Bytes()))
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/rcgoodfellow/agx"
+	"io"
+	"strings"
+	"testing"
+)
+
+// capture returns what f prints
+func capture(t *testing.T, f func() error) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	defer func(w io.Writer) { out = w }(out)
+	out = &buf
+	if err := f(); err != nil {
+		t.Fatalf("error dumping %v", err)
+	}
+	return strings.Split(strings.TrimSpace(buf.String()), "\n")
+}
+
+func pdus(t *testing.T) [][]byte {
+	id, descr := "1.2.3.4.7", "muffin man"
+	open, err := agx.NewOpenMessage(&id, &descr)
+	if err != nil {
+		t.Fatalf("error creating open message %v", err)
+	}
+	var bufs [][]byte
+	for _, m := range []agx.Message{open, agx.NewResponse(open.Header)} {
+		buf, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshalling %v", err)
+		}
+		bufs = append(bufs, buf)
+	}
+	return bufs
+}
+
+func TestDumpHex(t *testing.T) {
+	//as written by WithTrace, a summary line ahead of each hex dump
+	var in bytes.Buffer
+	for _, buf := range pdus(t) {
+		in.WriteString("2017-01-01T00:00:00.000000Z send Open ...\n")
+		in.WriteString(hex.Dump(buf))
+	}
+	lines := capture(t, func() error { return dumpHex(&in) })
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "Open ") ||
+		!strings.HasPrefix(lines[1], "Response ") {
+		t.Errorf("unexpected dump %q", lines)
+	}
+
+	//a plain hex stream
+	lines = capture(t, func() error {
+		return dumpHex(strings.NewReader(hex.EncodeToString(pdus(t)[0])))
+	})
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "Open ") {
+		t.Errorf("unexpected dump %q", lines)
+	}
+}
+
+// pcapFile is a capture of raw ipv4 packets
+type pcapFile struct {
+	bytes.Buffer
+}
+
+func newPcap() *pcapFile {
+	p := &pcapFile{}
+	var h [24]byte
+	binary.LittleEndian.PutUint32(h[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], 65535)
+	binary.LittleEndian.PutUint32(h[20:], linkRaw)
+	p.Write(h[:])
+	return p
+}
+
+// segment adds a tcp segment from port 47000 to 705 carrying payload
+func (p *pcapFile) segment(seq uint32, payload []byte) {
+	ip := make([]byte, 40, 40+len(payload))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(40+len(payload)))
+	ip[9] = 6
+	copy(ip[12:], []byte{10, 0, 0, 1})
+	copy(ip[16:], []byte{10, 0, 0, 2})
+	binary.BigEndian.PutUint16(ip[20:], 47000)
+	binary.BigEndian.PutUint16(ip[22:], 705)
+	binary.BigEndian.PutUint32(ip[24:], seq)
+	ip[32] = 5 << 4
+	ip = append(ip, payload...)
+
+	var h [16]byte
+	binary.LittleEndian.PutUint32(h[0:], 47)
+	binary.LittleEndian.PutUint32(h[8:], uint32(len(ip)))
+	binary.LittleEndian.PutUint32(h[12:], uint32(len(ip)))
+	p.Write(h[:])
+	p.Write(ip)
+}
+
+func TestDumpPcap(t *testing.T) {
+	bufs := pdus(t)
+	open, response := bufs[0], bufs[1]
+
+	//the open is split over two segments, the second retransmitted
+	p := newPcap()
+	p.segment(1000, open[:10])
+	p.segment(1010, open[10:])
+	p.segment(1010, open[10:])
+	p.segment(1000+uint32(len(open)), response[:8])
+	if !isPcap(p.Bytes()) {
+		t.Fatalf("capture not recognized")
+	}
+
+	dump := func(port uint16) []string {
+		return capture(t, func() error {
+			return dumpPcap(bytes.NewReader(p.Bytes()), port)
+		})
+	}
+	lines := dump(705)
+	expect := []string{
+		"00:00:47.000000 10.0.0.1:47000 > 10.0.0.2:705: Open ",
+		"incomplete pdu 10.0.0.1:47000 > 10.0.0.2:705: 8 bytes",
+	}
+	if len(lines) != len(expect) {
+		t.Fatalf("unexpected dump %q", lines)
+	}
+	for i := range expect {
+		if !strings.HasPrefix(lines[i], expect[i]) {
+			t.Errorf("dumped %q, expected %q", lines[i], expect[i])
+		}
+	}
+
+	//other ports are skipped
+	lines = dump(161)
+	if len(lines) != 1 || lines[0] != "" {
+		t.Errorf("unexpected dump %q", lines)
+	}
+}
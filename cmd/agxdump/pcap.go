@@ -0,0 +1,245 @@
+package main
+
+// This file contains just enough of a pcap reader to pull AgentX streams out
+// of tcp captures
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapMagicNanos = 0xa1b23c4d
+
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLinuxSLL = 113
+)
+
+func isPcap(magic []byte) bool {
+	if len(magic) < 4 {
+		return false
+	}
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		m := order.Uint32(magic)
+		if m == pcapMagic || m == pcapMagicNanos {
+			return true
+		}
+	}
+	return false
+}
+
+// flow is one direction of a tcp connection
+type flow struct {
+	src, dst string
+}
+
+func (f flow) String() string { return f.src + " > " + f.dst }
+
+// stream accumulates the in order payload of a flow
+type stream struct {
+	buf     bytes.Buffer
+	next    uint32
+	started bool
+}
+
+// dumpPcap prints the PDUs carried by tcp segments to or from port. Segments
+// are taken in capture order, retransmissions are dropped, and PDUs are
+// printed as each is completed.
+func dumpPcap(r io.Reader, port uint16) error {
+	var gh [24]byte
+	if _, err := io.ReadFull(r, gh[:]); err != nil {
+		return fmt.Errorf("error reading pcap header: %v", err)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if m := binary.BigEndian.Uint32(gh[:]); m == pcapMagic || m == pcapMagicNanos {
+		order = binary.BigEndian
+	}
+	nanos := order.Uint32(gh[:]) == pcapMagicNanos
+	link := order.Uint32(gh[20:])
+
+	streams := make(map[flow]*stream)
+	for {
+		var ph [16]byte
+		_, err := io.ReadFull(r, ph[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading packet header: %v", err)
+		}
+		sec, frac := order.Uint32(ph[0:]), order.Uint32(ph[4:])
+		if !nanos {
+			frac *= 1000
+		}
+		ts := time.Unix(int64(sec), int64(frac)).UTC()
+
+		pkt := make([]byte, order.Uint32(ph[8:]))
+		if _, err := io.ReadFull(r, pkt); err != nil {
+			return fmt.Errorf("error reading packet: %v", err)
+		}
+
+		f, seq, payload, ok := tcpSegment(link, pkt)
+		if !ok || (f.srcPort != port && f.dstPort != port) {
+			continue
+		}
+		s := streams[f.flow]
+		if s == nil {
+			s = &stream{}
+			streams[f.flow] = s
+		}
+		prefix := fmt.Sprintf("%s %v: ", ts.Format("15:04:05.000000"), f.flow)
+		s.add(prefix, seq, payload)
+		if err := s.dump(prefix); err != nil {
+			return err
+		}
+	}
+
+	//report anything left over that never formed a whole pdu
+	var partial []string
+	for f, s := range streams {
+		if s.buf.Len() > 0 {
+			partial = append(partial, fmt.Sprintf("%v: %d bytes", f, s.buf.Len()))
+		}
+	}
+	sort.Strings(partial)
+	for _, p := range partial {
+		fmt.Fprintf(out, "incomplete pdu %s\n", p)
+	}
+	return nil
+}
+
+// add appends a segment to the stream, if segments are missing from the
+// capture whatever was buffered is dropped and the stream restarted
+func (s *stream) add(prefix string, seq uint32, payload []byte) {
+	if !s.started {
+		s.started = true
+		s.next = seq
+	}
+	//drop whatever has been seen before
+	if d := int32(s.next - seq); d > 0 {
+		if int(d) >= len(payload) {
+			return
+		}
+		payload = payload[d:]
+		seq = s.next
+	}
+	if seq != s.next {
+		fmt.Fprintf(out,
+			"%s%d bytes missing from capture, dropping %d buffered\n",
+			prefix, seq-s.next, s.buf.Len())
+		s.buf.Reset()
+	}
+	s.buf.Write(payload)
+	s.next = seq + uint32(len(payload))
+}
+
+// dump prints the complete PDUs at the front of the stream
+func (s *stream) dump(prefix string) error {
+	for s.buf.Len() >= agx.HeaderSize {
+		b := s.buf.Bytes()
+		sz := agx.HeaderSize + int(binary.BigEndian.Uint32(b[16:agx.HeaderSize]))
+		if len(b) < sz {
+			return nil
+		}
+		if err := dumpStream(prefix, bytes.NewReader(b[:sz])); err != nil {
+			return err
+		}
+		s.buf.Next(sz)
+	}
+	return nil
+}
+
+type segment struct {
+	flow
+	srcPort, dstPort uint16
+}
+
+// tcpSegment pulls the tcp payload out of a captured frame
+func tcpSegment(link uint32, pkt []byte) (segment, uint32, []byte, bool) {
+	var seg segment
+
+	switch link {
+	case linkNull:
+		if len(pkt) < 4 {
+			return seg, 0, nil, false
+		}
+		pkt = pkt[4:]
+	case linkEthernet:
+		if len(pkt) < 14 {
+			return seg, 0, nil, false
+		}
+		pkt = pkt[14:]
+	case linkLinuxSLL:
+		if len(pkt) < 16 {
+			return seg, 0, nil, false
+		}
+		pkt = pkt[16:]
+	case linkRaw:
+	default:
+		return seg, 0, nil, false
+	}
+	if len(pkt) < 1 {
+		return seg, 0, nil, false
+	}
+
+	var src, dst net.IP
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 || pkt[9] != 6 {
+			return seg, 0, nil, false
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:]))
+		if ihl < 20 || total < ihl || len(pkt) < total {
+			return seg, 0, nil, false
+		}
+		src, dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		pkt = pkt[ihl:total]
+	case 6:
+		//extension headers are not followed
+		if len(pkt) < 40 || pkt[6] != 6 {
+			return seg, 0, nil, false
+		}
+		total := 40 + int(binary.BigEndian.Uint16(pkt[4:]))
+		if len(pkt) < total {
+			return seg, 0, nil, false
+		}
+		src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		pkt = pkt[40:total]
+	default:
+		return seg, 0, nil, false
+	}
+
+	if len(pkt) < 20 {
+		return seg, 0, nil, false
+	}
+	seg.srcPort = binary.BigEndian.Uint16(pkt[0:])
+	seg.dstPort = binary.BigEndian.Uint16(pkt[2:])
+	seq := binary.BigEndian.Uint32(pkt[4:])
+	off := int(pkt[12]>>4) * 4
+	if off < 20 || len(pkt) < off {
+		return seg, 0, nil, false
+	}
+	//a syn occupies a sequence number ahead of the payload
+	if pkt[13]&0x02 != 0 {
+		seq++
+	}
+
+	seg.flow = flow{
+		src: net.JoinHostPort(src.String(), fmt.Sprint(seg.srcPort)),
+		dst: net.JoinHostPort(dst.String(), fmt.Sprint(seg.dstPort)),
+	}
+	return seg, seq, pkt[off:], true
+}
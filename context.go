@@ -0,0 +1,36 @@
+package agx
+
+// This file contains the contexts PDUs are sent in, which are carried as an
+// octet string following the header when the NonDefaultContext flag is set
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+// Context is a context of the master agent a PDU is sent in, such as the
+// bridge a registration is for (RFC2741~6.1.1). The zero value is the default
+// context, which is sent without a context.
+type Context string
+
+// DefaultContext is the context of PDUs that do not name one
+const DefaultContext Context = ""
+
+// Apply sets the NonDefaultContext flag of h for a context other than the
+// default, and clears it for the default context, returning the context to
+// send after h. The default context is nil.
+func (c Context) Apply(h *Header) *OctetString {
+	if c == DefaultContext {
+		h.Flags &^= NonDefaultContext
+		return nil
+	}
+	h.Flags |= NonDefaultContext
+	return NewOctetString([]byte(c))
+}
+
+// ContextOf returns the context of a PDU whose context is s, which is the
+// default context when nil
+func ContextOf(s *OctetString) Context {
+	if s == nil {
+		return DefaultContext
+	}
+	return Context(s.Bytes())
+}
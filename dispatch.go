@@ -0,0 +1,852 @@
+package agx
+
+// This file contains the registry of handlers that variables are served from,
+// shared by every protocol front end that answers requests
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * Agents
+ *----------------------------------------------------------------------------*/
+type GetHandler func(oid Subtree) VarBind
+type GetSubtreeHandler func(oid Subtree, next bool) VarBind
+type TestSetHandler func(vars VarBind, sessionId uint32) TestSetResult
+type CommitSetHandler func(sessionId uint32) CommitSetResult
+type CleanupSetHandler func(sessionId uint32)
+
+// GetBatchHandler binds several variables beneath the oid it is installed for
+// at once, as a GetSubtreeHandler binds one, returning a varbind for each of
+// oids in order. Variables the handler does not hold are bound to
+// noSuchObject or noSuchInstance for a get, and to endOfMibView for a
+// getnext.
+type GetBatchHandler func(oids []Subtree, next bool) []VarBind
+
+// Dispatcher binds requested variables to the handlers registered for them.
+// A Connection embeds one to answer the master agent, and the same handlers
+// may be served over other protocols by sharing a Dispatcher. The zero value
+// is ready to use.
+type Dispatcher struct {
+	mtx                sync.Mutex
+	getHandlers        map[string]GetHandler
+	getSubtreeHandlers map[string]GetSubtreeHandler
+	getBatchHandlers   map[string]GetBatchHandler
+	testSetHandlers    map[string]TestSetHandler
+	commitSetHandler   CommitSetHandler
+	cleanupSetHandler  CleanupSetHandler
+
+	//sorted handler indices, rebuilt when nil
+	getHandlerIndex     HandlerBundles
+	testSetHandlerIndex HandlerBundles
+
+	//call counts and latencies, keyed by handler type and oid
+	stats map[handlerKey]*HandlerStats
+
+	//locks serializing the handlers of registered subtrees
+	regions regions
+
+	//declared syntaxes, sorted by oid
+	syntaxes []declaredSyntax
+
+	//handler deadlines, enforced once set with SetHandlerDeadline
+	deadline       time.Duration
+	deadlineMargin time.Duration
+
+	//where handlers are timed from and problems with them are logged to, the
+	//clock and logger of the connection the dispatcher is part of
+	clock  Clock
+	logger Logger
+}
+
+// now returns the time from the clock of the dispatcher
+func (d *Dispatcher) now() time.Time {
+	if d.clock == nil {
+		return time.Now()
+	}
+	return d.clock.Now()
+}
+
+// after waits on the clock of the dispatcher for duration t
+func (d *Dispatcher) after(t time.Duration) <-chan time.Time {
+	if d.clock == nil {
+		return time.After(t)
+	}
+	return d.clock.After(t)
+}
+
+// logf logs to the logger of the dispatcher
+func (d *Dispatcher) logf(format string, v ...interface{}) {
+	if d.logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	d.logger.Printf(format, v...)
+}
+
+func (d *Dispatcher) OnGet(oid string, f GetHandler) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.getHandlers == nil {
+		d.getHandlers = make(map[string]GetHandler)
+	}
+	d.getHandlers[oid] = f
+	d.getHandlerIndex = nil
+}
+
+func (d *Dispatcher) OnGetSubtree(oid string, f GetSubtreeHandler) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.getSubtreeHandlers == nil {
+		d.getSubtreeHandlers = make(map[string]GetSubtreeHandler)
+	}
+	d.getSubtreeHandlers[oid] = f
+	d.getHandlerIndex = nil
+}
+
+// OnGetBatch installs f for the variables beneath oid. Every variable a get
+// request asks for beneath oid is bound by a single call of f, so a handler
+// reading its variables from elsewhere, e.g. a command or a netlink dump, can
+// read them all at once. Getnext requests call f for each variable.
+func (d *Dispatcher) OnGetBatch(oid string, f GetBatchHandler) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.getBatchHandlers == nil {
+		d.getBatchHandlers = make(map[string]GetBatchHandler)
+	}
+	d.getBatchHandlers[oid] = f
+	d.getHandlerIndex = nil
+}
+
+func (d *Dispatcher) OnTestSet(oid string, f TestSetHandler) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.testSetHandlers == nil {
+		d.testSetHandlers = make(map[string]TestSetHandler)
+	}
+	d.testSetHandlers[oid] = f
+	d.testSetHandlerIndex = nil
+}
+
+func (d *Dispatcher) OnCommitSet(f CommitSetHandler) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.commitSetHandler = f
+}
+
+func (d *Dispatcher) OnCleanupSet(f CleanupSetHandler) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.cleanupSetHandler = f
+}
+
+// RemoveGet removes the get handler installed for oid
+func (d *Dispatcher) RemoveGet(oid string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.getHandlers, oid)
+	delete(d.stats, handlerKey{oid, GetHandlerType})
+	d.getHandlerIndex = nil
+}
+
+// RemoveGetSubtree removes the get-subtree handler installed for oid
+func (d *Dispatcher) RemoveGetSubtree(oid string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.getSubtreeHandlers, oid)
+	delete(d.stats, handlerKey{oid, GetSubtreeHandlerType})
+	d.getHandlerIndex = nil
+}
+
+// RemoveGetBatch removes the get-batch handler installed for oid
+func (d *Dispatcher) RemoveGetBatch(oid string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.getBatchHandlers, oid)
+	delete(d.stats, handlerKey{oid, GetBatchHandlerType})
+	d.getHandlerIndex = nil
+}
+
+// RemoveTestSet removes the test-set handler installed for oid
+func (d *Dispatcher) RemoveTestSet(oid string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.testSetHandlers, oid)
+	delete(d.stats, handlerKey{oid, TestSetHandlerType})
+	d.testSetHandlerIndex = nil
+}
+
+// RemoveHandlers removes every get, get-subtree, get-batch and test-set
+// handler installed for oid or for a variable beneath it, along with the
+// syntaxes declared there
+func (d *Dispatcher) RemoveHandlers(oid string) error {
+	root, err := NewSubtree(oid)
+	if err != nil {
+		return fmt.Errorf("bad oid %s: %v", oid, err)
+	}
+
+	for _, h := range d.Handlers() {
+		if h.Oid == "" || !h.Subtree.HasPrefix(*root) {
+			continue
+		}
+		switch h.Type {
+		case GetHandlerType:
+			d.RemoveGet(h.Oid)
+		case GetSubtreeHandlerType:
+			d.RemoveGetSubtree(h.Oid)
+		case GetBatchHandlerType:
+			d.RemoveGetBatch(h.Oid)
+		case TestSetHandlerType:
+			d.RemoveTestSet(h.Oid)
+		}
+	}
+
+	d.mtx.Lock()
+	var syntaxes []declaredSyntax
+	for _, x := range d.syntaxes {
+		if !x.root.HasPrefix(*root) {
+			syntaxes = append(syntaxes, x)
+		}
+	}
+	d.syntaxes = syntaxes
+	d.mtx.Unlock()
+	return nil
+}
+
+// requests ...................................................................
+
+// Get binds oid to a variable, as for an AgentX or SNMP get request. A
+// handler that overruns its deadline binds noSuchObject.
+func (d *Dispatcher) Get(oid Subtree) VarBind {
+	return orNoSuchObject(d.Bind(oid, false))
+}
+
+// GetNext binds the variable following oid, as for a getnext request
+func (d *Dispatcher) GetNext(oid Subtree) VarBind {
+	return orNoSuchObject(d.Bind(oid, true))
+}
+
+// Bind binds oid, or the variable following it when next is set, failing
+// with ErrHandlerDeadline when the handler overruns its deadline
+func (d *Dispatcher) Bind(oid Subtree, next bool) (VarBind, error) {
+	return d.varSearch(oid, d.getIndex(), next)
+}
+
+// BindAll binds oids as for a get request, the variables beneath each get-batch
+// handler being bound by one call of it. When a handler overruns its deadline
+// BindAll fails with ErrHandlerDeadline and the 1 based index of the oid it
+// was called for.
+func (d *Dispatcher) BindAll(oids []Subtree) ([]VarBind, int, error) {
+	vbs, index, err := d.bindBatches(oids)
+	if err != nil {
+		return nil, index, err
+	}
+	for i, oid := range oids {
+		if vbs[i] != nil {
+			continue
+		}
+		vb, err := d.Bind(oid, false)
+		if err != nil {
+			return nil, i + 1, err
+		}
+		vbs[i] = &vb
+	}
+	result := make([]VarBind, len(oids))
+	for i, vb := range vbs {
+		result[i] = *vb
+	}
+	return result, 0, nil
+}
+
+// bindBatches binds the oids of a get whose most specific handler is a
+// get-batch handler, calling each handler once. Oids a handler skips or binds
+// to endOfMibView fall back to the handlers enclosing it, as in varSearch. The
+// varbinds of other oids are nil.
+func (d *Dispatcher) bindBatches(oids []Subtree) ([]*VarBind, int, error) {
+	vbs := make([]*VarBind, len(oids))
+	handlers := d.getIndex()
+
+	//the oids each handler binds, in the order first asked for
+	var batches []*HandlerBundle
+	asked := make(map[*HandlerBundle][]int)
+	for i, oid := range oids {
+		h := mostSpecific(oid, handlers)
+		if h == nil || h.Type != GetBatchHandlerType {
+			continue
+		}
+		if _, ok := asked[h]; !ok {
+			batches = append(batches, h)
+		}
+		asked[h] = append(asked[h], i)
+	}
+
+	for _, h := range batches {
+		var batch []Subtree
+		for _, i := range asked[h] {
+			batch = append(batch, oids[i])
+		}
+		bound, err := d.callBatch(h, batch, false)
+		if err != nil {
+			return nil, asked[h][0] + 1, err
+		}
+		for j, i := range asked[h] {
+			if passedOver(bound[j]) {
+				bound[j], err = d.varSearch(oids[i], enclosing(h, handlers),
+					false)
+				if err != nil {
+					return nil, i + 1, err
+				}
+			}
+			vbs[i] = &bound[j]
+		}
+	}
+	return vbs, 0, nil
+}
+
+// enclosing returns the subtree handlers of handlers that hold the subtree of
+// the handler h, but not h itself
+func enclosing(h *HandlerBundle, handlers []HandlerBundle) []HandlerBundle {
+	var hs []HandlerBundle
+	for _, x := range handlers {
+		if x.Type != GetHandlerType && x.Subtree.length() < h.Subtree.length() &&
+			h.Subtree.HasPrefix(x.Subtree) {
+			hs = append(hs, x)
+		}
+	}
+	return hs
+}
+
+// mostSpecific returns the handler a get of oid is bound by first, a handler
+// for oid itself ahead of the subtree handler with the longest prefix of oid,
+// see varSearch
+func mostSpecific(oid Subtree, handlers []HandlerBundle) *HandlerBundle {
+	var h *HandlerBundle
+	for i := range handlers {
+		switch handlers[i].Type {
+		case GetHandlerType:
+			if handlers[i].Subtree.Eq(oid) {
+				return &handlers[i]
+			}
+		case GetSubtreeHandlerType, GetBatchHandlerType:
+			if oid.HasPrefix(handlers[i].Subtree) {
+				h = &handlers[i]
+			}
+		}
+	}
+	return h
+}
+
+func orNoSuchObject(vb VarBind, err error) VarBind {
+	if err != nil {
+		return NoSuchObjectVarBind(vb.Name)
+	}
+	return vb
+}
+
+// GetBulk answers a getbulk request (RFC3416~4.2.3). The first nonRepeaters
+// oids are bound to the variable following them once, the rest are walked
+// maxRepetitions times, the results for each repetition following those of
+// the previous one. Repetition stops early once every walk has reached the end
+// of the mib view.
+func (d *Dispatcher) GetBulk(nonRepeaters, maxRepetitions int,
+	oids []Subtree) []VarBind {
+
+	vbs, _, _ := d.getBulk(nonRepeaters, maxRepetitions, oids)
+	return vbs
+}
+
+// getBulk answers a getbulk request, failing with the 1 based index of the
+// oid being walked when a handler overruns its deadline
+func (d *Dispatcher) getBulk(nonRepeaters, maxRepetitions int,
+	oids []Subtree) ([]VarBind, int, error) {
+
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
+	}
+	if nonRepeaters > len(oids) {
+		nonRepeaters = len(oids)
+	}
+
+	index := d.getIndex()
+	var vbs []VarBind
+	for i, oid := range oids[:nonRepeaters] {
+		vb, err := d.varSearch(oid, index, true)
+		if err != nil {
+			return vbs, i + 1, err
+		}
+		vbs = append(vbs, vb)
+	}
+
+	cursor := make([]Subtree, len(oids)-nonRepeaters)
+	copy(cursor, oids[nonRepeaters:])
+	for r := 0; r < maxRepetitions && len(cursor) > 0; r++ {
+		done := true
+		for i, oid := range cursor {
+			vb, err := d.varSearch(oid, index, true)
+			if err != nil {
+				return vbs, nonRepeaters + i + 1, err
+			}
+			vbs = append(vbs, vb)
+			cursor[i] = vb.Name
+			if vb.Type != EndOfMibViewT {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	return vbs, 0, nil
+}
+
+// Walk returns the variables under root in order, found by repeated getnexts
+// as a manager walking the agent would. Handlers that do not advance the
+// walk are reported as errors rather than looping forever.
+func (d *Dispatcher) Walk(root string) ([]VarBind, error) {
+	r, err := NewSubtree(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var vbs []VarBind
+	oid := *r
+	for {
+		vb := d.GetNext(oid)
+		if vb.Type == EndOfMibViewT || !vb.Name.HasPrefix(*r) {
+			return vbs, nil
+		}
+		if !vb.Name.GreaterThan(oid) {
+			return vbs, fmt.Errorf("getnext of %s returned %s, walk is not advancing",
+				oid, vb.Name)
+		}
+		vbs = append(vbs, vb)
+		oid = vb.Name
+	}
+}
+
+// TestSet runs the test-set handlers for vars, each variable is tested by the
+// handler for the longest registered prefix of its name. The first failure is
+// returned along with the 1 based index of the variable that failed, which is
+// zero on success. Variables are checked against their declared syntax
+// before any handler runs. Variables that no handler is registered for are
+// not writable, and results that are not test-set errors become genErr, as
+// do handlers that overrun their deadline.
+func (d *Dispatcher) TestSet(vars []VarBind, sessionId uint32) (
+	TestSetResult, int) {
+
+	result, i, err := d.testSet(vars, sessionId)
+	if err != nil {
+		return TestSetGenError, i
+	}
+	return result, i
+}
+
+// testSet runs the test-set handlers for vars, failing with the 1 based index
+// of the variable whose handler overran its deadline
+func (d *Dispatcher) testSet(vars []VarBind, sessionId uint32) (
+	TestSetResult, int, error) {
+
+	if result, i := d.CheckSyntax(vars); result != TestSetNoError {
+		return result, i, nil
+	}
+
+	index := d.testSetIndex()
+	for i, v := range vars {
+		var handler *HandlerBundle
+		for j, h := range index {
+			//the index is sorted so later matches are more specific
+			if v.Name.HasPrefix(h.Subtree) {
+				handler = &index[j]
+			}
+		}
+		if handler == nil {
+			return TestSetNotWritable, i + 1, nil
+		}
+		var result TestSetResult
+		err := d.watch(handler, func() {
+			start := d.now()
+			result = handler.Handler.(TestSetHandler)(v, sessionId)
+			d.record(handler, d.now().Sub(start))
+		})
+		if err != nil {
+			return TestSetGenError, i + 1, err
+		}
+		if !result.IsValid() {
+			d.logf("test-set handler for %v returned invalid result %d",
+				v.Name, result)
+			result = TestSetGenError
+		}
+		if result != TestSetNoError {
+			return result, i + 1, nil
+		}
+	}
+	return TestSetNoError, 0, nil
+}
+
+// CommitSet runs the commit-set handler, succeeding if there is none
+func (d *Dispatcher) CommitSet(sessionId uint32) CommitSetResult {
+	d.mtx.Lock()
+	f := d.commitSetHandler
+	d.mtx.Unlock()
+
+	if f == nil {
+		return CommitSetNoError
+	}
+	defer d.regions.lockAll()()
+	return f(sessionId)
+}
+
+// CleanupSet runs the cleanup-set handler, if there is one
+func (d *Dispatcher) CleanupSet(sessionId uint32) {
+	d.mtx.Lock()
+	f := d.cleanupSetHandler
+	d.mtx.Unlock()
+
+	if f != nil {
+		defer d.regions.lockAll()()
+		f(sessionId)
+	}
+}
+
+// Handlers returns every installed handler, ordered by oid
+func (d *Dispatcher) Handlers() HandlerBundles {
+	var hs HandlerBundles
+	hs = append(hs, d.getIndex()...)
+	hs = append(hs, d.testSetIndex()...)
+	sort.Stable(hs)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.commitSetHandler != nil {
+		hs = append(hs, HandlerBundle{
+			Type: CommitSetHandlerType, Handler: d.commitSetHandler})
+	}
+	if d.cleanupSetHandler != nil {
+		hs = append(hs, HandlerBundle{
+			Type: CleanupSetHandlerType, Handler: d.cleanupSetHandler})
+	}
+	return hs
+}
+
+// Install installs handlers as returned by Handlers, e.g. to set up another
+// Dispatcher the same way
+func (d *Dispatcher) Install(hs HandlerBundles) error {
+	for _, h := range hs {
+		ok := false
+		switch h.Type {
+		case GetHandlerType:
+			var f GetHandler
+			if f, ok = h.Handler.(GetHandler); ok {
+				d.OnGet(h.Oid, f)
+			}
+		case GetSubtreeHandlerType:
+			var f GetSubtreeHandler
+			if f, ok = h.Handler.(GetSubtreeHandler); ok {
+				d.OnGetSubtree(h.Oid, f)
+			}
+		case TestSetHandlerType:
+			var f TestSetHandler
+			if f, ok = h.Handler.(TestSetHandler); ok {
+				d.OnTestSet(h.Oid, f)
+			}
+		case CommitSetHandlerType:
+			var f CommitSetHandler
+			if f, ok = h.Handler.(CommitSetHandler); ok {
+				d.OnCommitSet(f)
+			}
+		case CleanupSetHandlerType:
+			var f CleanupSetHandler
+			if f, ok = h.Handler.(CleanupSetHandler); ok {
+				d.OnCleanupSet(f)
+			}
+		case GetBatchHandlerType:
+			var f GetBatchHandler
+			if f, ok = h.Handler.(GetBatchHandler); ok {
+				d.OnGetBatch(h.Oid, f)
+			}
+		}
+		if !ok {
+			return fmt.Errorf("no %v handler for %q to install", h.Type, h.Oid)
+		}
+	}
+	return nil
+}
+
+// handlers ...................................................................
+
+type HandlerType int
+
+const (
+	GetHandlerType        = 1
+	GetSubtreeHandlerType = 2
+	TestSetHandlerType    = 3
+	CommitSetHandlerType  = 4
+	CleanupSetHandlerType = 5
+	GetBatchHandlerType   = 6
+)
+
+// HandlerBundle is a handler and the oid it is installed for, commit-set and
+// cleanup-set handlers have no oid. Only the oid and type are serialized.
+type HandlerBundle struct {
+	Oid     string      `json:"oid,omitempty"`
+	Subtree Subtree     `json:"-"`
+	Type    HandlerType `json:"type"`
+	Handler interface{} `json:"-"`
+}
+
+func (t HandlerType) String() string {
+	switch t {
+	case GetHandlerType:
+		return "get"
+	case GetSubtreeHandlerType:
+		return "getsubtree"
+	case TestSetHandlerType:
+		return "testset"
+	case CommitSetHandlerType:
+		return "commitset"
+	case CleanupSetHandlerType:
+		return "cleanupset"
+	case GetBatchHandlerType:
+		return "getbatch"
+	}
+	return fmt.Sprintf("HandlerType(%d)", int(t))
+}
+
+type HandlerBundles []HandlerBundle
+
+func (hs HandlerBundles) Len() int      { return len(hs) }
+func (hs HandlerBundles) Swap(i, j int) { hs[i], hs[j] = hs[j], hs[i] }
+func (hs HandlerBundles) Less(i, j int) bool {
+	//handlers for the same oid are ordered by type so the order is the same
+	//whatever order they were installed in
+	if c := hs[i].Subtree.Compare(hs[j].Subtree); c != 0 {
+		return c < 0
+	}
+	return hs[i].Type < hs[j].Type
+}
+
+// newHandlerBundle parses the oid of a handler so dispatch can compare it
+// numerically
+func newHandlerBundle(oid string, t HandlerType, h interface{}) HandlerBundle {
+	hb := HandlerBundle{Oid: oid, Type: t, Handler: h}
+	subtree, err := NewSubtree(oid)
+	if err != nil {
+		log.Printf("bad handler oid %s: %v", oid, err)
+	} else {
+		hb.Subtree = *subtree
+	}
+	return hb
+}
+
+// getIndex returns the get, get-subtree and get-batch handlers sorted by oid.
+// The index is built on first use after the handlers change, the returned
+// slice is never modified.
+func (d *Dispatcher) getIndex() HandlerBundles {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.getHandlerIndex == nil {
+		index := make(HandlerBundles, 0, len(d.getSubtreeHandlers)+
+			len(d.getBatchHandlers)+len(d.getHandlers))
+		for k, v := range d.getSubtreeHandlers {
+			index = append(index, newHandlerBundle(k, GetSubtreeHandlerType, v))
+		}
+		for k, v := range d.getBatchHandlers {
+			index = append(index, newHandlerBundle(k, GetBatchHandlerType, v))
+		}
+		for k, v := range d.getHandlers {
+			index = append(index, newHandlerBundle(k, GetHandlerType, v))
+		}
+		sort.Sort(index)
+		d.getHandlerIndex = index
+	}
+	return d.getHandlerIndex
+}
+
+// testSetIndex returns the test-set handlers sorted by oid, see getIndex
+func (d *Dispatcher) testSetIndex() HandlerBundles {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.testSetHandlerIndex == nil {
+		index := make(HandlerBundles, 0, len(d.testSetHandlers))
+		for k, v := range d.testSetHandlers {
+			index = append(index, newHandlerBundle(k, TestSetHandlerType, v))
+		}
+		sort.Sort(index)
+		d.testSetHandlerIndex = index
+	}
+	return d.testSetHandlerIndex
+}
+
+// varSearch binds oid to a variable, the handlers being sorted by oid. For a
+// get the most specific handler binds it, a handler for oid itself ahead of
+// the subtree handler with the longest prefix of oid. For a getnext every
+// handler that may hold a variable following oid is consulted, and the first
+// of those variables in oid order is bound, so overlapping handlers merge.
+// Where handlers hold the same variable the most specific one binds it.
+// Handlers that skip the variable are passed over.
+func (d *Dispatcher) varSearch(oid Subtree, handlers []HandlerBundle,
+	next bool) (VarBind, error) {
+
+	if next {
+		return d.nextSearch(oid, handlers)
+	}
+
+	var containing []*HandlerBundle
+	for i := range handlers {
+		h := &handlers[i]
+		switch h.Type {
+		case GetHandlerType:
+			if h.Subtree.Eq(oid) {
+				vb, err := d.call(h, oid, false)
+				if err != nil || !vb.Skipped() {
+					return vb, err
+				}
+			}
+		case GetSubtreeHandlerType, GetBatchHandlerType:
+			if oid.HasPrefix(h.Subtree) {
+				containing = append(containing, h)
+			}
+		}
+	}
+	//a subtree that does not have the oid falls back to the enclosing one
+	for i := len(containing) - 1; i >= 0; i-- {
+		vb, err := d.call(containing[i], oid, false)
+		if err != nil || !passedOver(vb) {
+			return vb, err
+		}
+	}
+	return EndOfMibViewVarBind(oid), nil
+}
+
+// passedOver returns whether vb leaves its variable to other handlers, by
+// skipping it or by its subtree having no more variables
+func passedOver(vb VarBind) bool {
+	return vb.Skipped() || vb.Type == EndOfMibViewT
+}
+
+// nextSearch binds the variable following oid, see varSearch
+func (d *Dispatcher) nextSearch(oid Subtree, handlers []HandlerBundle) (
+	VarBind, error) {
+
+	var best *VarBind
+	for i := range handlers {
+		h := &handlers[i]
+		//handlers after the best variable so far only hold variables after it
+		if best != nil && h.Subtree.Compare(best.Name) > 0 {
+			break
+		}
+		switch h.Type {
+		case GetSubtreeHandlerType, GetBatchHandlerType:
+			//truncate the target oid to the prefix length of the handler, if
+			//the handler comes at or after the truncation it may hold a
+			//variable following the oid
+			if compareUpTo(oid, h.Subtree, h.Subtree.length()) > 0 {
+				continue
+			}
+			vb, err := d.call(h, oid, true)
+			if err != nil {
+				return vb, err
+			}
+			if passedOver(vb) {
+				continue
+			}
+			if best == nil || !best.Name.LessThan(vb.Name) {
+				best = &vb
+			}
+		case GetHandlerType:
+			//a handler for the oid itself only binds for get
+			if h.Subtree.Compare(oid) <= 0 {
+				continue
+			}
+			if best == nil || !best.Name.LessThan(h.Subtree) {
+				vb, err := d.call(h, oid, true)
+				if err != nil {
+					return vb, err
+				}
+				if vb.Skipped() {
+					continue
+				}
+				best = &vb
+			}
+		}
+	}
+	if best == nil {
+		return EndOfMibViewVarBind(oid), nil
+	}
+	return *best, nil
+}
+
+// call runs the get handler h for oid, recording its statistics. The name of
+// the variable returned on error is oid.
+func (d *Dispatcher) call(h *HandlerBundle, oid Subtree, next bool) (
+	VarBind, error) {
+
+	var vb VarBind
+	err := d.watch(h, func() {
+		start := d.now()
+		switch h.Type {
+		case GetSubtreeHandlerType:
+			vb = h.Handler.(GetSubtreeHandler)(oid, next)
+		case GetBatchHandlerType:
+			vb = d.batchOf(h, []Subtree{oid}, next)[0]
+		default:
+			vb = h.Handler.(GetHandler)(h.Subtree)
+		}
+		d.record(h, d.now().Sub(start))
+	})
+	if err != nil {
+		return VarBind{Name: oid}, err
+	}
+	return vb, nil
+}
+
+// callBatch runs the get-batch handler h for oids, recording its statistics
+// as for one call, see call
+func (d *Dispatcher) callBatch(h *HandlerBundle, oids []Subtree, next bool) (
+	[]VarBind, error) {
+
+	var vbs []VarBind
+	err := d.watch(h, func() {
+		start := d.now()
+		vbs = d.batchOf(h, oids, next)
+		d.record(h, d.now().Sub(start))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vbs, nil
+}
+
+// batchOf runs the get-batch handler h for oids. A handler that does not
+// answer each oid leaves those it missed bound to noSuchObject, or to
+// endOfMibView for a getnext.
+func (d *Dispatcher) batchOf(h *HandlerBundle, oids []Subtree,
+	next bool) []VarBind {
+
+	vbs := h.Handler.(GetBatchHandler)(oids, next)
+	if len(vbs) != len(oids) {
+		d.logf("%s handler for %s bound %d of %d variables",
+			h.Type, h.Oid, len(vbs), len(oids))
+	}
+	result := make([]VarBind, len(oids))
+	for i, oid := range oids {
+		switch {
+		case i < len(vbs):
+			result[i] = vbs[i]
+		case next:
+			result[i] = EndOfMibViewVarBind(oid)
+		default:
+			result[i] = NoSuchObjectVarBind(oid)
+		}
+	}
+	return result
+}
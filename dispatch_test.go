@@ -0,0 +1,387 @@
+package agx_test
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/agxtest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	d := &agx.Dispatcher{}
+	d.OnGet(egress+".1", func(oid agx.Subtree) agx.VarBind {
+		return agx.IntegerVarBind(oid, 1)
+	})
+	d.OnGetSubtree(access, func(oid agx.Subtree, next bool) agx.VarBind {
+		time.Sleep(2 * time.Millisecond)
+		return agx.EndOfMibViewVarBind(oid)
+	})
+	d.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+		return agx.TestSetNoError
+	})
+
+	d.Get(subtree(t, egress+".1"))
+	d.GetNext(subtree(t, egress))
+	d.GetNext(subtree(t, access))
+	d.TestSet([]agx.VarBind{agx.IntegerVarBind(subtree(t, access+".1"), 1)}, 0)
+
+	stats := d.Stats()
+	if len(stats) != 3 {
+		t.Fatalf("expected stats for 3 handlers, got %v", stats)
+	}
+	get, subtreeGet, testSet := stats[0], stats[1], stats[2]
+	if get.Oid != egress+".1" || get.Type != agx.GetHandlerType ||
+		get.Calls != 2 {
+		t.Errorf("get handler stats %+v", get)
+	}
+	if subtreeGet.Oid != access || subtreeGet.Type != agx.GetSubtreeHandlerType ||
+		subtreeGet.Calls != 1 || subtreeGet.Max < 2*time.Millisecond ||
+		subtreeGet.Buckets[0]+subtreeGet.Buckets[1] != 0 {
+		t.Errorf("subtree handler stats %+v", subtreeGet)
+	}
+	if testSet.Oid != access || testSet.Type != agx.TestSetHandlerType ||
+		testSet.Calls != 1 {
+		t.Errorf("test set handler stats %+v", testSet)
+	}
+
+	d.ResetStats()
+	if stats := d.Stats(); len(stats) != 0 {
+		t.Errorf("stats remain after reset %v", stats)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	d := &agx.Dispatcher{}
+	for i := 1; i <= 3; i++ {
+		d.OnGet(fmt.Sprintf("%s.%d", egress, i), func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, int32(len(oid.Identifiers())))
+		})
+	}
+	d.OnGet(qbridge+".1.2.0", func(oid agx.Subtree) agx.VarBind {
+		return agx.IntegerVarBind(oid, 47)
+	})
+
+	vbs, err := d.Walk(egress)
+	if err != nil {
+		t.Fatalf("error walking %v", err)
+	}
+	var names []string
+	for _, vb := range vbs {
+		names = append(names, vb.Name.String())
+	}
+	expect := []string{egress + ".1", egress + ".2", egress + ".3"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("walk returned %v", names)
+	}
+	if vbs, err := d.Walk(qbridge); err != nil || len(vbs) != 4 {
+		t.Errorf("walk of %s returned %v %v", qbridge, vbs, err)
+	}
+
+	//a subtree handler that does not advance is caught
+	d.OnGetSubtree(access, func(oid agx.Subtree, next bool) agx.VarBind {
+		return agx.IntegerVarBind(oid, 0)
+	})
+	if _, err := d.Walk(access); err == nil {
+		t.Errorf("no error walking a stuck subtree")
+	}
+}
+
+func TestTestSetInvalidResult(t *testing.T) {
+	d := &agx.Dispatcher{}
+	d.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+		return agx.TestSetResult(agx.ResponseNotOpen)
+	})
+
+	vars := []agx.VarBind{agx.IntegerVarBind(subtree(t, access+".1"), 1)}
+	if result, index := d.TestSet(vars, 0); result != agx.TestSetGenError ||
+		index != 1 {
+		t.Errorf("expected genErr at 1, got %v at %d", result, index)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	//the subtree handler holds .1 and .3, overlapping the handlers for .2, .3
+	//and the inner subtree at .5
+	d := &agx.Dispatcher{}
+	held := []string{access + ".1", access + ".3"}
+	d.OnGetSubtree(access, func(oid agx.Subtree, next bool) agx.VarBind {
+		for _, x := range held {
+			name := subtree(t, x)
+			if (!next && oid.Eq(name)) || (next && name.GreaterThan(oid)) {
+				return *agx.OctetStringVarBind(name, []byte("subtree"))
+			}
+		}
+		return agx.EndOfMibViewVarBind(oid)
+	})
+	for _, x := range []string{access + ".2", access + ".3"} {
+		d.OnGet(x, func(oid agx.Subtree) agx.VarBind {
+			return *agx.OctetStringVarBind(oid, []byte("exact"))
+		})
+	}
+	d.OnGetSubtree(access+".5", func(oid agx.Subtree, next bool) agx.VarBind {
+		if next {
+			return agx.EndOfMibViewVarBind(oid)
+		}
+		return *agx.OctetStringVarBind(oid, []byte("inner"))
+	})
+
+	value := func(vb agx.VarBind) string {
+		b, _ := vb.OctetString()
+		return vb.Name.String() + " " + string(b)
+	}
+	tests := []struct {
+		oid    string
+		next   bool
+		expect string
+	}{
+		{access + ".1", false, access + ".1 subtree"},
+		{access + ".2", false, access + ".2 exact"},
+		{access + ".3", false, access + ".3 exact"},
+		{access + ".5.1", false, access + ".5.1 inner"},
+		{access, true, access + ".1 subtree"},
+		{access + ".1", true, access + ".2 exact"},
+		{access + ".2", true, access + ".3 exact"},
+		{access + ".3", true, access + ".3 "},
+	}
+	for _, x := range tests {
+		var vb agx.VarBind
+		if x.next {
+			vb = d.GetNext(subtree(t, x.oid))
+		} else {
+			vb = d.Get(subtree(t, x.oid))
+		}
+		s := value(vb)
+		if vb.Type == agx.EndOfMibViewT {
+			s = vb.Name.String() + " "
+		}
+		if s != x.expect {
+			t.Errorf("%s next=%v bound %q, expected %q", x.oid, x.next, s,
+				x.expect)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	//the outer handler holds .1, .2.1 and .3, the inner one .2.2 and skips the
+	//rest of .2, the exact handler for .1 skips it
+	d := &agx.Dispatcher{}
+	held := func(value string, oids ...string) agx.GetSubtreeHandler {
+		return func(oid agx.Subtree, next bool) agx.VarBind {
+			for _, x := range oids {
+				name := subtree(t, access+x)
+				if (!next && oid.Eq(name)) || (next && name.GreaterThan(oid)) {
+					return *agx.OctetStringVarBind(name, []byte(value))
+				}
+			}
+			if next {
+				return agx.EndOfMibViewVarBind(oid)
+			}
+			return agx.SkipVarBind(oid)
+		}
+	}
+	d.OnGetSubtree(access, held("outer", ".1", ".2.1", ".3"))
+	d.OnGetSubtree(access+".2", held("inner", ".2.2"))
+	d.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+		return agx.SkipVarBind(oid)
+	})
+
+	for oid, expect := range map[string]string{
+		".1": "outer", ".2.1": "outer", ".2.2": "inner", ".3": "outer"} {
+		vb := d.Get(subtree(t, access+oid))
+		b, _ := vb.OctetString()
+		if vb.Skipped() || string(b) != expect {
+			t.Errorf("get %s bound %v, expected %s", oid, vb, expect)
+		}
+	}
+	if vb := d.Get(subtree(t, access+".2.3")); vb.Type != agx.EndOfMibViewT {
+		t.Errorf("variable skipped by every handler bound %v", vb)
+	}
+
+	vbs, err := d.Walk(access)
+	if err != nil {
+		t.Fatalf("walk failed %v", err)
+	}
+	var walked []string
+	for _, vb := range vbs {
+		walked = append(walked, vb.Name.String())
+	}
+	expect := []string{access + ".1", access + ".2.1", access + ".2.2",
+		access + ".3"}
+	if !reflect.DeepEqual(walked, expect) {
+		t.Errorf("walked %v, expected %v", walked, expect)
+	}
+}
+
+// scalars serves access.1.0 to access.3.0 from a get-batch handler, counting
+// its calls
+func scalars(t *testing.T, d *agx.Dispatcher) *[][]string {
+	var calls [][]string
+	held := []string{access + ".1.0", access + ".2.0", access + ".3.0"}
+	d.OnGetBatch(access, func(oids []agx.Subtree, next bool) []agx.VarBind {
+		var call []string
+		var vbs []agx.VarBind
+		for _, oid := range oids {
+			call = append(call, oid.String())
+			vb := agx.EndOfMibViewVarBind(oid)
+			for _, x := range held {
+				name := subtree(t, x)
+				if (!next && oid.Eq(name)) || (next && name.GreaterThan(oid)) {
+					vb = *agx.OctetStringVarBind(name, []byte("batch"))
+					break
+				}
+			}
+			vbs = append(vbs, vb)
+		}
+		calls = append(calls, call)
+		return vbs
+	})
+	return &calls
+}
+
+func TestGetBatch(t *testing.T) {
+	d := &agx.Dispatcher{}
+	calls := scalars(t, d)
+	d.OnGet(access+".2.0", func(oid agx.Subtree) agx.VarBind {
+		return *agx.OctetStringVarBind(oid, []byte("exact"))
+	})
+
+	//the variables of the batch handler are bound by one call, those of more
+	//specific handlers are not
+	oids := []agx.Subtree{subtree(t, access+".3.0"), subtree(t, access+".2.0"),
+		subtree(t, egress+".1"), subtree(t, access+".1.0")}
+	vbs, _, err := d.BindAll(oids)
+	if err != nil {
+		t.Fatalf("bind failed %v", err)
+	}
+	var bound []string
+	for _, vb := range vbs {
+		b, _ := vb.OctetString()
+		bound = append(bound, fmt.Sprintf("%v %s", vb.Name, b))
+	}
+	expect := []string{access + ".3.0 batch", access + ".2.0 exact",
+		egress + ".1 ", access + ".1.0 batch"}
+	if !reflect.DeepEqual(bound, expect) {
+		t.Errorf("bound %v, expected %v", bound, expect)
+	}
+	if vbs[2].Type != agx.EndOfMibViewT {
+		t.Errorf("unhandled oid bound %v", vbs[2])
+	}
+	batches := [][]string{{access + ".3.0", access + ".1.0"}}
+	if !reflect.DeepEqual(*calls, batches) {
+		t.Errorf("handler called with %v, expected %v", *calls, batches)
+	}
+
+	//a walk calls the handler for each variable, and once more to find the
+	//end of it
+	*calls = nil
+	walked, err := d.Walk(access)
+	if err != nil {
+		t.Fatalf("walk failed %v", err)
+	}
+	if len(walked) != 3 || len(*calls) != 4 {
+		t.Errorf("walk bound %v with calls %v", walked, *calls)
+	}
+
+	var types []string
+	for _, h := range d.Handlers() {
+		types = append(types, h.Type.String())
+	}
+	if !reflect.DeepEqual(types, []string{"getbatch", "get"}) {
+		t.Errorf("unexpected handlers %v", types)
+	}
+}
+
+func TestRemoveHandlers(t *testing.T) {
+	d := &agx.Dispatcher{}
+	get := func(oid agx.Subtree) agx.VarBind {
+		return agx.IntegerVarBind(oid, 1)
+	}
+	d.OnGet(access+".1", get)
+	d.OnGet(access+".2", get)
+	d.OnGet(egress+".1", get)
+	d.OnGetSubtree(egress, func(oid agx.Subtree, next bool) agx.VarBind {
+		return agx.EndOfMibViewVarBind(oid)
+	})
+	d.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+		return agx.TestSetNoError
+	})
+
+	d.RemoveGet(access + ".1")
+	vb := d.GetNext(subtree(t, access))
+	if vb.Name.String() != access+".2" {
+		t.Errorf("removed get handler still answers getnext with %v", vb)
+	}
+
+	if err := d.RemoveHandlers(access); err != nil {
+		t.Fatalf("error removing handlers %v", err)
+	}
+	vb = d.GetNext(subtree(t, access))
+	if vb.Type != agx.EndOfMibViewT {
+		t.Errorf("removed handlers still answer getnext with %v", vb)
+	}
+	var oids []string
+	for _, h := range d.Handlers() {
+		oids = append(oids, h.Type.String()+" "+h.Oid)
+	}
+	expect := []string{"getsubtree " + egress, "get " + egress + ".1"}
+	if !reflect.DeepEqual(oids, expect) {
+		t.Errorf("handlers %v remain, expected %v", oids, expect)
+	}
+
+	d.RemoveGetSubtree(egress)
+	d.RemoveTestSet(access)
+	if hs := d.Handlers(); len(hs) != 1 {
+		t.Errorf("expected 1 handler, got %v", hs)
+	}
+}
+
+func TestHandlerDeadline(t *testing.T) {
+	m, err := agxtest.NewMockMaster()
+	if err != nil {
+		t.Fatalf("mock master failed %v", err)
+	}
+	defer m.Close()
+
+	c, err := agx.NewConnection(m.Pipe(), nil, nil,
+		agx.WithHandlerDeadline(900*time.Millisecond))
+	if err != nil {
+		t.Fatalf("connection failed %v", err)
+	}
+	defer c.Disconnect()
+
+	stuck := make(chan struct{})
+	defer close(stuck)
+	c.OnGet(egress+".1", func(oid agx.Subtree) agx.VarBind {
+		<-stuck
+		return agx.IntegerVarBind(oid, 1)
+	})
+	c.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+		return agx.IntegerVarBind(oid, 2)
+	})
+	//the deadline is the timeout of the registration less the margin
+	c.RegisterWith(agx.Registration{Subtree: egress, Priority: agx.BasePriority,
+		Timeout: 1})
+	c.Register(access)
+	if err := m.WaitRegistration(access); err != nil {
+		t.Fatalf("master did not see registration %v", err)
+	}
+
+	start := time.Now()
+	if _, err := m.Get(egress + ".1"); err == nil {
+		t.Errorf("get of stuck handler succeeded")
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || d > time.Second {
+		t.Errorf("stuck handler answered after %v", d)
+	}
+	vbs, err := m.Get(access + ".1")
+	if err != nil || vbs[0].Data != agx.Integer(2) {
+		t.Errorf("get next to stuck handler returned %v %v", vbs, err)
+	}
+
+	//direct callers see the error
+	if _, err := c.Bind(subtree(t, egress+".1"), false); err != agx.ErrHandlerDeadline {
+		t.Errorf("bind of stuck handler returned %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package agx
+
+// This file contains the stream of decoded PDUs received from the master
+// agent, for observing a session without taking part in it
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+// Subscribe returns a channel that every PDU received from the master agent
+// is delivered on, decoded as by ParsePDU, along with a function that ends
+// the subscription and closes the channel. Delivery never holds up dispatch,
+// PDUs that arrive while the channel is full are dropped, so size should
+// allow for bursts of traffic. Messages are shared between subscribers and
+// should not be modified.
+func (c *Connection) Subscribe(size int) (<-chan Message, func()) {
+	ch := make(chan Message, size)
+
+	c.mtx.Lock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[chan Message]struct{})
+	}
+	c.subscribers[ch] = struct{}{}
+	c.mtx.Unlock()
+
+	cancel := func() {
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		if _, ok := c.subscribers[ch]; ok {
+			delete(c.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// publish delivers the PDU in buf to the subscribers, if there are any. The
+// message is shared between subscribers and should not be modified.
+func (c *Connection) publish(buf []byte) {
+	c.mtx.Lock()
+	n := len(c.subscribers)
+	c.mtx.Unlock()
+	if n == 0 {
+		return
+	}
+
+	m, err := ParsePDU(buf)
+	if err != nil {
+		return
+	}
+
+	//sending under the lock keeps cancel from closing a channel mid send
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for ch := range c.subscribers {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package agx
+
+// This file contains human readable formatting of protocol data units for
+// use in logging and debugging
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * Names
+ *----------------------------------------------------------------------------*/
+
+var pduNames = map[PDUType]string{
+	OpenPDU:            "Open",
+	ClosePDU:           "Close",
+	RegisterPDU:        "Register",
+	UnregisterPDU:      "Unregister",
+	GetPDU:             "Get",
+	GetNextPDU:         "GetNext",
+	GetBulkPDU:         "GetBulk",
+	TestSetPDU:         "TestSet",
+	CommitSetPDU:       "CommitSet",
+	UndoSetPDU:         "UndoSet",
+	CleanupSetPDU:      "CleanupSet",
+	NotifyPDU:          "Notify",
+	PingPDU:            "Ping",
+	IndexAllocatePDU:   "IndexAllocate",
+	IndexDeallocatePDU: "IndexDeallocate",
+	AddAgentCapsPDU:    "AddAgentCaps",
+	RemoveAgentCapsPDU: "RemoveAgentCaps",
+	ResponsePDU:        "Response",
+}
+
+var flagNames = []struct {
+	flag Flags
+	name string
+}{
+	{InstanceRegistration, "InstanceRegistration"},
+	{NewIndex, "NewIndex"},
+	{AnyIndex, "AnyIndex"},
+	{NonDefaultContext, "NonDefaultContext"},
+	{NetworkByteOrder, "NetworkByteOrder"},
+}
+
+// the error field of a response carries both AgentX errors and the SNMP
+// errors resulting from set processing (RFC2741~6.2.16)
+var errorNames = map[int16]string{
+	ResponseNoError:               "noError",
+	ResponseTooBig:                "tooBig",
+	ResponseGenErr:                "genErr",
+	ResponseNoAccess:              "noAccess",
+	7:                             "wrongType",
+	8:                             "wrongLength",
+	9:                             "wrongEncoding",
+	10:                            "wrongValue",
+	11:                            "noCreation",
+	12:                            "inconsistentValue",
+	13:                            "resourceUnavailable",
+	14:                            "commitFailed",
+	15:                            "undoFailed",
+	ResponseNotWritable:           "notWritable",
+	18:                            "inconsistentName",
+	ResponseOpenFailed:            "openFailed",
+	ResponseNotOpen:               "notOpen",
+	ResponseIndexWrongType:        "indexWrongType",
+	ResponseIndexAlreadyAllocated: "indexAlreadyAllocated",
+	ResponseIndexNoneAvailable:    "indexNoneAvailable",
+	ResponseIndexNotAllocated:     "indexNotAllocated",
+	ResponseUnsupportedContext:    "unsupportedContext",
+	ResponseDuplicateRegistration: "duplicateRegistration",
+	ResponseUnknownRegistration:   "unknownRegistration",
+	ResponseUnknownAgentCaps:      "unknownAgentCaps",
+	ResponseParseError:            "parseError",
+	ResponseRequestDenied:         "requestDenied",
+	ResponseProcessingError:       "processingError",
+}
+
+var closeReasonNames = map[CloseReason]string{
+	CloseReasonOther:         "other",
+	CloseReasonParseError:    "parseError",
+	CloseReasonProtocolError: "protocolError",
+	CloseReasonTimeouts:      "timeouts",
+	CloseReasonShutdown:      "shutdown",
+	CloseReasonByManager:     "byManager",
+}
+
+var varBindTypeNames = map[int16]string{
+	IntegerT:          "INTEGER",
+	OctetStringT:      "STRING",
+	NullT:             "NULL",
+	ObjectIdentifierT: "OID",
+	IpAddressT:        "IpAddress",
+	Counter32T:        "Counter32",
+	Gauge32T:          "Gauge32",
+	TimeTicksT:        "Timeticks",
+	OpaqueT:           "Opaque",
+	Counter64T:        "Counter64",
+	NoSuchObjectT:     "noSuchObject",
+	NoSuchInstanceT:   "noSuchInstance",
+	EndOfMibViewT:     "endOfMibView",
+}
+
+func (t PDUType) String() string {
+	if s, ok := pduNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("PDU(%d)", byte(t))
+}
+
+func (f Flags) String() string {
+	var names []string
+	for _, x := range flagNames {
+		if f&x.flag != 0 {
+			names = append(names, x.name)
+			f &^= x.flag
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("%#x", byte(f)))
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+func errorName(code int16) string {
+	if s, ok := errorNames[code]; ok {
+		return s
+	}
+	return fmt.Sprintf("error(%d)", code)
+}
+
+func varBindTypeName(t int16) string {
+	if s, ok := varBindTypeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("type(%d)", t)
+}
+
+func (r CloseReason) String() string {
+	if s, ok := closeReasonNames[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("reason(%d)", byte(r))
+}
+
+func (r TestSetResult) String() string   { return errorName(int16(r)) }
+func (r CommitSetResult) String() string { return errorName(int16(r)) }
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * PDUs
+ *----------------------------------------------------------------------------*/
+
+// String formats the header as e.g. "GetNext sid=12 tid=9 pid=1", flags other
+// than NetworkByteOrder are listed when present
+func (h Header) String() string {
+	s := fmt.Sprintf("%s sid=%d tid=%d pid=%d",
+		h.Type, h.SessionId, h.TransactionId, h.PacketId)
+	if f := h.Flags &^ NetworkByteOrder; f != 0 {
+		s += " flags=" + f.String()
+	}
+	return s
+}
+
+func (v VarBind) String() string {
+	name := varBindTypeName(v.Type)
+	switch v.Type {
+	case NullT, NoSuchObjectT, NoSuchInstanceT, EndOfMibViewT:
+		return fmt.Sprintf("%s = %s", v.Name, name)
+	}
+	return fmt.Sprintf("%s = %s: %s", v.Name, name, formatData(v.Data))
+}
+
+func formatData(d Value) string {
+	if d == nil {
+		return "<nil>"
+	}
+	return d.String()
+}
+
+// String formats the octets as a quoted string when they are printable and as
+// hex otherwise, padding is not shown
+func (s OctetString) String() string {
+	n := int(s.OctetStringLength)
+	if n < 0 || n > len(s.Octets) {
+		n = len(s.Octets)
+	}
+	b := s.Octets[:n]
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Sprintf("% x", b)
+		}
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+func (r SearchRange) String() string {
+	if r.End.NSubid == 0 && r.End.Prefix == 0 {
+		return r.Start.String()
+	}
+	return r.Start.String() + "-" + r.End.String()
+}
+
+func (m OpenMessage) String() string {
+	return fmt.Sprintf("%v timeout=%d id=%v descr=%v",
+		m.Header, m.Timeout, m.Id, m.Desc)
+}
+
+func (m CloseMessage) String() string {
+	return fmt.Sprintf("%v reason=%s", m.Header, m.Reason)
+}
+
+func (m RegisterMessage) String() string {
+	s := fmt.Sprintf("%v%s subtree=%v priority=%d timeout=%d",
+		m.Header, contextString(m.Context), m.Subtree, m.Priority, m.Timeout)
+	if m.RangeSubid != 0 && m.UpperBound != nil {
+		s += fmt.Sprintf(" range=%d:%d", m.RangeSubid, *m.UpperBound)
+	}
+	return s
+}
+
+func (m PingMessage) String() string {
+	return fmt.Sprintf("%v%s", m.Header, contextString(m.Context))
+}
+
+func (m GetMessage) String() string {
+	return fmt.Sprintf("%v%s ranges=%v",
+		m.Header, contextString(m.Context), m.SearchRanges)
+}
+
+func (m GetBulkMessage) String() string {
+	return fmt.Sprintf("%v%s non-repeaters=%d max-repetitions=%d ranges=%v",
+		m.Header, contextString(m.Context), m.NonRepeaters, m.MaxRepetitions,
+		m.SearchRanges)
+}
+
+func (m SetMessage) String() string {
+	return fmt.Sprintf("%v%s varbinds=%v",
+		m.Header, contextString(m.Context), m.VarBindList)
+}
+
+func (m SetPhaseMessage) String() string {
+	return m.Header.String()
+}
+
+func (m NotifyMessage) String() string {
+	return fmt.Sprintf("%v%s varbinds=%v",
+		m.Header, contextString(m.Context), m.VarBindList)
+}
+
+func (m IndexAllocateMessage) String() string {
+	return fmt.Sprintf("%v%s varbinds=%v",
+		m.Header, contextString(m.Context), m.VarBindList)
+}
+
+func (m AddAgentCapsMessage) String() string {
+	return fmt.Sprintf("%v%s id=%v descr=%v",
+		m.Header, contextString(m.Context), m.Id, m.Descr)
+}
+
+func (m RemoveAgentCapsMessage) String() string {
+	return fmt.Sprintf("%v%s id=%v", m.Header, contextString(m.Context), m.Id)
+}
+
+func (m Response) String() string {
+	s := fmt.Sprintf("%v uptime=%d error=%s",
+		m.Header, m.SysUptime, errorName(m.Error))
+	if m.Error != ResponseNoError {
+		s += fmt.Sprintf(" index=%d", m.Index)
+	}
+	if len(m.VarBindList) > 0 {
+		s += fmt.Sprintf(" varbinds=%v", m.VarBindList)
+	}
+	return s
+}
+
+func contextString(c *OctetString) string {
+	if c == nil {
+		return ""
+	}
+	return " context=" + c.String()
+}
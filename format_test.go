@@ -0,0 +1,158 @@
+package agx_test
+
+import (
+	"encoding/json"
+	"github.com/rcgoodfellow/agx"
+	"reflect"
+	"testing"
+)
+
+func TestString(t *testing.T) {
+	name := subtree(t, "1.3.6.1.2.1.1.5.0")
+	end := subtree(t, "1.3.6.1.2.1.2")
+
+	tests := []struct {
+		m      interface{}
+		expect string
+	}{
+		{
+			agx.GetNextMessage{GetMessage: agx.GetMessage{
+				Header: agx.Header{Type: agx.GetNextPDU, Flags: agx.NetworkByteOrder,
+					SessionId: 12, TransactionId: 9, PacketId: 1},
+				SearchRanges: []agx.SearchRange{{Start: name, End: end}},
+			}},
+			"GetNext sid=12 tid=9 pid=1 ranges=[1.3.6.1.2.1.1.5.0-1.3.6.1.2.1.2]",
+		},
+		{
+			agx.Response{
+				Header: agx.Header{Type: agx.ResponsePDU, SessionId: 12},
+				ResponsePayload: agx.ResponsePayload{
+					Error: agx.ResponseNotOpen, Index: 1},
+			},
+			"Response sid=12 tid=0 pid=0 uptime=0 error=notOpen index=1",
+		},
+		{
+			*agx.NewCloseMessage(agx.CloseReasonShutdown, 47),
+			"Close sid=47 tid=86 pid=1 reason=shutdown",
+		},
+		{
+			agx.Header{Type: 99, Flags: agx.NonDefaultContext | 0x80},
+			"PDU(99) sid=0 tid=0 pid=0 flags=NonDefaultContext|0x80",
+		},
+		{
+			*agx.OctetStringVarBind(name, []byte("muffin")),
+			`1.3.6.1.2.1.1.5.0 = STRING: "muffin"`,
+		},
+		{
+			*agx.OctetStringVarBind(name, []byte{0xcc, 0x33}),
+			`1.3.6.1.2.1.1.5.0 = STRING: cc 33`,
+		},
+		{
+			agx.IntegerVarBind(name, 47),
+			`1.3.6.1.2.1.1.5.0 = INTEGER: 47`,
+		},
+		{agx.TestSetNotWritable, "notWritable"},
+		{agx.CommitSetCommitFailed, "commitFailed"},
+		{agx.GetBulkPDU, "GetBulk"},
+		{agx.CloseReasonByManager, "byManager"},
+		{agx.CloseReason(9), "reason(9)"},
+		{agx.InstanceRegistration | agx.AnyIndex, "InstanceRegistration|AnyIndex"},
+		{agx.Flags(0), "0"},
+	}
+
+	for _, x := range tests {
+		s := x.m.(interface{ String() string }).String()
+		if s != x.expect {
+			t.Errorf("got %q, expected %q", s, x.expect)
+		}
+	}
+}
+
+func TestIsValid(t *testing.T) {
+	tests := []struct {
+		v      interface{ IsValid() bool }
+		expect bool
+	}{
+		{agx.OpenPDU, true},
+		{agx.ResponsePDU, true},
+		{agx.PDUType(0), false},
+		{agx.PDUType(19), false},
+		{agx.CloseReasonOther, true},
+		{agx.CloseReasonByManager, true},
+		{agx.CloseReason(7), false},
+		{agx.NetworkByteOrder | agx.NonDefaultContext, true},
+		{agx.Flags(0x20), false},
+		{agx.TestSetInconsistentName, true},
+		{agx.TestSetResult(14), false},
+		{agx.CommitSetCommitFailed, true},
+		{agx.CommitSetResult(5), false},
+	}
+
+	for _, x := range tests {
+		if x.v.IsValid() != x.expect {
+			t.Errorf("%v: IsValid is %v, expected %v", x.v, !x.expect, x.expect)
+		}
+	}
+}
+
+func TestVarBindJSON(t *testing.T) {
+	name := subtree(t, "1.3.6.1.2.1.1.5.0")
+
+	tests := []struct {
+		vb     agx.VarBind
+		expect string
+	}{
+		{agx.IntegerVarBind(name, -47),
+			`{"oid":"1.3.6.1.2.1.1.5.0","type":"INTEGER","value":-47}`},
+		{*agx.OctetStringVarBind(name, []byte("muffin")),
+			`{"oid":"1.3.6.1.2.1.1.5.0","type":"STRING","value":"muffin"}`},
+		{*agx.OctetStringVarBind(name, []byte{0xcc, 0x33}),
+			`{"oid":"1.3.6.1.2.1.1.5.0","type":"STRING","hex":"cc33"}`},
+		{agx.VarBind{Type: agx.ObjectIdentifierT, Name: name,
+			Data: agx.Oid{Subtree: subtree(t, "1.3.6.1.4.1.47")}},
+			`{"oid":"1.3.6.1.2.1.1.5.0","type":"OID","value":"1.3.6.1.4.1.47"}`},
+		{agx.VarBind{Type: agx.IpAddressT, Name: name, Data: agx.IpAddress{10, 0, 0, 47}},
+			`{"oid":"1.3.6.1.2.1.1.5.0","type":"IpAddress","value":"10.0.0.47"}`},
+		{agx.VarBind{Type: agx.Counter64T, Name: name, Data: agx.Counter64(1) << 63},
+			`{"oid":"1.3.6.1.2.1.1.5.0","type":"Counter64","value":9223372036854775808}`},
+		{agx.VarBind{Type: agx.TimeTicksT, Name: name, Data: agx.TimeTicks(47)},
+			`{"oid":"1.3.6.1.2.1.1.5.0","type":"Timeticks","value":47}`},
+		{agx.NoSuchObjectVarBind(name),
+			`{"oid":"1.3.6.1.2.1.1.5.0","type":"noSuchObject"}`},
+	}
+
+	for _, x := range tests {
+		buf, err := json.Marshal(x.vb)
+		if err != nil {
+			t.Errorf("error marshalling %v: %v", x.vb, err)
+			continue
+		}
+		if string(buf) != x.expect {
+			t.Errorf("%v marshalled as %s, expected %s", x.vb, buf, x.expect)
+		}
+		var vb agx.VarBind
+		if err := json.Unmarshal(buf, &vb); err != nil {
+			t.Errorf("error unmarshalling %s: %v", buf, err)
+			continue
+		}
+		if !reflect.DeepEqual(vb, x.vb) {
+			t.Errorf("%s unmarshalled as %#v, expected %#v", buf, vb, x.vb)
+		}
+	}
+
+	bad := []string{
+		`{"oid":"1.3.6.1","type":"muffin"}`,
+		`{"oid":"1..3","type":"NULL"}`,
+		`{"oid":"1.3.6.1","type":"INTEGER","value":"47"}`,
+		`{"oid":"1.3.6.1","type":"IpAddress","value":"::1"}`,
+	}
+	for _, s := range bad {
+		var vb agx.VarBind
+		if err := json.Unmarshal([]byte(s), &vb); err == nil {
+			t.Errorf("no error unmarshalling %s", s)
+		}
+	}
+	if _, err := json.Marshal(agx.VarBind{Type: agx.IntegerT, Name: name}); err == nil {
+		t.Errorf("no error marshalling an integer without data")
+	}
+}
@@ -0,0 +1,289 @@
+// Package gosnmpconv converts between agx varbinds and gosnmp PDUs, so that
+// value handling code written for a gosnmp client can be reused by handlers
+// of a subagent.
+package gosnmpconv
+
+// This file contains the conversions between agx and gosnmp types
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"github.com/gosnmp/gosnmp"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/snmp"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// OidString returns s in the dotted form gosnmp uses for names, with a
+// leading dot
+func OidString(s agx.Subtree) string {
+	var b strings.Builder
+	for _, x := range s.Identifiers() {
+		b.WriteByte('.')
+		b.WriteString(strconv.FormatUint(uint64(x), 10))
+	}
+	return b.String()
+}
+
+// ParseOid parses a gosnmp name, the leading dot is optional
+func ParseOid(name string) (agx.Subtree, error) {
+	name = strings.TrimPrefix(name, ".")
+	if name == "" {
+		return agx.Subtree{}, nil
+	}
+	parts := strings.Split(name, ".")
+	ids := make([]uint32, len(parts))
+	for i, p := range parts {
+		x, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return agx.Subtree{}, fmt.Errorf("bad oid %q: %v", name, err)
+		}
+		ids[i] = uint32(x)
+	}
+	s, err := agx.NewSubtreeFromIdentifiers(ids)
+	if err != nil {
+		return agx.Subtree{}, err
+	}
+	return *s, nil
+}
+
+// ToSnmpPDU converts vb to a gosnmp PDU, values take the types gosnmp
+// produces when decoding a response
+func ToSnmpPDU(vb agx.VarBind) (gosnmp.SnmpPDU, error) {
+	pdu := gosnmp.SnmpPDU{Name: OidString(vb.Name)}
+	bad := func() (gosnmp.SnmpPDU, error) {
+		return pdu, fmt.Errorf("varbind %v of type %d has %T data",
+			vb.Name, vb.Type, vb.Data)
+	}
+
+	if vb.Data != nil && vb.Data.Type() != vb.Type {
+		return bad()
+	}
+	switch vb.Type {
+	case agx.IntegerT:
+		x, ok := vb.Int32()
+		if !ok {
+			return bad()
+		}
+		pdu.Type, pdu.Value = gosnmp.Integer, int(x)
+	case agx.OctetStringT, agx.OpaqueT:
+		b, ok := vb.OctetString()
+		if !ok {
+			return bad()
+		}
+		pdu.Type, pdu.Value = gosnmp.OctetString, append([]byte{}, b...)
+		if vb.Type == agx.OpaqueT {
+			pdu.Type = gosnmp.Opaque
+		}
+	case agx.NullT:
+		pdu.Type = gosnmp.Null
+	case agx.ObjectIdentifierT:
+		x, ok := vb.OID()
+		if !ok {
+			return bad()
+		}
+		pdu.Type, pdu.Value = gosnmp.ObjectIdentifier, OidString(x)
+	case agx.IpAddressT:
+		x, ok := vb.IP()
+		if !ok || x.To4() == nil {
+			return bad()
+		}
+		pdu.Type, pdu.Value = gosnmp.IPAddress, x.To4().String()
+	case agx.Counter32T, agx.Gauge32T:
+		x, ok := vb.Uint32()
+		if !ok {
+			return bad()
+		}
+		pdu.Type, pdu.Value = gosnmp.Counter32, uint(x)
+		if vb.Type == agx.Gauge32T {
+			pdu.Type = gosnmp.Gauge32
+		}
+	case agx.TimeTicksT:
+		x, ok := vb.Uint32()
+		if !ok {
+			return bad()
+		}
+		pdu.Type, pdu.Value = gosnmp.TimeTicks, x
+	case agx.Counter64T:
+		x, ok := vb.Uint64()
+		if !ok {
+			return bad()
+		}
+		pdu.Type, pdu.Value = gosnmp.Counter64, x
+	case agx.NoSuchObjectT:
+		pdu.Type = gosnmp.NoSuchObject
+	case agx.NoSuchInstanceT:
+		pdu.Type = gosnmp.NoSuchInstance
+	case agx.EndOfMibViewT:
+		pdu.Type = gosnmp.EndOfMibView
+	default:
+		return pdu, fmt.Errorf("unknown varbind type %d", vb.Type)
+	}
+	return pdu, nil
+}
+
+// FromSnmpPDU converts a gosnmp PDU to a varbind. Values are accepted in any
+// of the go types gosnmp accepts when encoding a request, so a PDU built for
+// a gosnmp set can be returned from a handler.
+func FromSnmpPDU(pdu gosnmp.SnmpPDU) (agx.VarBind, error) {
+	name, err := ParseOid(pdu.Name)
+	if err != nil {
+		return agx.VarBind{}, err
+	}
+	vb := agx.VarBind{Name: name}
+	bad := func() (agx.VarBind, error) {
+		return vb, fmt.Errorf("pdu %s of type %#x has %T value",
+			pdu.Name, byte(pdu.Type), pdu.Value)
+	}
+
+	switch pdu.Type {
+	case gosnmp.Integer:
+		x, ok := toInt64(pdu.Value)
+		if !ok || x < math.MinInt32 || x > math.MaxInt32 {
+			return bad()
+		}
+		vb.Type, vb.Data = agx.IntegerT, agx.Integer(x)
+	case gosnmp.OctetString, gosnmp.Opaque:
+		var b []byte
+		switch x := pdu.Value.(type) {
+		case []byte:
+			b = x
+		case string:
+			b = []byte(x)
+		default:
+			return bad()
+		}
+		vb.Type, vb.Data = agx.OctetStringT, *agx.NewOctetString(b)
+		if pdu.Type == gosnmp.Opaque {
+			vb.Type, vb.Data = agx.OpaqueT, agx.NewOpaque(b)
+		}
+	case gosnmp.Null:
+		vb.Type = agx.NullT
+	case gosnmp.ObjectIdentifier:
+		x, ok := pdu.Value.(string)
+		if !ok {
+			return bad()
+		}
+		oid, err := ParseOid(x)
+		if err != nil {
+			return vb, err
+		}
+		vb.Type, vb.Data = agx.ObjectIdentifierT, agx.Oid{Subtree: oid}
+	case gosnmp.IPAddress:
+		var ip net.IP
+		switch x := pdu.Value.(type) {
+		case string:
+			ip = net.ParseIP(x)
+		case net.IP:
+			ip = x
+		}
+		if ip.To4() == nil {
+			return bad()
+		}
+		vb.Type, vb.Data = agx.IpAddressT, agx.IpAddress(ip.To4())
+	case gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Uinteger32:
+		x, ok := toUint64(pdu.Value)
+		if !ok || x > math.MaxUint32 {
+			return bad()
+		}
+		switch pdu.Type {
+		case gosnmp.Counter32:
+			vb.Type, vb.Data = agx.Counter32T, agx.Counter32(x)
+		case gosnmp.TimeTicks:
+			vb.Type, vb.Data = agx.TimeTicksT, agx.TimeTicks(x)
+		default:
+			//Unsigned32 is indistinguishable from Gauge32 (RFC2578~7.1.11)
+			vb.Type, vb.Data = agx.Gauge32T, agx.Gauge32(x)
+		}
+	case gosnmp.Counter64:
+		x, ok := toUint64(pdu.Value)
+		if !ok {
+			return bad()
+		}
+		vb.Type, vb.Data = agx.Counter64T, agx.Counter64(x)
+	case gosnmp.NoSuchObject:
+		vb.Type = agx.NoSuchObjectT
+	case gosnmp.NoSuchInstance:
+		vb.Type = agx.NoSuchInstanceT
+	case gosnmp.EndOfMibView:
+		vb.Type = agx.EndOfMibViewT
+	default:
+		return vb, fmt.Errorf("pdu %s has unsupported type %#x",
+			pdu.Name, byte(pdu.Type))
+	}
+	return vb, nil
+}
+
+// MarshalValue returns the BER encoding of the value of pdu
+func MarshalValue(pdu gosnmp.SnmpPDU) ([]byte, error) {
+	vb, err := FromSnmpPDU(pdu)
+	if err != nil {
+		return nil, err
+	}
+	return snmp.EncodeValue(vb)
+}
+
+// UnmarshalValue decodes the BER encoded value in buf as the value of a PDU
+// named name
+func UnmarshalValue(name string, buf []byte) (gosnmp.SnmpPDU, error) {
+	oid, err := ParseOid(name)
+	if err != nil {
+		return gosnmp.SnmpPDU{}, err
+	}
+	vb, err := snmp.DecodeValue(oid, buf)
+	if err != nil {
+		return gosnmp.SnmpPDU{}, err
+	}
+	return ToSnmpPDU(vb)
+}
+
+// helpers ====================================================================
+
+func toInt64(v interface{}) (int64, bool) {
+	switch x := v.(type) {
+	case int:
+		return int64(x), true
+	case int8:
+		return int64(x), true
+	case int16:
+		return int64(x), true
+	case int32:
+		return int64(x), true
+	case int64:
+		return x, true
+	case uint, uint8, uint16, uint32, uint64:
+		u, _ := toUint64(x)
+		if u > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(u), true
+	}
+	return 0, false
+}
+
+func toUint64(v interface{}) (uint64, bool) {
+	switch x := v.(type) {
+	case uint:
+		return uint64(x), true
+	case uint8:
+		return uint64(x), true
+	case uint16:
+		return uint64(x), true
+	case uint32:
+		return uint64(x), true
+	case uint64:
+		return x, true
+	case int, int8, int16, int32, int64:
+		i, _ := toInt64(x)
+		if i < 0 {
+			return 0, false
+		}
+		return uint64(i), true
+	}
+	return 0, false
+}
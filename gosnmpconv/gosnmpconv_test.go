@@ -0,0 +1,104 @@
+package gosnmpconv_test
+
+import (
+	"github.com/gosnmp/gosnmp"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/gosnmpconv"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	name, err := gosnmpconv.ParseOid(".1.3.6.1.2.1.2.2.1.10.4294967295")
+	if err != nil {
+		t.Fatalf("error parsing oid %v", err)
+	}
+	if s := gosnmpconv.OidString(name); s != ".1.3.6.1.2.1.2.2.1.10.4294967295" {
+		t.Errorf("oid formatted as %s", s)
+	}
+	oid, _ := gosnmpconv.ParseOid("1.3.6.1.4.1")
+
+	vbs := []agx.VarBind{
+		agx.IntegerVarBind(name, -129),
+		*agx.OctetStringVarBind(name, []byte("muffin")),
+		{Type: agx.ObjectIdentifierT, Name: name, Data: agx.Oid{Subtree: oid}},
+		{Type: agx.IpAddressT, Name: name, Data: agx.IpAddress{10, 0, 0, 47}},
+		{Type: agx.Counter32T, Name: name, Data: agx.Counter32(0xffffffff)},
+		agx.Gauge32VarBind(name, 47),
+		{Type: agx.TimeTicksT, Name: name, Data: agx.TimeTicks(47)},
+		{Type: agx.Counter64T, Name: name, Data: agx.Counter64(1) << 63},
+		agx.EndOfMibViewVarBind(name),
+	}
+	for _, vb := range vbs {
+		pdu, err := gosnmpconv.ToSnmpPDU(vb)
+		if err != nil {
+			t.Fatalf("error converting %v: %v", vb, err)
+		}
+		back, err := gosnmpconv.FromSnmpPDU(pdu)
+		if err != nil {
+			t.Fatalf("error converting %v back: %v", pdu, err)
+		}
+		if !reflect.DeepEqual(vb, back) {
+			t.Errorf("%v came back as %v", vb, back)
+		}
+
+		buf, err := gosnmpconv.MarshalValue(pdu)
+		if err != nil {
+			t.Fatalf("error encoding %v: %v", pdu, err)
+		}
+		decoded, err := gosnmpconv.UnmarshalValue(pdu.Name, buf)
+		if err != nil {
+			t.Fatalf("error decoding %v: %v", pdu, err)
+		}
+		if !reflect.DeepEqual(pdu, decoded) {
+			t.Errorf("%v decoded as %v", pdu, decoded)
+		}
+	}
+}
+
+func TestFromSnmpPDU(t *testing.T) {
+	name := subtree(t, "1.3.6.1.2.1.1.5.0")
+
+	//values are accepted as gosnmp accepts them for requests
+	pdus := []gosnmp.SnmpPDU{
+		{Name: "1.3.6.1.2.1.1.5.0", Type: gosnmp.OctetString, Value: "muffin"},
+		{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.Integer, Value: int64(47)},
+		{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.Uinteger32, Value: 47},
+	}
+	expect := []agx.VarBind{
+		*agx.OctetStringVarBind(name, []byte("muffin")),
+		agx.IntegerVarBind(name, 47),
+		agx.Gauge32VarBind(name, 47),
+	}
+	for i, pdu := range pdus {
+		vb, err := gosnmpconv.FromSnmpPDU(pdu)
+		if err != nil {
+			t.Fatalf("error converting %v: %v", pdu, err)
+		}
+		if !reflect.DeepEqual(vb, expect[i]) {
+			t.Errorf("%v converted to %v, expected %v", pdu, vb, expect[i])
+		}
+	}
+
+	bad := []gosnmp.SnmpPDU{
+		{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.Integer, Value: int64(1) << 40},
+		{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.Counter32, Value: -1},
+		{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.IPAddress, Value: "::1"},
+		{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.BitString},
+		{Name: ".1.3.6.1.2.1.1.5.x", Type: gosnmp.Null},
+	}
+	for _, pdu := range bad {
+		if vb, err := gosnmpconv.FromSnmpPDU(pdu); err == nil {
+			t.Errorf("%v converted to %v", pdu, vb)
+		}
+	}
+}
+
+func subtree(t *testing.T, oid string) agx.Subtree {
+	t.Helper()
+	s, err := agx.NewSubtree(oid)
+	if err != nil {
+		t.Fatalf("bad oid %s: %v", oid, err)
+	}
+	return *s
+}
@@ -0,0 +1,1589 @@
+package agx_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//harness ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+// harness wires a Connection to a scripted master over net.Pipe. Tests play
+// the part of the master by injecting PDUs and asserting on what comes back.
+type harness struct {
+	t       *testing.T
+	c       *agx.Connection
+	conn    net.Conn
+	in      chan agx.Message
+	session uint32
+	packet  uint32
+}
+
+const harnessTimeout = 5 * time.Second
+
+// newHarness opens a session with the scripted master, the handlers the test
+// needs are expected to be installed by setup before any request is injected
+func newHarness(t *testing.T, setup func(c *agx.Connection),
+	opts ...agx.Option) *harness {
+
+	client, server := net.Pipe()
+	h := &harness{
+		t:       t,
+		conn:    server,
+		in:      make(chan agx.Message, 64),
+		session: 47,
+	}
+
+	//everything the subagent sends is read as it is sent, so the subagent
+	//never blocks writing to the pipe
+	go func() {
+		defer close(h.in)
+		for {
+			m, err := agx.ReadMessage(server)
+			if err != nil {
+				return
+			}
+			h.in <- m
+		}
+	}()
+
+	type result struct {
+		c   *agx.Connection
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		id, descr := "1.2.3.4.7", "muffin man"
+		c, err := agx.NewConnection(client, &id, &descr, opts...)
+		done <- result{c, err}
+	}()
+
+	open := h.expect(agx.OpenPDU).(*agx.OpenMessage)
+	h.respond(open.Header, agx.ResponseNoError)
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("error opening session %v", r.err)
+	}
+	h.c = r.c
+	if setup != nil {
+		setup(h.c)
+	}
+
+	t.Cleanup(func() { server.Close() })
+	return h
+}
+
+// header returns a header for a request from the master
+func (h *harness) header(t agx.PDUType, tid uint32) agx.Header {
+	h.packet++
+	return agx.Header{
+		Version:       1,
+		Type:          t,
+		Flags:         agx.NetworkByteOrder,
+		SessionId:     h.session,
+		TransactionId: tid,
+		PacketId:      h.packet,
+	}
+}
+
+// inject writes a PDU to the subagent
+func (h *harness) inject(m agx.Message) {
+	h.t.Helper()
+	h.conn.SetWriteDeadline(time.Now().Add(harnessTimeout))
+	if _, err := agx.WriteMessage(h.conn, m); err != nil {
+		h.t.Fatalf("error injecting %v: %v", m, err)
+	}
+}
+
+// expect returns the next PDU from the subagent, failing unless it is of
+// type t
+func (h *harness) expect(t agx.PDUType) agx.Message {
+	h.t.Helper()
+	select {
+	case m, ok := <-h.in:
+		if !ok {
+			h.t.Fatalf("connection closed waiting for %v pdu", t)
+		}
+		buf, err := m.MarshalBinary()
+		if err != nil || agx.PDUType(buf[1]) != t {
+			h.t.Fatalf("expected %v pdu, got %v", t, m)
+		}
+		return m
+	case <-time.After(harnessTimeout):
+		h.t.Fatalf("timed out waiting for %v pdu", t)
+	}
+	return nil
+}
+
+// expectNothing fails if the subagent answers any of the PDUs injected so
+// far, an empty get acts as a barrier as it is answered after all of them
+func (h *harness) expectNothing() {
+	h.t.Helper()
+	m := &agx.GetMessage{Header: h.header(agx.GetPDU, 0)}
+	r := h.request(m)
+	if r.Header.PacketId != m.Header.PacketId {
+		h.t.Fatalf("unexpected response %v", r)
+	}
+}
+
+// request injects m and returns the response to it
+func (h *harness) request(m agx.Message) *agx.Response {
+	h.t.Helper()
+	h.inject(m)
+	return h.expect(agx.ResponsePDU).(*agx.Response)
+}
+
+// respond answers a PDU from the subagent
+func (h *harness) respond(req agx.Header, code int16) {
+	h.t.Helper()
+	h.inject(&agx.Response{
+		Header: agx.Header{
+			Version:       1,
+			Type:          agx.ResponsePDU,
+			Flags:         agx.NetworkByteOrder,
+			SessionId:     h.session,
+			TransactionId: req.TransactionId,
+			PacketId:      req.PacketId,
+		},
+		ResponsePayload: agx.ResponsePayload{Error: code},
+	})
+}
+
+func (h *harness) getNext(oids ...string) *agx.Response {
+	h.t.Helper()
+	m := &agx.GetNextMessage{GetMessage: agx.GetMessage{
+		Header: h.header(agx.GetNextPDU, h.packet+1)}}
+	for _, oid := range oids {
+		m.SearchRanges = append(m.SearchRanges,
+			agx.SearchRange{Start: subtree(h.t, oid)})
+	}
+	return h.request(m)
+}
+
+//tests ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+func TestHarnessGetNextOrdering(t *testing.T) {
+	oids := []string{qbridge + ".1.2.0", qbridge + ".1.4.0", qbridge + ".1.10.0"}
+	h := newHarness(t, func(c *agx.Connection) {
+		//registered out of order, dispatch must order numerically
+		for _, i := range []int{2, 0, 1} {
+			v := int32(i)
+			c.OnGet(oids[i], func(oid agx.Subtree) agx.VarBind {
+				return agx.IntegerVarBind(oid, v)
+			})
+		}
+	})
+
+	r := h.getNext(qbridge, oids[0], oids[1], oids[2])
+	if r.Error != agx.ResponseNoError {
+		t.Fatalf("getnext returned %v", r)
+	}
+	expect := []agx.VarBind{
+		agx.IntegerVarBind(subtree(t, oids[0]), 0),
+		agx.IntegerVarBind(subtree(t, oids[1]), 1),
+		agx.IntegerVarBind(subtree(t, oids[2]), 2),
+		agx.EndOfMibViewVarBind(subtree(t, oids[2])),
+	}
+	if len(r.VarBindList) != len(expect) {
+		t.Fatalf("expected %d varbinds, got %v", len(expect), r)
+	}
+	for i := range expect {
+		if r.VarBindList[i].String() != expect[i].String() {
+			t.Errorf("varbind %d is %v, expected %v", i, r.VarBindList[i], expect[i])
+		}
+	}
+}
+
+func TestHarnessSetTransaction(t *testing.T) {
+	var log []string
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+			log = append(log, "test")
+			if vb.Data != agx.Integer(1) {
+				return agx.TestSetWrongValue
+			}
+			return agx.TestSetNoError
+		})
+		c.OnCommitSet(func(sessionId uint32) agx.CommitSetResult {
+			log = append(log, "commit")
+			return agx.CommitSetNoError
+		})
+		c.OnCleanupSet(func(sessionId uint32) {
+			log = append(log, "cleanup")
+		})
+	})
+	name := subtree(t, access+".47")
+
+	//a good value goes through test, commit and cleanup
+	r := h.request(&agx.SetMessage{
+		Header:      h.header(agx.TestSetPDU, 100),
+		VarBindList: []agx.VarBind{agx.IntegerVarBind(name, 1)},
+	})
+	if r.Error != agx.ResponseNoError {
+		t.Errorf("test set returned %v", r)
+	}
+	r = h.request(&agx.SetPhaseMessage{Header: h.header(agx.CommitSetPDU, 100)})
+	if r.Error != agx.ResponseNoError {
+		t.Errorf("commit set returned %v", r)
+	}
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CleanupSetPDU, 100)})
+	h.expectNothing()
+
+	//a bad value fails the test and is only cleaned up
+	r = h.request(&agx.SetMessage{
+		Header:      h.header(agx.TestSetPDU, 101),
+		VarBindList: []agx.VarBind{agx.IntegerVarBind(name, 2)},
+	})
+	if r.Error != int16(agx.TestSetWrongValue) {
+		t.Errorf("test set returned %v, expected wrongValue", r)
+	}
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CleanupSetPDU, 101)})
+	h.expectNothing()
+
+	expect := []string{"test", "commit", "cleanup", "test", "cleanup"}
+	if len(log) != len(expect) {
+		t.Fatalf("handlers ran %v, expected %v", log, expect)
+	}
+	for i := range expect {
+		if log[i] != expect[i] {
+			t.Fatalf("handlers ran %v, expected %v", log, expect)
+		}
+	}
+}
+
+func TestHarnessShutdown(t *testing.T) {
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+			return agx.TestSetNoError
+		})
+		c.OnCommitSet(func(sessionId uint32) agx.CommitSetResult {
+			return agx.CommitSetNoError
+		})
+		c.OnCleanupSet(func(sessionId uint32) {})
+	})
+	h.c.Register(access)
+	h.respond(h.expect(agx.RegisterPDU).(*agx.RegisterMessage).Header,
+		agx.ResponseNoError)
+	name := subtree(t, access+".47")
+
+	r := h.request(&agx.SetMessage{
+		Header:      h.header(agx.TestSetPDU, 100),
+		VarBindList: []agx.VarBind{agx.IntegerVarBind(name, 1)},
+	})
+	if r.Error != agx.ResponseNoError {
+		t.Fatalf("test set returned %v", r)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.c.Shutdown(context.Background())
+	}()
+
+	//new requests are refused once draining, the open transaction is not
+	for i := 0; ; i++ {
+		r = h.request(&agx.GetMessage{Header: h.header(agx.GetPDU, 0)})
+		if r.Error == agx.ResponseProcessingError {
+			break
+		}
+		if i > 1000 {
+			t.Fatalf("requests still served while shutting down")
+		}
+	}
+	r = h.request(&agx.SetMessage{
+		Header:      h.header(agx.TestSetPDU, 101),
+		VarBindList: []agx.VarBind{agx.IntegerVarBind(name, 1)},
+	})
+	if r.Error != agx.ResponseProcessingError {
+		t.Errorf("new transaction opened while shutting down %v", r)
+	}
+	select {
+	case <-done:
+		t.Fatalf("shut down with a transaction open")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r = h.request(&agx.SetPhaseMessage{Header: h.header(agx.CommitSetPDU, 100)})
+	if r.Error != agx.ResponseNoError {
+		t.Errorf("commit set returned %v", r)
+	}
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CleanupSetPDU, 100)})
+
+	//then the registrations are undone and the session closed
+	h.expect(agx.UnregisterPDU)
+	h.expect(agx.ClosePDU)
+	if err := <-done; err != nil {
+		t.Errorf("shutdown failed %v", err)
+	}
+}
+
+func TestHarnessRejects(t *testing.T) {
+	h := newHarness(t, nil)
+
+	//requests for another session are refused
+	m := &agx.GetMessage{Header: h.header(agx.GetPDU, 1)}
+	m.Header.SessionId++
+	r := h.request(m)
+	if r.Error != agx.ResponseNotOpen {
+		t.Errorf("wrong session returned %v, expected notOpen", r)
+	}
+
+	//pdus the subagent does not implement are answered with an error
+	r = h.request(&agx.SetPhaseMessage{Header: h.header(agx.UndoSetPDU, 2)})
+	if r.Error != agx.ResponseProcessingError {
+		t.Errorf("undo set returned %v, expected processingError", r)
+	}
+}
+
+func TestHarnessHeaderValidation(t *testing.T) {
+	h := newHarness(t, nil)
+
+	//a version other than 1 is answered with a parse error
+	m := &agx.GetMessage{Header: h.header(agx.GetPDU, 1)}
+	m.Header.Version = 2
+	r := h.request(m)
+	if r.Error != agx.ResponseParseError {
+		t.Errorf("version 2 returned %v, expected parseError", r)
+	}
+
+	//payloads up to the maximum are served, larger ones close the session
+	h.c.SetMaxPayloadLength(64)
+	ranges := []agx.SearchRange{{Start: subtree(t, access+".1")}}
+	r = h.request(&agx.GetMessage{
+		Header: h.header(agx.GetPDU, 2), SearchRanges: ranges})
+	if r.Error != agx.ResponseNoError {
+		t.Errorf("get within the maximum returned %v", r)
+	}
+	for i := 0; i < 4; i++ {
+		ranges = append(ranges, ranges[0])
+	}
+	//the session is closed on reading the header, before the rest is written
+	go agx.WriteMessage(h.conn, &agx.GetMessage{
+		Header: h.header(agx.GetPDU, 3), SearchRanges: ranges})
+	c := h.expect(agx.ClosePDU).(*agx.CloseMessage)
+	if c.Reason != agx.CloseReasonParseError {
+		t.Errorf("closed with %v, expected parseError", c.Reason)
+	}
+}
+
+func TestHarnessUnsupported(t *testing.T) {
+	h := newHarness(t, nil)
+
+	//pdus only subagents send are answered with an error, the session stays
+	r := h.request(&agx.IndexAllocateMessage{
+		Header: h.header(agx.IndexAllocatePDU, 1)})
+	if r.Error != agx.ResponseProcessingError {
+		t.Errorf("index allocate returned %v, expected processingError", r)
+	}
+	h.expectNothing()
+
+	//a pdu type agentx does not define is not answered, the session is
+	//closed as the master is not speaking agentx
+	hdr := h.header(agx.PDUType(99), 2)
+	buf, err := hdr.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error marshalling header %v", err)
+	}
+	if _, err := h.conn.Write(buf); err != nil {
+		t.Fatalf("error injecting header %v", err)
+	}
+	m := h.expect(agx.ClosePDU).(*agx.CloseMessage)
+	if m.Reason != agx.CloseReasonProtocolError {
+		t.Errorf("closed with %v, expected protocolError", m.Reason)
+	}
+	select {
+	case <-h.c.Done():
+	case <-time.After(harnessTimeout):
+		t.Fatalf("timed out waiting for session to close")
+	}
+}
+
+func TestHarnessTrace(t *testing.T) {
+	var traced lockedBuffer
+	h := newHarness(t, nil,
+		agx.WithTrace(&traced, agx.TracePretty|agx.TraceHex))
+	h.request(&agx.GetMessage{Header: h.header(agx.GetPDU, 1)})
+
+	//pdus are traced once written, which may be after the master has them
+	deadline := time.Now().Add(harnessTimeout)
+	for !strings.Contains(traced.String(), "send Response") &&
+		time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	//each pdu is a line with its direction and summary, then its hex dump
+	var pdus []string
+	for _, line := range strings.Split(traced.String(), "\n") {
+		f := strings.Fields(line)
+		if len(f) > 2 && !strings.HasPrefix(line, "0") {
+			pdus = append(pdus, f[1]+" "+f[2])
+		}
+	}
+	expect := []string{"send Open", "recv Response", "recv Get", "send Response"}
+	if !reflect.DeepEqual(pdus, expect) {
+		t.Errorf("traced %v, expected %v\n%s", pdus, expect, traced.String())
+	}
+	if !strings.Contains(traced.String(), "00000000  01 ") {
+		t.Errorf("no hex dump traced\n%s", traced.String())
+	}
+}
+
+// spanRecorder is a SpanTracer that records each span as the path of span
+// names leading to it
+type spanRecorder struct {
+	mtx   sync.Mutex
+	ended []string
+}
+
+type recordedSpan struct {
+	r     *spanRecorder
+	path  string
+	attrs map[string]interface{}
+}
+
+type spanPath struct{}
+
+func (r *spanRecorder) Start(ctx context.Context, name string) (
+	context.Context, agx.Span) {
+
+	path := name
+	if parent, ok := ctx.Value(spanPath{}).(string); ok {
+		path = parent + "/" + name
+	}
+	s := &recordedSpan{r: r, path: path, attrs: map[string]interface{}{}}
+	return context.WithValue(ctx, spanPath{}, path), s
+}
+
+func (s *recordedSpan) SetAttribute(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+func (s *recordedSpan) SetError(err error) {}
+
+func (s *recordedSpan) End() {
+	s.r.mtx.Lock()
+	defer s.r.mtx.Unlock()
+	e := s.path
+	if oid, ok := s.attrs["agentx.oid"]; ok {
+		e += fmt.Sprintf(" %v", oid)
+	}
+	if err, ok := s.attrs["agentx.error"]; ok {
+		e += fmt.Sprintf(" %v", err)
+	}
+	s.r.ended = append(s.r.ended, e)
+}
+
+func TestHarnessSpans(t *testing.T) {
+	r := &spanRecorder{}
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, 1)
+		})
+		c.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+			if vb.Data != agx.Integer(1) {
+				return agx.TestSetWrongValue
+			}
+			return agx.TestSetNoError
+		})
+	}, agx.WithSpanTracer(r))
+
+	h.getNext(access)
+	h.request(&agx.SetMessage{
+		Header: h.header(agx.TestSetPDU, 100),
+		VarBindList: []agx.VarBind{
+			agx.IntegerVarBind(subtree(t, access+".1"), 1),
+			agx.IntegerVarBind(subtree(t, access+".2"), 2),
+		},
+	})
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CleanupSetPDU, 100)})
+	h.expectNothing()
+
+	expect := []string{
+		"agentx GetNext/agentx varbind " + access,
+		"agentx GetNext",
+		"agentx set transaction/agentx TestSet/agentx varbind " + access + ".1",
+		"agentx set transaction/agentx TestSet/agentx varbind " + access + ".2 wrongValue",
+		"agentx set transaction/agentx TestSet wrongValue",
+		"agentx set transaction/agentx CleanupSet",
+		"agentx set transaction",
+		"agentx Get",
+	}
+	//the span of the barrier get ends just after its response is sent
+	deadline := time.Now().Add(harnessTimeout)
+	r.mtx.Lock()
+	for len(r.ended) < len(expect) && time.Now().Before(deadline) {
+		r.mtx.Unlock()
+		time.Sleep(time.Millisecond)
+		r.mtx.Lock()
+	}
+	defer r.mtx.Unlock()
+	if !reflect.DeepEqual(r.ended, expect) {
+		t.Errorf("spans\n%q\nexpected\n%q", r.ended, expect)
+	}
+}
+
+func TestHarnessAudit(t *testing.T) {
+	var records []agx.AuditRecord
+	audit := func(r agx.AuditRecord) { records = append(records, r) }
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, 7)
+		})
+		c.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+			return agx.TestSetNoError
+		})
+		c.OnCommitSet(func(sessionId uint32) agx.CommitSetResult {
+			return agx.CommitSetNoError
+		})
+	}, agx.WithAudit(audit))
+
+	set := []agx.VarBind{
+		agx.IntegerVarBind(subtree(t, access+".1"), 1),
+		agx.IntegerVarBind(subtree(t, access+".2"), 2),
+	}
+	h.request(&agx.SetMessage{Header: h.header(agx.TestSetPDU, 100),
+		VarBindList: set})
+	h.request(&agx.SetPhaseMessage{Header: h.header(agx.CommitSetPDU, 100)})
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CleanupSetPDU, 100)})
+	h.expectNothing()
+
+	if len(records) != 4 {
+		t.Fatalf("expected 4 audit records, got %v", records)
+	}
+	phases := []agx.PDUType{agx.TestSetPDU, agx.TestSetPDU, agx.CommitSetPDU,
+		agx.CommitSetPDU}
+	for i, r := range records {
+		if r.Phase != phases[i] || r.TransactionId != 100 ||
+			r.New.String() != set[i%2].String() || r.Result != 0 {
+			t.Errorf("record %d is %v", i, r)
+		}
+	}
+	if records[0].Old.Data != agx.Integer(7) ||
+		records[1].Old.Type != agx.NoSuchInstanceT {
+		t.Errorf("old values %v and %v", records[0].Old, records[1].Old)
+	}
+}
+
+func TestHarnessAccessControl(t *testing.T) {
+	var tested []agx.VarBind
+	deny := func(pdu agx.PDUType, context string, oid agx.Subtree) int16 {
+		if context == "secret" {
+			return agx.ResponseNoAccess
+		}
+		if pdu == agx.TestSetPDU && !oid.HasPrefix(subtree(t, access)) {
+			return agx.ResponseNotWritable
+		}
+		return agx.ResponseNoError
+	}
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, 1)
+		})
+		c.OnTestSet(qbridge, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+			tested = append(tested, vb)
+			return agx.TestSetNoError
+		})
+	}, agx.WithAccessControl(deny))
+
+	if r := h.getNext(access); r.Error != agx.ResponseNoError ||
+		r.VarBindList[0].Data != agx.Integer(1) {
+		t.Errorf("allowed getnext returned %v", r)
+	}
+
+	m := &agx.GetMessage{Header: h.header(agx.GetPDU, 1),
+		SearchRanges: []agx.SearchRange{{Start: subtree(t, access+".1")}}}
+	m.Header.Flags |= agx.NonDefaultContext
+	m.Context = agx.NewOctetString([]byte("secret"))
+	if r := h.request(m); r.Error != agx.ResponseNoAccess || r.Index != 1 {
+		t.Errorf("get in a denied context returned %v", r)
+	}
+
+	r := h.request(&agx.SetMessage{
+		Header: h.header(agx.TestSetPDU, 100),
+		VarBindList: []agx.VarBind{
+			agx.IntegerVarBind(subtree(t, access+".1"), 1),
+			agx.IntegerVarBind(subtree(t, egress+".1"), 1),
+		},
+	})
+	if r.Error != agx.ResponseNotWritable || r.Index != 2 {
+		t.Errorf("denied test set returned %v", r)
+	}
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CleanupSetPDU, 100)})
+	h.expectNothing()
+	if len(tested) != 0 {
+		t.Errorf("denied varbinds reached the handler %v", tested)
+	}
+}
+
+func TestHarnessResponseLimits(t *testing.T) {
+	h := newHarness(t, func(c *agx.Connection) {
+		for i := 1; i <= 20; i++ {
+			v := int32(i)
+			c.OnGet(fmt.Sprintf("%s.%d", access, i), func(oid agx.Subtree) agx.VarBind {
+				return agx.IntegerVarBind(oid, v)
+			})
+		}
+		c.OnGet(egress+".1", func(oid agx.Subtree) agx.VarBind {
+			return *agx.OctetStringVarBind(oid, make([]byte, 300))
+		})
+	})
+	size := agx.IntegerVarBind(subtree(t, access+".1"), 1).WireSize()
+	getBulk := func(nonRepeaters, maxRepetitions int16, oids ...string) *agx.Response {
+		t.Helper()
+		m := &agx.GetBulkMessage{
+			Header:         h.header(agx.GetBulkPDU, 0),
+			NonRepeaters:   nonRepeaters,
+			MaxRepetitions: maxRepetitions,
+		}
+		for _, oid := range oids {
+			m.SearchRanges = append(m.SearchRanges,
+				agx.SearchRange{Start: subtree(t, oid)})
+		}
+		return h.request(m)
+	}
+
+	//repetitions are cut short to fit
+	h.c.SetMaxResponseLength(8 + 10*size + size/2)
+	r := getBulk(0, 15, access)
+	if r.Error != agx.ResponseNoError || len(r.VarBindList) != 10 {
+		t.Errorf("expected 10 varbinds, got %v", r)
+	}
+	if r.VarBindList[9].String() !=
+		agx.IntegerVarBind(subtree(t, access+".10"), 10).String() {
+		t.Errorf("unexpected last varbind %v", r.VarBindList[9])
+	}
+
+	//only whole repetitions are sent
+	h.c.SetMaxResponseLength(8 + 5*size)
+	r = getBulk(0, 15, access, access+".10")
+	if r.Error != agx.ResponseNoError || len(r.VarBindList) != 4 {
+		t.Errorf("expected 2 repetitions of 2 varbinds, got %v", r)
+	}
+
+	//non-repeaters that do not fit are too big
+	r = getBulk(6, 1, access, access, access, access, access, access)
+	if r.Error != agx.ResponseTooBig || r.Index != 6 ||
+		len(r.VarBindList) != 6 {
+		t.Errorf("expected tooBig at 6, got %v", r)
+	}
+
+	//as are varbinds of gets that do not fit
+	r = h.getNext(access, egress)
+	if r.Error != agx.ResponseTooBig || r.Index != 2 ||
+		len(r.VarBindList) != 2 || r.VarBindList[1].Type != agx.NullT {
+		t.Errorf("expected tooBig at 2, got %v", r)
+	}
+
+	h.c.SetMaxResponseLength(agx.DefaultMaxResponseLength)
+	r = h.getNext(access, egress)
+	if r.Error != agx.ResponseNoError || len(r.VarBindList) != 2 {
+		t.Errorf("getnext returned %v", r)
+	}
+}
+
+func TestHarnessGetBatch(t *testing.T) {
+	var calls *[][]string
+	h := newHarness(t, func(c *agx.Connection) {
+		calls = scalars(t, &c.Dispatcher)
+	})
+
+	var ranges []agx.SearchRange
+	for _, x := range []string{".1.0", ".4.0", ".2.0"} {
+		ranges = append(ranges, agx.SearchRange{Start: subtree(t, access+x)})
+	}
+	r := h.request(&agx.GetMessage{
+		Header:       h.header(agx.GetPDU, 1),
+		SearchRanges: ranges,
+	})
+	if len(r.VarBindList) != 3 || r.VarBindList[1].Type != agx.EndOfMibViewT {
+		t.Errorf("unexpected response %v", r)
+	}
+	if len(*calls) != 1 || len((*calls)[0]) != 3 {
+		t.Errorf("expected one call for every variable, got %v", *calls)
+	}
+}
+
+func TestHarnessRawPDU(t *testing.T) {
+	var undone []uint32
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnRawPDU(agx.GetPDU, func(h agx.Header, pdu []byte) ([]byte, error) {
+			m := &agx.GetMessage{}
+			if _, err := m.UnmarshalBinary(pdu); err != nil {
+				return nil, err
+			}
+			r := agx.NewResponse(h)
+			for _, x := range m.SearchRanges {
+				r.Add(agx.IntegerVarBind(x.Start, 47))
+			}
+			buf, err := r.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			return buf[agx.HeaderSize:], nil
+		})
+		c.OnRawPDU(agx.GetNextPDU, func(h agx.Header, pdu []byte) ([]byte, error) {
+			return nil, fmt.Errorf("muffin")
+		})
+		c.OnRawPDU(agx.UndoSetPDU, func(h agx.Header, pdu []byte) ([]byte, error) {
+			undone = append(undone, h.TransactionId)
+			return nil, nil
+		})
+	})
+	name := subtree(t, access+".1")
+
+	r := h.request(&agx.GetMessage{
+		Header:       h.header(agx.GetPDU, 0),
+		SearchRanges: []agx.SearchRange{{Start: name}},
+	})
+	if r.Error != agx.ResponseNoError || len(r.VarBindList) != 1 ||
+		r.VarBindList[0].Data != agx.Integer(47) {
+		t.Errorf("raw get returned %v", r)
+	}
+
+	r = h.getNext(access)
+	if r.Error != agx.ResponseProcessingError {
+		t.Errorf("expected processing error, got %v", r)
+	}
+
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.UndoSetPDU, 100)})
+	h.c.OnRawPDU(agx.GetPDU, nil)
+	h.expectNothing()
+	if len(undone) != 1 || undone[0] != 100 {
+		t.Errorf("undo handled for %v", undone)
+	}
+}
+
+func TestHarnessSubscribe(t *testing.T) {
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, 1)
+		})
+	})
+	ch, cancel := h.c.Subscribe(4)
+	full, cancelFull := h.c.Subscribe(1)
+	defer cancelFull()
+
+	h.getNext(access)
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CleanupSetPDU, 100)})
+	h.expectNothing()
+
+	//every pdu is seen, including those that are not answered
+	var types []string
+	for i := 0; i < 3; i++ {
+		select {
+		case m := <-ch:
+			types = append(types, fmt.Sprintf("%T", m))
+		case <-time.After(harnessTimeout):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+	expect := []string{"*agx.GetNextMessage", "*agx.SetPhaseMessage",
+		"*agx.GetMessage"}
+	if !reflect.DeepEqual(types, expect) {
+		t.Errorf("received %v, expected %v", types, expect)
+	}
+
+	//a full subscriber does not hold up dispatch
+	if len(full) != 1 {
+		t.Errorf("expected 1 buffered message, got %d", len(full))
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Errorf("channel open after cancel")
+	}
+	h.getNext(access)
+}
+
+func TestHarnessRegistrations(t *testing.T) {
+	h := newHarness(t, nil)
+
+	if err := h.c.Register(qbridge); err != nil {
+		t.Fatalf("register failed %v", err)
+	}
+	m := h.expect(agx.RegisterPDU).(*agx.RegisterMessage)
+	if m.Priority != agx.BasePriority || m.Subtree.String() != qbridge ||
+		m.Context != nil || m.Header.Flags&agx.NonDefaultContext != 0 {
+		t.Errorf("unexpected registration %v", m)
+	}
+	h.respond(m.Header, agx.ResponseNoError)
+
+	//an identical registration is refused without asking the master
+	if err := h.c.Register("." + qbridge); err == nil {
+		t.Errorf("expected duplicate registration error")
+	}
+	h.expectNothing()
+
+	//the same subtree at another priority is a distinct registration
+	err := h.c.RegisterWith(agx.Registration{
+		Subtree:  qbridge,
+		Priority: 127,
+		Timeout:  agx.ConnectionTimeout,
+	})
+	if err != nil {
+		t.Fatalf("register with priority failed %v", err)
+	}
+	m = h.expect(agx.RegisterPDU).(*agx.RegisterMessage)
+	if m.Priority != 127 {
+		t.Errorf("expected priority 127, got %d", m.Priority)
+	}
+
+	regs := h.c.Snapshot().Registrations
+	if !reflect.DeepEqual(regs, []string{qbridge, qbridge}) {
+		t.Errorf("unexpected registrations %v", regs)
+	}
+}
+
+func TestHarnessUnregisterMirrors(t *testing.T) {
+	h := newHarness(t, nil)
+
+	r := agx.Registration{
+		Subtree:    egress,
+		Context:    "vlan",
+		Priority:   100,
+		Timeout:    agx.ConnectionTimeout,
+		RangeSubid: 14,
+		UpperBound: 24,
+	}
+	if err := h.c.RegisterWith(r); err != nil {
+		t.Fatalf("register failed %v", err)
+	}
+	h.expect(agx.RegisterPDU)
+
+	if err := h.c.Unregister(egress); err != nil {
+		t.Fatalf("unregister failed %v", err)
+	}
+	m := h.expect(agx.UnregisterPDU).(*agx.RegisterMessage)
+	if m.Priority != 100 || m.RangeSubid != 14 || m.UpperBound == nil ||
+		*m.UpperBound != 24 || m.Context == nil ||
+		string(m.Context.Octets) != "vlan" {
+		t.Errorf("unregistration does not mirror registration %v", m)
+	}
+
+	if err := h.c.Unregister(egress); err == nil {
+		t.Errorf("expected error unregistering twice")
+	}
+	h.expectNothing()
+}
+
+func TestHarnessUnregisterOnDisconnect(t *testing.T) {
+	h := newHarness(t, nil, agx.WithUnregisterOnDisconnect(harnessTimeout))
+	h.c.Register(egress)
+	h.c.Register(access)
+	h.expect(agx.RegisterPDU)
+	h.expect(agx.RegisterPDU)
+
+	done := make(chan struct{})
+	go func() {
+		h.c.Disconnect()
+		close(done)
+	}()
+
+	//the session is only closed once every unregistration is acknowledged
+	var unregs []agx.Header
+	for i := 0; i < 2; i++ {
+		m := h.expect(agx.UnregisterPDU).(*agx.RegisterMessage)
+		unregs = append(unregs, m.Header)
+	}
+	h.respond(unregs[0], agx.ResponseNoError)
+	select {
+	case <-done:
+		t.Fatalf("disconnected before unregistrations were acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+	h.respond(unregs[1], agx.ResponseNoError)
+	h.expect(agx.ClosePDU)
+	<-done
+	if regs := h.c.Snapshot().Registrations; len(regs) != 0 {
+		t.Errorf("registrations remain after disconnect %v", regs)
+	}
+}
+
+func TestHarnessResponseCorrelation(t *testing.T) {
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnGet(access, func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, 47)
+		})
+	}, agx.WithUnregisterOnDisconnect(harnessTimeout))
+
+	h.c.Register(egress)
+	h.c.Register(access)
+	h.c.Notify("1.3.6.1.6.3.1.1.5.4")
+	requests := []agx.Header{
+		h.expect(agx.RegisterPDU).(*agx.RegisterMessage).Header,
+		h.expect(agx.RegisterPDU).(*agx.RegisterMessage).Header,
+		h.expect(agx.NotifyPDU).(*agx.NotifyMessage).Header,
+	}
+	packets := make(map[uint32]bool)
+	for _, x := range requests {
+		packets[x.PacketId] = true
+		h.respond(x, agx.ResponseNoError)
+	}
+	if len(packets) != len(requests) {
+		t.Errorf("requests share packet ids %v", requests)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.c.Disconnect()
+		close(done)
+	}()
+	first := h.expect(agx.UnregisterPDU).(*agx.RegisterMessage)
+	second := h.expect(agx.UnregisterPDU).(*agx.RegisterMessage)
+
+	//the unregistrations are answered out of order, with a request from the
+	//master and a response to nothing in between
+	h.respond(second.Header, agx.ResponseNoError)
+	r := h.request(&agx.GetMessage{
+		Header:       h.header(agx.GetPDU, 1),
+		SearchRanges: []agx.SearchRange{{Start: subtree(t, access)}},
+	})
+	if len(r.VarBindList) != 1 || r.VarBindList[0].Data != agx.Integer(47) {
+		t.Errorf("unexpected response %v", r)
+	}
+	h.respond(agx.Header{TransactionId: agx.UnregisterTransactionId,
+		PacketId: 4747}, agx.ResponseNoError)
+	select {
+	case <-done:
+		t.Fatalf("disconnected before unregistrations were acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+	h.respond(first.Header, agx.ResponseNoError)
+	h.expect(agx.ClosePDU)
+	<-done
+}
+
+func TestHarnessMasterErrors(t *testing.T) {
+	h := newHarness(t, nil)
+	ctx := context.Background()
+	r := agx.Registration{Subtree: qbridge, Timeout: agx.ConnectionTimeout}
+
+	//a registration the master refuses is returned as its error and forgotten
+	errs := make(chan error, 1)
+	go func() { errs <- h.c.RegisterContext(ctx, r) }()
+	m := h.expect(agx.RegisterPDU).(*agx.RegisterMessage)
+	h.respond(m.Header, agx.ResponseDuplicateRegistration)
+	if err := <-errs; !errors.Is(err, agx.ErrDuplicateRegistration) {
+		t.Errorf("expected duplicate registration error, got %v", err)
+	}
+	if regs := h.c.Snapshot().Registrations; len(regs) != 0 {
+		t.Errorf("refused registration kept %v", regs)
+	}
+
+	//so it can be registered again
+	go func() { errs <- h.c.RegisterContext(ctx, r) }()
+	m = h.expect(agx.RegisterPDU).(*agx.RegisterMessage)
+	h.respond(m.Header, agx.ResponseNoError)
+	if err := <-errs; err != nil {
+		t.Fatalf("register failed %v", err)
+	}
+
+	go func() { errs <- h.c.UnregisterContext(ctx, r) }()
+	m = h.expect(agx.UnregisterPDU).(*agx.RegisterMessage)
+	h.respond(m.Header, agx.ResponseUnknownRegistration)
+	err := <-errs
+	if !errors.Is(err, agx.ErrUnknownRegistration) {
+		t.Errorf("expected unknown registration error, got %v", err)
+	}
+	if err.Error() != "master agent answered unknownRegistration" {
+		t.Errorf("unexpected message %q", err)
+	}
+
+	//waiting ends with the context
+	ctx, cancel := context.WithCancel(ctx)
+	go func() { errs <- h.c.RegisterContext(ctx, r) }()
+	h.expect(agx.RegisterPDU)
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("expected context error, got %v", err)
+	}
+}
+
+func TestHarnessUnregisterOnDisconnectTimeout(t *testing.T) {
+	h := newHarness(t, nil,
+		agx.WithUnregisterOnDisconnect(50*time.Millisecond))
+	h.c.Register(egress)
+	h.expect(agx.RegisterPDU)
+
+	go h.c.Disconnect()
+	h.expect(agx.UnregisterPDU)
+	h.expect(agx.ClosePDU)
+}
+
+func TestHarnessWorkers(t *testing.T) {
+	release := make(chan struct{})
+	var mtx sync.Mutex
+	var phases []string
+	phase := func(s string) {
+		mtx.Lock()
+		phases = append(phases, s)
+		mtx.Unlock()
+	}
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+			<-release
+			return agx.IntegerVarBind(oid, 1)
+		})
+		c.OnGet(access+".2", func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, 2)
+		})
+		c.OnTestSet(egress, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+			time.Sleep(20 * time.Millisecond)
+			phase("test")
+			return agx.TestSetNoError
+		})
+		c.OnCommitSet(func(sessionId uint32) agx.CommitSetResult {
+			phase("commit")
+			return agx.CommitSetNoError
+		})
+		c.OnCleanupSet(func(sessionId uint32) {
+			phase("cleanup")
+		})
+	}, agx.WithWorkers(4))
+
+	get := func(oid string) *agx.GetMessage {
+		return &agx.GetMessage{
+			Header:       h.header(agx.GetPDU, h.packet+1),
+			SearchRanges: []agx.SearchRange{{Start: subtree(t, oid)}},
+		}
+	}
+
+	//a slow handler does not hold up the requests after it
+	slow := get(access + ".1")
+	h.inject(slow)
+	fast := get(access + ".2")
+	r := h.request(fast)
+	if r.Header.PacketId != fast.Header.PacketId {
+		t.Errorf("expected response to %v first, got %v", fast, r)
+	}
+	close(release)
+	r = h.expect(agx.ResponsePDU).(*agx.Response)
+	if r.Header.PacketId != slow.Header.PacketId {
+		t.Errorf("expected response to %v, got %v", slow, r)
+	}
+
+	//the phases of a set are handled in order
+	h.inject(&agx.SetMessage{
+		Header: h.header(agx.TestSetPDU, 100),
+		VarBindList: []agx.VarBind{
+			agx.IntegerVarBind(subtree(t, egress+".1"), 1)},
+	})
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CommitSetPDU, 100)})
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CleanupSetPDU, 100)})
+	for i := 0; i < 2; i++ {
+		r := h.expect(agx.ResponsePDU).(*agx.Response)
+		if r.Error != agx.ResponseNoError {
+			t.Errorf("set phase returned %v", r)
+		}
+	}
+	deadline := time.Now().Add(harnessTimeout)
+	for {
+		mtx.Lock()
+		n := len(phases)
+		mtx.Unlock()
+		if n == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	expect := []string{"test", "commit", "cleanup"}
+	if !reflect.DeepEqual(phases, expect) {
+		t.Errorf("handlers ran %v, expected %v", phases, expect)
+	}
+}
+
+func TestHarnessRegionSerialization(t *testing.T) {
+	var mtx sync.Mutex
+	active, most := 0, 0
+	get := func(oid agx.Subtree) agx.VarBind {
+		mtx.Lock()
+		active++
+		if active > most {
+			most = active
+		}
+		mtx.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mtx.Lock()
+		active--
+		mtx.Unlock()
+		return agx.IntegerVarBind(oid, 1)
+	}
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnGet(access+".1", get)
+		c.OnGet(access+".2", get)
+	}, agx.WithWorkers(4))
+	h.c.Register(access)
+	h.expect(agx.RegisterPDU)
+
+	//handlers beneath the same registration never overlap
+	for i := 0; i < 8; i++ {
+		h.inject(&agx.GetMessage{
+			Header: h.header(agx.GetPDU, h.packet+1),
+			SearchRanges: []agx.SearchRange{
+				{Start: subtree(t, fmt.Sprintf("%s.%d", access, i%2+1))}},
+		})
+	}
+	for i := 0; i < 8; i++ {
+		h.expect(agx.ResponsePDU)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if most != 1 {
+		t.Errorf("%d handlers ran at once", most)
+	}
+}
+
+func TestHarnessRateLimit(t *testing.T) {
+	setup := func(c *agx.Connection) {
+		for _, oid := range []string{access + ".1", egress + ".1"} {
+			c.OnGet(oid, func(oid agx.Subtree) agx.VarBind {
+				return agx.IntegerVarBind(oid, 1)
+			})
+		}
+	}
+	get := func(h *harness, oids ...string) *agx.Response {
+		m := &agx.GetMessage{Header: h.header(agx.GetPDU, h.packet+1)}
+		for _, oid := range oids {
+			m.SearchRanges = append(m.SearchRanges,
+				agx.SearchRange{Start: subtree(t, oid)})
+		}
+		return h.request(m)
+	}
+
+	//the session may burst up to its limit
+	h := newHarness(t, setup,
+		agx.WithRateLimit(agx.RateLimit{Rate: 0.001, Burst: 2}))
+	for i := 0; i < 2; i++ {
+		if r := get(h, access+".1"); r.Error != agx.ResponseNoError {
+			t.Errorf("get %d refused %v", i, r)
+		}
+	}
+	if r := get(h, access+".1"); r.Error != agx.ResponseGenErr || r.Index != 0 {
+		t.Errorf("expected genErr over the session limit, got %v", r)
+	}
+
+	//subtree limits only hold back requests for the subtree
+	h = newHarness(t, setup)
+	err := h.c.LimitSubtree(egress, agx.RateLimit{Rate: 0.001, Burst: 1})
+	if err != nil {
+		t.Fatalf("error limiting subtree %v", err)
+	}
+	if r := get(h, egress+".1"); r.Error != agx.ResponseNoError {
+		t.Errorf("get refused %v", r)
+	}
+	r := get(h, access+".1", egress+".1")
+	if r.Error != agx.ResponseGenErr || r.Index != 2 {
+		t.Errorf("expected genErr at index 2, got %v", r)
+	}
+	if r := get(h, access+".1"); r.Error != agx.ResponseNoError {
+		t.Errorf("get outside limited subtree refused %v", r)
+	}
+
+	h.c.LimitSubtree(egress, agx.RateLimit{})
+	if r := get(h, egress+".1"); r.Error != agx.ResponseNoError {
+		t.Errorf("get refused after removing limit %v", r)
+	}
+}
+
+func TestHarnessSendQueue(t *testing.T) {
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, 1)
+		})
+	}, agx.WithSendQueue(4, agx.QueueBlock))
+	r := h.getNext(access)
+	if r.Error != agx.ResponseNoError || len(r.VarBindList) != 1 {
+		t.Errorf("unexpected response through queue %v", r)
+	}
+
+	//a master that stops reading has its session closed once the queue fills
+	h = newHarness(t, nil, agx.WithSendQueue(1, agx.QueueClose))
+	for i := 0; ; i++ {
+		m := &agx.GetMessage{Header: h.header(agx.GetPDU, h.packet+1)}
+		h.conn.SetWriteDeadline(time.Now().Add(harnessTimeout))
+		if _, err := agx.WriteMessage(h.conn, m); err != nil {
+			break
+		}
+		if i > 1000 {
+			t.Fatalf("session still open after %d requests", i)
+		}
+	}
+	select {
+	case <-h.c.Done():
+	case <-time.After(harnessTimeout):
+		t.Fatalf("timed out waiting for session to close")
+	}
+	if h.c.IsConnected() || h.c.Err() == nil {
+		t.Errorf("session still connected")
+	}
+}
+
+// fakeClock is a clock that only moves when advanced
+type fakeClock struct {
+	mtx    sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	ch := make(chan time.Time, 1)
+	f.timers = append(f.timers, fakeTimer{f.now.Add(d), ch})
+	return ch
+}
+
+// advance moves the clock on by d once n timers are waiting, firing those
+// that are due
+func (f *fakeClock) advance(t *testing.T, n int, d time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(harnessTimeout)
+	for {
+		f.mtx.Lock()
+		if len(f.timers) >= n {
+			break
+		}
+		f.mtx.Unlock()
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d timers", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	defer f.mtx.Unlock()
+
+	f.now = f.now.Add(d)
+	var pending []fakeTimer
+	for _, x := range f.timers {
+		if x.at.After(f.now) {
+			pending = append(pending, x)
+			continue
+		}
+		x.ch <- f.now
+	}
+	f.timers = pending
+}
+
+func TestHarnessClock(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+	h := newHarness(t, nil, agx.WithClock(clk),
+		agx.WithKeepalive(time.Minute))
+
+	//the master is pinged once the interval has passed on the clock
+	clk.advance(t, 1, time.Minute)
+	ping := h.expect(agx.PingPDU).(*agx.PingMessage)
+	clk.advance(t, 1, 3*time.Second)
+	h.respond(ping.Header, agx.ResponseNoError)
+
+	deadline := time.Now().Add(harnessTimeout)
+	for h.c.LastPingRTT() != 3*time.Second {
+		if time.Now().After(deadline) {
+			t.Fatalf("ping round trip %v, expected 3s", h.c.LastPingRTT())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if up := h.c.SysUpTime(); up != 6300 {
+		t.Errorf("sysUpTime %d, expected 6300", up)
+	}
+	if !h.c.LastActivity().Equal(clk.Now()) {
+		t.Errorf("last activity %v, expected %v", h.c.LastActivity(),
+			clk.Now())
+	}
+}
+
+func TestHarnessPing(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+	h := newHarness(t, nil, agx.WithClock(clk))
+
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	results := make(chan result, 1)
+	ping := func() {
+		rtt, err := h.c.Ping(context.Background())
+		results <- result{rtt, err}
+	}
+
+	go ping()
+	m := h.expect(agx.PingPDU).(*agx.PingMessage)
+	clk.advance(t, 0, 3*time.Second)
+	h.respond(m.Header, agx.ResponseNoError)
+	if r := <-results; r.err != nil || r.rtt != 3*time.Second {
+		t.Errorf("ping returned %v %v, expected 3s", r.rtt, r.err)
+	}
+
+	//the error the master answers with comes along with the round trip
+	go ping()
+	m = h.expect(agx.PingPDU).(*agx.PingMessage)
+	clk.advance(t, 0, time.Second)
+	h.respond(m.Header, agx.ResponseNotOpen)
+	if r := <-results; r.err != agx.ErrNotOpen || r.rtt != time.Second {
+		t.Errorf("ping returned %v %v, expected 1s and notOpen", r.rtt, r.err)
+	}
+
+	//waiting ends with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.c.Ping(ctx); err != context.Canceled {
+		t.Errorf("expected context error, got %v", err)
+	}
+	h.expect(agx.PingPDU)
+}
+
+func TestHarnessHandlerDeadline(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var logged lockedBuffer
+	stuck := make(chan struct{})
+	defer close(stuck)
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+			<-stuck
+			return agx.IntegerVarBind(oid, 1)
+		})
+	}, agx.WithClock(clk), agx.WithLogger(log.New(&logged, "", 0)),
+		agx.WithHandlerDeadline(time.Second))
+
+	//the watchdog waits on the clock of the connection and logs to its logger
+	m := &agx.GetMessage{
+		Header:       h.header(agx.GetPDU, 1),
+		SearchRanges: []agx.SearchRange{{Start: subtree(t, access+".1")}},
+	}
+	h.inject(m)
+	clk.advance(t, 1, agx.OpenTimeout*time.Second)
+	r := h.expect(agx.ResponsePDU).(*agx.Response)
+	if r.Error != agx.ResponseProcessingError || r.Index != 1 {
+		t.Errorf("stuck handler answered %v, expected processingError", r)
+	}
+	if !strings.Contains(logged.String(), "[watchdog]") {
+		t.Errorf("watchdog not logged to the connection logger: %q",
+			logged.String())
+	}
+}
+
+func TestHarnessNotify(t *testing.T) {
+	clk := &fakeClock{now: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+	h := newHarness(t, nil, agx.WithClock(clk))
+	clk.advance(t, 0, 2*time.Second)
+
+	linkUp := "1.3.6.1.6.3.1.1.5.4"
+	ifIndex := subtree(t, "1.3.6.1.2.1.2.2.1.1.7")
+	err := h.c.Notify(linkUp, agx.IntegerVarBind(ifIndex, 7))
+	if err != nil {
+		t.Fatalf("notify failed %v", err)
+	}
+	m := h.expect(agx.NotifyPDU).(*agx.NotifyMessage)
+	if len(m.VarBindList) != 3 {
+		t.Fatalf("expected 3 varbinds, got %v", m)
+	}
+	if up, ok := m.VarBindList[0].Data.(agx.TimeTicks); !ok || up != 200 {
+		t.Errorf("expected sysUpTime 200, got %v", m.VarBindList[0])
+	}
+	trap, ok := m.VarBindList[1].Data.(agx.Oid)
+	if m.VarBindList[1].Name.String() != "1.3.6.1.6.3.1.1.4.1.0" || !ok ||
+		trap.String() != linkUp {
+		t.Errorf("expected snmpTrapOID %s, got %v", linkUp, m.VarBindList[1])
+	}
+	if m.VarBindList[2].Name.String() != "1.3.6.1.2.1.2.2.1.1.7" {
+		t.Errorf("unexpected varbind %v", m.VarBindList[2])
+	}
+	h.respond(m.Header, agx.ResponseNoError)
+	if m.Context != nil {
+		t.Errorf("notification in the default context has context %v",
+			m.Context)
+	}
+
+	if err := h.c.NotifyIn("bridge", linkUp); err != nil {
+		t.Fatalf("notify failed %v", err)
+	}
+	m = h.expect(agx.NotifyPDU).(*agx.NotifyMessage)
+	if agx.ContextOf(m.Context) != "bridge" {
+		t.Errorf("expected notification in context bridge, got %v", m)
+	}
+	h.respond(m.Header, agx.ResponseNoError)
+
+	if err := h.c.Notify("not.an.oid"); err == nil {
+		t.Errorf("expected error notifying a bad oid")
+	}
+	h.expectNothing()
+}
+
+func TestHarnessNotifyHangUp(t *testing.T) {
+	h := newHarness(t, nil)
+
+	//notifications sent as the master hangs up fail as the session ends, the
+	//requests they were pending as are abandoned once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h.c.IsConnected() {
+				h.c.Notify("1.3.6.1.6.3.1.1.5.4")
+			}
+		}()
+	}
+	h.conn.Close()
+	select {
+	case <-h.c.Done():
+	case <-time.After(harnessTimeout):
+		t.Fatalf("timed out waiting for the session to end")
+	}
+	wg.Wait()
+	if err := h.c.Notify("1.3.6.1.6.3.1.1.5.4"); err == nil {
+		t.Errorf("notify succeeded after the master hung up")
+	}
+}
+
+func TestHarnessDeclaredSyntax(t *testing.T) {
+	tested := 0
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+			tested++
+			return agx.TestSetNoError
+		})
+		err := c.DeclareSyntax(access+".1", agx.Syntax{Type: agx.IntegerT})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.DeclareSyntax(access+".2", agx.Syntax{
+			Type:  agx.OctetStringT,
+			Sizes: []agx.Range{{Min: 1, Max: 4}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	number, name := subtree(t, access+".1.47"), subtree(t, access+".2.47")
+
+	expect := []struct {
+		vbs   []agx.VarBind
+		err   agx.TestSetResult
+		index int16
+	}{
+		{[]agx.VarBind{
+			agx.IntegerVarBind(number, 1),
+			*agx.OctetStringVarBind(name, []byte("vlan")),
+		}, agx.TestSetNoError, 0},
+		{[]agx.VarBind{
+			agx.IntegerVarBind(number, 1),
+			agx.Gauge32VarBind(name, 1),
+		}, agx.TestSetWrongType, 2},
+		{[]agx.VarBind{
+			*agx.OctetStringVarBind(name, []byte("muffin")),
+		}, agx.TestSetWrongLength, 1},
+	}
+	for i, x := range expect {
+		id := uint32(200 + i)
+		r := h.request(&agx.SetMessage{
+			Header:      h.header(agx.TestSetPDU, id),
+			VarBindList: x.vbs,
+		})
+		if r.Error != int16(x.err) || r.Index != x.index {
+			t.Errorf("test set %d returned %v, expected %d at %d", i, r, x.err, x.index)
+		}
+		h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CleanupSetPDU, id)})
+		h.expectNothing()
+	}
+
+	//mismatches never reach the handler
+	if tested != 2 {
+		t.Errorf("test-set handler ran %d times, expected 2", tested)
+	}
+}
+
+func TestHarnessRecordReplay(t *testing.T) {
+	state := int32(1)
+	serve := func(d *agx.Dispatcher) {
+		d.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, state)
+		})
+		d.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+			if x, _ := vb.Int32(); x > 10 {
+				return agx.TestSetWrongValue
+			}
+			return agx.TestSetNoError
+		})
+	}
+
+	var recording bytes.Buffer
+	h := newHarness(t, func(c *agx.Connection) { serve(&c.Dispatcher) },
+		agx.WithRecorder(agx.NewRecorder(&recording)))
+	name := subtree(t, access+".1")
+
+	h.request(&agx.GetMessage{
+		Header:       h.header(agx.GetPDU, 300),
+		SearchRanges: []agx.SearchRange{{Start: name}},
+	})
+	h.request(&agx.SetMessage{
+		Header:      h.header(agx.TestSetPDU, 301),
+		VarBindList: []agx.VarBind{agx.IntegerVarBind(name, 47)},
+	})
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CleanupSetPDU, 301)})
+	h.expectNothing()
+
+	recs, err := agx.ReadRecording(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatalf("error reading recording: %v", err)
+	}
+	//the open and its response, then the requests and their responses
+	if len(recs) != 9 || !recs[0].Sent || recs[1].Sent {
+		t.Fatalf("recorded %d pdus", len(recs))
+	}
+
+	//the same handlers answer the same way
+	var d agx.Dispatcher
+	serve(&d)
+	results, err := agx.Replay(bytes.NewReader(recording.Bytes()), &d)
+	if err != nil {
+		t.Fatalf("error replaying: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("replayed %d requests, expected 4", len(results))
+	}
+	for i, x := range results {
+		if !x.Matches() {
+			t.Errorf("request %d %v answered %v, recorded %v",
+				i, x.Request, x.Replayed, x.Recorded)
+		}
+	}
+	if results[1].Replayed.Error != int16(agx.TestSetWrongValue) {
+		t.Errorf("test set replayed as %v", results[1].Replayed)
+	}
+	if results[2].Recorded != nil || results[2].Replayed != nil {
+		t.Errorf("cleanup set answered")
+	}
+
+	//a regression shows up as a mismatch
+	state = 2
+	results, err = agx.Replay(bytes.NewReader(recording.Bytes()), &d)
+	if err != nil {
+		t.Fatalf("error replaying: %v", err)
+	}
+	if results[0].Matches() || !results[1].Matches() {
+		t.Errorf("get replayed as %v, recorded %v",
+			results[0].Replayed, results[0].Recorded)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+// This file contains an example agent serving the load, cpu, memory and disk
+// statistics of the host, as the UCD-SNMP-MIB objects net-snmp serves them
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * MIB Objects
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+const ucd = "1.3.6.1.4.1.2021"
+
+// memory, in kB
+const (
+	memory        = ucd + ".4"
+	mem_total_swp = memory + ".3.0"
+	mem_avail_swp = memory + ".4.0"
+	mem_total     = memory + ".5.0"
+	mem_avail     = memory + ".6.0"
+	mem_buffer    = memory + ".14.0"
+	mem_cached    = memory + ".15.0"
+)
+
+// dskTable, of the disks given with -disks
+const (
+	dsk_entry   = ucd + ".9.1"
+	dsk_index   = 1
+	dsk_path    = 2
+	dsk_device  = 3
+	dsk_total   = 6
+	dsk_avail   = 7
+	dsk_used    = 8
+	dsk_percent = 9
+)
+
+// laTable, of the 1, 5 and 15 minute load averages
+const (
+	la_entry      = ucd + ".10.1"
+	la_index      = 1
+	la_names      = 2
+	la_load       = 3
+	la_load_int   = 5
+	la_load_float = 6
+)
+
+// systemStats, raw cpu counters are in ticks
+const (
+	system_stats    = ucd + ".11"
+	ss_cpu_user     = system_stats + ".50.0"
+	ss_cpu_nice     = system_stats + ".51.0"
+	ss_cpu_system   = system_stats + ".52.0"
+	ss_cpu_idle     = system_stats + ".53.0"
+	ss_cpu_wait     = system_stats + ".54.0"
+	ss_cpu_num_cpus = system_stats + ".67.0"
+)
+
+// diskIOTable, of block devices
+const (
+	disk_io_entry       = ucd + ".13.15.1.1"
+	disk_io_index       = 1
+	disk_io_device      = 2
+	disk_io_reads       = 5
+	disk_io_writes      = 6
+	disk_io_nread_x     = 12
+	disk_io_nwritten_x  = 13
+	disk_io_sector_size = 512
+)
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * Entry Point
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+func main() {
+
+	disks := flag.String("disks", "/",
+		"comma separated mount points served in dskTable")
+	interval := flag.Duration("interval", 5*time.Second,
+		"how long statistics are kept before they are read again")
+	flag.Parse()
+
+	host := &poller{interval: *interval, disks: strings.Split(*disks, ",")}
+
+	c, err := agx.Connect("1.3.6.1.4.1.47.3",
+		agx.WithDescription("hoststats-agent"))
+	if err != nil {
+		log.Fatalf("connection failed %v", err)
+	}
+
+	//scalar groups are served by a get handler for each scalar, reading the
+	//statistics last polled
+	scalars := map[string]func(s *stats) agx.Value{
+		mem_total_swp:   memValue("SwapTotal"),
+		mem_avail_swp:   memValue("SwapFree"),
+		mem_total:       memValue("MemTotal"),
+		mem_avail:       memValue("MemAvailable"),
+		mem_buffer:      memValue("Buffers"),
+		mem_cached:      memValue("Cached"),
+		ss_cpu_user:     cpuValue(cpu_user),
+		ss_cpu_nice:     cpuValue(cpu_nice),
+		ss_cpu_system:   cpuValue(cpu_system),
+		ss_cpu_idle:     cpuValue(cpu_idle),
+		ss_cpu_wait:     cpuValue(cpu_wait),
+		ss_cpu_num_cpus: func(s *stats) agx.Value { return agx.Integer(s.cpus) },
+	}
+	for oid, f := range scalars {
+		f := f
+		c.OnGet(oid, func(oid agx.Subtree) agx.VarBind {
+			return agx.NewVarBind(oid, f(host.get()))
+		})
+	}
+
+	//tables are loaded from the statistics last polled
+	tables := map[string]func() []agx.TableRow{
+		dsk_entry:     func() []agx.TableRow { return dskRows(host.get()) },
+		la_entry:      func() []agx.TableRow { return laRows(host.get()) },
+		disk_io_entry: func() []agx.TableRow { return diskIORows(host.get()) },
+	}
+	for entry, load := range tables {
+		t, _ := agx.NewTable(entry)
+		t.Load = load
+		t.CacheTime = *interval
+		t.Attach(&c.Dispatcher)
+	}
+
+	for _, oid := range []string{memory, dsk_entry, la_entry, system_stats,
+		disk_io_entry} {
+		err = c.Register(oid)
+		if err != nil {
+			log.Fatalf("registration of %s failed %v", oid, err)
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case s := <-sigs:
+		log.Printf("received %v, shutting down", s)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.Shutdown(ctx)
+	case <-c.Done():
+		log.Printf("session closed")
+	}
+}
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * Tables
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+func dskRows(s *stats) []agx.TableRow {
+
+	var rows []agx.TableRow
+	for i, d := range s.disks {
+		percent := 0
+		if d.total > 0 {
+			percent = int(100 * (d.total - d.avail) / d.total)
+		}
+		rows = append(rows, agx.TableRow{
+			Index: agx.IntegerIndex(uint32(i + 1)),
+			Columns: map[uint32]agx.VarBind{
+				dsk_index:   value(agx.Integer(i + 1)),
+				dsk_path:    value(octets(d.path)),
+				dsk_device:  value(octets(d.device)),
+				dsk_total:   value(kb(d.total)),
+				dsk_avail:   value(kb(d.avail)),
+				dsk_used:    value(kb(d.total - d.avail)),
+				dsk_percent: value(agx.Integer(percent)),
+			},
+		})
+	}
+	return rows
+}
+
+func laRows(s *stats) []agx.TableRow {
+
+	var rows []agx.TableRow
+	for i, name := range []string{"Load-1", "Load-5", "Load-15"} {
+		load := s.load[i]
+		rows = append(rows, agx.TableRow{
+			Index: agx.IntegerIndex(uint32(i + 1)),
+			Columns: map[uint32]agx.VarBind{
+				la_index:      value(agx.Integer(i + 1)),
+				la_names:      value(octets(name)),
+				la_load:       value(octets(fmt.Sprintf("%.2f", load))),
+				la_load_int:   value(agx.Integer(math.Round(load * 100))),
+				la_load_float: agx.FloatVarBind(agx.Subtree{}, float32(load)),
+			},
+		})
+	}
+	return rows
+}
+
+// The octets read and written are Counter64s, which do not wrap on busy disks
+// as the Counter32s of operations do
+func diskIORows(s *stats) []agx.TableRow {
+
+	var rows []agx.TableRow
+	for i, d := range s.diskIO {
+		rows = append(rows, agx.TableRow{
+			Index: agx.IntegerIndex(uint32(i + 1)),
+			Columns: map[uint32]agx.VarBind{
+				disk_io_index:  value(agx.Integer(i + 1)),
+				disk_io_device: value(octets(d.device)),
+				disk_io_reads:  value(agx.Counter32(d.reads)),
+				disk_io_writes: value(agx.Counter32(d.writes)),
+				disk_io_nread_x: value(
+					agx.Counter64(d.sectorsRead * disk_io_sector_size)),
+				disk_io_nwritten_x: value(
+					agx.Counter64(d.sectorsWritten * disk_io_sector_size)),
+			},
+		})
+	}
+	return rows
+}
+
+// helpers ====================================================================
+
+// Returns a scalar value of an amount of memory from /proc/meminfo
+func memValue(key string) func(s *stats) agx.Value {
+	return func(s *stats) agx.Value { return kb(s.mem[key]) }
+}
+
+// Returns a scalar value of the ticks cpus have spent in a state. The UCD
+// counters are 32 bits wide and wrap as the kernel's do not.
+func cpuValue(state int) func(s *stats) agx.Value {
+	return func(s *stats) agx.Value { return agx.Counter32(s.cpu[state]) }
+}
+
+func value(v agx.Value) agx.VarBind {
+	return agx.NewVarBind(agx.Subtree{}, v)
+}
+
+func octets(s string) agx.OctetString {
+	return *agx.NewOctetString([]byte(s))
+}
+
+// Returns an amount of bytes in kB as an Integer32, which saturates
+func kb(bytes uint64) agx.Integer {
+	k := bytes / 1024
+	if k > math.MaxInt32 {
+		return agx.Integer(math.MaxInt32)
+	}
+	return agx.Integer(k)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/agxtest"
+	"github.com/rcgoodfellow/agx/mibs"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// useFake has the agent read a procfs of a host with two cpus and one disk,
+// returning the mount point of the disk
+func useFake(t *testing.T) string {
+	dir := t.TempDir()
+	disk := t.TempDir()
+	files := map[string]string{
+		"loadavg": "0.52 1.25 2.00 1/123 4567\n",
+		"meminfo": "MemTotal:       16314516 kB\n" +
+			"MemAvailable:    8000000 kB\n" +
+			"Buffers:             100 kB\n" +
+			"HugePages_Total:       0\n",
+		"stat": "cpu  100 2 30 4000 5 0 0 0 0 0\n" +
+			"cpu0 50 1 15 2000 3 0 0 0 0 0\n" +
+			"cpu1 50 1 15 2000 2 0 0 0 0 0\n" +
+			"intr 12345\n",
+		"diskstats": "   8       0 sda 10 0 80 0 20 0 160 0 0 0 0\n" +
+			"   8       1 sda1 short\n",
+		"mounts": "/dev/sda2 " + disk + " ext4 rw 0 0\n" +
+			"/dev/sda1 " + disk + " ext4 rw 0 0\n",
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := proc
+	proc = dir
+	t.Cleanup(func() { proc = root })
+	return disk
+}
+
+func str(v agx.Value) string {
+	s, _ := v.(agx.OctetString)
+	return string(s.Octets[:s.OctetStringLength])
+}
+
+func TestPoller(t *testing.T) {
+	disk := useFake(t)
+	p := &poller{interval: time.Minute, disks: []string{disk, "/not/a/disk"}}
+
+	s := p.get()
+	if s.load != [3]float64{0.52, 1.25, 2} {
+		t.Errorf("load %v", s.load)
+	}
+	if s.mem["MemTotal"] != 16314516*1024 || s.mem["HugePages_Total"] != 0 {
+		t.Errorf("memory %v", s.mem)
+	}
+	if s.cpu != [cpu_states]uint64{100, 2, 30, 4000, 5} || s.cpus != 2 {
+		t.Errorf("cpu %v of %d cpus", s.cpu, s.cpus)
+	}
+	//short lines of diskstats are skipped
+	if len(s.diskIO) != 1 || s.diskIO[0] != (diskIO{device: "sda", reads: 10,
+		writes: 20, sectorsRead: 80, sectorsWritten: 160}) {
+		t.Errorf("disk io %+v", s.diskIO)
+	}
+	//disks that cannot be read are left out, the device is that of the last
+	//mount
+	if len(s.disks) != 1 || s.disks[0].device != "/dev/sda1" ||
+		s.disks[0].total == 0 {
+		t.Errorf("disks %+v", s.disks)
+	}
+
+	//statistics are read again once they are out of date
+	if p.get() != s {
+		t.Errorf("statistics read again within the interval")
+	}
+	p.at = p.at.Add(-time.Minute)
+	if p.get() == s {
+		t.Errorf("statistics not read again after the interval")
+	}
+}
+
+func TestTables(t *testing.T) {
+	s := &stats{
+		load: [3]float64{0.52, 1.25, 2},
+		disks: []disk{{path: "/", device: "/dev/sda1", total: 4096 * 1024,
+			avail: 1024 * 1024}},
+		diskIO: []diskIO{{device: "sda", reads: 10, writes: 20,
+			sectorsRead: 80, sectorsWritten: 160}},
+	}
+	dsk := func() []agx.TableRow { return dskRows(s) }
+	la := func() []agx.TableRow { return laRows(s) }
+	io := func() []agx.TableRow { return diskIORows(s) }
+
+	for _, x := range []struct {
+		entry  string
+		load   func() []agx.TableRow
+		column uint32
+		index  uint32
+		value  agx.Value
+	}{
+		{dsk_entry, dsk, dsk_total, 1, agx.Integer(4096)},
+		{dsk_entry, dsk, dsk_avail, 1, agx.Integer(1024)},
+		{dsk_entry, dsk, dsk_used, 1, agx.Integer(3072)},
+		{dsk_entry, dsk, dsk_percent, 1, agx.Integer(75)},
+		{la_entry, la, la_load_int, 2, agx.Integer(125)},
+		{disk_io_entry, io, disk_io_reads, 1, agx.Counter32(10)},
+		{disk_io_entry, io, disk_io_nread_x, 1, agx.Counter64(80 * 512)},
+		{disk_io_entry, io, disk_io_nwritten_x, 1, agx.Counter64(160 * 512)},
+	} {
+		v := agxtest.BindTable(t, x.entry, x.load,
+			mibs.Instance(x.entry, x.column, x.index))
+		if v != x.value {
+			t.Errorf("%s.%d.%d is %v, expected %v", x.entry, x.column,
+				x.index, v, x.value)
+		}
+	}
+
+	v := agxtest.BindTable(t, la_entry, la, mibs.Instance(la_entry, la_load, 1))
+	if str(v) != "0.52" {
+		t.Errorf("laLoad.1 is %v, expected 0.52", v)
+	}
+	v = agxtest.BindTable(t, dsk_entry, dsk,
+		mibs.Instance(dsk_entry, dsk_device, 1))
+	if str(v) != "/dev/sda1" {
+		t.Errorf("dskDevice.1 is %v, expected /dev/sda1", v)
+	}
+}
+
+func TestKb(t *testing.T) {
+	if k := kb(2048); k != 2 {
+		t.Errorf("2048 bytes is %d kB", k)
+	}
+	if k := kb(math.MaxUint64); k != math.MaxInt32 {
+		t.Errorf("kB do not saturate, got %d", k)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+// This file contains the poller, which reads the statistics of the host from
+// /proc and keeps them for an interval, so the scalars and tables of a walk
+// are served from one reading
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// where procfs is mounted, which tests replace
+var proc = "/proc"
+
+// the columns of the cpu line of /proc/stat
+const (
+	cpu_user = iota
+	cpu_nice
+	cpu_system
+	cpu_idle
+	cpu_wait
+	cpu_states
+)
+
+// stats is one reading of the statistics of the host
+type stats struct {
+	load   [3]float64
+	mem    map[string]uint64 //bytes, by /proc/meminfo key
+	cpu    [cpu_states]uint64
+	cpus   int
+	disks  []disk
+	diskIO []diskIO
+}
+
+// disk is the space of a mounted filesystem, in bytes
+type disk struct {
+	path   string
+	device string
+	total  uint64
+	avail  uint64
+}
+
+// diskIO is the activity of a block device since boot
+type diskIO struct {
+	device         string
+	reads          uint64
+	writes         uint64
+	sectorsRead    uint64
+	sectorsWritten uint64
+}
+
+// poller keeps the last reading of the statistics of the host, reading them
+// again once they are older than the interval
+type poller struct {
+	mtx      sync.Mutex
+	interval time.Duration
+	disks    []string //mount points of the disks to report
+	last     *stats
+	at       time.Time
+}
+
+// Returns the statistics of the host, reading them if they are out of date.
+// Statistics that cannot be read are logged and left zero.
+func (p *poller) get() *stats {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.last != nil && time.Since(p.at) < p.interval {
+		return p.last
+	}
+
+	s := &stats{mem: make(map[string]uint64)}
+	for name, read := range map[string]func(*stats) error{
+		"load":   readLoad,
+		"memory": readMemory,
+		"cpu":    readCPU,
+		"diskio": readDiskIO,
+	} {
+		if err := read(s); err != nil {
+			log.Printf("[%s] %v", name, err)
+		}
+	}
+	for _, path := range p.disks {
+		d, err := readDisk(path)
+		if err != nil {
+			log.Printf("[disk] %v", err)
+			continue
+		}
+		s.disks = append(s.disks, d)
+	}
+
+	p.last = s
+	p.at = time.Now()
+	return s
+}
+
+// readers ====================================================================
+
+func readLoad(s *stats) error {
+
+	buf, err := ioutil.ReadFile(filepath.Join(proc, "loadavg"))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(buf))
+	if len(fields) < 3 {
+		return fmt.Errorf("short loadavg %q", buf)
+	}
+	for i := range s.load {
+		s.load[i], err = strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMemory(s *stats) error {
+
+	f, err := os.Open(filepath.Join(proc, "meminfo"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	//lines are of the form 'MemTotal:       16314516 kB'
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		x, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			x *= 1024
+		}
+		s.mem[strings.TrimSuffix(fields[0], ":")] = x
+	}
+	return scanner.Err()
+}
+
+func readCPU(s *stats) error {
+
+	f, err := os.Open(filepath.Join(proc, "stat"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	//the cpu line sums the cpuN lines that follow it
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if fields[0] != "cpu" {
+			s.cpus++
+			continue
+		}
+		for i := range s.cpu {
+			if i+1 < len(fields) {
+				s.cpu[i], _ = strconv.ParseUint(fields[i+1], 10, 64)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func readDiskIO(s *stats) error {
+
+	f, err := os.Open(filepath.Join(proc, "diskstats"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	//fields are major, minor, device, then reads, reads merged, sectors
+	//read, time reading, writes, writes merged, sectors written, ...
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		var x [4]uint64
+		for i, field := range []int{3, 7, 5, 9} {
+			x[i], _ = strconv.ParseUint(fields[field], 10, 64)
+		}
+		s.diskIO = append(s.diskIO, diskIO{
+			device:         fields[2],
+			reads:          x[0],
+			writes:         x[1],
+			sectorsRead:    x[2],
+			sectorsWritten: x[3],
+		})
+	}
+	return scanner.Err()
+}
+
+func readDisk(path string) (disk, error) {
+
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(path, &fs)
+	if err != nil {
+		return disk{}, err
+	}
+	return disk{
+		path:   path,
+		device: mountDevice(path),
+		total:  fs.Blocks * uint64(fs.Bsize),
+		avail:  fs.Bavail * uint64(fs.Bsize),
+	}, nil
+}
+
+// Returns the device mounted at path, from the last mount there in
+// /proc/mounts, or an empty string if it is not a mount point
+func mountDevice(path string) string {
+
+	buf, err := ioutil.ReadFile(filepath.Join(proc, "mounts"))
+	if err != nil {
+		return ""
+	}
+	device := ""
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 1 && fields[1] == path {
+			device = fields[0]
+		}
+	}
+	return device
+}
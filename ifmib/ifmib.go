@@ -0,0 +1,250 @@
+package main
+
+// This file contains an example agent serving the interfaces of the host, the
+// ifTable and ifXTable of IF-MIB, from the links and link statistics netlink
+// reports
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"context"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/mibs"
+	"github.com/rcgoodfellow/netlink"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// how long the rows of the tables are kept before netlink is asked again,
+// so a walk sees a single snapshot of the counters
+const cache_time = 2 * time.Second
+
+// where the links of the host and their speeds are read from, which tests
+// replace
+var (
+	linkList  = netlink.LinkList
+	sysfs_net = "/sys/class/net"
+)
+
+func main() {
+
+	ifTable, _ := agx.NewTable(mibs.IfEntry)
+	ifTable.Load = ifRows
+	ifTable.CacheTime = cache_time
+
+	ifXTable, _ := agx.NewTable(mibs.IfXEntry)
+	ifXTable.Load = ifXRows
+	ifXTable.CacheTime = cache_time
+
+	c, err := agx.Connect("1.3.6.1.4.1.47.2",
+		agx.WithDescription("ifmib-agent"))
+	if err != nil {
+		log.Fatalf("connection failed %v", err)
+	}
+
+	c.OnGet(mibs.IfNumber+".0", func(oid agx.Subtree) agx.VarBind {
+		return agx.IntegerVarBind(oid, int32(len(ifTable.Rows())))
+	})
+	ifTable.Attach(&c.Dispatcher)
+	ifXTable.Attach(&c.Dispatcher)
+
+	for _, oid := range []string{mibs.Interfaces, mibs.IfXTable} {
+		err = c.Register(oid)
+		if err != nil {
+			log.Fatalf("registration of %s failed %v", oid, err)
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case s := <-sigs:
+		log.Printf("received %v, shutting down", s)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.Shutdown(ctx)
+	case <-c.Done():
+		log.Printf("session closed")
+	}
+}
+
+// Returns the rows of ifTable, one for each link
+func ifRows() []agx.TableRow {
+
+	links, err := linkList()
+	if err != nil {
+		log.Printf("[ifTable] error reading links: %v", err)
+		return nil
+	}
+
+	var rows []agx.TableRow
+	for _, l := range links {
+		a := l.Attrs()
+		s := stats(a)
+		ucast := s.RxPackets - s.Multicast
+		speed, _ := linkSpeed(a.Name)
+
+		rows = append(rows, agx.TableRow{
+			Index: agx.IntegerIndex(uint32(a.Index)),
+			Columns: map[uint32]agx.VarBind{
+				column(mibs.IfIndex):        value(agx.Integer(a.Index)),
+				column(mibs.IfDescr):        value(octets(a.Name)),
+				column(mibs.IfType):         value(agx.Integer(ifType(l))),
+				column(mibs.IfMtu):          value(agx.Integer(a.MTU)),
+				column(mibs.IfSpeed):        value(agx.Gauge32(ifSpeed(speed))),
+				column(mibs.IfPhysAddress):  value(*agx.NewOctetString(a.HardwareAddr)),
+				column(mibs.IfAdminStatus):  value(agx.Integer(adminStatus(a))),
+				column(mibs.IfOperStatus):   value(agx.Integer(operStatus(a))),
+				column(mibs.IfInOctets):     value(agx.Counter32(s.RxBytes)),
+				column(mibs.IfInUcastPkts):  value(agx.Counter32(ucast)),
+				column(mibs.IfInDiscards):   value(agx.Counter32(s.RxDropped)),
+				column(mibs.IfInErrors):     value(agx.Counter32(s.RxErrors)),
+				column(mibs.IfOutOctets):    value(agx.Counter32(s.TxBytes)),
+				column(mibs.IfOutUcastPkts): value(agx.Counter32(s.TxPackets)),
+				column(mibs.IfOutDiscards):  value(agx.Counter32(s.TxDropped)),
+				column(mibs.IfOutErrors):    value(agx.Counter32(s.TxErrors)),
+			},
+		})
+	}
+	return rows
+}
+
+// Returns the rows of ifXTable, one for each link. The kernel counts received
+// multicast packets only, so transmitted packets are all counted as unicast.
+func ifXRows() []agx.TableRow {
+
+	links, err := linkList()
+	if err != nil {
+		log.Printf("[ifXTable] error reading links: %v", err)
+		return nil
+	}
+
+	var rows []agx.TableRow
+	for _, l := range links {
+		a := l.Attrs()
+		s := stats(a)
+		ucast := s.RxPackets - s.Multicast
+		speed, _ := linkSpeed(a.Name)
+
+		rows = append(rows, agx.TableRow{
+			Index: agx.IntegerIndex(uint32(a.Index)),
+			Columns: map[uint32]agx.VarBind{
+				column(mibs.IfName):              value(octets(a.Name)),
+				column(mibs.IfInMulticastPkts):   value(agx.Counter32(s.Multicast)),
+				column(mibs.IfHCInOctets):        value(agx.Counter64(s.RxBytes)),
+				column(mibs.IfHCInUcastPkts):     value(agx.Counter64(ucast)),
+				column(mibs.IfHCInMulticastPkts): value(agx.Counter64(s.Multicast)),
+				column(mibs.IfHCOutOctets):       value(agx.Counter64(s.TxBytes)),
+				column(mibs.IfHCOutUcastPkts):    value(agx.Counter64(s.TxPackets)),
+				column(mibs.IfHighSpeed):         value(agx.Gauge32(speed)),
+				column(mibs.IfAlias):             value(octets(a.Alias)),
+			},
+		})
+	}
+	return rows
+}
+
+// helpers ====================================================================
+
+// Returns the statistics of a link, which are zero when netlink has none
+func stats(a *netlink.LinkAttrs) netlink.LinkStatistics {
+	if a.Statistics == nil {
+		return netlink.LinkStatistics{}
+	}
+	return *a.Statistics
+}
+
+func ifType(l netlink.Link) int {
+	switch {
+	case l.Attrs().Flags&net.FlagLoopback != 0:
+		return mibs.IfTypeSoftwareLoopback
+	case l.Type() == "bridge":
+		return mibs.IfTypeBridge
+	case l.Type() == "vlan":
+		return mibs.IfTypeL2vlan
+	case len(l.Attrs().HardwareAddr) == 6:
+		return mibs.IfTypeEthernetCsmacd
+	}
+	return mibs.IfTypeOther
+}
+
+func adminStatus(a *netlink.LinkAttrs) int {
+	if a.Flags&net.FlagUp != 0 {
+		return mibs.IfStatusUp
+	}
+	return mibs.IfStatusDown
+}
+
+// Translates the operational state of a link (RFC2863~3.1.14, which the
+// kernel follows) into ifOperStatus
+func operStatus(a *netlink.LinkAttrs) int {
+	switch a.OperState {
+	case netlink.OperUp:
+		return mibs.IfStatusUp
+	case netlink.OperDown:
+		return mibs.IfStatusDown
+	case netlink.OperTesting:
+		return mibs.IfStatusTesting
+	case netlink.OperDormant:
+		return mibs.IfStatusDormant
+	case netlink.OperNotPresent:
+		return mibs.IfStatusNotPresent
+	case netlink.OperLowerLayerDown:
+		return mibs.IfStatusLowerLayerDown
+	}
+	//links without a notion of state, e.g. loopback, are up while up
+	if a.Flags&net.FlagUp != 0 {
+		return mibs.IfStatusUp
+	}
+	return mibs.IfStatusUnknown
+}
+
+// Returns the speed of a link in Mb/s, which netlink does not report but the
+// driver does through sysfs
+func linkSpeed(name string) (uint32, error) {
+	buf, err := ioutil.ReadFile(path.Join(sysfs_net, name, "speed"))
+	if err != nil {
+		return 0, err
+	}
+	speed, err := strconv.ParseInt(strings.TrimSpace(string(buf)), 10, 64)
+	if err != nil || speed < 0 {
+		//unknown speeds are read as -1
+		return 0, err
+	}
+	return uint32(speed), nil
+}
+
+// Returns ifSpeed in b/s for a speed in Mb/s, which saturates for links faster
+// than ifSpeed can say (RFC2863~3.1.15)
+func ifSpeed(mbps uint32) uint32 {
+	bps := uint64(mbps) * 1000000
+	if bps > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(bps)
+}
+
+// Returns the column number of a column of a table entry
+func column(oid string) uint32 {
+	s, _ := agx.NewSubtree(oid)
+	ids := s.Identifiers()
+	return ids[len(ids)-1]
+}
+
+func value(v agx.Value) agx.VarBind {
+	return agx.NewVarBind(agx.Subtree{}, v)
+}
+
+func octets(s string) agx.OctetString {
+	return *agx.NewOctetString([]byte(s))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/agxtest"
+	"github.com/rcgoodfellow/agx/mibs"
+	"github.com/rcgoodfellow/netlink"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// link is a link of a fake host
+type link struct {
+	attrs netlink.LinkAttrs
+	kind  string
+}
+
+func (l *link) Attrs() *netlink.LinkAttrs { return &l.attrs }
+func (l *link) Type() string              { return l.kind }
+
+// useFake has the agent serve a host with a loopback, an ethernet link eth0
+// of 10Gb/s with traffic on it and a bridge br0 that is down
+func useFake(t *testing.T) {
+	mac, _ := net.ParseMAC("00:00:00:00:00:01")
+	links := []netlink.Link{
+		&link{kind: "device", attrs: netlink.LinkAttrs{
+			Index: 1, Name: "lo", MTU: 65536,
+			Flags: net.FlagUp | net.FlagLoopback,
+		}},
+		&link{kind: "device", attrs: netlink.LinkAttrs{
+			Index: 2, Name: "eth0", MTU: 1500, HardwareAddr: mac,
+			Flags: net.FlagUp, OperState: netlink.OperUp, Alias: "uplink",
+			Statistics: &netlink.LinkStatistics{
+				RxPackets: 10, Multicast: 3, RxBytes: 1000,
+				TxPackets: 4, TxBytes: 400, RxDropped: 1, TxErrors: 2,
+			},
+		}},
+		&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{
+			Index: 3, Name: "br0", MTU: 1500, HardwareAddr: mac,
+			OperState: netlink.OperDown,
+		}},
+	}
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "eth0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := os.WriteFile(filepath.Join(dir, "eth0", "speed"), []byte("10000\n"),
+		0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, sysfs := linkList, sysfs_net
+	linkList = func() ([]netlink.Link, error) { return links, nil }
+	sysfs_net = dir
+	t.Cleanup(func() { linkList, sysfs_net = list, sysfs })
+}
+
+func TestIfTable(t *testing.T) {
+	useFake(t)
+
+	for _, x := range []struct {
+		column string
+		index  uint32
+		value  agx.Value
+	}{
+		{mibs.IfIndex, 2, agx.Integer(2)},
+		{mibs.IfType, 1, agx.Integer(mibs.IfTypeSoftwareLoopback)},
+		{mibs.IfType, 2, agx.Integer(mibs.IfTypeEthernetCsmacd)},
+		{mibs.IfType, 3, agx.Integer(mibs.IfTypeBridge)},
+		{mibs.IfMtu, 1, agx.Integer(65536)},
+		//ifSpeed saturates, the speed of br0 is unknown
+		{mibs.IfSpeed, 2, agx.Gauge32(math.MaxUint32)},
+		{mibs.IfSpeed, 3, agx.Gauge32(0)},
+		{mibs.IfAdminStatus, 3, agx.Integer(mibs.IfStatusDown)},
+		//links without a state are up while up
+		{mibs.IfOperStatus, 1, agx.Integer(mibs.IfStatusUp)},
+		{mibs.IfOperStatus, 2, agx.Integer(mibs.IfStatusUp)},
+		{mibs.IfOperStatus, 3, agx.Integer(mibs.IfStatusDown)},
+		{mibs.IfInOctets, 2, agx.Counter32(1000)},
+		{mibs.IfInUcastPkts, 2, agx.Counter32(7)},
+		{mibs.IfInDiscards, 2, agx.Counter32(1)},
+		{mibs.IfOutUcastPkts, 2, agx.Counter32(4)},
+		{mibs.IfOutErrors, 2, agx.Counter32(2)},
+		//links without statistics count nothing
+		{mibs.IfInOctets, 3, agx.Counter32(0)},
+	} {
+		v := agxtest.BindTable(t, mibs.IfEntry, ifRows,
+			mibs.Instance(x.column, x.index))
+		if v != x.value {
+			t.Errorf("%s.%d is %v, expected %v", x.column, x.index, v,
+				x.value)
+		}
+	}
+
+	descr := agxtest.BindTable(t, mibs.IfEntry, ifRows,
+		mibs.Instance(mibs.IfDescr, 2)).(agx.OctetString)
+	if string(descr.Octets[:descr.OctetStringLength]) != "eth0" {
+		t.Errorf("ifDescr.2 is %v, expected eth0", descr)
+	}
+}
+
+func TestIfXTable(t *testing.T) {
+	useFake(t)
+
+	for _, x := range []struct {
+		column string
+		index  uint32
+		value  agx.Value
+	}{
+		{mibs.IfInMulticastPkts, 2, agx.Counter32(3)},
+		{mibs.IfHCInOctets, 2, agx.Counter64(1000)},
+		{mibs.IfHCInUcastPkts, 2, agx.Counter64(7)},
+		{mibs.IfHCInMulticastPkts, 2, agx.Counter64(3)},
+		{mibs.IfHCOutOctets, 2, agx.Counter64(400)},
+		{mibs.IfHCOutUcastPkts, 2, agx.Counter64(4)},
+		{mibs.IfHighSpeed, 2, agx.Gauge32(10000)},
+	} {
+		v := agxtest.BindTable(t, mibs.IfXEntry, ifXRows,
+			mibs.Instance(x.column, x.index))
+		if v != x.value {
+			t.Errorf("%s.%d is %v, expected %v", x.column, x.index, v,
+				x.value)
+		}
+	}
+
+	alias := agxtest.BindTable(t, mibs.IfXEntry, ifXRows,
+		mibs.Instance(mibs.IfAlias, 2)).(agx.OctetString)
+	if string(alias.Octets[:alias.OctetStringLength]) != "uplink" {
+		t.Errorf("ifAlias.2 is %v, expected uplink", alias)
+	}
+}
+
+func TestOperStatus(t *testing.T) {
+	for state, status := range map[netlink.LinkOperState]int{
+		netlink.OperTesting:        mibs.IfStatusTesting,
+		netlink.OperDormant:        mibs.IfStatusDormant,
+		netlink.OperNotPresent:     mibs.IfStatusNotPresent,
+		netlink.OperLowerLayerDown: mibs.IfStatusLowerLayerDown,
+	} {
+		if s := operStatus(&netlink.LinkAttrs{OperState: state}); s != status {
+			t.Errorf("state %d is status %d, expected %d", state, s, status)
+		}
+	}
+	if s := operStatus(&netlink.LinkAttrs{}); s != mibs.IfStatusUnknown {
+		t.Errorf("link that is down without a state is status %d", s)
+	}
+}
@@ -0,0 +1,322 @@
+package agx
+
+// This file contains the commit journal, a write ahead log of set
+// transactions that lets an agent recover from crashing part way through
+// applying a set
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * Journal
+ *
+ * The journal is a file of AgentX PDUs. A transaction that passes test-set is
+ * written as a TestSet PDU carrying the new values of its varbinds followed by
+ * the values they had before the set. A CommitSet PDU is written before the
+ * commit handler runs and a CleanupSet PDU once the transaction is cleaned
+ * up. Every write is synced before the transaction proceeds.
+ *----------------------------------------------------------------------------*/
+
+// Journal records set transactions as they proceed so that transactions
+// interrupted by a crash can be recovered when the agent restarts
+type Journal struct {
+	mtx  sync.Mutex
+	f    *os.File
+	open map[journalKey]*JournalEntry
+}
+
+// JournalEntry is a set transaction that has not completed
+type JournalEntry struct {
+	SessionId     uint32
+	TransactionId uint32
+	//VarBinds hold the values being set, Old the values they replace, which
+	//are noSuchInstance for variables that had no value
+	VarBinds []VarBind
+	Old      []VarBind
+	//Committing is set once the commit of the transaction has begun, so its
+	//changes may have been partially applied
+	Committing bool
+}
+
+type journalKey struct {
+	sid, tid uint32
+}
+
+// RecoveryMode selects what Recover does with interrupted commits
+type RecoveryMode int
+
+const (
+	//RecoverReplay sets the new values again, completing the transaction
+	RecoverReplay RecoveryMode = iota
+	//RecoverRollback sets the old values again, undoing the transaction
+	RecoverRollback
+)
+
+// WithJournal records set transactions in j. Transactions left incomplete by
+// a previous run should be recovered before any subtrees are registered.
+func WithJournal(j *Journal) Option {
+	return func(c *Connection) {
+		c.journal = j
+	}
+}
+
+// OpenJournal opens the journal at path, creating it if it does not exist.
+// Transactions the journal holds that did not complete are available from
+// Incomplete until they are recovered.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal: %v", err)
+	}
+	j := &Journal{f: f, open: make(map[journalKey]*JournalEntry)}
+	if err := j.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.f.Close()
+}
+
+// Incomplete returns the transactions that have not been cleaned up, ordered
+// by session and transaction id
+func (j *Journal) Incomplete() []JournalEntry {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	var entries []JournalEntry
+	for _, e := range j.open {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		if entries[a].SessionId != entries[b].SessionId {
+			return entries[a].SessionId < entries[b].SessionId
+		}
+		return entries[a].TransactionId < entries[b].TransactionId
+	})
+	return entries
+}
+
+// Recover resolves incomplete transactions through the set handlers of d.
+// Transactions that had begun committing are replayed or rolled back
+// according to mode, variables without an old value cannot be rolled back
+// and are left as they are. Transactions that had not begun committing never
+// changed anything and are discarded. Once every transaction is resolved the
+// journal is emptied.
+func (j *Journal) Recover(d *Dispatcher, mode RecoveryMode) error {
+	for _, e := range j.Incomplete() {
+		if !e.Committing {
+			continue
+		}
+		vbs := e.VarBinds
+		if mode == RecoverRollback {
+			vbs = nil
+			for _, old := range e.Old {
+				if old.Type != NoSuchInstanceT {
+					vbs = append(vbs, old)
+				}
+			}
+		}
+		if len(vbs) == 0 {
+			continue
+		}
+
+		log.Printf("[journal] recovering sid=%d tid=%d", e.SessionId,
+			e.TransactionId)
+		sid := e.SessionId
+		result, index := d.TestSet(vbs, sid)
+		if result != TestSetNoError {
+			d.CleanupSet(sid)
+			return fmt.Errorf("recovering sid=%d tid=%d: %v testing %v",
+				e.SessionId, e.TransactionId, result, vbs[index-1].Name)
+		}
+		if result := d.CommitSet(sid); result != CommitSetNoError {
+			d.CleanupSet(sid)
+			return fmt.Errorf("recovering sid=%d tid=%d: %v",
+				e.SessionId, e.TransactionId, result)
+		}
+		d.CleanupSet(sid)
+	}
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	j.open = make(map[journalKey]*JournalEntry)
+	return j.truncate()
+}
+
+// transaction phases .........................................................
+
+// prepare records a transaction that has passed test-set. The phases of a
+// transaction may be recorded on a nil journal, which records nothing.
+func (j *Journal) prepare(sid, tid uint32, vbs, old []VarBind) error {
+	if j == nil {
+		return nil
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	m := &SetMessage{
+		Header:      journalHeader(TestSetPDU, sid, tid),
+		VarBindList: append(append([]VarBind{}, vbs...), old...),
+	}
+	if err := j.write(m); err != nil {
+		return err
+	}
+	j.open[journalKey{sid, tid}] = &JournalEntry{
+		SessionId:     sid,
+		TransactionId: tid,
+		VarBinds:      vbs,
+		Old:           old,
+	}
+	return nil
+}
+
+// commit records that the commit of a transaction is about to begin
+func (j *Journal) commit(sid, tid uint32) error {
+	if j == nil {
+		return nil
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	e, ok := j.open[journalKey{sid, tid}]
+	if !ok {
+		return nil
+	}
+	m := &SetPhaseMessage{Header: journalHeader(CommitSetPDU, sid, tid)}
+	if err := j.write(m); err != nil {
+		return err
+	}
+	e.Committing = true
+	return nil
+}
+
+// done records that a transaction has been cleaned up, the journal is emptied
+// whenever no transactions remain open
+func (j *Journal) done(sid, tid uint32) error {
+	if j == nil {
+		return nil
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	k := journalKey{sid, tid}
+	if _, ok := j.open[k]; !ok {
+		return nil
+	}
+	delete(j.open, k)
+	if len(j.open) == 0 {
+		return j.truncate()
+	}
+	m := &SetPhaseMessage{Header: journalHeader(CleanupSetPDU, sid, tid)}
+	return j.write(m)
+}
+
+// helpers ====================================================================
+
+func journalHeader(t PDUType, sid, tid uint32) Header {
+	return Header{
+		Version:       1,
+		Type:          t,
+		Flags:         NetworkByteOrder,
+		SessionId:     sid,
+		TransactionId: tid,
+	}
+}
+
+// write appends m to the journal and syncs it to disk
+func (j *Journal) write(m Message) error {
+	if _, err := WriteMessage(j.f, m); err != nil {
+		return fmt.Errorf("error writing journal: %v", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("error syncing journal: %v", err)
+	}
+	return nil
+}
+
+func (j *Journal) truncate() error {
+	if err := j.f.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating journal: %v", err)
+	}
+	if _, err := j.f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error truncating journal: %v", err)
+	}
+	return j.f.Sync()
+}
+
+// load reads the transactions recorded in the journal. A record torn by a
+// crash while it was written is discarded along with anything after it.
+func (j *Journal) load() error {
+	r := &countingReader{r: j.f}
+	for {
+		good := r.n
+		m, err := ReadMessage(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Printf("[journal] discarding bad record at %d: %v", good, err)
+			}
+			if err := j.f.Truncate(good); err != nil {
+				return fmt.Errorf("error truncating journal: %v", err)
+			}
+			break
+		}
+		j.replay(m)
+	}
+	_, err := j.f.Seek(0, io.SeekEnd)
+	return err
+}
+
+// replay applies a record read from the journal to the open transactions
+func (j *Journal) replay(m Message) {
+	switch m := m.(type) {
+	case *SetMessage:
+		h := m.Header
+		n := len(m.VarBindList) / 2
+		j.open[journalKey{h.SessionId, h.TransactionId}] = &JournalEntry{
+			SessionId:     h.SessionId,
+			TransactionId: h.TransactionId,
+			VarBinds:      m.VarBindList[:n],
+			Old:           m.VarBindList[n:],
+		}
+	case *SetPhaseMessage:
+		k := journalKey{m.Header.SessionId, m.Header.TransactionId}
+		switch m.Header.Type {
+		case CommitSetPDU:
+			if e, ok := j.open[k]; ok {
+				e.Committing = true
+			}
+		case CleanupSetPDU:
+			delete(j.open, k)
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
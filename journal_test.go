@@ -0,0 +1,92 @@
+package agx_test
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := agx.OpenJournal(path)
+	if err != nil {
+		t.Fatalf("error opening journal %v", err)
+	}
+
+	name := subtree(t, access+".1")
+	h := newHarness(t, func(c *agx.Connection) {
+		c.OnGet(access+".1", func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, 7)
+		})
+		c.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+			return agx.TestSetNoError
+		})
+	}, agx.WithJournal(j))
+
+	//a completed transaction leaves nothing behind
+	set := []agx.VarBind{agx.IntegerVarBind(name, 1)}
+	h.request(&agx.SetMessage{Header: h.header(agx.TestSetPDU, 100),
+		VarBindList: set})
+	h.request(&agx.SetPhaseMessage{Header: h.header(agx.CommitSetPDU, 100)})
+	h.inject(&agx.SetPhaseMessage{Header: h.header(agx.CleanupSetPDU, 100)})
+	h.expectNothing()
+	if e := j.Incomplete(); len(e) != 0 {
+		t.Errorf("completed transaction left %v", e)
+	}
+
+	//the agent crashes during the commit of one transaction while another is
+	//still being tested
+	h.request(&agx.SetMessage{Header: h.header(agx.TestSetPDU, 101),
+		VarBindList: []agx.VarBind{agx.IntegerVarBind(name, 2)}})
+	h.request(&agx.SetMessage{Header: h.header(agx.TestSetPDU, 102),
+		VarBindList: []agx.VarBind{agx.IntegerVarBind(name, 3)}})
+	h.request(&agx.SetPhaseMessage{Header: h.header(agx.CommitSetPDU, 101)})
+	j.Close()
+
+	//a torn record from the crash is ignored
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("error opening journal file %v", err)
+	}
+	f.Write([]byte{1, byte(agx.CleanupSetPDU), 0x10})
+	f.Close()
+
+	j, err = agx.OpenJournal(path)
+	if err != nil {
+		t.Fatalf("error reopening journal %v", err)
+	}
+	defer j.Close()
+	incomplete := j.Incomplete()
+	if len(incomplete) != 2 || !incomplete[0].Committing ||
+		incomplete[1].Committing {
+		t.Fatalf("incomplete transactions %+v", incomplete)
+	}
+	if !reflect.DeepEqual(incomplete[0].VarBinds,
+		[]agx.VarBind{agx.IntegerVarBind(name, 2)}) ||
+		!reflect.DeepEqual(incomplete[0].Old,
+			[]agx.VarBind{agx.IntegerVarBind(name, 7)}) {
+		t.Errorf("interrupted transaction %+v", incomplete[0])
+	}
+
+	//only the interrupted commit is rolled back
+	var applied []agx.VarBind
+	d := &agx.Dispatcher{}
+	d.OnTestSet(access, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+		applied = append(applied, vb)
+		return agx.TestSetNoError
+	})
+	if err := j.Recover(d, agx.RecoverRollback); err != nil {
+		t.Fatalf("error recovering %v", err)
+	}
+	if !reflect.DeepEqual(applied, []agx.VarBind{agx.IntegerVarBind(name, 7)}) {
+		t.Errorf("recovery applied %v", applied)
+	}
+	if e := j.Incomplete(); len(e) != 0 {
+		t.Errorf("transactions remain after recovery %v", e)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 {
+		t.Errorf("journal not emptied after recovery")
+	}
+}
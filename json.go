@@ -0,0 +1,148 @@
+package agx
+
+// This file contains the JSON representation of variables, which is meant for
+// debugging endpoints and tooling rather than the wire
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"unicode/utf8"
+)
+
+// jsonVarBind is the JSON schema of a VarBind. Numbers are JSON numbers, oids
+// and ip addresses are dotted strings. Octet strings that are valid UTF-8 are
+// held in value as strings and others in hex. Null and exception values have
+// no value.
+type jsonVarBind struct {
+	Oid   string          `json:"oid"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Hex   string          `json:"hex,omitempty"`
+}
+
+// MarshalJSON encodes v as e.g. {"oid":"1.3.6.1.2.1.1.5.0","type":"STRING",
+// "value":"muffin"}, the type is named as in varbind strings
+func (v VarBind) MarshalJSON() ([]byte, error) {
+	j := jsonVarBind{Oid: v.Name.String(), Type: varBindTypeName(v.Type)}
+
+	if err := v.check(); err != nil {
+		return nil, err
+	}
+	var value interface{}
+	switch x := v.Data.(type) {
+	case Integer, Counter32, Gauge32, TimeTicks, Counter64:
+		value = x
+	case OctetString, Opaque:
+		b, _ := v.OctetString()
+		if utf8.Valid(b) {
+			value = string(b)
+		} else {
+			j.Hex = hex.EncodeToString(b)
+		}
+	case Oid, IpAddress:
+		value = x.String()
+	}
+
+	if value != nil {
+		buf, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		j.Value = buf
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes a varbind encoded by MarshalJSON
+func (v *VarBind) UnmarshalJSON(buf []byte) error {
+	var j jsonVarBind
+	if err := json.Unmarshal(buf, &j); err != nil {
+		return err
+	}
+
+	name, err := NewSubtree(j.Oid)
+	if err != nil {
+		return err
+	}
+	t, ok := varBindTypeByName(j.Type)
+	if !ok {
+		return fmt.Errorf("unknown varbind type %q", j.Type)
+	}
+	x := VarBind{Type: t, Name: *name}
+
+	bad := func(err error) error {
+		return fmt.Errorf("bad %s value for %s: %v", j.Type, j.Oid, err)
+	}
+	switch t {
+	case IntegerT:
+		var i Integer
+		err = json.Unmarshal(j.Value, &i)
+		x.Data = i
+	case Counter32T:
+		var i Counter32
+		err = json.Unmarshal(j.Value, &i)
+		x.Data = i
+	case Gauge32T:
+		var i Gauge32
+		err = json.Unmarshal(j.Value, &i)
+		x.Data = i
+	case TimeTicksT:
+		var i TimeTicks
+		err = json.Unmarshal(j.Value, &i)
+		x.Data = i
+	case Counter64T:
+		var i Counter64
+		err = json.Unmarshal(j.Value, &i)
+		x.Data = i
+	case OctetStringT, OpaqueT:
+		var b []byte
+		if j.Hex != "" {
+			b, err = hex.DecodeString(j.Hex)
+		} else if j.Value != nil {
+			var s string
+			err = json.Unmarshal(j.Value, &s)
+			b = []byte(s)
+		}
+		x.Data = *NewOctetString(b)
+		if t == OpaqueT {
+			x.Data = NewOpaque(b)
+		}
+	case ObjectIdentifierT:
+		var s string
+		if err = json.Unmarshal(j.Value, &s); err == nil {
+			var oid *Subtree
+			if oid, err = NewSubtree(s); err == nil {
+				x.Data = Oid{*oid}
+			}
+		}
+	case IpAddressT:
+		var s string
+		if err = json.Unmarshal(j.Value, &s); err == nil {
+			ip := net.ParseIP(s).To4()
+			if ip == nil {
+				err = fmt.Errorf("%q is not an ipv4 address", s)
+			}
+			x.Data = IpAddress(ip)
+		}
+	}
+	if err != nil {
+		return bad(err)
+	}
+
+	*v = x
+	return nil
+}
+
+func varBindTypeByName(name string) (int16, bool) {
+	for t, s := range varBindTypeNames {
+		if s == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
@@ -1,7 +1,10 @@
 package agx_test
 
 import (
+	"bytes"
+	"encoding/binary"
 	"github.com/rcgoodfellow/agx"
+	"io"
 	"reflect"
 	"testing"
 )
@@ -20,6 +23,40 @@ func TestMarshalOpenMessage(t *testing.T) {
 	roundTripTest(t, a, b)
 }
 
+// An omitted id and description are sent as the null oid and the empty octet
+// string, which the payload length counts
+func TestMarshalOpenMessageEmpty(t *testing.T) {
+
+	empty := ""
+	for _, x := range [][2]*string{{nil, nil}, {&empty, &empty}} {
+		a, err := agx.NewOpenMessage(x[0], x[1])
+		if err != nil {
+			t.Fatalf("error creating open message %v ", err)
+		}
+		buf, err := a.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshalling message %v ", err)
+		}
+		payload := buf[agx.HeaderSize:]
+		if int(a.Header.PayloadLength) != len(payload) {
+			t.Errorf("payload length %d, %d bytes encoded",
+				a.Header.PayloadLength, len(payload))
+		}
+		expect := []byte{5, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+		if !bytes.Equal(payload, expect) {
+			t.Errorf("payload % x, expected % x", payload, expect)
+		}
+
+		b := &agx.OpenMessage{}
+		if _, err := b.UnmarshalBinary(buf); err != nil {
+			t.Fatalf("error unmarshalling message %v ", err)
+		}
+		if b.Id.NSubid != 0 || b.Desc.OctetStringLength != 0 {
+			t.Errorf("expected null id and description, got %v", b)
+		}
+	}
+}
+
 // +++ CloseMessage +++
 func TestMarshalCloseMessage(t *testing.T) {
 	a := agx.NewCloseMessage(agx.CloseReasonShutdown, 47)
@@ -27,10 +64,50 @@ func TestMarshalCloseMessage(t *testing.T) {
 	roundTripTest(t, a, b)
 }
 
+// +++ Header +++
+func TestMarshalHeaderHighIds(t *testing.T) {
+	a := agx.NewPingMessage(0xfffffffe)
+	a.Header.TransactionId = 1 << 31
+	a.Header.PacketId = 0xffffffff
+	b := &agx.PingMessage{}
+	roundTripTest(t, a, b)
+
+	expect := "Ping sid=4294967294 tid=2147483648 pid=4294967295"
+	if s := b.Header.String(); s != expect {
+		t.Errorf("got %q, expected %q", s, expect)
+	}
+}
+
+// +++ Response +++
+func TestNewResponse(t *testing.T) {
+	h := agx.Header{Version: 1, Type: agx.GetPDU,
+		Flags: agx.NetworkByteOrder | agx.NonDefaultContext, SessionId: 47,
+		TransactionId: 7, PacketId: 3}
+	name := subtree(t, "1.3.6.1.2.1.1.5.0")
+
+	a := agx.NewResponse(h).Add(
+		agx.IntegerVarBind(name, 47),
+		*agx.OctetStringVarBind(name, []byte("muffin")))
+	if a.Header.Type != agx.ResponsePDU || a.Header.Flags != agx.NetworkByteOrder ||
+		a.Header.SessionId != 47 || a.Header.TransactionId != 7 ||
+		a.Header.PacketId != 3 {
+		t.Errorf("response header %v does not answer %v", a.Header, h)
+	}
+	b := &agx.Response{}
+	roundTripTest(t, a, b)
+
+	a.Refuse(agx.ResponseNoAccess, 2, []agx.Subtree{name, name})
+	if a.Error != agx.ResponseNoAccess || a.Index != 2 ||
+		len(a.VarBindList) != 2 || a.VarBindList[0].Type != agx.NullT {
+		t.Errorf("refused response %v", a)
+	}
+	b = &agx.Response{}
+	roundTripTest(t, a, b)
+}
+
 // +++ RegisterMessage +++
 func TestMarshalRegisterMessage(t *testing.T) {
-	context := "pirates"
-	a, err := agx.NewRegisterMessage("1.2.3.4.7", &context, nil)
+	a, err := agx.NewRegisterMessage("1.2.3.4.7", "pirates", nil)
 	if err != nil {
 		t.Fatalf("error creating register message %v ", err)
 	}
@@ -38,6 +115,58 @@ func TestMarshalRegisterMessage(t *testing.T) {
 	roundTripTest(t, a, b)
 }
 
+// +++ Contexts +++
+func TestMarshalContexts(t *testing.T) {
+	name := subtree(t, "1.3.6.1.2.1.17.7.1.4.3.1.1.1")
+
+	for _, context := range []agx.Context{agx.DefaultContext, "bridge"} {
+		reg, err := agx.NewRegisterMessage("1.2.3.4.7", context, nil)
+		if err != nil {
+			t.Fatalf("error creating register message %v ", err)
+		}
+		messages := []struct {
+			a, b agx.Message
+			h    *agx.Header
+			ctx  **agx.OctetString
+		}{
+			{a: reg, b: &agx.RegisterMessage{}},
+			{a: agx.NewNotifyMessage(47, context, nil), b: &agx.NotifyMessage{}},
+			{a: agx.NewIndexAllocateMessage(47, context, agx.AnyIndex,
+				[]agx.VarBind{agx.IntegerVarBind(name, 0)}),
+				b: &agx.IndexAllocateMessage{}},
+			{a: agx.NewIndexDeallocateMessage(47, context,
+				[]agx.VarBind{agx.IntegerVarBind(name, 3)}),
+				b: &agx.IndexAllocateMessage{}},
+			{a: agx.NewAddAgentCapsMessage(47, context,
+				subtree(t, "1.3.6.1.4.1.47"), "muffin man"),
+				b: &agx.AddAgentCapsMessage{}},
+			{a: agx.NewRemoveAgentCapsMessage(47, context,
+				subtree(t, "1.3.6.1.4.1.47")),
+				b: &agx.RemoveAgentCapsMessage{}},
+		}
+		for _, x := range messages {
+			roundTripTest(t, x.a, x.b)
+
+			//the header and context of every pdu are encoded alike
+			buf, err := x.a.MarshalBinary()
+			if err != nil {
+				t.Fatalf("error marshalling message %v ", err)
+			}
+			flagged := buf[2]&byte(agx.NonDefaultContext) != 0
+			if flagged != (context != agx.DefaultContext) {
+				t.Errorf("%v in context %q flagged %v", x.a, context, flagged)
+			}
+			if flagged && string(buf[agx.HeaderSize+4:agx.HeaderSize+10]) !=
+				string(context) {
+				t.Errorf("%v does not carry context %q", x.a, context)
+			}
+		}
+		if got := agx.ContextOf(reg.Context); got != context {
+			t.Errorf("context of registration %q, expected %q", got, context)
+		}
+	}
+}
+
 // +++ Integer VarBind +++
 func TestMarshalIntegerVarbind(t *testing.T) {
 	a := &agx.VarBind{}
@@ -47,7 +176,7 @@ func TestMarshalIntegerVarbind(t *testing.T) {
 		t.Fatalf("error creating varbind %v", err)
 	}
 	a.Name = *name
-	a.Data = int32(47)
+	a.Data = agx.Integer(47)
 
 	b := &agx.VarBind{}
 	roundTripTest(t, a, b)
@@ -68,6 +197,327 @@ func TestMarshalOctetStringVarbind(t *testing.T) {
 	roundTripTest(t, a, b)
 }
 
+// +++ Truncated input +++
+func TestUnmarshalTruncated(t *testing.T) {
+	id, descr := "1.2.3.4.7", "muffin man"
+	open, err := agx.NewOpenMessage(&id, &descr)
+	if err != nil {
+		t.Fatalf("error creating open message %v ", err)
+	}
+	reg, err := agx.NewRegisterMessage("1.2.3.4.7", "pirates", nil)
+	if err != nil {
+		t.Fatalf("error creating register message %v ", err)
+	}
+	name, err := agx.NewSubtree("1.3.5.1.2.1.17")
+	if err != nil {
+		t.Fatalf("error creating varbind %v", err)
+	}
+	vb := agx.OctetStringVarBind(*name, []byte{0xcc, 0x33})
+
+	tests := []struct {
+		a   agx.Message
+		new func() agx.Message
+	}{
+		{open, func() agx.Message { return &agx.OpenMessage{} }},
+		{reg, func() agx.Message { return &agx.RegisterMessage{} }},
+		{vb, func() agx.Message { return &agx.VarBind{} }},
+	}
+
+	for _, x := range tests {
+		buf, err := x.a.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshalling message %v ", err)
+		}
+		for i := 0; i < len(buf); i++ {
+			_, err := x.new().UnmarshalBinary(buf[:i])
+			if err == nil {
+				t.Errorf("%T: no error unmarshalling %d of %d bytes", x.a, i, len(buf))
+			}
+		}
+	}
+}
+
+// +++ Oversized length fields +++
+func TestUnmarshalOversized(t *testing.T) {
+	//octet string claiming far more data than there is
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint32(buf, 0x7fffffff)
+	s := &agx.OctetString{}
+	if _, err := s.UnmarshalBinary(buf); err == nil {
+		t.Errorf("no error unmarshalling oversized octet string")
+	}
+
+	//subtree exceeding the sub-identifier limit
+	buf = make([]byte, 4+4*255)
+	buf[0] = 255
+	st := &agx.Subtree{}
+	if _, err := st.UnmarshalBinary(buf); err == nil {
+		t.Errorf("no error unmarshalling oversized subtree")
+	}
+}
+
+// +++ SetMessage +++
+func TestUnmarshalSetMessage(t *testing.T) {
+	name, err := agx.NewSubtree("1.3.6.1.2.1.17.7.1.4.3.1.2.47")
+	if err != nil {
+		t.Fatalf("error creating varbind %v", err)
+	}
+	vbs := []agx.VarBind{
+		*agx.OctetStringVarBind(*name, []byte{0xcc, 0x33}),
+		agx.IntegerVarBind(*name, 47),
+	}
+
+	var payload []byte
+	for _, vb := range vbs {
+		buf, err := vb.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshalling varbind %v", err)
+		}
+		payload = append(payload, buf...)
+	}
+	h := agx.Header{
+		Version:       1,
+		Type:          agx.TestSetPDU,
+		Flags:         agx.NetworkByteOrder,
+		PayloadLength: int32(len(payload)),
+	}
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error marshalling header %v", err)
+	}
+	buf = append(buf, payload...)
+
+	m := &agx.SetMessage{}
+	n, err := m.UnmarshalBinary(buf)
+	if err != nil {
+		t.Fatalf("error unmarshalling set message %v", err)
+	}
+	if n != len(buf) {
+		t.Errorf("unmarshalled %d of %d bytes", n, len(buf))
+	}
+	if !reflect.DeepEqual(m.VarBindList, vbs) {
+		t.Errorf("varbinds are not equal %v %v", m.VarBindList, vbs)
+	}
+}
+
+// +++ Search ranges +++
+func TestMarshalSearchRangeList(t *testing.T) {
+	a := &agx.GetMessage{
+		Header: agx.Header{Version: 1, Type: agx.GetPDU,
+			Flags: agx.NetworkByteOrder},
+		SearchRangeList: []agx.Subtree{subtree(t, egress), subtree(t, access)},
+	}
+	buf, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error marshalling get message %v", err)
+	}
+	binary.BigEndian.PutUint32(buf[16:20], uint32(len(buf)-agx.HeaderSize))
+	b := &agx.GetMessage{}
+	if _, err := b.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("error unmarshalling get message %v", err)
+	}
+
+	//the starts are encoded as unbounded ranges, and decoded as both
+	if !reflect.DeepEqual(b.SearchRangeList, a.SearchRangeList) {
+		t.Errorf("search range list %v, expected %v", b.SearchRangeList,
+			a.SearchRangeList)
+	}
+	if len(b.SearchRanges) != 2 || b.SearchRanges[1].Start.String() != access ||
+		b.SearchRanges[1].End.NSubid != 0 {
+		t.Errorf("unexpected search ranges %v", b.SearchRanges)
+	}
+}
+
+// +++ AppendBinary +++
+func TestAppendBinary(t *testing.T) {
+	id, descr := "1.2.3.4.7", "muffin man"
+	a, err := agx.NewOpenMessage(&id, &descr)
+	if err != nil {
+		t.Fatalf("error creating open message %v ", err)
+	}
+	buf, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error marshalling message %v ", err)
+	}
+
+	prefix := []byte{0x47, 0x47}
+	abuf, err := a.AppendBinary(prefix)
+	if err != nil {
+		t.Fatalf("error appending message %v ", err)
+	}
+	if !reflect.DeepEqual(abuf[:len(prefix)], prefix) {
+		t.Errorf("append clobbered destination")
+	}
+	if !reflect.DeepEqual(abuf[len(prefix):], buf) {
+		t.Errorf("append and marshal disagree")
+	}
+}
+
+// +++ ParsePDU +++
+func TestParsePDU(t *testing.T) {
+	name := subtree(t, "1.3.6.1.2.1.17.7.1.4.3.1.2.47")
+	end := subtree(t, "1.3.6.1.2.1.17.7.1.4.3.1.3")
+	context := agx.NewOctetString([]byte("pirates"))
+	vbs := []agx.VarBind{
+		*agx.OctetStringVarBind(name, []byte{0xcc, 0x33}),
+		agx.IntegerVarBind(name, 47),
+	}
+	srs := []agx.SearchRange{{Start: name, End: end}}
+	h := func(t agx.PDUType, flags agx.Flags) agx.Header {
+		return agx.Header{
+			Version: 1, Type: t, Flags: flags | agx.NetworkByteOrder}
+	}
+
+	msgs := []agx.Message{
+		&agx.GetMessage{
+			Header: h(agx.GetPDU, 0), SearchRanges: srs},
+		&agx.GetNextMessage{GetMessage: agx.GetMessage{
+			Header:       h(agx.GetNextPDU, agx.NonDefaultContext),
+			Context:      context,
+			SearchRanges: srs,
+		}},
+		&agx.GetBulkMessage{
+			Header: h(agx.GetBulkPDU, 0), NonRepeaters: 1, MaxRepetitions: 10,
+			SearchRanges: srs},
+		&agx.SetMessage{Header: h(agx.TestSetPDU, 0), VarBindList: vbs},
+		&agx.SetPhaseMessage{Header: h(agx.CommitSetPDU, 0)},
+		&agx.NotifyMessage{Header: h(agx.NotifyPDU, 0), VarBindList: vbs},
+		&agx.IndexAllocateMessage{
+			Header: h(agx.IndexAllocatePDU, 0), VarBindList: vbs},
+		&agx.AddAgentCapsMessage{
+			Header: h(agx.AddAgentCapsPDU, 0), Id: name,
+			Descr: *agx.NewOctetString([]byte("muffin man"))},
+		&agx.RemoveAgentCapsMessage{Header: h(agx.RemoveAgentCapsPDU, 0), Id: name},
+		&agx.Response{
+			Header: h(agx.ResponsePDU, 0),
+			ResponsePayload: agx.ResponsePayload{
+				SysUptime: 47, VarBindList: vbs},
+		},
+	}
+
+	for _, a := range msgs {
+		buf, err := a.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshalling %T %v", a, err)
+		}
+		binary.BigEndian.PutUint32(buf[16:20], uint32(len(buf)-agx.HeaderSize))
+
+		b, err := agx.ParsePDU(buf)
+		if err != nil {
+			t.Fatalf("error parsing %T %v", a, err)
+		}
+		if reflect.TypeOf(a) != reflect.TypeOf(b) {
+			t.Errorf("parsed %T as %T", a, b)
+			continue
+		}
+		bbuf, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshalling parsed %T %v", b, err)
+		}
+		if !reflect.DeepEqual(buf, bbuf) {
+			t.Errorf("%T does not survive a round trip", a)
+		}
+	}
+}
+
+func TestParsePDUErrors(t *testing.T) {
+	m := &agx.SetPhaseMessage{Header: agx.Header{
+		Version: 1, Type: 99, Flags: agx.NetworkByteOrder}}
+	buf, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error marshalling message %v", err)
+	}
+	if _, err := agx.ParsePDU(buf); err == nil {
+		t.Errorf("expected error for unknown pdu type")
+	}
+
+	// a payload the message does not consume is an error
+	buf[1] = byte(agx.CommitSetPDU)
+	buf = append(buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[16:20], 4)
+	if _, err := agx.ParsePDU(buf); err == nil {
+		t.Errorf("expected error for unconsumed payload")
+	}
+}
+
+// +++ ReadMessage +++
+func TestReadMessage(t *testing.T) {
+	var stream bytes.Buffer
+	msgs := []agx.Message{
+		agx.NewCloseMessage(agx.CloseReasonShutdown, 47),
+		agx.NewPingMessage(47),
+	}
+	for _, m := range msgs {
+		buf, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshalling message %v", err)
+		}
+		stream.Write(buf)
+	}
+	whole := stream.Bytes()
+
+	for _, a := range msgs {
+		b, err := agx.ReadMessage(&stream)
+		if err != nil {
+			t.Fatalf("error reading message %v", err)
+		}
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("read %v, expected %v", b, a)
+		}
+	}
+	if _, err := agx.ReadMessage(&stream); err != io.EOF {
+		t.Errorf("expected EOF at end of stream, got %v", err)
+	}
+
+	r := bytes.NewReader(whole[:len(whole)-2])
+	if _, err := agx.ReadMessage(r); err != nil {
+		t.Fatalf("error reading first message %v", err)
+	}
+	if _, err := agx.ReadMessage(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF for partial pdu, got %v", err)
+	}
+
+	big := append([]byte{}, whole...)
+	binary.BigEndian.PutUint32(big[16:20], 1<<30)
+	if _, err := agx.ReadMessage(bytes.NewReader(big)); err == nil {
+		t.Errorf("expected error for oversized payload")
+	}
+}
+
+// +++ WriteMessage +++
+func TestWriteMessage(t *testing.T) {
+	name := subtree(t, "1.3.6.1.2.1.17.7.1.4.3.1.2.47")
+	a := &agx.NotifyMessage{
+		Header:      agx.Header{Version: 1, Type: agx.NotifyPDU, PayloadLength: 4},
+		VarBindList: []agx.VarBind{agx.IntegerVarBind(name, 47)},
+	}
+
+	var stream bytes.Buffer
+	n, err := agx.WriteMessage(&stream, a)
+	if err != nil {
+		t.Fatalf("error writing message %v", err)
+	}
+	if n != stream.Len() {
+		t.Errorf("wrote %d bytes but reported %d", stream.Len(), n)
+	}
+
+	m, err := agx.ReadMessage(&stream)
+	if err != nil {
+		t.Fatalf("error reading message %v", err)
+	}
+	b := m.(*agx.NotifyMessage)
+	if int(b.Header.PayloadLength) != n-agx.HeaderSize {
+		t.Errorf("payload length %d, expected %d",
+			b.Header.PayloadLength, n-agx.HeaderSize)
+	}
+	if b.Header.Flags&agx.NetworkByteOrder == 0 {
+		t.Errorf("network byte order flag not set")
+	}
+	if !reflect.DeepEqual(a.VarBindList, b.VarBindList) {
+		t.Errorf("varbinds are not equal %v %v", a.VarBindList, b.VarBindList)
+	}
+}
+
 //helpers =====================================================================
 
 func roundTripTest(t *testing.T, a, b agx.Message) {
@@ -86,3 +536,39 @@ func roundTripTest(t *testing.T, a, b agx.Message) {
 	}
 
 }
+
+//benchmarks ==================================================================
+
+func BenchmarkUnmarshalOctetString(b *testing.B) {
+	buf, err := agx.NewOctetString(make([]byte, 512)).MarshalBinary()
+	if err != nil {
+		b.Fatalf("error marshalling octet string %v", err)
+	}
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := &agx.OctetString{}
+		if _, err := s.UnmarshalBinary(buf); err != nil {
+			b.Fatalf("error unmarshalling octet string %v", err)
+		}
+	}
+}
+
+func BenchmarkAppendResponse(b *testing.B) {
+	name, err := agx.NewSubtree("1.3.6.1.2.1.17.7.1.4.3.1.2.47")
+	if err != nil {
+		b.Fatalf("error creating varbind %v", err)
+	}
+	r := agx.Response{}
+	for i := 0; i < 16; i++ {
+		r.VarBindList = append(r.VarBindList,
+			*agx.OctetStringVarBind(*name, make([]byte, 64)))
+	}
+	buf := make([]byte, 0, 4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.AppendBinary(buf[:0]); err != nil {
+			b.Fatalf("error appending response %v", err)
+		}
+	}
+}
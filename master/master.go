@@ -0,0 +1,653 @@
+package master
+
+// This file contains an embedded master agent, which serves AgentX sessions
+// and dispatches requests to the subagents registered for them
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is how long the master waits on a subagent by default
+const DefaultTimeout = 5 * time.Second
+
+// Master is a master agent serving the AgentX sessions of subagents, that
+// requests are dispatched through as registered in its Table. Requests are
+// made in the default context.
+type Master struct {
+	//Table holds the registrations of the sessions
+	Table Table
+	//Timeout bounds how long requests wait on a subagent response
+	Timeout time.Duration
+	//Registered, when set, is called with each registration added to Table.
+	//Should it fail the registration is taken back out of Table, and the
+	//register PDU is answered with the MasterError it failed with or else a
+	//processingError.
+	Registered func(r Registration) error
+	//Unregistered, when set, is called with each registration removed from
+	//Table, including those of sessions that go away
+	Unregistered func(r Registration)
+
+	mtx         sync.Mutex
+	changed     *sync.Cond
+	sessions    map[uint32]*session
+	listeners   []net.Listener
+	nextSession uint32
+	nextPacket  uint32
+	closed      bool
+}
+
+type session struct {
+	id   uint32 //zero until the session is opened
+	conn net.Conn
+
+	//PDUs are written from a queue so the master never blocks on a subagent
+	//that is itself busy writing, which matters on synchronous transports
+	//such as net.Pipe
+	out      chan agx.Message
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	mtx     sync.Mutex
+	pending map[uint32]chan *agx.Response //by packet id
+}
+
+// New returns a master agent without sessions
+func New() *Master {
+	m := &Master{
+		Timeout:  DefaultTimeout,
+		sessions: make(map[uint32]*session),
+	}
+	m.changed = sync.NewCond(&m.mtx)
+	return m
+}
+
+// Serve accepts sessions on ln until the master is closed, which returns nil,
+// or ln fails
+func (m *Master) Serve(ln net.Listener) error {
+	m.mtx.Lock()
+	if m.closed {
+		m.mtx.Unlock()
+		ln.Close()
+		return nil
+	}
+	m.listeners = append(m.listeners, ln)
+	m.mtx.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			m.mtx.Lock()
+			closed := m.closed
+			m.mtx.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go m.ServeConn(conn)
+	}
+}
+
+// ServeConn serves the session of the subagent at the other end of conn until
+// it goes away
+func (m *Master) ServeConn(conn net.Conn) {
+	s := &session{
+		conn:    conn,
+		pending: make(map[uint32]chan *agx.Response),
+		out:     make(chan agx.Message, 64),
+		quit:    make(chan struct{}),
+	}
+	go s.write()
+	defer m.drop(s)
+
+	for {
+		msg, err := agx.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+
+		switch x := msg.(type) {
+		case *agx.OpenMessage:
+			if s.id != 0 {
+				s.reply(x.Header, agx.ResponseOpenFailed)
+				continue
+			}
+			if !m.open(s) {
+				s.reply(x.Header, agx.ResponseOpenFailed)
+				return
+			}
+			x.Header.SessionId = s.id
+			s.reply(x.Header, agx.ResponseNoError)
+
+		case *agx.RegisterMessage:
+			if s.id == 0 {
+				s.reply(x.Header, agx.ResponseNotOpen)
+				continue
+			}
+			s.reply(x.Header, m.register(s, x))
+
+		case *agx.PingMessage:
+			s.reply(x.Header, agx.ResponseNoError)
+
+		case *agx.NotifyMessage:
+			s.reply(x.Header, agx.ResponseNoError)
+
+		case *agx.CloseMessage:
+			s.reply(x.Header, agx.ResponseNoError)
+			return
+
+		case *agx.Response:
+			s.deliver(x)
+
+		default:
+			s.reply(headerOf(msg), agx.ResponseProcessingError)
+		}
+	}
+}
+
+// Pipe returns the subagent end of an in-memory connection to the master,
+// for use with agx.NewConnection
+func (m *Master) Pipe() net.Conn {
+	client, server := net.Pipe()
+	go m.ServeConn(server)
+	return client
+}
+
+// Close stops the master, dropping all sessions without sending close PDUs.
+// Use CloseSessions first to close them cleanly.
+func (m *Master) Close() error {
+	m.mtx.Lock()
+	m.closed = true
+	listeners := m.listeners
+	m.listeners = nil
+	var conns []net.Conn
+	for _, s := range m.sessions {
+		conns = append(conns, s.conn)
+	}
+	m.changed.Broadcast()
+	m.mtx.Unlock()
+
+	var err error
+	for _, ln := range listeners {
+		if e := ln.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	return err
+}
+
+// WaitRegistration waits until a subagent has registered oid, or the timeout
+// of the master passes
+func (m *Master) WaitRegistration(oid string) error {
+	timer := time.AfterFunc(m.Timeout, func() {
+		m.mtx.Lock()
+		m.changed.Broadcast()
+		m.mtx.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(m.Timeout)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for {
+		for _, r := range m.Table.Registrations() {
+			if r.Subtree.String() == oid {
+				return nil
+			}
+		}
+		if m.closed {
+			return fmt.Errorf("master closed waiting for registration of %s", oid)
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("timed out waiting for registration of %s", oid)
+		}
+		m.changed.Wait()
+	}
+}
+
+// requests ...................................................................
+
+// Get requests oids from the subagents they are registered to. Variables
+// that are not registered at all are bound to noSuchObject.
+func (m *Master) Get(oids ...agx.Subtree) ([]agx.VarBind, error) {
+	result := make([]agx.VarBind, len(oids))
+	batches := make(map[*session][]int)
+	var order []*session
+
+	for i, oid := range oids {
+		s := m.route(oid)
+		if s == nil {
+			result[i] = agx.NoSuchObjectVarBind(oid)
+			continue
+		}
+		if _, ok := batches[s]; !ok {
+			order = append(order, s)
+		}
+		batches[s] = append(batches[s], i)
+	}
+
+	for _, s := range order {
+		idx := batches[s]
+		g := agx.GetMessage{Header: m.header(s, agx.GetPDU, 0)}
+		for _, i := range idx {
+			g.SearchRanges = append(g.SearchRanges,
+				agx.SearchRange{Start: oids[i]})
+		}
+		vbs, err := m.bind(s, &g, g.Header.PacketId, len(idx))
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range idx {
+			result[i] = vbs[j]
+		}
+	}
+	return result, nil
+}
+
+// GetNext requests the variables following oids from the subagents
+// registered at or after them. Each is asked for the variables of the span
+// it is responsible for, the next span being tried when it has none there.
+// Variables past every registration are bound to endOfMibView.
+func (m *Master) GetNext(oids ...agx.Subtree) ([]agx.VarBind, error) {
+	result := make([]agx.VarBind, len(oids))
+	for i, oid := range oids {
+		vb, err := m.getNext(oid)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = vb
+	}
+	return result, nil
+}
+
+func (m *Master) getNext(oid agx.Subtree) (agx.VarBind, error) {
+	at := oid
+	for {
+		span, ok := m.Table.Next("", at)
+		if !ok {
+			return agx.EndOfMibViewVarBind(oid), nil
+		}
+		m.mtx.Lock()
+		s := m.sessions[span.Session]
+		m.mtx.Unlock()
+
+		r := agx.SearchRange{Start: span.Start}
+		if !span.Start.Eq(oid) {
+			//the search starts at the span, which is included in it
+			r.Start.Zero = 1
+		}
+		if span.End != nil {
+			r.End = *span.End
+		}
+		if s != nil {
+			g := agx.GetNextMessage{GetMessage: agx.GetMessage{
+				Header:       m.header(s, agx.GetNextPDU, 0),
+				SearchRanges: []agx.SearchRange{r},
+			}}
+			vbs, err := m.bind(s, &g, g.Header.PacketId, 1)
+			if err != nil {
+				return agx.VarBind{}, err
+			}
+			vb := vbs[0]
+			if vb.Type != agx.EndOfMibViewT &&
+				(span.End == nil || vb.Name.LessThan(*span.End)) {
+				return vb, nil
+			}
+		}
+		if span.End == nil {
+			return agx.EndOfMibViewVarBind(oid), nil
+		}
+		at = *span.End
+		at.Zero = 0
+	}
+}
+
+// GetBulk answers a getbulk request (RFC3416~4.2.3) with repeated getnexts,
+// stopping early once every walk has reached the end of the mib view
+func (m *Master) GetBulk(nonRepeaters, maxRepetitions int, oids []agx.Subtree) (
+	[]agx.VarBind, error) {
+
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
+	}
+	if nonRepeaters > len(oids) {
+		nonRepeaters = len(oids)
+	}
+
+	vbs, err := m.GetNext(oids[:nonRepeaters]...)
+	if err != nil {
+		return nil, err
+	}
+	cursor := append([]agx.Subtree(nil), oids[nonRepeaters:]...)
+	for r := 0; r < maxRepetitions && len(cursor) > 0; r++ {
+		next, err := m.GetNext(cursor...)
+		if err != nil {
+			return nil, err
+		}
+		done := true
+		for i, vb := range next {
+			vbs = append(vbs, vb)
+			cursor[i] = vb.Name
+			if vb.Type != agx.EndOfMibViewT {
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	return vbs, nil
+}
+
+// Set runs a set transaction for vbs against the subagents they are
+// registered to, returning the error status and 1 based index of the first
+// variable to fail. A test failure results in the transaction being cleaned
+// up, a commit failure in it being undone and then cleaned up.
+func (m *Master) Set(vbs ...agx.VarBind) (int16, int16, error) {
+	batches := make(map[*session][]int)
+	var order []*session
+	for i, vb := range vbs {
+		s := m.route(vb.Name)
+		if s == nil {
+			return int16(agx.TestSetNotWritable), int16(i + 1), nil
+		}
+		if _, ok := batches[s]; !ok {
+			order = append(order, s)
+		}
+		batches[s] = append(batches[s], i)
+	}
+
+	m.mtx.Lock()
+	m.nextPacket++
+	tid := m.nextPacket
+	m.mtx.Unlock()
+
+	//phase sends a set phase PDU to every session in the transaction and
+	//returns the first error, its index translated to the index in vbs
+	phase := func(t agx.PDUType) (int16, int16, error) {
+		var status, index int16
+		for _, s := range order {
+			h := m.header(s, t, tid)
+			var req agx.Message = &agx.SetPhaseMessage{Header: h}
+			if t == agx.TestSetPDU {
+				set := &agx.SetMessage{Header: h}
+				for _, i := range batches[s] {
+					set.VarBindList = append(set.VarBindList, vbs[i])
+				}
+				req = set
+			}
+			if t == agx.CleanupSetPDU {
+				//cleanup is not answered (RFC2741~7.2.4.4)
+				if err := s.send(req); err != nil {
+					return 0, 0, err
+				}
+				continue
+			}
+			r, err := m.request(s, h.PacketId, req)
+			if err != nil {
+				return 0, 0, err
+			}
+			if r.Error != agx.ResponseNoError && status == agx.ResponseNoError {
+				status = r.Error
+				if i := int(r.Index) - 1; i >= 0 && i < len(batches[s]) {
+					index = int16(batches[s][i] + 1)
+				}
+			}
+		}
+		return status, index, nil
+	}
+
+	status, index, err := phase(agx.TestSetPDU)
+	if err != nil {
+		return 0, 0, err
+	}
+	if status == agx.ResponseNoError {
+		status, index, err = phase(agx.CommitSetPDU)
+		if err != nil {
+			return 0, 0, err
+		}
+		if status != agx.ResponseNoError {
+			if _, _, err := phase(agx.UndoSetPDU); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	if _, _, err := phase(agx.CleanupSetPDU); err != nil {
+		return 0, 0, err
+	}
+	return status, index, nil
+}
+
+// CloseSessions closes every open session from the master side for reason,
+// waiting for the subagents to acknowledge
+func (m *Master) CloseSessions(reason agx.CloseReason) error {
+	m.mtx.Lock()
+	var sessions []*session
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mtx.Unlock()
+
+	for _, s := range sessions {
+		c := agx.NewCloseMessage(reason, s.id)
+		c.Header = m.header(s, agx.ClosePDU, 0)
+		_, err := m.request(s, c.Header.PacketId, c)
+		if err != nil {
+			return err
+		}
+		m.drop(s)
+	}
+	return nil
+}
+
+// helpers ====================================================================
+
+// open assigns s a session id, unless the master is closed
+func (m *Master) open(s *session) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.closed {
+		return false
+	}
+	m.nextSession++
+	s.id = m.nextSession
+	m.sessions[s.id] = s
+	m.changed.Broadcast()
+	return true
+}
+
+// drop forgets a session, reclaiming its registrations
+func (m *Master) drop(s *session) {
+	m.mtx.Lock()
+	var removed []Registration
+	if s.id != 0 && m.sessions[s.id] == s {
+		delete(m.sessions, s.id)
+		removed = m.Table.RemoveSession(s.id)
+	}
+	m.changed.Broadcast()
+	s.quitOnce.Do(func() { close(s.quit) })
+	m.mtx.Unlock()
+
+	if m.Unregistered != nil {
+		for _, r := range removed {
+			m.Unregistered(r)
+		}
+	}
+}
+
+func (m *Master) register(s *session, x *agx.RegisterMessage) int16 {
+	r := NewRegistration(x)
+	r.Session = s.id
+
+	var code int16
+	if x.Header.Type == agx.UnregisterPDU {
+		code = m.Table.Unregister(r)
+		if code == agx.ResponseNoError && m.Unregistered != nil {
+			m.Unregistered(r)
+		}
+	} else {
+		code = m.Table.Register(r)
+		if code == agx.ResponseNoError && m.Registered != nil {
+			if err := m.Registered(r); err != nil {
+				m.Table.Unregister(r)
+				code = agx.ResponseProcessingError
+				if e, ok := err.(agx.MasterError); ok {
+					code = int16(e)
+				}
+			}
+		}
+	}
+
+	m.mtx.Lock()
+	m.changed.Broadcast()
+	m.mtx.Unlock()
+
+	return code
+}
+
+// route finds the session oid is dispatched to (RFC2741~7.1.5.1)
+func (m *Master) route(oid agx.Subtree) *session {
+	r, ok := m.Table.Lookup("", oid)
+	if !ok {
+		return nil
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.sessions[r.Session]
+}
+
+// header returns a header for a new request to s, a zero tid allocates a new
+// transaction
+func (m *Master) header(s *session, t agx.PDUType, tid uint32) agx.Header {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	m.nextPacket++
+	if tid == 0 {
+		tid = m.nextPacket
+	}
+	return agx.Header{
+		Version:       1,
+		Type:          t,
+		Flags:         agx.NetworkByteOrder,
+		SessionId:     s.id,
+		TransactionId: tid,
+		PacketId:      m.nextPacket,
+	}
+}
+
+// bind sends the get request req to s, returning the n variables it binds
+func (m *Master) bind(s *session, req agx.Message, packet uint32, n int) (
+	[]agx.VarBind, error) {
+
+	r, err := m.request(s, packet, req)
+	if err != nil {
+		return nil, err
+	}
+	if r.Error != agx.ResponseNoError {
+		return nil, fmt.Errorf("subagent returned error %d at index %d",
+			r.Error, r.Index)
+	}
+	if len(r.VarBindList) != n {
+		return nil, fmt.Errorf("asked for %d variables, subagent returned %d",
+			n, len(r.VarBindList))
+	}
+	return r.VarBindList, nil
+}
+
+// request sends req to the subagent and waits for the response to packet
+func (m *Master) request(s *session, packet uint32, req agx.Message) (
+	*agx.Response, error) {
+
+	ch := make(chan *agx.Response, 1)
+	s.mtx.Lock()
+	s.pending[packet] = ch
+	s.mtx.Unlock()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.pending, packet)
+		s.mtx.Unlock()
+	}()
+
+	if err := s.send(req); err != nil {
+		return nil, err
+	}
+
+	t := time.NewTimer(m.Timeout)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		return r, nil
+	case <-t.C:
+		return nil, fmt.Errorf("timed out waiting for response to %v", req)
+	}
+}
+
+func (s *session) send(m agx.Message) error {
+	select {
+	case s.out <- m:
+		return nil
+	case <-s.quit:
+		return fmt.Errorf("session %d is closed", s.id)
+	}
+}
+
+// write sends queued PDUs until the session is dropped, then flushes what
+// remains and closes the connection
+func (s *session) write() {
+	defer s.conn.Close()
+	for {
+		select {
+		case m := <-s.out:
+			if _, err := agx.WriteMessage(s.conn, m); err != nil {
+				return
+			}
+		case <-s.quit:
+			for {
+				select {
+				case m := <-s.out:
+					if _, err := agx.WriteMessage(s.conn, m); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *session) deliver(r *agx.Response) {
+	s.mtx.Lock()
+	ch, ok := s.pending[r.Header.PacketId]
+	s.mtx.Unlock()
+	if ok {
+		ch <- r
+	}
+}
+
+// reply answers the request with header h with an empty response
+func (s *session) reply(h agx.Header, code int16) {
+	s.send(agx.NewResponse(h).SetError(code, 0))
+}
+
+// headerOf digs the header out of a decoded message
+func headerOf(m agx.Message) agx.Header {
+	var h agx.Header
+	buf, err := m.MarshalBinary()
+	if err == nil {
+		h.UnmarshalBinary(buf)
+	}
+	return h
+}
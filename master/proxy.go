@@ -0,0 +1,214 @@
+package master
+
+// This file contains the multiplexing proxy, which presents the sessions of
+// several local subagents to a master agent as a single session
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"context"
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"log"
+	"sync"
+)
+
+// Proxy is a master agent for local subagents that forwards their
+// registrations to an upstream master over a single session, and answers
+// the requests of the upstream master from them. Registrations of the same
+// region made by several subagents are forwarded once. Only the default
+// context is proxied, registrations in other contexts are denied.
+//
+// The proxy installs handlers on the upstream connection for the regions it
+// forwards, along with its commit-set and cleanup-set handlers, so the
+// connection should be dedicated to the proxy. Variables are tested against
+// the local registrations in the test phase of a set, the set transaction of
+// the subagents is run in the commit phase.
+type Proxy struct {
+	*Master
+
+	upstream *agx.Connection
+
+	mtx      sync.Mutex
+	forwards map[string]int //registrations forwarded, by use count
+	regions  map[string]int //regions handled, by use count
+	pending  map[uint32][]agx.VarBind
+}
+
+// NewProxy returns a proxy forwarding to the master agent of upstream. Local
+// subagents are served with the Serve, ServeConn and Pipe of the proxy.
+func NewProxy(upstream *agx.Connection) *Proxy {
+	p := &Proxy{
+		Master:   New(),
+		upstream: upstream,
+		forwards: make(map[string]int),
+		regions:  make(map[string]int),
+		pending:  make(map[uint32][]agx.VarBind),
+	}
+	p.Table.Allow = func(r Registration) bool { return r.Context == "" }
+	p.Registered = p.forward
+	p.Unregistered = p.withdraw
+	upstream.OnCommitSet(p.commit)
+	upstream.OnCleanupSet(p.cleanup)
+	return p
+}
+
+// forward registers r upstream, unless a subagent already has, waiting on the
+// answer of the upstream master for as long as a request may take. Should the
+// upstream master refuse the registration it is taken back, and the subagent
+// is answered with the error of the upstream master.
+func (p *Proxy) forward(r Registration) error {
+	key := upstreamKey(r)
+	regions, _ := r.regions()
+
+	p.mtx.Lock()
+	p.forwards[key]++
+	first := p.forwards[key] == 1
+	for _, x := range regions {
+		oid := x.String()
+		p.regions[oid]++
+		if p.regions[oid] == 1 {
+			p.upstream.OnGetSubtree(oid, p.get(x))
+			p.upstream.OnTestSet(oid, p.testSet)
+		}
+	}
+	p.mtx.Unlock()
+
+	if !first {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	err := p.upstream.RegisterContext(ctx, upstreamRegistration(r))
+	if err != nil {
+		log.Printf("[proxy] error registering %s upstream: %v", r.Subtree, err)
+		p.release(key, regions)
+		return err
+	}
+	return nil
+}
+
+// withdraw unregisters r upstream once no subagent holds it
+func (p *Proxy) withdraw(r Registration) {
+	key := upstreamKey(r)
+	regions, _ := r.regions()
+
+	if p.release(key, regions) {
+		err := p.upstream.UnregisterWith(upstreamRegistration(r))
+		if err != nil {
+			log.Printf("[proxy] error unregistering %s upstream: %v",
+				r.Subtree, err)
+		}
+	}
+}
+
+// release drops a use of the upstream registration key and of the regions it
+// is made up of, removing the handlers of regions no longer used. Whether it
+// was the last use of the registration is returned.
+func (p *Proxy) release(key string, regions []agx.Subtree) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.forwards[key]--
+	last := p.forwards[key] == 0
+	if last {
+		delete(p.forwards, key)
+	}
+	for _, x := range regions {
+		oid := x.String()
+		p.regions[oid]--
+		if p.regions[oid] == 0 {
+			delete(p.regions, oid)
+			p.upstream.RemoveGetSubtree(oid)
+			p.upstream.RemoveTestSet(oid)
+		}
+	}
+	return last
+}
+
+// get returns the handler answering the upstream master for region from the
+// subagents. A getnext is bounded by the region, as the variables after it
+// are answered by the handlers of the regions they are in.
+func (p *Proxy) get(region agx.Subtree) agx.GetSubtreeHandler {
+	return func(oid agx.Subtree, next bool) agx.VarBind {
+		if !next {
+			vbs, err := p.Master.Get(oid)
+			if err != nil {
+				//there is no way to fail a single variable of a get
+				return agx.NoSuchObjectVarBind(oid)
+			}
+			return vbs[0]
+		}
+
+		//a walk into the region starts with the region itself
+		if oid.LessThan(region) {
+			vbs, err := p.Master.Get(region)
+			if err == nil && isValue(vbs[0]) {
+				return vbs[0]
+			}
+			oid = region
+		}
+		vbs, err := p.Master.GetNext(oid)
+		if err != nil || !vbs[0].Name.HasPrefix(region) {
+			return agx.EndOfMibViewVarBind(oid)
+		}
+		return vbs[0]
+	}
+}
+
+func (p *Proxy) testSet(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+	if _, ok := p.Table.Lookup("", vb.Name); !ok {
+		return agx.TestSetNotWritable
+	}
+	p.mtx.Lock()
+	p.pending[sessionId] = append(p.pending[sessionId], vb)
+	p.mtx.Unlock()
+	return agx.TestSetNoError
+}
+
+func (p *Proxy) commit(sessionId uint32) agx.CommitSetResult {
+	p.mtx.Lock()
+	vbs := p.pending[sessionId]
+	p.mtx.Unlock()
+
+	status, _, err := p.Master.Set(vbs...)
+	if err != nil || status != agx.ResponseNoError {
+		return agx.CommitSetCommitFailed
+	}
+	return agx.CommitSetNoError
+}
+
+func (p *Proxy) cleanup(sessionId uint32) {
+	p.mtx.Lock()
+	delete(p.pending, sessionId)
+	p.mtx.Unlock()
+}
+
+// helpers ====================================================================
+
+// upstreamKey identifies the upstream registration r is forwarded as
+func upstreamKey(r Registration) string {
+	return fmt.Sprintf("%s %d %d %d", r.Subtree, r.Priority, r.RangeSubid,
+		r.UpperBound)
+}
+
+func upstreamRegistration(r Registration) agx.Registration {
+	return agx.Registration{
+		Subtree:    r.Subtree.String(),
+		Context:    r.Context,
+		Priority:   r.Priority,
+		Timeout:    r.Timeout,
+		RangeSubid: r.RangeSubid,
+		UpperBound: r.UpperBound,
+	}
+}
+
+// isValue reports whether vb binds a variable rather than an exception
+func isValue(vb agx.VarBind) bool {
+	switch vb.Type {
+	case agx.NoSuchObjectT, agx.NoSuchInstanceT, agx.EndOfMibViewT:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package master_test
+
+import (
+	"context"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/agxtest"
+	"github.com/rcgoodfellow/agx/master"
+	"testing"
+	"time"
+)
+
+func TestProxy(t *testing.T) {
+	upstream, err := agxtest.NewMockMaster()
+	if err != nil {
+		t.Fatalf("mock master failed %v", err)
+	}
+	defer upstream.Close()
+
+	conn, err := agx.NewConnection(upstream.Pipe(), nil, nil)
+	if err != nil {
+		t.Fatalf("upstream connection failed %v", err)
+	}
+	defer conn.Disconnect()
+	p := master.NewProxy(conn)
+	defer p.Close()
+
+	sysName, ifs := "1.3.6.1.2.1.1.5", "1.3.6.1.2.1.2.2.1.1"
+	var set []agx.VarBind
+	subagent := func(oid string, value int32) *agx.Connection {
+		c, err := agx.NewConnection(p.Pipe(), nil, nil)
+		if err != nil {
+			t.Fatalf("local connection failed %v", err)
+		}
+		c.OnGet(oid+".1", func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, value)
+		})
+		c.OnTestSet(oid, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+			set = append(set, vb)
+			return agx.TestSetNoError
+		})
+		c.Register(oid)
+		if err := upstream.WaitRegistration(oid); err != nil {
+			t.Fatalf("upstream did not see registration %v", err)
+		}
+		return c
+	}
+	a := subagent(sysName, 47)
+	defer a.Disconnect()
+	b := subagent(ifs, 74)
+
+	//both subagents are served over the one upstream session
+	rs := upstream.Table.Registrations()
+	if len(rs) != 2 || rs[0].Session != rs[1].Session {
+		t.Errorf("upstream registrations %v", rs)
+	}
+
+	vbs, err := upstream.Get(sysName+".1", ifs+".1")
+	if err != nil {
+		t.Fatalf("get failed %v", err)
+	}
+	if vbs[0].Data != agx.Integer(47) || vbs[1].Data != agx.Integer(74) {
+		t.Errorf("get returned %v", vbs)
+	}
+	vbs, err = upstream.GetNext("1.3.6.1.2.1", sysName+".1")
+	if err != nil {
+		t.Fatalf("getnext failed %v", err)
+	}
+	if vbs[0].Data != agx.Integer(47) || vbs[1].Data != agx.Integer(74) {
+		t.Errorf("getnext returned %v", vbs)
+	}
+
+	vb := agx.IntegerVarBind(subtree(t, ifs+".1"), 7)
+	status, _, err := upstream.Set(vb)
+	if err != nil || status != agx.ResponseNoError || len(set) != 1 {
+		t.Errorf("set returned %d %v, subagents saw %v", status, err, set)
+	}
+
+	//a subagent going away withdraws its registrations upstream
+	b.Disconnect()
+	<-b.Done()
+	deadline := time.Now().Add(time.Second)
+	for len(upstream.Registrations()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r := upstream.Registrations(); len(r) != 1 || r[0] != sysName {
+		t.Errorf("upstream registrations after disconnect %v", r)
+	}
+}
+
+func TestProxyRefused(t *testing.T) {
+	upstream, err := agxtest.NewMockMaster()
+	if err != nil {
+		t.Fatalf("mock master failed %v", err)
+	}
+	defer upstream.Close()
+
+	conn, err := agx.NewConnection(upstream.Pipe(), nil, nil)
+	if err != nil {
+		t.Fatalf("upstream connection failed %v", err)
+	}
+	defer conn.Disconnect()
+	p := master.NewProxy(conn)
+	defer p.Close()
+
+	sysName := "1.3.6.1.2.1.1.5"
+	c, err := agx.NewConnection(p.Pipe(), nil, nil)
+	if err != nil {
+		t.Fatalf("local connection failed %v", err)
+	}
+	defer c.Disconnect()
+	c.OnGet(sysName+".1", func(oid agx.Subtree) agx.VarBind {
+		return agx.IntegerVarBind(oid, 47)
+	})
+
+	//a registration the upstream master refuses is refused locally too, and
+	//leaves nothing behind
+	allow := false
+	upstream.Table.Allow = func(r master.Registration) bool { return allow }
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r := agx.Registration{Subtree: sysName, Priority: agx.BasePriority,
+		Timeout: agx.ConnectionTimeout}
+	if err := c.RegisterContext(ctx, r); err != agx.ErrRequestDenied {
+		t.Fatalf("refused registration returned %v", err)
+	}
+	if rs := p.Table.Registrations(); len(rs) != 0 {
+		t.Errorf("local registrations after refusal %v", rs)
+	}
+	for _, h := range conn.Handlers() {
+		if h.Oid != "" {
+			t.Errorf("upstream handler after refusal %v", h)
+		}
+	}
+
+	//registering again once upstream allows it is forwarded anew
+	allow = true
+	if err := c.RegisterContext(ctx, r); err != nil {
+		t.Fatalf("registration failed %v", err)
+	}
+	vbs, err := upstream.Get(sysName + ".1")
+	if err != nil || vbs[0].Data != agx.Integer(47) {
+		t.Errorf("get returned %v %v", vbs, err)
+	}
+}
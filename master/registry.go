@@ -0,0 +1,315 @@
+// Package master implements the parts of an AgentX master agent (RFC2741),
+// such as the table of registrations that decides which session a variable
+// is dispatched to.
+package master
+
+// This file contains the registration table, which arbitrates overlapping
+// registrations by specificity and priority (RFC2741~7.1.4.1, 7.1.5.1)
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"sort"
+	"sync"
+)
+
+// Registration is a region of the mib registered by a session. When
+// RangeSubid is non-zero the sub-identifier at that position of Subtree ranges
+// up to UpperBound, registering a region for each value.
+type Registration struct {
+	Session    uint32
+	Context    agx.Context
+	Subtree    agx.Subtree
+	Priority   byte
+	Timeout    byte
+	RangeSubid byte
+	UpperBound uint32
+}
+
+// NewRegistration returns the registration m asks for
+func NewRegistration(m *agx.RegisterMessage) Registration {
+	r := Registration{
+		Session:    m.Header.SessionId,
+		Subtree:    m.Subtree,
+		Priority:   m.Priority,
+		Timeout:    m.Timeout,
+		RangeSubid: m.RangeSubid,
+		Context:    agx.ContextOf(m.Context),
+	}
+	if m.UpperBound != nil {
+		r.UpperBound = uint32(*m.UpperBound)
+	}
+	return r
+}
+
+// same reports whether r and x are the same registration of the same session
+func (r Registration) same(x Registration) bool {
+	return r.Session == x.Session && r.Context == x.Context &&
+		r.Subtree.Eq(x.Subtree) && r.Priority == x.Priority &&
+		r.RangeSubid == x.RangeSubid && r.UpperBound == x.UpperBound
+}
+
+// maxRange is the largest number of regions a range registration may span
+const maxRange = 1 << 16
+
+// regions returns the subtrees r registers, one for each value of a range, or
+// false if the range is not valid for the subtree
+func (r Registration) regions() ([]agx.Subtree, bool) {
+	if r.RangeSubid == 0 {
+		return []agx.Subtree{r.Subtree}, true
+	}
+	ids := r.Subtree.Identifiers()
+	i := int(r.RangeSubid) - 1
+	if i >= len(ids) || r.UpperBound < ids[i] ||
+		r.UpperBound-ids[i] >= maxRange {
+		return nil, false
+	}
+
+	var regions []agx.Subtree
+	for x := uint64(ids[i]); x <= uint64(r.UpperBound); x++ {
+		ids[i] = uint32(x)
+		s, err := agx.NewSubtreeFromIdentifiers(ids)
+		if err != nil {
+			return nil, false
+		}
+		regions = append(regions, *s)
+	}
+	return regions, true
+}
+
+// entry is a registration in the table, seq orders registrations by when
+// they were made
+type entry struct {
+	Registration
+	regions []agx.Subtree
+	seq     uint64
+}
+
+// Table holds the registrations of the sessions of a master agent. The zero
+// value is ready to use.
+type Table struct {
+	//Allow, when set, decides whether a registration may be made, those it
+	//refuses are answered with requestDenied
+	Allow func(r Registration) bool
+
+	mtx     sync.Mutex
+	entries []*entry
+	seq     uint64
+}
+
+// Register adds r to the table, returning the response error the register
+// PDU is answered with. Registrations may overlap, but registering a region
+// already registered in the same context at the same priority is a
+// duplicate.
+func (t *Table) Register(r Registration) int16 {
+	regions, ok := r.regions()
+	if !ok {
+		return agx.ResponseParseError
+	}
+	if t.Allow != nil && !t.Allow(r) {
+		return agx.ResponseRequestDenied
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for _, e := range t.entries {
+		if e.Context != r.Context || e.Priority != r.Priority {
+			continue
+		}
+		for _, x := range e.regions {
+			for _, y := range regions {
+				if x.Eq(y) {
+					return agx.ResponseDuplicateRegistration
+				}
+			}
+		}
+	}
+
+	t.seq++
+	t.entries = append(t.entries, &entry{r, regions, t.seq})
+	return agx.ResponseNoError
+}
+
+// Unregister removes the registration r made earlier, returning the response
+// error the unregister PDU is answered with
+func (t *Table) Unregister(r Registration) int16 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for i, e := range t.entries {
+		if e.same(r) {
+			t.entries = append(t.entries[:i], t.entries[i+1:]...)
+			return agx.ResponseNoError
+		}
+	}
+	return agx.ResponseUnknownRegistration
+}
+
+// RemoveSession removes the registrations of session, reclaiming the regions
+// they held for the registrations they overlapped, and returns them
+func (t *Table) RemoveSession(session uint32) []Registration {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	var keep []*entry
+	var removed []Registration
+	for _, e := range t.entries {
+		if e.Session == session {
+			removed = append(removed, e.Registration)
+		} else {
+			keep = append(keep, e)
+		}
+	}
+	t.entries = keep
+	return removed
+}
+
+// Registrations returns the registrations in the table in the order they
+// were made
+func (t *Table) Registrations() []Registration {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	var rs []Registration
+	for _, e := range t.entries {
+		rs = append(rs, e.Registration)
+	}
+	return rs
+}
+
+// Lookup returns the registration oid is dispatched to in context: of the
+// regions containing oid the most specific, of those the one with the lowest
+// priority value, and of those the earliest.
+func (t *Table) Lookup(context agx.Context, oid agx.Subtree) (
+	Registration, bool) {
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	e, _ := t.lookup(context, oid)
+	if e == nil {
+		return Registration{}, false
+	}
+	return e.Registration, true
+}
+
+// lookup finds the entry oid is dispatched to and the region it is in, t must
+// be locked
+func (t *Table) lookup(context agx.Context, oid agx.Subtree) (
+	*entry, agx.Subtree) {
+
+	var best *entry
+	var region agx.Subtree
+	for _, e := range t.entries {
+		if e.Context != context {
+			continue
+		}
+		for _, x := range e.regions {
+			if !oid.HasPrefix(x) {
+				continue
+			}
+			if best == nil || better(x, e, region, best) {
+				best, region = e, x
+			}
+		}
+	}
+	return best, region
+}
+
+// better reports whether region x of a takes precedence over region y of b,
+// both containing the same oid
+func better(x agx.Subtree, a *entry, y agx.Subtree, b *entry) bool {
+	nx, ny := len(x.Identifiers()), len(y.Identifiers())
+	if nx != ny {
+		return nx > ny
+	}
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	return a.seq < b.seq
+}
+
+// Span is a stretch of the oid space dispatched to one registration, from
+// Start up to but not including End. End is nil where the span runs to the
+// end of the oid space.
+type Span struct {
+	Registration
+	Start agx.Subtree
+	End   *agx.Subtree
+}
+
+// Next returns the span of context that oid lies in or, if no registration is
+// responsible for oid, the first span after it. This is where a getnext for
+// oid is dispatched, with the search range bounded by the end of the span.
+func (t *Table) Next(context agx.Context, oid agx.Subtree) (Span, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	//dispatch can only change where a region starts or ends
+	var bounds []agx.Subtree
+	for _, e := range t.entries {
+		if e.Context != context {
+			continue
+		}
+		for _, x := range e.regions {
+			bounds = append(bounds, x)
+			if end, ok := successor(x); ok {
+				bounds = append(bounds, end)
+			}
+		}
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i].LessThan(bounds[j]) })
+
+	//the stretch between consecutive bounds has a single owner
+	start := oid
+	for i := 0; i <= len(bounds); i++ {
+		if i < len(bounds) && bounds[i].LessThanEq(oid) {
+			continue
+		}
+		owner, _ := t.lookup(context, start)
+		if owner == nil {
+			if i == len(bounds) {
+				return Span{}, false
+			}
+			start = bounds[i]
+			continue
+		}
+
+		//the span runs on through stretches with the same owner
+		span := Span{Registration: owner.Registration, Start: start}
+		for ; i < len(bounds); i++ {
+			if bounds[i].Eq(start) {
+				continue
+			}
+			if e, _ := t.lookup(context, bounds[i]); e != owner {
+				end := bounds[i]
+				span.End = &end
+				break
+			}
+		}
+		return span, true
+	}
+	return Span{}, false
+}
+
+// successor returns the first oid after every oid in the subtree s, or false
+// if there is none
+func successor(s agx.Subtree) (agx.Subtree, bool) {
+	ids := s.Identifiers()
+	for len(ids) > 0 {
+		last := len(ids) - 1
+		if ids[last] != ^uint32(0) {
+			ids[last]++
+			x, err := agx.NewSubtreeFromIdentifiers(ids)
+			if err != nil {
+				return agx.Subtree{}, false
+			}
+			return *x, true
+		}
+		ids = ids[:last]
+	}
+	return agx.Subtree{}, false
+}
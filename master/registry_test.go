@@ -0,0 +1,121 @@
+package master_test
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/master"
+	"testing"
+)
+
+func subtree(t *testing.T, oid string) agx.Subtree {
+	t.Helper()
+	s, err := agx.NewSubtree(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *s
+}
+
+func TestTableArbitration(t *testing.T) {
+	var tab master.Table
+	tab.Allow = func(r master.Registration) bool {
+		return !r.Subtree.HasPrefix(subtree(t, "1.3.6.1.6.3"))
+	}
+	reg := func(session uint32, oid string, priority byte) master.Registration {
+		return master.Registration{
+			Session:  session,
+			Subtree:  subtree(t, oid),
+			Priority: priority,
+		}
+	}
+
+	expect := []struct {
+		r    master.Registration
+		code int16
+	}{
+		{reg(1, "1.3.6.1.2.1.2", 127), agx.ResponseNoError},
+		//overlapping registrations are fine, duplicates are not
+		{reg(2, "1.3.6.1.2.1.2.2", 127), agx.ResponseNoError},
+		{reg(3, "1.3.6.1.2.1.2", 127), agx.ResponseDuplicateRegistration},
+		{reg(3, "1.3.6.1.2.1.2", 100), agx.ResponseNoError},
+		{reg(4, "1.3.6.1.6.3.1", 127), agx.ResponseRequestDenied},
+		//the table of session 2 is taken over row by row for ifIndex 1..3
+		{master.Registration{Session: 4, Subtree: subtree(t, "1.3.6.1.2.1.2.2.1.1.1"),
+			Priority: 127, RangeSubid: 11, UpperBound: 3}, agx.ResponseNoError},
+		{master.Registration{Session: 4, Subtree: subtree(t, "1.3.6.1.2.1.2.2.1.1.4"),
+			Priority: 127, RangeSubid: 11, UpperBound: 3}, agx.ResponseParseError},
+	}
+	for i, x := range expect {
+		if code := tab.Register(x.r); code != x.code {
+			t.Errorf("registration %d answered %d, expected %d", i, code, x.code)
+		}
+	}
+
+	lookups := []struct {
+		oid     string
+		session uint32
+	}{
+		//the lowest priority value wins between equal subtrees
+		{"1.3.6.1.2.1.2.1.0", 3},
+		//the most specific subtree wins whatever its priority
+		{"1.3.6.1.2.1.2.2.1.2.1", 2},
+		{"1.3.6.1.2.1.2.2.1.1.2", 4},
+		{"1.3.6.1.2.1.2.2.1.1.4", 2},
+		{"1.3.6.1.2.1.1.1.0", 0},
+	}
+	for _, x := range lookups {
+		r, ok := tab.Lookup("", subtree(t, x.oid))
+		if x.session == 0 {
+			if ok {
+				t.Errorf("%s dispatched to session %d", x.oid, r.Session)
+			}
+			continue
+		}
+		if !ok || r.Session != x.session {
+			t.Errorf("%s dispatched to session %d, expected %d", x.oid, r.Session,
+				x.session)
+		}
+	}
+	if _, ok := tab.Lookup("vlan", subtree(t, "1.3.6.1.2.1.2.1.0")); ok {
+		t.Errorf("registration found in another context")
+	}
+
+	//getnext spans end where another registration takes over
+	span, ok := tab.Next("", subtree(t, "1.3.6.1.2.1.1"))
+	if !ok || span.Session != 3 || span.Start.String() != "1.3.6.1.2.1.2" ||
+		span.End == nil || span.End.String() != "1.3.6.1.2.1.2.2" {
+		t.Errorf("next of system is %+v %v", span, ok)
+	}
+	span, ok = tab.Next("", subtree(t, "1.3.6.1.2.1.2.2.1.1.1"))
+	if !ok || span.Session != 4 || span.End == nil ||
+		span.End.String() != "1.3.6.1.2.1.2.2.1.1.4" {
+		t.Errorf("next of ifIndex.1 is %+v %v", span, ok)
+	}
+	span, ok = tab.Next("", subtree(t, "1.3.6.1.2.1.2.5"))
+	if !ok || span.Session != 3 || span.End == nil || span.End.String() != "1.3.6.1.2.1.3" {
+		t.Errorf("next of interfaces.5 is %+v %v", span, ok)
+	}
+	if span, ok := tab.Next("", subtree(t, "1.3.6.1.2.1.3")); ok {
+		t.Errorf("next past the registrations is %+v", span)
+	}
+
+	//unregistering must match the registration, closing reclaims regions
+	if code := tab.Unregister(reg(3, "1.3.6.1.2.1.2", 127)); code !=
+		agx.ResponseUnknownRegistration {
+		t.Errorf("unregistering at another priority answered %d", code)
+	}
+	if code := tab.Unregister(reg(3, "1.3.6.1.2.1.2", 100)); code != agx.ResponseNoError {
+		t.Errorf("unregister answered %d", code)
+	}
+	if r, _ := tab.Lookup("", subtree(t, "1.3.6.1.2.1.2.1.0")); r.Session != 1 {
+		t.Errorf("interfaces dispatched to session %d after unregister", r.Session)
+	}
+	if removed := tab.RemoveSession(4); len(removed) != 1 {
+		t.Errorf("closing session 4 removed %v", removed)
+	}
+	if r, _ := tab.Lookup("", subtree(t, "1.3.6.1.2.1.2.2.1.1.2")); r.Session != 2 {
+		t.Errorf("ifIndex.2 dispatched to session %d after close", r.Session)
+	}
+	if n := len(tab.Registrations()); n != 2 {
+		t.Errorf("%d registrations left", n)
+	}
+}
@@ -0,0 +1,30 @@
+package master
+
+// This file contains the SNMPv2c front-end of the master, which answers
+// requests from managers with the variables of the subagents
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/snmp"
+)
+
+// SNMPServer returns a read only SNMPv2c server answering requests with
+// community from the subagents of m. Set WriteCommunity on it to allow sets.
+func (m *Master) SNMPServer(community string) *snmp.Server {
+	s := snmp.NewServer(nil, community)
+	s.Agent = snmpAgent{m}
+	return s
+}
+
+// snmpAgent adapts a master to the requests of an snmp.Server
+type snmpAgent struct {
+	*Master
+}
+
+func (a snmpAgent) Set(vbs ...agx.VarBind) (int, int, error) {
+	status, index, err := a.Master.Set(vbs...)
+	return int(status), int(index), err
+}
@@ -0,0 +1,110 @@
+package master_test
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/master"
+	"github.com/rcgoodfellow/agx/snmp"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSNMPFrontEnd(t *testing.T) {
+	m := master.New()
+	defer m.Close()
+
+	sysName := "1.3.6.1.2.1.1.5.0"
+	ifs := "1.3.6.1.2.1.2.2.1.1"
+	c, err := agx.NewConnection(m.Pipe(), nil, nil)
+	if err != nil {
+		t.Fatalf("connection failed %v", err)
+	}
+	defer c.Disconnect()
+	c.OnGet(sysName, func(oid agx.Subtree) agx.VarBind {
+		return *agx.OctetStringVarBind(oid, []byte("muffin"))
+	})
+	for _, oid := range []string{ifs + ".1", ifs + ".2"} {
+		c.OnGet(oid, func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, int32(oid.Identifiers()[10]))
+		})
+	}
+	c.OnTestSet(sysName, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+		return agx.TestSetNoError
+	})
+	c.OnCommitSet(func(sessionId uint32) agx.CommitSetResult {
+		return agx.CommitSetNoError
+	})
+	c.Register(sysName)
+	c.Register(ifs)
+	if err := m.WaitRegistration(ifs); err != nil {
+		t.Fatalf("master did not see registration %v", err)
+	}
+
+	s := m.SNMPServer("public")
+	s.WriteCommunity = "private"
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening %v", err)
+	}
+	go s.Serve(pc)
+	defer s.Close()
+
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("error dialing %v", err)
+	}
+	defer client.Close()
+
+	request := func(community string, typ byte, a, b int, vbs ...agx.VarBind) *snmp.Message {
+		t.Helper()
+		req := &snmp.Message{
+			Version: snmp.Version2c, Community: community, Type: typ,
+			RequestId: 47, ErrorStatus: a, ErrorIndex: b, VarBinds: vbs,
+		}
+		buf, err := req.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshalling request %v", err)
+		}
+		if _, err := client.Write(buf); err != nil {
+			t.Fatalf("error sending request %v", err)
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		in := make([]byte, 65536)
+		n, err := client.Read(in)
+		if err != nil {
+			t.Fatalf("no response %v", err)
+		}
+		r := &snmp.Message{}
+		if err := r.UnmarshalBinary(in[:n]); err != nil {
+			t.Fatalf("error unmarshalling response %v", err)
+		}
+		return r
+	}
+	null := func(oid string) agx.VarBind {
+		return agx.VarBind{Type: agx.NullT, Name: subtree(t, oid)}
+	}
+
+	r := request("public", snmp.GetRequest, 0, 0, null(sysName), null("1.3.6.1.4"))
+	if len(r.VarBinds) != 2 || r.VarBinds[0].Type != agx.OctetStringT ||
+		r.VarBinds[1].Type != agx.NoSuchObjectT {
+		t.Errorf("get returned %v", r.VarBinds)
+	}
+
+	r = request("public", snmp.GetBulkRequest, 0, 3, null(ifs))
+	if len(r.VarBinds) != 3 || r.VarBinds[0].Data != agx.Integer(1) ||
+		r.VarBinds[1].Data != agx.Integer(2) ||
+		r.VarBinds[2].Type != agx.EndOfMibViewT {
+		t.Errorf("getbulk returned %v", r.VarBinds)
+	}
+
+	vb := *agx.OctetStringVarBind(subtree(t, sysName), []byte("pirate"))
+	r = request("private", snmp.SetRequest, 0, 0, vb)
+	if r.ErrorStatus != snmp.NoError {
+		t.Errorf("set returned %v", r)
+	}
+	vb.Name = subtree(t, "1.3.6.1.4.1")
+	r = request("private", snmp.SetRequest, 0, 0, vb)
+	if r.ErrorStatus != snmp.NotWritable || r.ErrorIndex != 1 {
+		t.Errorf("set of unregistered variable returned %v", r)
+	}
+}
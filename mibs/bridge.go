@@ -0,0 +1,175 @@
+package mibs
+
+// This file contains the objects of BRIDGE-MIB (RFC4188) and Q-BRIDGE-MIB
+// (RFC4363)
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * BRIDGE-MIB
+ *----------------------------------------------------------------------------*/
+
+// dot1dBase
+const (
+	Dot1dBridge            = Mib2 + ".17"
+	Dot1dBase              = Dot1dBridge + ".1"
+	Dot1dBaseBridgeAddress = Dot1dBase + ".1"
+	Dot1dBaseNumPorts      = Dot1dBase + ".2"
+	Dot1dBaseType          = Dot1dBase + ".3"
+)
+
+// dot1dBasePortTable
+const (
+	Dot1dBasePortTable                 = Dot1dBase + ".4"
+	Dot1dBasePortEntry                 = Dot1dBasePortTable + ".1"
+	Dot1dBasePort                      = Dot1dBasePortEntry + ".1"
+	Dot1dBasePortIfIndex               = Dot1dBasePortEntry + ".2"
+	Dot1dBasePortCircuit               = Dot1dBasePortEntry + ".3"
+	Dot1dBasePortDelayExceededDiscards = Dot1dBasePortEntry + ".4"
+	Dot1dBasePortMtuExceededDiscards   = Dot1dBasePortEntry + ".5"
+)
+
+// notifications
+const (
+	Dot1dNotifications = Dot1dBridge + ".0"
+	NewRoot            = Dot1dNotifications + ".1"
+	TopologyChange     = Dot1dNotifications + ".2"
+)
+
+// dot1dStp
+const (
+	Dot1dStp                      = Dot1dBridge + ".2"
+	Dot1dStpProtocolSpecification = Dot1dStp + ".1"
+	Dot1dStpPriority              = Dot1dStp + ".2"
+	Dot1dStpDesignatedRoot        = Dot1dStp + ".5"
+	Dot1dStpRootCost              = Dot1dStp + ".6"
+	Dot1dStpRootPort              = Dot1dStp + ".7"
+)
+
+// dot1dTp
+const (
+	Dot1dTp                     = Dot1dBridge + ".4"
+	Dot1dTpLearnedEntryDiscards = Dot1dTp + ".1"
+	Dot1dTpAgingTime            = Dot1dTp + ".2"
+	Dot1dTpFdbTable             = Dot1dTp + ".3"
+	Dot1dTpFdbEntry             = Dot1dTpFdbTable + ".1"
+	Dot1dTpFdbAddress           = Dot1dTpFdbEntry + ".1"
+	Dot1dTpFdbPort              = Dot1dTpFdbEntry + ".2"
+	Dot1dTpFdbStatus            = Dot1dTpFdbEntry + ".3"
+)
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * Q-BRIDGE-MIB
+ *----------------------------------------------------------------------------*/
+
+// dot1qBase
+const (
+	QBridgeMIB             = Dot1dBridge + ".7"
+	QBridgeMIBObjects      = QBridgeMIB + ".1"
+	Dot1qBase              = QBridgeMIBObjects + ".1"
+	Dot1qVlanVersionNumber = Dot1qBase + ".1"
+	Dot1qMaxVlanId         = Dot1qBase + ".2"
+	Dot1qMaxSupportedVlans = Dot1qBase + ".3"
+	Dot1qNumVlans          = Dot1qBase + ".4"
+	Dot1qGvrpStatus        = Dot1qBase + ".5"
+)
+
+// dot1qTp
+const (
+	Dot1qTp              = QBridgeMIBObjects + ".2"
+	Dot1qFdbTable        = Dot1qTp + ".1"
+	Dot1qFdbEntry        = Dot1qFdbTable + ".1"
+	Dot1qFdbId           = Dot1qFdbEntry + ".1"
+	Dot1qFdbDynamicCount = Dot1qFdbEntry + ".2"
+	Dot1qTpFdbTable      = Dot1qTp + ".2"
+	Dot1qTpFdbEntry      = Dot1qTpFdbTable + ".1"
+	Dot1qTpFdbAddress    = Dot1qTpFdbEntry + ".1"
+	Dot1qTpFdbPort       = Dot1qTpFdbEntry + ".2"
+	Dot1qTpFdbStatus     = Dot1qTpFdbEntry + ".3"
+)
+
+// dot1qStatic
+const (
+	Dot1qStatic               = QBridgeMIBObjects + ".3"
+	Dot1qStaticUnicastTable   = Dot1qStatic + ".1"
+	Dot1qStaticMulticastTable = Dot1qStatic + ".2"
+)
+
+// dot1qVlan
+const (
+	Dot1qVlan                   = QBridgeMIBObjects + ".4"
+	Dot1qVlanNumDeletes         = Dot1qVlan + ".1"
+	Dot1qNextFreeLocalVlanIndex = Dot1qVlan + ".4"
+)
+
+// dot1qVlanCurrentTable
+const (
+	Dot1qVlanCurrentTable         = Dot1qVlan + ".2"
+	Dot1qVlanCurrentEntry         = Dot1qVlanCurrentTable + ".1"
+	Dot1qVlanTimeMark             = Dot1qVlanCurrentEntry + ".1"
+	Dot1qVlanIndex                = Dot1qVlanCurrentEntry + ".2"
+	Dot1qVlanFdbId                = Dot1qVlanCurrentEntry + ".3"
+	Dot1qVlanCurrentEgressPorts   = Dot1qVlanCurrentEntry + ".4"
+	Dot1qVlanCurrentUntaggedPorts = Dot1qVlanCurrentEntry + ".5"
+	Dot1qVlanStatus               = Dot1qVlanCurrentEntry + ".6"
+	Dot1qVlanCreationTime         = Dot1qVlanCurrentEntry + ".7"
+)
+
+// dot1qVlanStaticTable
+const (
+	Dot1qVlanStaticTable          = Dot1qVlan + ".3"
+	Dot1qVlanStaticEntry          = Dot1qVlanStaticTable + ".1"
+	Dot1qVlanStaticName           = Dot1qVlanStaticEntry + ".1"
+	Dot1qVlanStaticEgressPorts    = Dot1qVlanStaticEntry + ".2"
+	Dot1qVlanForbiddenEgressPorts = Dot1qVlanStaticEntry + ".3"
+	Dot1qVlanStaticUntaggedPorts  = Dot1qVlanStaticEntry + ".4"
+	Dot1qVlanStaticRowStatus      = Dot1qVlanStaticEntry + ".5"
+)
+
+// dot1qPortVlanTable
+const (
+	Dot1qPortVlanTable                  = Dot1qVlan + ".5"
+	Dot1qPortVlanEntry                  = Dot1qPortVlanTable + ".1"
+	Dot1qPvid                           = Dot1qPortVlanEntry + ".1"
+	Dot1qPortAcceptableFrameTypes       = Dot1qPortVlanEntry + ".2"
+	Dot1qPortIngressFiltering           = Dot1qPortVlanEntry + ".3"
+	Dot1qPortGvrpStatus                 = Dot1qPortVlanEntry + ".4"
+	Dot1qPortGvrpFailedRegistrations    = Dot1qPortVlanEntry + ".5"
+	Dot1qPortGvrpLastPduOrigin          = Dot1qPortVlanEntry + ".6"
+	Dot1qPortRestrictedVlanRegistration = Dot1qPortVlanEntry + ".7"
+)
+
+// values of dot1qVlanStatus
+const (
+	Dot1qVlanStatusOther       = 1
+	Dot1qVlanStatusPermanent   = 2
+	Dot1qVlanStatusDynamicGvrp = 3
+)
+
+// values of RowStatus (SNMPv2-TC), as taken by dot1qVlanStaticRowStatus
+const (
+	RowStatusActive        = 1
+	RowStatusNotInService  = 2
+	RowStatusNotReady      = 3
+	RowStatusCreateAndGo   = 4
+	RowStatusCreateAndWait = 5
+	RowStatusDestroy       = 6
+)
+
+// values of dot1dBaseType
+const (
+	Dot1dBaseTypeUnknown         = 1
+	Dot1dBaseTypeTransparentOnly = 2
+	Dot1dBaseTypeSourceRouteOnly = 3
+	Dot1dBaseTypeSrt             = 4
+)
+
+// values of dot1qTpFdbStatus
+const (
+	Dot1qTpFdbStatusOther   = 1
+	Dot1qTpFdbStatusInvalid = 2
+	Dot1qTpFdbStatusLearned = 3
+	Dot1qTpFdbStatusSelf    = 4
+	Dot1qTpFdbStatusMgmt    = 5
+)
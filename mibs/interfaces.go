@@ -0,0 +1,94 @@
+package mibs
+
+// This file contains the interfaces group of IF-MIB (RFC2863)
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+// interfaces
+const (
+	Interfaces = Mib2 + ".2"
+	IfNumber   = Interfaces + ".1"
+)
+
+// ifTable
+const (
+	IfTable           = Interfaces + ".2"
+	IfEntry           = IfTable + ".1"
+	IfIndex           = IfEntry + ".1"
+	IfDescr           = IfEntry + ".2"
+	IfType            = IfEntry + ".3"
+	IfMtu             = IfEntry + ".4"
+	IfSpeed           = IfEntry + ".5"
+	IfPhysAddress     = IfEntry + ".6"
+	IfAdminStatus     = IfEntry + ".7"
+	IfOperStatus      = IfEntry + ".8"
+	IfLastChange      = IfEntry + ".9"
+	IfInOctets        = IfEntry + ".10"
+	IfInUcastPkts     = IfEntry + ".11"
+	IfInNUcastPkts    = IfEntry + ".12"
+	IfInDiscards      = IfEntry + ".13"
+	IfInErrors        = IfEntry + ".14"
+	IfInUnknownProtos = IfEntry + ".15"
+	IfOutOctets       = IfEntry + ".16"
+	IfOutUcastPkts    = IfEntry + ".17"
+	IfOutNUcastPkts   = IfEntry + ".18"
+	IfOutDiscards     = IfEntry + ".19"
+	IfOutErrors       = IfEntry + ".20"
+	IfOutQLen         = IfEntry + ".21"
+	IfSpecific        = IfEntry + ".22"
+)
+
+// ifXTable
+const (
+	IfMIB                      = Mib2 + ".31"
+	IfXTable                   = IfMIB + ".1.1"
+	IfXEntry                   = IfXTable + ".1"
+	IfName                     = IfXEntry + ".1"
+	IfInMulticastPkts          = IfXEntry + ".2"
+	IfInBroadcastPkts          = IfXEntry + ".3"
+	IfOutMulticastPkts         = IfXEntry + ".4"
+	IfOutBroadcastPkts         = IfXEntry + ".5"
+	IfHCInOctets               = IfXEntry + ".6"
+	IfHCInUcastPkts            = IfXEntry + ".7"
+	IfHCInMulticastPkts        = IfXEntry + ".8"
+	IfHCInBroadcastPkts        = IfXEntry + ".9"
+	IfHCOutOctets              = IfXEntry + ".10"
+	IfHCOutUcastPkts           = IfXEntry + ".11"
+	IfHCOutMulticastPkts       = IfXEntry + ".12"
+	IfHCOutBroadcastPkts       = IfXEntry + ".13"
+	IfLinkUpDownTrapEnable     = IfXEntry + ".14"
+	IfHighSpeed                = IfXEntry + ".15"
+	IfPromiscuousMode          = IfXEntry + ".16"
+	IfConnectorPresent         = IfXEntry + ".17"
+	IfAlias                    = IfXEntry + ".18"
+	IfCounterDiscontinuityTime = IfXEntry + ".19"
+)
+
+// notifications, sent with the ifIndex, ifAdminStatus and ifOperStatus of the
+// interface
+const (
+	LinkDown = SnmpTraps + ".3"
+	LinkUp   = SnmpTraps + ".4"
+)
+
+// values of ifAdminStatus and ifOperStatus
+const (
+	IfStatusUp             = 1
+	IfStatusDown           = 2
+	IfStatusTesting        = 3
+	IfStatusUnknown        = 4 //ifOperStatus only
+	IfStatusDormant        = 5 //ifOperStatus only
+	IfStatusNotPresent     = 6 //ifOperStatus only
+	IfStatusLowerLayerDown = 7 //ifOperStatus only
+)
+
+// values of ifType (IANAifType-MIB)
+const (
+	IfTypeOther            = 1
+	IfTypeEthernetCsmacd   = 6
+	IfTypeSoftwareLoopback = 24
+	IfTypeTunnel           = 131
+	IfTypeL2vlan           = 135
+	IfTypeBridge           = 209
+)
@@ -0,0 +1,83 @@
+// Package mibs holds the object identifiers of well known MIB modules, so
+// agents can refer to objects by name rather than by dotted oid strings.
+// Object names follow the descriptors of the modules, e.g.
+// dot1qVlanStaticEgressPorts is Dot1qVlanStaticEgressPorts.
+package mibs
+
+// This file contains helpers for building instance identifiers
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scalar returns the instance identifier of the scalar object oid, e.g.
+// Scalar(SysName) is 1.3.6.1.2.1.1.5.0
+func Scalar(oid string) string {
+	return oid + ".0"
+}
+
+// Instance returns the identifier of the instance of the column oid at index,
+// e.g. Instance(IfDescr, 3) is 1.3.6.1.2.1.2.2.1.2.3
+func Instance(oid string, index ...uint32) string {
+	var b strings.Builder
+	b.WriteString(oid)
+	for _, x := range index {
+		fmt.Fprintf(&b, ".%d", x)
+	}
+	return b.String()
+}
+
+// PortList is the PortList textual convention of Q-BRIDGE-MIB (RFC4363~3),
+// a bitmap of ports in which the most significant bit of the first octet
+// is port 1
+type PortList []byte
+
+// NewPortList returns an empty port list with room for n ports
+func NewPortList(n int) PortList {
+	return make(PortList, (n+7)/8)
+}
+
+// Has returns whether port is in the list
+func (p PortList) Has(port int) bool {
+	i := port - 1
+	if i < 0 || i/8 >= len(p) {
+		return false
+	}
+	return p[i/8]&(1<<uint(7-i%8)) != 0
+}
+
+// Set adds port to the list, growing the list if needed
+func (p *PortList) Set(port int) {
+	i := port - 1
+	if i < 0 {
+		return
+	}
+	for i/8 >= len(*p) {
+		*p = append(*p, 0)
+	}
+	(*p)[i/8] |= 1 << uint(7-i%8)
+}
+
+// Clear removes port from the list
+func (p PortList) Clear(port int) {
+	i := port - 1
+	if i < 0 || i/8 >= len(p) {
+		return
+	}
+	p[i/8] &^= 1 << uint(7-i%8)
+}
+
+// Ports returns the ports in the list in ascending order
+func (p PortList) Ports() []int {
+	var ports []int
+	for i := 0; i < len(p)*8; i++ {
+		if p.Has(i + 1) {
+			ports = append(ports, i+1)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,45 @@
+package mibs_test
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/mibs"
+	"reflect"
+	"testing"
+)
+
+func TestOids(t *testing.T) {
+	for oid, expect := range map[string]string{
+		mibs.Scalar(mibs.SysName):      "1.3.6.1.2.1.1.5.0",
+		mibs.Instance(mibs.IfDescr, 3): "1.3.6.1.2.1.2.2.1.2.3",
+		mibs.IfHCInOctets:              "1.3.6.1.2.1.31.1.1.1.6",
+		mibs.Scalar(mibs.SnmpTrapOID):  "1.3.6.1.6.3.1.1.4.1.0",
+		mibs.LinkUp:                    "1.3.6.1.6.3.1.1.5.4",
+		mibs.NewRoot:                   "1.3.6.1.2.1.17.0.1",
+		mibs.Dot1dBasePortIfIndex:      "1.3.6.1.2.1.17.1.4.1.2",
+		mibs.Instance(mibs.Dot1qVlanStaticEgressPorts, 47): "1.3.6.1.2.1.17.7.1.4.3.1.2.47",
+	} {
+		if oid != expect {
+			t.Errorf("%s is not %s", oid, expect)
+		}
+		if _, err := agx.NewSubtree(oid); err != nil {
+			t.Errorf("bad oid %s: %v", oid, err)
+		}
+	}
+}
+
+func TestPortList(t *testing.T) {
+	p := mibs.NewPortList(8)
+	p.Set(1)
+	p.Set(8)
+	p.Set(10)
+	if !reflect.DeepEqual([]byte(p), []byte{0x81, 0x40}) {
+		t.Errorf("port list is %x", []byte(p))
+	}
+	p.Clear(8)
+	if p.Has(8) || !p.Has(10) || p.Has(0) || p.Has(100) {
+		t.Errorf("port list is %x", []byte(p))
+	}
+	if ports := p.Ports(); !reflect.DeepEqual(ports, []int{1, 10}) {
+		t.Errorf("ports are %v", ports)
+	}
+}
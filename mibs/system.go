@@ -0,0 +1,48 @@
+package mibs
+
+// This file contains the system group of SNMPv2-MIB (RFC3418)
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+// roots of the registration tree
+const (
+	Internet     = "1.3.6.1"
+	Mgmt         = Internet + ".2"
+	Mib2         = Mgmt + ".1"
+	Experimental = Internet + ".3"
+	Enterprises  = Internet + ".4.1"
+)
+
+// system
+const (
+	System          = Mib2 + ".1"
+	SysDescr        = System + ".1"
+	SysObjectID     = System + ".2"
+	SysUpTime       = System + ".3"
+	SysContact      = System + ".4"
+	SysName         = System + ".5"
+	SysLocation     = System + ".6"
+	SysServices     = System + ".7"
+	SysORLastChange = System + ".8"
+)
+
+// sysORTable
+const (
+	SysORTable  = System + ".9"
+	SysOREntry  = SysORTable + ".1"
+	SysORIndex  = SysOREntry + ".1"
+	SysORID     = SysOREntry + ".2"
+	SysORDescr  = SysOREntry + ".3"
+	SysORUpTime = SysOREntry + ".4"
+)
+
+// snmpTrap and the generic notifications (RFC3418~2)
+const (
+	SnmpMIB               = Internet + ".6.3.1"
+	SnmpTrapOID           = SnmpMIB + ".1.4.1"
+	SnmpTraps             = SnmpMIB + ".1.5"
+	ColdStart             = SnmpTraps + ".1"
+	WarmStart             = SnmpTraps + ".2"
+	AuthenticationFailure = SnmpTraps + ".5"
+)
@@ -0,0 +1,39 @@
+package agx
+
+// This file contains the resolution of symbolic object names to oids
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"sync"
+)
+
+// NameResolver returns the oid of the object with the symbolic name name,
+// e.g. ifIndex or IF-MIB::ifIndex, and whether the name is known
+type NameResolver func(name string) ([]uint32, bool)
+
+var (
+	resolverMtx sync.RWMutex
+	resolver    NameResolver
+)
+
+// SetNameResolver makes NewSubtree resolve oids that start with a symbolic
+// name, e.g. ifIndex.3, through r. The smi package resolves the names of the
+// MIB modules it has parsed. A nil r stops resolution.
+func SetNameResolver(r NameResolver) {
+	resolverMtx.Lock()
+	defer resolverMtx.Unlock()
+	resolver = r
+}
+
+func resolveName(name string) ([]uint32, bool) {
+	resolverMtx.RLock()
+	r := resolver
+	resolverMtx.RUnlock()
+
+	if r == nil {
+		return nil, false
+	}
+	return r(name)
+}
@@ -0,0 +1,143 @@
+package agx
+
+// This file contains the oid map, which keeps values by oid in oid order, for
+// agents to cache the variables they serve in
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"sort"
+	"sync"
+)
+
+// OidMap maps oids to values, keeping them sorted by oid as a getnext walks
+// them. It is safe for concurrent use. A cache that is rebuilt periodically
+// builds a new map and swaps it in with Replace, so that readers see either
+// every old value or every new one. The zero value is an empty map.
+type OidMap struct {
+	mtx     sync.RWMutex
+	entries []oidEntry //sorted by oid
+}
+
+type oidEntry struct {
+	oid   Subtree
+	value interface{}
+}
+
+// Len returns the number of oids in the map
+func (m *OidMap) Len() int {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return len(m.entries)
+}
+
+// Get returns the value of oid
+func (m *OidMap) Get(oid Subtree) (interface{}, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	i, ok := m.search(oid)
+	if !ok {
+		return nil, false
+	}
+	return m.entries[i].value, true
+}
+
+// Set sets the value of oid. Setting oids in order appends them, so a map is
+// built in time linear to its size.
+func (m *OidMap) Set(oid Subtree, value interface{}) {
+	//the map keeps its own copy of the oid
+	e := oidEntry{oid: oid, value: value}
+	e.oid.SubIdentifiers = append([]int32(nil), oid.SubIdentifiers...)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	n := len(m.entries)
+	if n == 0 || m.entries[n-1].oid.LessThan(oid) {
+		m.entries = append(m.entries, e)
+		return
+	}
+	i, ok := m.search(oid)
+	if ok {
+		m.entries[i] = e
+		return
+	}
+	m.entries = append(m.entries, oidEntry{})
+	copy(m.entries[i+1:], m.entries[i:])
+	m.entries[i] = e
+}
+
+// Delete removes oid from the map, returning whether it was there
+func (m *OidMap) Delete(oid Subtree) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	i, ok := m.search(oid)
+	if !ok {
+		return false
+	}
+	m.entries = append(m.entries[:i], m.entries[i+1:]...)
+	return true
+}
+
+// Next returns the first oid following oid in the map and its value, as a
+// getnext of oid finds it
+func (m *OidMap) Next(oid Subtree) (Subtree, interface{}, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	i, ok := m.search(oid)
+	if ok {
+		i++
+	}
+	if i >= len(m.entries) {
+		return Subtree{}, nil, false
+	}
+	return m.entries[i].oid, m.entries[i].value, true
+}
+
+// Range calls f for each oid of the map from the first not before from, in
+// order, until f returns false. The map is locked for reading meanwhile, so f
+// must not change it.
+func (m *OidMap) Range(from Subtree,
+	f func(oid Subtree, value interface{}) bool) {
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	i, _ := m.search(from)
+	for ; i < len(m.entries); i++ {
+		if !f(m.entries[i].oid, m.entries[i].value) {
+			return
+		}
+	}
+}
+
+// Walk calls f for each oid of the map under root, in order, until f returns
+// false, see Range
+func (m *OidMap) Walk(root Subtree,
+	f func(oid Subtree, value interface{}) bool) {
+
+	m.Range(root, func(oid Subtree, value interface{}) bool {
+		return oid.HasPrefix(root) && f(oid, value)
+	})
+}
+
+// Replace replaces the contents of the map with those of n, which is left
+// empty. Readers of the map see it either before or after.
+func (m *OidMap) Replace(n *OidMap) {
+	n.mtx.Lock()
+	entries := n.entries
+	n.entries = nil
+	n.mtx.Unlock()
+
+	m.mtx.Lock()
+	m.entries = entries
+	m.mtx.Unlock()
+}
+
+// search returns the index of the first entry not before oid, and whether it
+// is for oid. The map must be locked.
+func (m *OidMap) search(oid Subtree) (int, bool) {
+	i := sort.Search(len(m.entries), func(i int) bool {
+		return m.entries[i].oid.GreaterThanEq(oid)
+	})
+	return i, i < len(m.entries) && m.entries[i].oid.Eq(oid)
+}
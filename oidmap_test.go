@@ -0,0 +1,107 @@
+package agx_test
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestOidMap(t *testing.T) {
+
+	var m agx.OidMap
+	for _, x := range []string{"1.3.6.1.2.1.10", "1.3.6.1.2.1.2.1",
+		"1.3.6.1.2.1.9", "1.3.6.1.2.1.2", "1.3.6.1.2.1.2.2"} {
+		m.Set(subtree(t, x), x)
+	}
+	m.Set(subtree(t, "1.3.6.1.2.1.9"), "nine")
+	if !m.Delete(subtree(t, "1.3.6.1.2.1.2.2")) {
+		t.Errorf("delete found nothing")
+	}
+	if m.Delete(subtree(t, "1.3.6.1.2.1.3")) {
+		t.Errorf("delete of a missing oid found something")
+	}
+	if m.Len() != 4 {
+		t.Errorf("expected 4 oids, got %d", m.Len())
+	}
+	if v, ok := m.Get(subtree(t, "1.3.6.1.2.1.9")); !ok || v != "nine" {
+		t.Errorf("get returned %v %v", v, ok)
+	}
+
+	//ranges are in numeric order
+	var oids []string
+	m.Range(subtree(t, "1.3.6.1.2.1.2.0"), func(oid agx.Subtree,
+		v interface{}) bool {
+		oids = append(oids, oid.String())
+		return true
+	})
+	expect := []string{"1.3.6.1.2.1.2.1", "1.3.6.1.2.1.9", "1.3.6.1.2.1.10"}
+	if !reflect.DeepEqual(oids, expect) {
+		t.Errorf("ranged over %v, expected %v", oids, expect)
+	}
+	oids = nil
+	m.Walk(subtree(t, "1.3.6.1.2.1.2"), func(oid agx.Subtree,
+		v interface{}) bool {
+		oids = append(oids, oid.String())
+		return true
+	})
+	expect = []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.2.1"}
+	if !reflect.DeepEqual(oids, expect) {
+		t.Errorf("walked %v, expected %v", oids, expect)
+	}
+
+	for oid, next := range map[string]string{
+		"1.3.6.1.2.1":     "1.3.6.1.2.1.2",
+		"1.3.6.1.2.1.2":   "1.3.6.1.2.1.2.1",
+		"1.3.6.1.2.1.2.1": "1.3.6.1.2.1.9",
+		"1.3.6.1.2.1.10":  "",
+	} {
+		n, _, ok := m.Next(subtree(t, oid))
+		if ok != (next != "") || ok && n.String() != next {
+			t.Errorf("next of %s is %v %v, expected %q", oid, n, ok, next)
+		}
+	}
+}
+
+// Readers see every value of one generation of the map while it is replaced
+func TestOidMapReplace(t *testing.T) {
+
+	build := func(gen int) *agx.OidMap {
+		m := &agx.OidMap{}
+		for i := 1; i <= 100; i++ {
+			m.Set(subtree(t, fmt.Sprintf("1.3.6.1.4.1.47.%d", i)), gen)
+		}
+		return m
+	}
+	var m agx.OidMap
+	m.Replace(build(0))
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				gen, n := -1, 0
+				m.Range(agx.Subtree{}, func(oid agx.Subtree, v interface{}) bool {
+					if gen == -1 {
+						gen = v.(int)
+					}
+					if v.(int) != gen {
+						t.Errorf("generations %d and %d mixed", gen, v)
+					}
+					n++
+					return true
+				})
+				if n != 100 {
+					t.Errorf("ranged over %d oids, expected 100", n)
+				}
+			}
+		}()
+	}
+	for gen := 1; gen <= 20; gen++ {
+		m.Replace(build(gen))
+	}
+	wg.Wait()
+}
@@ -9,11 +9,15 @@ package agx
 
 import (
 	"bytes"
+	"encoding/asn1"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 /*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
@@ -43,47 +47,102 @@ const (
 /*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
  * AgentX Protocol
  *----------------------------------------------------------------------------*/
+// PDUType is the type of an AgentX PDU (RFC2741~6.1)
+type PDUType byte
+
 const (
-	OpenPDU            = 1
-	ClosePDU           = 2
-	RegisterPDU        = 3
-	UnregisterPDU      = 4
-	GetPDU             = 5
-	GetNextPDU         = 6
-	GetBulkPDU         = 7
-	TestSetPDU         = 8
-	CommitSetPDU       = 9
-	UndoSetPDU         = 10
-	CleanupSetPDU      = 11
-	NotifyPDU          = 12
-	PingPDU            = 13
-	IndexAllocatePDU   = 14
-	IndexDeallocatePDU = 15
-	AddAgentCapsPDU    = 16
-	RemoveAgentCapsPDU = 17
-	ResponsePDU        = 18
+	OpenPDU            PDUType = 1
+	ClosePDU           PDUType = 2
+	RegisterPDU        PDUType = 3
+	UnregisterPDU      PDUType = 4
+	GetPDU             PDUType = 5
+	GetNextPDU         PDUType = 6
+	GetBulkPDU         PDUType = 7
+	TestSetPDU         PDUType = 8
+	CommitSetPDU       PDUType = 9
+	UndoSetPDU         PDUType = 10
+	CleanupSetPDU      PDUType = 11
+	NotifyPDU          PDUType = 12
+	PingPDU            PDUType = 13
+	IndexAllocatePDU   PDUType = 14
+	IndexDeallocatePDU PDUType = 15
+	AddAgentCapsPDU    PDUType = 16
+	RemoveAgentCapsPDU PDUType = 17
+	ResponsePDU        PDUType = 18
 )
 
+// IsValid reports whether t is a PDU type defined by RFC2741
+func (t PDUType) IsValid() bool {
+	return t >= OpenPDU && t <= ResponsePDU
+}
+
+// Flags are the flags of a PDU header (RFC2741~6.1)
+type Flags byte
+
 const (
-	InstanceRegistration = 0x01
-	NewIndex             = 0x02
-	AnyIndex             = 0x04
-	NonDefaultContext    = 0x08
-	NetworkByteOrder     = 0x10
+	InstanceRegistration Flags = 0x01
+	NewIndex             Flags = 0x02
+	AnyIndex             Flags = 0x04
+	NonDefaultContext    Flags = 0x08
+	NetworkByteOrder     Flags = 0x10
 )
 
+// IsValid reports whether f has only flags defined by RFC2741 set
+func (f Flags) IsValid() bool {
+	return f&^(InstanceRegistration|NewIndex|AnyIndex|NonDefaultContext|
+		NetworkByteOrder) == 0
+}
+
 const (
 	CloseTransactionId      = 86
 	RegisterTransactionId   = 47
 	UnregisterTransactionId = 74
+	PingTransactionId       = 63
+	NotifyTransactionId     = 96
+)
+
+// response errors (RFC2741~6.2.16)
+const (
+	ResponseNoError               = 0
+	ResponseOpenFailed            = 256
+	ResponseNotOpen               = 257
+	ResponseIndexWrongType        = 258
+	ResponseIndexAlreadyAllocated = 259
+	ResponseIndexNoneAvailable    = 260
+	ResponseIndexNotAllocated     = 261
+	ResponseUnsupportedContext    = 262
+	ResponseDuplicateRegistration = 263
+	ResponseUnknownRegistration   = 264
+	ResponseUnknownAgentCaps      = 265
+	ResponseParseError            = 266
+	ResponseRequestDenied         = 267
+	ResponseProcessingError       = 268
+)
+
+// snmp errors a response may carry for a varbind (RFC2741~7.2.4), or for an
+// undo-set as a whole
+const (
+	ResponseTooBig      = 1
+	ResponseGenErr      = 5
+	ResponseNoAccess    = 6
+	ResponseUndoFailed  = 15
+	ResponseNotWritable = 17
 )
 
 const (
 	HeaderSize int = 20
 )
 
+// MaxSubIdentifiers is the largest number of sub-identifiers an object
+// identifier may carry on the wire (RFC2741~5.1)
+const MaxSubIdentifiers = 128
+
+// ErrTruncated is returned when decoding runs past the end of a buffer
+var ErrTruncated = errors.New("truncated buffer")
+
 type Message interface {
 	MarshalBinary() ([]byte, error)
+	AppendBinary(dst []byte) ([]byte, error)
 	UnmarshalBinary([]byte) (int, error)
 	//TODO
 	//WireSize() int
@@ -92,30 +151,39 @@ type Message interface {
 // Header .....................................................................
 
 type Header struct {
-	Version, Type, Flags, Reserved byte
-	SessionId                      int32
-	TransactionId                  int32
-	PacketId                       int32
-	PayloadLength                  int32
+	Version       byte
+	Type          PDUType
+	Flags         Flags
+	Reserved      byte
+	SessionId     uint32
+	TransactionId uint32
+	PacketId      uint32
+	PayloadLength int32
 }
 
 func (h Header) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, h)
-	if err != nil {
-		return nil, err
-	}
-	return buf.Bytes(), nil
+	return h.AppendBinary(make([]byte, 0, HeaderSize))
+}
+
+func (h Header) AppendBinary(dst []byte) ([]byte, error) {
+	dst = append(dst, h.Version, byte(h.Type), byte(h.Flags), h.Reserved)
+	dst = binary.BigEndian.AppendUint32(dst, h.SessionId)
+	dst = binary.BigEndian.AppendUint32(dst, h.TransactionId)
+	dst = binary.BigEndian.AppendUint32(dst, h.PacketId)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(h.PayloadLength))
+	return dst, nil
 }
 
 func (h *Header) UnmarshalBinary(buf []byte) (int, error) {
-	r := bytes.NewReader(buf)
-	begin := r.Len()
+	if err := need(buf, HeaderSize); err != nil {
+		return 0, err
+	}
+	r := bytes.NewReader(buf[:HeaderSize])
 	err := binary.Read(r, binary.BigEndian, h)
 	if err != nil {
-		return begin - r.Len(), err
+		return 0, err
 	}
-	return begin - r.Len(), nil
+	return HeaderSize, nil
 }
 
 // Response ...................................................................
@@ -133,6 +201,11 @@ func (m *Response) UnmarshalBinary(buf []byte) (int, error) {
 	}
 	i += n
 
+	buf, err = pduBytes(buf, &m.Header)
+	if err != nil {
+		return i, err
+	}
+
 	n, err = m.ResponsePayload.UnmarshalBinary(buf[i:])
 	if err != nil {
 		return i, err
@@ -143,21 +216,70 @@ func (m *Response) UnmarshalBinary(buf []byte) (int, error) {
 }
 
 func (m Response) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	if _, err := marshalToBuf(buf, &m.Header); err != nil {
-		return nil, err
-	}
-	if err := netMarshalMany(buf, m.SysUptime, m.Error, m.Index); err != nil {
+	return m.AppendBinary(nil)
+}
+
+func (m Response) AppendBinary(dst []byte) ([]byte, error) {
+	dst, err := m.Header.AppendBinary(dst)
+	if err != nil {
 		return nil, err
 	}
+	dst = binary.BigEndian.AppendUint32(dst, uint32(m.SysUptime))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(m.Error))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(m.Index))
 	for _, v := range m.VarBindList {
-		b, err := v.MarshalBinary()
+		dst, err = v.AppendBinary(dst)
 		if err != nil {
 			return nil, err
 		}
-		buf.Write(b)
 	}
-	return buf.Bytes(), nil
+	return dst, nil
+}
+
+// NewResponse returns an empty response to the request with header h. The
+// payload length of the response is kept up to date as it is built, e.g.
+//
+//	r := NewResponse(h).Add(vbs...)
+//	r := NewResponse(h).SetError(ResponseNoAccess, 1)
+func NewResponse(h Header) *Response {
+	return &Response{
+		Header: Header{
+			Version:       1,
+			Type:          ResponsePDU,
+			Flags:         h.Flags & NetworkByteOrder,
+			SessionId:     h.SessionId,
+			TransactionId: h.TransactionId,
+			PacketId:      h.PacketId,
+			PayloadLength: 8,
+		},
+	}
+}
+
+// Add appends vbs to the varbinds of the response
+func (m *Response) Add(vbs ...VarBind) *Response {
+	for _, vb := range vbs {
+		m.VarBindList = append(m.VarBindList, vb)
+		m.Header.PayloadLength += int32(vb.WireSize())
+	}
+	return m
+}
+
+// SetError sets the error of the response and the 1 based index of the
+// varbind it is for, zero if it is for none in particular
+func (m *Response) SetError(code int16, index int) *Response {
+	m.Error, m.Index = code, int16(index)
+	return m
+}
+
+// Refuse sets the error of the response and replaces its varbinds with the
+// requested names, as refused requests are answered (RFC2741~7.2.3.1)
+func (m *Response) Refuse(code int16, index int, names []Subtree) *Response {
+	m.VarBindList = nil
+	m.Header.PayloadLength = 8
+	for _, name := range names {
+		m.Add(VarBind{Type: NullT, Name: name})
+	}
+	return m.SetError(code, index)
 }
 
 type ResponsePayload struct {
@@ -167,9 +289,10 @@ type ResponsePayload struct {
 	VarBindList []VarBind
 }
 
+// UnmarshalBinary decodes a response payload, buf must hold exactly the
+// payload as everything following the fixed fields is taken to be varbinds.
 func (p *ResponsePayload) UnmarshalBinary(buf []byte) (int, error) {
 	r := bytes.NewReader(buf)
-	before := r.Len()
 
 	i := 0
 	n, err := netUnmarshalMany(r, &p.SysUptime, &p.Error, &p.Index)
@@ -178,9 +301,13 @@ func (p *ResponsePayload) UnmarshalBinary(buf []byte) (int, error) {
 	}
 	i += n
 
-	//TODO unmarshal var bind list
+	p.VarBindList, n, err = unmarshalVarBindList(buf[i:])
+	i += n
+	if err != nil {
+		return i, err
+	}
 
-	return before - r.Len(), nil
+	return i, nil
 }
 
 func NoSuchObjectVarBind(oid Subtree) VarBind {
@@ -197,6 +324,28 @@ func EndOfMibViewVarBind(oid Subtree) VarBind {
 	return v
 }
 
+// the type of the varbinds of handlers that defer to other handlers, which is
+// never sent
+const skipT = -1
+
+// SkipVarBind is what a get handler returns for oid when it does not hold the
+// variable, deferring to the other handlers that may. Unlike endOfMibView,
+// which a subtree handler returns once it holds no more variables, a skipped
+// variable is never answered to the master: for a get the enclosing subtree
+// handler is asked instead, and for a getnext the handlers that follow.
+func SkipVarBind(oid Subtree) VarBind {
+	var v VarBind
+	v.Type = skipT
+	v.Name = oid
+	return v
+}
+
+// Skipped returns whether the handler that bound vb deferred to other
+// handlers, see SkipVarBind
+func (vb VarBind) Skipped() bool {
+	return vb.Type == skipT
+}
+
 func OctetStringVarBind(oid Subtree, s []byte) *VarBind {
 	return &VarBind{
 		Type: OctetStringT,
@@ -207,87 +356,77 @@ func OctetStringVarBind(oid Subtree, s []byte) *VarBind {
 
 // VarBind
 
+// VarBind binds the variable Name to a value. Data holds the value, which is
+// nil for Null and the exception types, and its type must be Type.
 type VarBind struct {
 	Type     int16
 	Reserved int16
 	Name     Subtree
-	Data     interface{}
+	Data     Value
 }
 
-func (v VarBind) WireSize() int {
+// NewVarBind binds oid to the value v
+func NewVarBind(oid Subtree, v Value) VarBind {
+	return VarBind{Type: v.Type(), Name: oid, Data: v}
+}
 
+func (v VarBind) WireSize() int {
 	sz := 4 + v.Name.WireSize()
-
-	switch v.Type {
-	case IntegerT:
-		sz += 4
-	case OctetStringT:
-		s := v.Data.(OctetString)
-		sz += 4 + len(s.Octets)
-	case Gauge32T:
-		sz += 4
-	//TODO below not implemented
-	case NullT:
-	case ObjectIdentifierT:
-	case IpAddressT:
-	case Counter32T:
-	case TimeTicksT:
-	case OpaqueT:
-	case Counter64T:
-	case NoSuchObjectT:
-	case NoSuchInstanceT:
-	case EndOfMibViewT:
+	if v.Data != nil {
+		sz += v.Data.WireSize()
 	}
-
 	return sz
 }
 
 func (v VarBind) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
+	return v.AppendBinary(make([]byte, 0, v.WireSize()))
+}
 
-	if err := netMarshalMany(buf, v.Type, v.Reserved); err != nil {
+func (v VarBind) AppendBinary(dst []byte) ([]byte, error) {
+	if err := v.check(); err != nil {
 		return nil, err
 	}
 
-	if _, err := marshalToBuf(buf, &v.Name); err != nil {
+	dst = binary.BigEndian.AppendUint16(dst, uint16(v.Type))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(v.Reserved))
+
+	dst, err := v.Name.AppendBinary(dst)
+	if err != nil {
 		return nil, err
 	}
-
-	switch v.Type {
-	case IntegerT:
-		i := v.Data.(int32)
-		if err := netMarshal(buf, i); err != nil {
+	if v.Data != nil {
+		if dst, err = v.Data.AppendBinary(dst); err != nil {
 			return nil, err
 		}
-	case OctetStringT:
-		s := v.Data.(OctetString)
-		if _, err := marshalToBuf(buf, &s); err != nil {
-			return nil, err
+	}
+	return dst, nil
+}
+
+// check returns an error if the data of v does not agree with its type
+func (v VarBind) check() error {
+	switch v.Type {
+	case NullT, NoSuchObjectT, NoSuchInstanceT, EndOfMibViewT:
+		if v.Data != nil {
+			return dataTypeError(v)
 		}
-	case Gauge32T:
-		i := v.Data.(uint32)
-		if err := netMarshal(buf, i); err != nil {
-			return nil, err
+	case IntegerT, OctetStringT, ObjectIdentifierT, IpAddressT, Counter32T,
+		Gauge32T, TimeTicksT, OpaqueT, Counter64T:
+		if v.Data == nil || v.Data.Type() != v.Type {
+			return dataTypeError(v)
 		}
-	//TODO below not implemented
-	case NullT:
-	case ObjectIdentifierT:
-	case IpAddressT:
-	case Counter32T:
-	case TimeTicksT:
-	case OpaqueT:
-	case Counter64T:
-	case NoSuchObjectT:
-	case NoSuchInstanceT:
-	case EndOfMibViewT:
+	default:
+		return fmt.Errorf("unknown varbind type %d", v.Type)
 	}
+	return nil
+}
 
-	return buf.Bytes(), nil
+func dataTypeError(v VarBind) error {
+	return fmt.Errorf("varbind %s of type %d cannot hold data of type %T",
+		v.Name.String(), v.Type, v.Data)
 }
 
 func (v *VarBind) UnmarshalBinary(buf []byte) (int, error) {
 	r := bytes.NewReader(buf)
-	before := r.Len()
 
 	i := 0
 	n, err := netUnmarshalMany(r, &v.Type, &v.Reserved)
@@ -302,62 +441,31 @@ func (v *VarBind) UnmarshalBinary(buf []byte) (int, error) {
 	}
 	i += n
 
-	r = bytes.NewReader(buf[i:])
-	switch v.Type {
-	case IntegerT:
-		var x int32
-		n, err := netUnmarshal(r, &x)
-		if err != nil {
-			return i, err
-		}
-		v.Data = x
-		i += n
-	case OctetStringT:
-		var x OctetString
-		n, err := x.UnmarshalBinary(buf[i:])
-		if err != nil {
-			return i, err
-		}
-		v.Data = x
-		i += n
-	case Gauge32T:
-		var x uint32
-		n, err := netUnmarshal(r, &x)
-		if err != nil {
-			return i, err
-		}
-		v.Data = x
-		i += n
-	//TODO below not implemented
-	case NullT:
-	case ObjectIdentifierT:
-	case IpAddressT:
-	case Counter32T:
-	case TimeTicksT:
-	case OpaqueT:
-	case Counter64T:
-	case NoSuchObjectT:
-	case NoSuchInstanceT:
-	case EndOfMibViewT:
+	v.Data, n, err = decodeValue(v.Type, buf[i:])
+	if err != nil {
+		return i, err
 	}
+	i += n
 
-	return before - r.Len(), nil
+	return i, nil
 }
 
 func IntegerVarBind(oid Subtree, value int32) VarBind {
-	var v VarBind
-	v.Type = IntegerT
-	v.Name = oid
-	v.Data = value
-	return v
+	return NewVarBind(oid, Integer(value))
 }
 
 func Gauge32VarBind(oid Subtree, value uint32) VarBind {
-	var v VarBind
-	v.Type = Gauge32T
-	v.Name = oid
-	v.Data = value
-	return v
+	return NewVarBind(oid, Gauge32(value))
+}
+
+// FloatVarBind binds oid to value as an opaque float, as net-snmp does
+func FloatVarBind(oid Subtree, value float32) VarBind {
+	return NewVarBind(oid, NewOpaqueFloat(value))
+}
+
+// DoubleVarBind binds oid to value as an opaque double, as net-snmp does
+func DoubleVarBind(oid Subtree, value float64) VarBind {
+	return NewVarBind(oid, NewOpaqueDouble(value))
 }
 
 // Subtree ....................................................................
@@ -367,99 +475,233 @@ type Subtree struct {
 	SubIdentifiers                 []int32
 }
 
+// HasPrefix reports whether p is a prefix of s, comparing whole
+// sub-identifiers so that 1.3.6.1.2.1.1 is not a prefix of 1.3.6.1.2.1.17.
 func (s Subtree) HasPrefix(p Subtree) bool {
-	//TODO can be more efficient without string conv
-	return strings.HasPrefix(s.String(), p.String())
+	n := p.length()
+	return n <= s.length() && compareUpTo(s, p, n) == 0
 }
 
 func (s Subtree) GreaterThan(x Subtree) bool {
-	//TODO can be more efficient without string conv
-	return s.String() > x.String()
+	return s.Compare(x) > 0
 }
 
 func (s Subtree) GreaterThanEq(x Subtree) bool {
-	//TODO can be more efficient without string conv
-	return s.String() >= x.String()
+	return s.Compare(x) >= 0
 }
 
 func (s Subtree) LessThan(x Subtree) bool {
-	//TODO can be more efficient without string conv
-	return s.String() < x.String()
+	return s.Compare(x) < 0
 }
 
 func (s Subtree) LessThanEq(x Subtree) bool {
-	//TODO can be more efficient without string conv
-	return s.String() <= x.String()
+	return s.Compare(x) <= 0
 }
 
 func (s Subtree) Eq(x Subtree) bool {
-	//TODO can be more efficient without string conv
-	return s.String() == x.String()
+	return s.Compare(x) == 0
+}
+
+// Compare orders subtrees numerically by sub-identifier, with any prefix
+// expanded, the result is -1 if s comes before x, 1 if s comes after x and 0
+// if they are the same.
+func (s Subtree) Compare(x Subtree) int {
+	return compareUpTo(s, x, math.MaxInt32)
+}
+
+// internetPrefix is the oid expanded from a non-zero Prefix (RFC2741~5.1)
+var internetPrefix = [...]int32{1, 3, 6, 1}
+
+// length is the number of sub-identifiers in s with any prefix expanded
+func (s Subtree) length() int {
+	if s.Prefix != 0 {
+		return len(internetPrefix) + 1 + len(s.SubIdentifiers)
+	}
+	return len(s.SubIdentifiers)
+}
+
+// Identifiers returns the sub-identifiers of s with any prefix expanded
+func (s Subtree) Identifiers() []uint32 {
+	ids := make([]uint32, s.length())
+	for i := range ids {
+		ids[i] = s.subid(i)
+	}
+	return ids
+}
+
+// ToASN1 returns s as an asn1.ObjectIdentifier, with any prefix expanded, for
+// encoding/asn1 and the libraries built on it. Where int is 32 bits wide,
+// sub-identifiers above math.MaxInt32 do not fit and come out negative.
+func (s Subtree) ToASN1() asn1.ObjectIdentifier {
+	oid := make(asn1.ObjectIdentifier, s.length())
+	for i := range oid {
+		oid[i] = int(s.subid(i))
+	}
+	return oid
+}
+
+// FromASN1 sets s to the asn1.ObjectIdentifier oid, without prefix
+// compression. Sub-identifiers must fit in 32 bits unsigned (RFC2741~5.1).
+func (s *Subtree) FromASN1(oid asn1.ObjectIdentifier) error {
+	ids := make([]uint32, len(oid))
+	for i, x := range oid {
+		if x < 0 || int64(x) > math.MaxUint32 {
+			return fmt.Errorf("bad oid %v, sub-identifier %d out of range",
+				oid, x)
+		}
+		ids[i] = uint32(x)
+	}
+	t, err := NewSubtreeFromIdentifiers(ids)
+	if err != nil {
+		return err
+	}
+	*s = *t
+	return nil
+}
+
+// subid returns the i'th sub-identifier of s with any prefix expanded
+func (s Subtree) subid(i int) uint32 {
+	if s.Prefix != 0 {
+		if i < len(internetPrefix) {
+			return uint32(internetPrefix[i])
+		}
+		if i == len(internetPrefix) {
+			return uint32(s.Prefix)
+		}
+		i -= len(internetPrefix) + 1
+	}
+	return uint32(s.SubIdentifiers[i])
+}
+
+// compareUpTo compares the first n sub-identifiers of a and b, see Compare
+func compareUpTo(a, b Subtree, n int) int {
+	na, nb := a.length(), b.length()
+	if na > n {
+		na = n
+	}
+	if nb > n {
+		nb = n
+	}
+	for i := 0; i < na && i < nb; i++ {
+		x, y := a.subid(i), b.subid(i)
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	switch {
+	case na < nb:
+		return -1
+	case na > nb:
+		return 1
+	}
+	return 0
 }
 
 func (s Subtree) WireSize() int {
 	return 4 + len(s.SubIdentifiers)*4
 }
 
+// NewSubtree parses a dotted oid such as 1.3.6.1.2.1.2.2.1.1.3, which may have
+// a leading dot. When a NameResolver is set the oid may also start with a
+// symbolic name, e.g. ifIndex.3 or IF-MIB::ifIndex.3.
 func NewSubtree(oid string) (*Subtree, error) {
-	t := &Subtree{}
+	s := strings.TrimPrefix(oid, ".")
+	if s == "" {
+		return nil, fmt.Errorf("empty oid")
+	}
+	parts := strings.Split(s, ".")
 
-	ids := strings.Split(oid, ".")
-	t.NSubid = byte(len(ids))
-	for _, x := range ids {
-		i, err := strconv.ParseInt(x, 10, 32)
+	var ids []uint32
+	if first := parts[0]; first != "" && (first[0] < '0' || first[0] > '9') {
+		base, ok := resolveName(first)
+		if !ok {
+			return nil, fmt.Errorf("bad oid %q, unknown name %q", oid, first)
+		}
+		ids = append(ids, base...)
+		parts = parts[1:]
+	}
+	for i, x := range parts {
+		if x == "" {
+			return nil, fmt.Errorf("bad oid %q, empty sub-identifier %d", oid, i+1)
+		}
+		id, err := strconv.ParseUint(x, 10, 32)
 		if err != nil {
+			if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+				return nil, fmt.Errorf("bad oid %q, sub-identifier %s overflows 32 bits",
+					oid, x)
+			}
 			return nil, fmt.Errorf("bad id, must be oid format: %v", err)
 		}
-		t.SubIdentifiers = append(t.SubIdentifiers, int32(i))
+		ids = append(ids, uint32(id))
 	}
 
+	return NewSubtreeFromIdentifiers(ids)
+}
+
+// NewSubtreeFromIdentifiers creates a subtree holding the provided
+// sub-identifiers, without prefix compression
+func NewSubtreeFromIdentifiers(ids []uint32) (*Subtree, error) {
+	if len(ids) > MaxSubIdentifiers {
+		return nil, fmt.Errorf("oid has %d sub-identifiers, at most %d allowed",
+			len(ids), MaxSubIdentifiers)
+	}
+	t := &Subtree{NSubid: byte(len(ids))}
+	for _, x := range ids {
+		t.SubIdentifiers = append(t.SubIdentifiers, int32(x))
+	}
 	return t, nil
 }
 
 func (s Subtree) String() string {
-	str := strconv.Itoa(int(s.SubIdentifiers[0]))
-	for _, x := range s.SubIdentifiers[1:] {
-		str += "." + strconv.Itoa(int(x))
-	}
+	var ids []string
 	if s.Prefix != 0 {
-		str = fmt.Sprintf("1.3.6.1.%d.%s", s.Prefix, str)
+		ids = append(ids, "1", "3", "6", "1", strconv.Itoa(int(s.Prefix)))
+	}
+	for _, x := range s.SubIdentifiers {
+		ids = append(ids, strconv.FormatUint(uint64(uint32(x)), 10))
 	}
-	return str
+	return strings.Join(ids, ".")
 }
 
 func (s Subtree) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
+	return s.AppendBinary(make([]byte, 0, s.WireSize()))
+}
 
-	if err := netMarshalMany(buf,
-		s.NSubid, s.Prefix, s.Zero, s.Reserved); err != nil {
-		return nil, err
-	}
+func (s Subtree) AppendBinary(dst []byte) ([]byte, error) {
+	dst = append(dst, s.NSubid, s.Prefix, s.Zero, s.Reserved)
 	for _, v := range s.SubIdentifiers {
-		if err := netMarshal(buf, v); err != nil {
-			return nil, err
-		}
+		dst = binary.BigEndian.AppendUint32(dst, uint32(v))
 	}
-	return buf.Bytes(), nil
+	return dst, nil
 }
 
 func (s *Subtree) UnmarshalBinary(buf []byte) (int, error) {
 	r := bytes.NewReader(buf)
-	before := r.Len()
 
-	if n, err := netUnmarshalMany(r,
+	if _, err := netUnmarshalMany(r,
 		&s.NSubid, &s.Prefix, &s.Zero, &s.Reserved); err != nil {
-		return n, err
+		return 0, err
 	}
-	//log.Printf("reading %d subids", int(s.NSubid))
-	for i := 0; i < int(s.NSubid); i++ {
-		var v int32
-		if n, err := netUnmarshal(r, &v); err != nil {
-			return n, err
+	if int(s.NSubid) > MaxSubIdentifiers {
+		return 0, fmt.Errorf("oid has %d sub-identifiers, at most %d allowed",
+			s.NSubid, MaxSubIdentifiers)
+	}
+	sz := 4 + 4*int(s.NSubid)
+	if err := need(buf, sz); err != nil {
+		return 0, err
+	}
+
+	s.SubIdentifiers = nil
+	if s.NSubid > 0 {
+		s.SubIdentifiers = make([]int32, s.NSubid)
+		if _, err := netUnmarshal(r, s.SubIdentifiers); err != nil {
+			return 0, err
 		}
-		s.SubIdentifiers = append(s.SubIdentifiers, v)
 	}
-	return before - r.Len(), nil
+	return sz, nil
 }
 
 // OctetString ..........................................................
@@ -469,7 +711,9 @@ type OctetString struct {
 	Octets            []byte
 }
 
-func NewOctetString(s []byte) *OctetString {
+// NewOctetString returns an octet string holding a copy of s, which may be
+// given as bytes or as a string
+func NewOctetString[T ~[]byte | ~string](s T) *OctetString {
 	os := &OctetString{
 		OctetStringLength: int32(len(s)),
 	}
@@ -480,6 +724,15 @@ func NewOctetString(s []byte) *OctetString {
 	return os
 }
 
+// Bytes returns the octets of s without padding
+func (s OctetString) Bytes() []byte {
+	n := int(s.OctetStringLength)
+	if n < 0 || n > len(s.Octets) {
+		n = len(s.Octets)
+	}
+	return s.Octets[:n]
+}
+
 func (s *OctetString) Pad() int {
 	r := len(s.Octets) % 4
 	if r == 0 {
@@ -495,34 +748,48 @@ func (s *OctetString) Pad() int {
 	return n
 }
 
+func (s OctetString) WireSize() int {
+	return 4 + padLen(len(s.Octets))
+}
+
 func (s OctetString) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	s.Pad()
+	return s.AppendBinary(make([]byte, 0, 4+padLen(len(s.Octets))))
+}
 
-	if err := netMarshal(buf, s.OctetStringLength); err != nil {
-		return nil, err
-	}
-	if _, err := buf.Write(s.Octets); err != nil {
-		return nil, err
+func (s OctetString) AppendBinary(dst []byte) ([]byte, error) {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(s.OctetStringLength))
+	dst = append(dst, s.Octets...)
+	for i := len(s.Octets); i < padLen(len(s.Octets)); i++ {
+		dst = append(dst, 0)
 	}
-
-	return buf.Bytes(), nil
+	return dst, nil
 }
 
 func (s *OctetString) UnmarshalBinary(buf []byte) (int, error) {
-	r := bytes.NewReader(buf)
-	if _, err := netUnmarshal(r, &s.OctetStringLength); err != nil {
+	if err := need(buf, 4); err != nil {
 		return 0, err
 	}
-	for i := 0; i < int(s.OctetStringLength); i++ {
-		var v byte
-		if _, err := netUnmarshal(r, &v); err != nil {
-			return i + 4, err
-		}
-		s.Octets = append(s.Octets, v)
+	s.OctetStringLength = int32(binary.BigEndian.Uint32(buf))
+
+	//the octets and their padding must all be present
+	if s.OctetStringLength < 0 || int(s.OctetStringLength) > len(buf)-4 {
+		return 0, fmt.Errorf("%w: octet string of length %d with %d bytes left",
+			ErrTruncated, s.OctetStringLength, len(buf)-4)
+	}
+	sz := 4 + padLen(int(s.OctetStringLength))
+	if err := need(buf, sz); err != nil {
+		return 0, err
 	}
-	padding := s.Pad()
-	return 4 + int(s.OctetStringLength) + padding, nil
+
+	//padding is kept as zeros, same as Pad would produce
+	s.Octets = make([]byte, sz-4)
+	copy(s.Octets, buf[4:4+s.OctetStringLength])
+	return sz, nil
+}
+
+// padLen rounds n up to a multiple of 4
+func padLen(n int) int {
+	return (n + 3) &^ 3
 }
 
 // open ......................................................................
@@ -535,52 +802,50 @@ type OpenMessage struct {
 	Desc     OctetString
 }
 
+// NewOpenMessage creates an open of a session for the subagent identified by
+// id and described by descr. A nil or empty id is sent as the null object
+// identifier and a nil or empty descr as the zero length octet string, as
+// RFC2741~6.2.1 allows.
 func NewOpenMessage(id, descr *string) (*OpenMessage, error) {
 	m := &OpenMessage{}
 	m.Header.Version = 1
 	m.Header.Type = OpenPDU
 	m.Header.Flags = NetworkByteOrder
-	m.Header.PayloadLength = 4
-	m.Timeout = 5
-
-	if id != nil {
-		ids := strings.Split(*id, ".")
-		m.Id.NSubid = byte(len(ids))
-		m.Header.PayloadLength += int32(4 + 4*m.Id.NSubid)
-		for _, x := range ids {
-			i, err := strconv.ParseInt(x, 10, 32)
-			if err != nil {
-				return nil, fmt.Errorf("bad id, must be oid format: %v", err)
-			}
-			m.Id.SubIdentifiers = append(m.Id.SubIdentifiers, int32(i))
+	m.Timeout = OpenTimeout
+
+	if id != nil && *id != "" {
+		s, err := NewSubtree(*id)
+		if err != nil {
+			return nil, fmt.Errorf("bad id, must be oid format: %v", err)
 		}
+		m.Id = *s
 	}
 
 	if descr != nil {
 		bs := []byte(*descr)
 		m.Desc.OctetStringLength = int32(len(bs))
 		m.Desc.Octets = bs
-		padlen := m.Desc.Pad()
-		m.Header.PayloadLength += int32(4 + len(bs) + padlen)
+		m.Desc.Pad()
 	}
 
+	//the id and description are on the wire even when null
+	m.Header.PayloadLength = int32(4 + m.Id.WireSize() + m.Desc.WireSize())
+
 	return m, nil
 }
 
 func (m OpenMessage) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
+	return m.AppendBinary(nil)
+}
 
-	if _, err := marshalToBuf(buf, &m.Header); err != nil {
-		return nil, err
-	}
-	if err := netMarshalMany(buf, m.Timeout, m.Reserved); err != nil {
-		return nil, err
-	}
-	if _, err := marshalToBufs(buf, &m.Id, &m.Desc); err != nil {
+func (m OpenMessage) AppendBinary(dst []byte) ([]byte, error) {
+	dst, err := m.Header.AppendBinary(dst)
+	if err != nil {
 		return nil, err
 	}
-
-	return buf.Bytes(), nil
+	dst = append(dst, m.Timeout)
+	dst = append(dst, m.Reserved[:]...)
+	return appendAll(dst, &m.Id, &m.Desc)
 }
 
 func (m *OpenMessage) UnmarshalBinary(buf []byte) (int, error) {
@@ -593,7 +858,7 @@ func (m *OpenMessage) UnmarshalBinary(buf []byte) (int, error) {
 	i += n
 
 	r := bytes.NewReader(buf[i:])
-	if _, err = netUnmarshal(r, &m.Timeout); err != nil {
+	if _, err = netUnmarshalMany(r, &m.Timeout, &m.Reserved); err != nil {
 		return i, err
 	}
 	i += 4
@@ -617,11 +882,11 @@ func (m *OpenMessage) UnmarshalBinary(buf []byte) (int, error) {
 
 type CloseMessage struct {
 	Header   Header
-	Reason   byte
+	Reason   CloseReason
 	Reserved [3]byte
 }
 
-func NewCloseMessage(reason byte, sessionId int32) *CloseMessage {
+func NewCloseMessage(reason CloseReason, sessionId uint32) *CloseMessage {
 	m := &CloseMessage{}
 	m.Header.Version = 1
 	m.Header.Type = ClosePDU
@@ -635,15 +900,17 @@ func NewCloseMessage(reason byte, sessionId int32) *CloseMessage {
 }
 
 func (m CloseMessage) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
+	return m.AppendBinary(nil)
+}
 
-	if _, err := marshalToBuf(buf, &m.Header); err != nil {
-		return nil, err
-	}
-	if err := netMarshalMany(buf, m.Reason, m.Reserved); err != nil {
+func (m CloseMessage) AppendBinary(dst []byte) ([]byte, error) {
+	dst, err := m.Header.AppendBinary(dst)
+	if err != nil {
 		return nil, err
 	}
-	return buf.Bytes(), nil
+	dst = append(dst, byte(m.Reason))
+	dst = append(dst, m.Reserved[:]...)
+	return dst, nil
 }
 
 func (m *CloseMessage) UnmarshalBinary(buf []byte) (int, error) {
@@ -655,7 +922,7 @@ func (m *CloseMessage) UnmarshalBinary(buf []byte) (int, error) {
 	i += n
 
 	r := bytes.NewReader(buf[i:])
-	if _, err := netUnmarshal(r, &m.Reason); err != nil {
+	if _, err := netUnmarshalMany(r, &m.Reason, &m.Reserved); err != nil {
 		return i, err
 	}
 	i += 4
@@ -663,15 +930,26 @@ func (m *CloseMessage) UnmarshalBinary(buf []byte) (int, error) {
 	return i, nil
 }
 
+// CloseReason is the reason given for closing a session (RFC2741~6.2.2)
+type CloseReason byte
+
 const (
-	CloseReasonOther         byte = 1
-	CloseReasonParseError         = 2
-	CloseReasonProtocolError      = 3
-	CloseReasonTimeouts           = 4
-	CloseReasonShutdown           = 5
-	CloseReasonByManaget          = 6
+	CloseReasonOther         CloseReason = 1
+	CloseReasonParseError    CloseReason = 2
+	CloseReasonProtocolError CloseReason = 3
+	CloseReasonTimeouts      CloseReason = 4
+	CloseReasonShutdown      CloseReason = 5
+	CloseReasonByManager     CloseReason = 6
 )
 
+// Deprecated: CloseReasonByManaget is a misspelling of CloseReasonByManager
+const CloseReasonByManaget = CloseReasonByManager
+
+// IsValid reports whether r is a close reason defined by RFC2741
+func (r CloseReason) IsValid() bool {
+	return r >= CloseReasonOther && r <= CloseReasonByManager
+}
+
 // register ...................................................................
 
 type RegisterMessage struct {
@@ -682,7 +960,10 @@ type RegisterMessage struct {
 	UpperBound                              *int32
 }
 
-func NewRegisterMessage(subtree string, context *string, upperBound *int32) (
+// NewRegisterMessage creates a registration of subtree in context. When
+// upperBound is set the registration ranges over the sub-identifier
+// RangeSubid, which is for the caller to set.
+func NewRegisterMessage(subtree string, context Context, upperBound *int32) (
 	*RegisterMessage, error) {
 
 	m := &RegisterMessage{}
@@ -693,15 +974,10 @@ func NewRegisterMessage(subtree string, context *string, upperBound *int32) (
 	m.Header.TransactionId = RegisterTransactionId
 	m.Timeout = ConnectionTimeout //from agx.go
 	m.Priority = BasePriority     //from agx.go
-	if context != nil {
-		m.Header.Flags |= NonDefaultContext
-	}
 
 	//context
-	if context != nil {
-		m.Context = NewOctetString([]byte(*context))
-		m.Header.PayloadLength += 4 + int32(len(m.Context.Octets))
-	}
+	m.Context = context.Apply(&m.Header)
+	m.Header.PayloadLength += contextSize(m.Context)
 
 	//subtree
 	subtree_, err := NewSubtree(subtree)
@@ -722,40 +998,33 @@ func NewRegisterMessage(subtree string, context *string, upperBound *int32) (
 }
 
 func (m RegisterMessage) MarshalBinary() ([]byte, error) {
-	buf := new(bytes.Buffer)
+	return m.AppendBinary(nil)
+}
 
-	if _, err := marshalToBuf(buf, &m.Header); err != nil {
+func (m RegisterMessage) AppendBinary(dst []byte) ([]byte, error) {
+	dst, err := appendHeaderContext(dst, &m.Header, m.Context)
+	if err != nil {
 		return nil, err
 	}
 
-	if m.Context != nil {
-		if _, err := marshalToBuf(buf, m.Context); err != nil {
-			return nil, err
-		}
-	}
-
-	if err := netMarshalMany(buf,
-		m.Timeout, m.Priority, m.RangeSubid, m.Reserved); err != nil {
-		return nil, err
-	}
+	dst = append(dst, m.Timeout, m.Priority, m.RangeSubid, m.Reserved)
 
-	if _, err := marshalToBuf(buf, &m.Subtree); err != nil {
+	dst, err = m.Subtree.AppendBinary(dst)
+	if err != nil {
 		return nil, err
 	}
 
 	if m.UpperBound != nil {
-		if err := netMarshal(buf, *m.UpperBound); err != nil {
-			return nil, err
-		}
+		dst = binary.BigEndian.AppendUint32(dst, uint32(*m.UpperBound))
 	}
-	return buf.Bytes(), nil
+	return dst, nil
 }
 
 func (m *RegisterMessage) UnmarshalBinary(buf []byte) (int, error) {
 	i := 0
 	n, err := m.Header.UnmarshalBinary(buf)
 	if err != nil {
-		return i, nil
+		return i, err
 	}
 	i += n
 
@@ -763,7 +1032,7 @@ func (m *RegisterMessage) UnmarshalBinary(buf []byte) (int, error) {
 		m.Context = &OctetString{}
 		n, err = m.Context.UnmarshalBinary(buf[i:])
 		if err != nil {
-			return i, nil
+			return i, err
 		}
 		i += n
 	}
@@ -778,17 +1047,17 @@ func (m *RegisterMessage) UnmarshalBinary(buf []byte) (int, error) {
 
 	n, err = m.Subtree.UnmarshalBinary(buf[i:])
 	if err != nil {
-		return i, nil
+		return i, err
 	}
 	i += n
 
 	if m.RangeSubid != 0 {
 		r := bytes.NewReader(buf[i:])
 		m.UpperBound = new(int32)
-		if _, err := netUnmarshal(r, &m.UpperBound); err != nil {
+		if _, err := netUnmarshal(r, m.UpperBound); err != nil {
 			return i, err
 		}
-		i++
+		i += 4
 	}
 
 	return i, nil
@@ -796,7 +1065,9 @@ func (m *RegisterMessage) UnmarshalBinary(buf []byte) (int, error) {
 
 // unregister .................................................................
 
-func NewUnregisterMessage(subtree string, context *string, upperBound *int32) (
+// NewUnregisterMessage creates an unregistration of subtree in context, see
+// NewRegisterMessage
+func NewUnregisterMessage(subtree string, context Context, upperBound *int32) (
 	*RegisterMessage, error) {
 	m, err := NewRegisterMessage(subtree, context, upperBound)
 	if err != nil {
@@ -807,60 +1078,142 @@ func NewUnregisterMessage(subtree string, context *string, upperBound *int32) (
 	return m, nil
 }
 
+// ping .......................................................................
+
+type PingMessage struct {
+	Header  Header
+	Context *OctetString
+}
+
+func NewPingMessage(sessionId uint32) *PingMessage {
+	m := &PingMessage{}
+	m.Header.Version = 1
+	m.Header.Type = PingPDU
+	m.Header.Flags = NetworkByteOrder
+	m.Header.SessionId = sessionId
+	m.Header.TransactionId = PingTransactionId
+	return m
+}
+
+func (m PingMessage) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(nil)
+}
+
+func (m PingMessage) AppendBinary(dst []byte) ([]byte, error) {
+	return appendHeaderContext(dst, &m.Header, m.Context)
+}
+
+func (m *PingMessage) UnmarshalBinary(buf []byte) (int, error) {
+	_, i, err := unmarshalHeaderContext(buf, &m.Header, &m.Context)
+	return i, err
+}
+
 // get ........................................................................
 
 type GetMessage struct {
-	Header          Header
-	Context         *OctetString
+	Header       Header
+	Context      *OctetString
+	SearchRanges []SearchRange
+
+	//SearchRangeList holds the start of each of the SearchRanges of a decoded
+	//request. A request with no SearchRanges is encoded with a range from each
+	//of these that is unbounded.
 	SearchRangeList []Subtree
 }
 
+// SearchRange is a pair of object identifiers bounding the variables a get
+// request is interested in (RFC2741~5.2), a null End means unbounded
+type SearchRange struct {
+	Start, End Subtree
+}
+
 type GetNextMessage struct {
 	GetMessage
 }
 
-const (
-	SearchRangeListPaddingLength = 4
-)
-
-func (m *GetMessage) UnmarshalBinary(buf []byte) (int, error) {
-	return m.unmarshalBinary(buf, true)
+func (m GetMessage) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(nil)
 }
 
-func (m *GetNextMessage) UnmarshalBinary(buf []byte) (int, error) {
-	return m.GetMessage.unmarshalBinary(buf, true)
+func (m GetMessage) AppendBinary(dst []byte) ([]byte, error) {
+	dst, err := appendHeaderContext(dst, &m.Header, m.Context)
+	if err != nil {
+		return nil, err
+	}
+	srs := m.SearchRanges
+	if len(srs) == 0 {
+		for _, x := range m.SearchRangeList {
+			srs = append(srs, SearchRange{Start: x})
+		}
+	}
+	return appendSearchRangeList(dst, srs)
 }
 
-func (m *GetMessage) unmarshalBinary(buf []byte, padded bool) (int, error) {
-	i := 0
-	n, err := m.Header.UnmarshalBinary(buf)
+func (m *GetMessage) UnmarshalBinary(buf []byte) (int, error) {
+	buf, i, err := unmarshalHeaderContext(buf, &m.Header, &m.Context)
 	if err != nil {
-		return i, nil
+		return i, err
 	}
-	i += n
 
-	if (m.Header.Flags & NonDefaultContext) != 0 {
-		m.Context = &OctetString{}
-		n, err = m.Context.UnmarshalBinary(buf[i:])
-		if err != nil {
-			return i, nil
-		}
-		i += n
+	var n int
+	m.SearchRanges, n, err = unmarshalSearchRangeList(buf[i:])
+	i += n
+	m.SearchRangeList = nil
+	for _, x := range m.SearchRanges {
+		m.SearchRangeList = append(m.SearchRangeList, x.Start)
+	}
+	if err != nil {
+		return i, err
 	}
 
-	for i < len(buf) {
-		var t Subtree
-		n, err = t.UnmarshalBinary(buf[i:])
-		if err != nil {
-			return i, nil
-		}
-		if padded {
-			i += n + SearchRangeListPaddingLength
-		}
-		if t.NSubid == 0 {
-			continue
-		}
-		m.SearchRangeList = append(m.SearchRangeList, t)
+	return i, nil
+}
+
+func (m *GetNextMessage) UnmarshalBinary(buf []byte) (int, error) {
+	return m.GetMessage.UnmarshalBinary(buf)
+}
+
+// getbulk ....................................................................
+
+type GetBulkMessage struct {
+	Header         Header
+	Context        *OctetString
+	NonRepeaters   int16
+	MaxRepetitions int16
+	SearchRanges   []SearchRange
+}
+
+func (m GetBulkMessage) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(nil)
+}
+
+func (m GetBulkMessage) AppendBinary(dst []byte) ([]byte, error) {
+	dst, err := appendHeaderContext(dst, &m.Header, m.Context)
+	if err != nil {
+		return nil, err
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(m.NonRepeaters))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(m.MaxRepetitions))
+	return appendSearchRangeList(dst, m.SearchRanges)
+}
+
+func (m *GetBulkMessage) UnmarshalBinary(buf []byte) (int, error) {
+	buf, i, err := unmarshalHeaderContext(buf, &m.Header, &m.Context)
+	if err != nil {
+		return i, err
+	}
+
+	r := bytes.NewReader(buf[i:])
+	n, err := netUnmarshalMany(r, &m.NonRepeaters, &m.MaxRepetitions)
+	if err != nil {
+		return i, err
+	}
+	i += n
+
+	m.SearchRanges, n, err = unmarshalSearchRangeList(buf[i:])
+	i += n
+	if err != nil {
+		return i, err
 	}
 
 	return i, nil
@@ -885,6 +1238,19 @@ const (
 	TestSetInconsistentName    = TestSetResult(18)
 )
 
+// IsValid reports whether r is an error a test-set may result in
+func (r TestSetResult) IsValid() bool {
+	switch r {
+	case TestSetNoError, TestSetGenError, TestSetNoAccess, TestSetWrongType,
+		TestSetWrongLength, TestSetWrongEncoding, TestSetWrongValue,
+		TestSetNoCreation, TestSetInconsistentValue,
+		TestSetResourceUnavailable, TestSetNotWritable,
+		TestSetInconsistentName:
+		return true
+	}
+	return false
+}
+
 type CommitSetResult int16
 
 const (
@@ -892,56 +1258,619 @@ const (
 	CommitSetCommitFailed = CommitSetResult(14)
 )
 
+// IsValid reports whether r is an error a commit-set may result in
+func (r CommitSetResult) IsValid() bool {
+	return r == CommitSetNoError || r == CommitSetCommitFailed
+}
+
 type SetMessage struct {
 	Header      Header
 	Context     *OctetString
 	VarBindList []VarBind
 }
 
+func (m SetMessage) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(nil)
+}
+
+func (m SetMessage) AppendBinary(dst []byte) ([]byte, error) {
+	dst, err := appendHeaderContext(dst, &m.Header, m.Context)
+	if err != nil {
+		return nil, err
+	}
+	return appendVarBindList(dst, m.VarBindList)
+}
+
 func (m *SetMessage) UnmarshalBinary(buf []byte) (int, error) {
+	buf, i, err := unmarshalHeaderContext(buf, &m.Header, &m.Context)
+	if err != nil {
+		return i, err
+	}
+
+	var n int
+	m.VarBindList, n, err = unmarshalVarBindList(buf[i:])
+	i += n
+	if err != nil {
+		return i, err
+	}
+	return i, nil
+}
+
+// SetPhaseMessage is the header only PDU used for the CommitSet, UndoSet and
+// CleanupSet phases of a set transaction (RFC2741~6.2.8)
+type SetPhaseMessage struct {
+	Header Header
+}
+
+func (m SetPhaseMessage) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(nil)
+}
+
+func (m SetPhaseMessage) AppendBinary(dst []byte) ([]byte, error) {
+	return m.Header.AppendBinary(dst)
+}
+
+func (m *SetPhaseMessage) UnmarshalBinary(buf []byte) (int, error) {
+	return m.Header.UnmarshalBinary(buf)
+}
+
+// notify .....................................................................
+
+type NotifyMessage struct {
+	Header      Header
+	Context     *OctetString
+	VarBindList []VarBind
+}
+
+// NewNotifyMessage creates a notification in context. The first varbinds of
+// vbs are expected to be sysUpTime.0, which is optional, and snmpTrapOID.0
+// (RFC2741~6.2.10).
+func NewNotifyMessage(sessionId uint32, context Context,
+	vbs []VarBind) *NotifyMessage {
+
+	m := &NotifyMessage{VarBindList: vbs}
+	m.Header.Version = 1
+	m.Header.Type = NotifyPDU
+	m.Header.Flags = NetworkByteOrder
+	m.Header.SessionId = sessionId
+	m.Header.TransactionId = NotifyTransactionId
+	m.Context = context.Apply(&m.Header)
+	m.Header.PayloadLength = contextSize(m.Context) + varBindsSize(vbs)
+	return m
+}
+
+func (m NotifyMessage) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(nil)
+}
+
+func (m NotifyMessage) AppendBinary(dst []byte) ([]byte, error) {
+	dst, err := appendHeaderContext(dst, &m.Header, m.Context)
+	if err != nil {
+		return nil, err
+	}
+	return appendVarBindList(dst, m.VarBindList)
+}
+
+func (m *NotifyMessage) UnmarshalBinary(buf []byte) (int, error) {
+	buf, i, err := unmarshalHeaderContext(buf, &m.Header, &m.Context)
+	if err != nil {
+		return i, err
+	}
+
+	var n int
+	m.VarBindList, n, err = unmarshalVarBindList(buf[i:])
+	i += n
+	if err != nil {
+		return i, err
+	}
+	return i, nil
+}
+
+// index allocation ...........................................................
+
+// IndexAllocateMessage is used for both the IndexAllocate and IndexDeallocate
+// PDUs (RFC2741~6.2.13)
+type IndexAllocateMessage struct {
+	Header      Header
+	Context     *OctetString
+	VarBindList []VarBind
+}
+
+// NewIndexAllocateMessage creates an allocation in context of the indexes
+// vbs name, flags being NewIndex or AnyIndex to ask the master to pick them
+func NewIndexAllocateMessage(sessionId uint32, context Context, flags Flags,
+	vbs []VarBind) *IndexAllocateMessage {
+
+	m := &IndexAllocateMessage{VarBindList: vbs}
+	m.Header.Version = 1
+	m.Header.Type = IndexAllocatePDU
+	m.Header.Flags = NetworkByteOrder | flags&(NewIndex|AnyIndex)
+	m.Header.SessionId = sessionId
+	m.Context = context.Apply(&m.Header)
+	m.Header.PayloadLength = contextSize(m.Context) + varBindsSize(vbs)
+	return m
+}
+
+// NewIndexDeallocateMessage creates a release in context of the indexes vbs
+// name
+func NewIndexDeallocateMessage(sessionId uint32, context Context,
+	vbs []VarBind) *IndexAllocateMessage {
+
+	m := NewIndexAllocateMessage(sessionId, context, 0, vbs)
+	m.Header.Type = IndexDeallocatePDU
+	return m
+}
+
+func (m IndexAllocateMessage) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(nil)
+}
+
+func (m IndexAllocateMessage) AppendBinary(dst []byte) ([]byte, error) {
+	dst, err := appendHeaderContext(dst, &m.Header, m.Context)
+	if err != nil {
+		return nil, err
+	}
+	return appendVarBindList(dst, m.VarBindList)
+}
+
+func (m *IndexAllocateMessage) UnmarshalBinary(buf []byte) (int, error) {
+	buf, i, err := unmarshalHeaderContext(buf, &m.Header, &m.Context)
+	if err != nil {
+		return i, err
+	}
+
+	var n int
+	m.VarBindList, n, err = unmarshalVarBindList(buf[i:])
+	i += n
+	if err != nil {
+		return i, err
+	}
+	return i, nil
+}
+
+// agent capabilities .........................................................
+
+type AddAgentCapsMessage struct {
+	Header  Header
+	Context *OctetString
+	Id      Subtree
+	Descr   OctetString
+}
+
+// NewAddAgentCapsMessage creates an advertisement in context of the
+// capabilities id, described by descr
+func NewAddAgentCapsMessage(sessionId uint32, context Context, id Subtree,
+	descr string) *AddAgentCapsMessage {
+
+	m := &AddAgentCapsMessage{Id: id, Descr: *NewOctetString([]byte(descr))}
+	m.Header.Version = 1
+	m.Header.Type = AddAgentCapsPDU
+	m.Header.Flags = NetworkByteOrder
+	m.Header.SessionId = sessionId
+	m.Context = context.Apply(&m.Header)
+	m.Header.PayloadLength = contextSize(m.Context) +
+		int32(m.Id.WireSize()+m.Descr.WireSize())
+	return m
+}
+
+func (m AddAgentCapsMessage) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(nil)
+}
+
+func (m AddAgentCapsMessage) AppendBinary(dst []byte) ([]byte, error) {
+	dst, err := appendHeaderContext(dst, &m.Header, m.Context)
+	if err != nil {
+		return nil, err
+	}
+	return appendAll(dst, &m.Id, &m.Descr)
+}
+
+func (m *AddAgentCapsMessage) UnmarshalBinary(buf []byte) (int, error) {
+	buf, i, err := unmarshalHeaderContext(buf, &m.Header, &m.Context)
+	if err != nil {
+		return i, err
+	}
+
+	n, err := m.Id.UnmarshalBinary(buf[i:])
+	if err != nil {
+		return i, err
+	}
+	i += n
+
+	n, err = m.Descr.UnmarshalBinary(buf[i:])
+	if err != nil {
+		return i, err
+	}
+	i += n
+
+	return i, nil
+}
+
+type RemoveAgentCapsMessage struct {
+	Header  Header
+	Context *OctetString
+	Id      Subtree
+}
+
+// NewRemoveAgentCapsMessage creates a withdrawal in context of the
+// capabilities id
+func NewRemoveAgentCapsMessage(sessionId uint32, context Context,
+	id Subtree) *RemoveAgentCapsMessage {
+
+	m := &RemoveAgentCapsMessage{Id: id}
+	m.Header.Version = 1
+	m.Header.Type = RemoveAgentCapsPDU
+	m.Header.Flags = NetworkByteOrder
+	m.Header.SessionId = sessionId
+	m.Context = context.Apply(&m.Header)
+	m.Header.PayloadLength = contextSize(m.Context) + int32(m.Id.WireSize())
+	return m
+}
+
+func (m RemoveAgentCapsMessage) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(nil)
+}
+
+func (m RemoveAgentCapsMessage) AppendBinary(dst []byte) ([]byte, error) {
+	dst, err := appendHeaderContext(dst, &m.Header, m.Context)
+	if err != nil {
+		return nil, err
+	}
+	return m.Id.AppendBinary(dst)
+}
+
+func (m *RemoveAgentCapsMessage) UnmarshalBinary(buf []byte) (int, error) {
+	buf, i, err := unmarshalHeaderContext(buf, &m.Header, &m.Context)
+	if err != nil {
+		return i, err
+	}
+
+	n, err := m.Id.UnmarshalBinary(buf[i:])
+	if err != nil {
+		return i, err
+	}
+	i += n
+
+	return i, nil
+}
+
+// parsing ....................................................................
+
+// ParsePDU decodes the PDU at the start of buf into a message of the concrete
+// type given by its header, e.g. a *GetNextMessage for a GetNext PDU. Both
+// Register and Unregister PDUs decode to a *RegisterMessage, the CommitSet,
+// UndoSet and CleanupSet PDUs to a *SetPhaseMessage and the IndexAllocate and
+// IndexDeallocate PDUs to an *IndexAllocateMessage.
+func ParsePDU(buf []byte) (Message, error) {
+	var h Header
+	if _, err := h.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+
+	m, err := newMessage(h.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := m.UnmarshalBinary(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing pdu type %d: %v", h.Type, err)
+	}
+	if n != HeaderSize+int(h.PayloadLength) {
+		return nil, fmt.Errorf(
+			"pdu type %d has payload length %d but decoded %d payload bytes",
+			h.Type, h.PayloadLength, n-HeaderSize)
+	}
+
+	return m, nil
+}
+
+// newMessage returns an empty message of the type used to decode pdu type t
+func newMessage(t PDUType) (Message, error) {
+	switch t {
+	case OpenPDU:
+		return &OpenMessage{}, nil
+	case ClosePDU:
+		return &CloseMessage{}, nil
+	case RegisterPDU, UnregisterPDU:
+		return &RegisterMessage{}, nil
+	case GetPDU:
+		return &GetMessage{}, nil
+	case GetNextPDU:
+		return &GetNextMessage{}, nil
+	case GetBulkPDU:
+		return &GetBulkMessage{}, nil
+	case TestSetPDU:
+		return &SetMessage{}, nil
+	case CommitSetPDU, UndoSetPDU, CleanupSetPDU:
+		return &SetPhaseMessage{}, nil
+	case NotifyPDU:
+		return &NotifyMessage{}, nil
+	case PingPDU:
+		return &PingMessage{}, nil
+	case IndexAllocatePDU, IndexDeallocatePDU:
+		return &IndexAllocateMessage{}, nil
+	case AddAgentCapsPDU:
+		return &AddAgentCapsMessage{}, nil
+	case RemoveAgentCapsPDU:
+		return &RemoveAgentCapsMessage{}, nil
+	case ResponsePDU:
+		return &Response{}, nil
+	}
+	return nil, fmt.Errorf("unknown pdu type %d", t)
+}
+
+// streaming ..................................................................
+
+// ReadMessage reads exactly one PDU from r and decodes it as ParsePDU does.
+// Payloads longer than DefaultMaxPayloadLength are rejected. io.EOF is only
+// returned when r ends cleanly between PDUs.
+func ReadMessage(r io.Reader) (Message, error) {
+	_, buf, err := readFrame(r, nil, DefaultMaxPayloadLength)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePDU(buf)
+}
+
+// WriteMessage encodes m and writes it to w as a single PDU, returning the
+// number of bytes written. The payload length in the header is set from the
+// encoded payload, and as the payload is always encoded in network byte order
+// the NetworkByteOrder flag is set to match.
+func WriteMessage(w io.Writer, m Message) (int, error) {
+	b := getBuffer()
+	defer putBuffer(b)
+
+	buf, err := m.AppendBinary(*b)
+	if err != nil {
+		return 0, fmt.Errorf("error marshalling message: %v", err)
+	}
+	*b = buf
+
+	err = frame(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	return w.Write(buf)
+}
+
+// frame fixes up the header of the encoded PDU in buf to agree with the
+// encoded payload
+func frame(buf []byte) error {
+	if err := need(buf, HeaderSize); err != nil {
+		return err
+	}
+	payload := len(buf) - HeaderSize
+	if payload%4 != 0 {
+		return fmt.Errorf("payload length %d is not a multiple of 4", payload)
+	}
+	buf[2] |= byte(NetworkByteOrder)
+	binary.BigEndian.PutUint32(buf[16:HeaderSize], uint32(payload))
+	return nil
+}
+
+// frameError indicates an incoming header that does not delimit a valid PDU
+type frameError struct {
+	msg string
+}
+
+func (e frameError) Error() string { return e.msg }
+
+// readFrame reads the next PDU on r, reusing the storage of buf. The header is
+// decoded and returned alongside any error about the payload length it
+// carries, as the payload length is all there is to delimit PDUs on a stream.
+func readFrame(r io.Reader, buf []byte, max int) (*Header, []byte, error) {
+	hdr, buf, err := readHeader(r, buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf, err = readPayload(r, buf, hdr, max)
+	if _, ok := err.(frameError); ok {
+		return hdr, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return hdr, buf, nil
+}
+
+// readHeader reads the header of the next PDU on r into a buffer of its own,
+// reusing the storage of buf
+func readHeader(r io.Reader, buf []byte) (*Header, []byte, error) {
+	buf = append(buf[:0], make([]byte, HeaderSize)...)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hdr := &Header{}
+	_, err = hdr.UnmarshalBinary(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hdr, buf, nil
+}
+
+// readPayload appends the payload of the PDU whose header h was read into buf
+// by readHeader, returning a frameError unless h delimits a payload of at
+// most max bytes
+func readPayload(r io.Reader, buf []byte, h *Header, max int) ([]byte, error) {
+	err := checkFrame(h, max)
+	if err != nil {
+		return nil, err
+	}
+
+	buf = append(buf, make([]byte, h.PayloadLength)...)
+	_, err = io.ReadFull(r, buf[HeaderSize:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// checkFrame returns a frameError unless h carries a sane payload length no
+// longer than max
+func checkFrame(h *Header, max int) error {
+	if h.PayloadLength < 0 || h.PayloadLength%4 != 0 {
+		return frameError{
+			fmt.Sprintf("payload length %d is not a multiple of 4", h.PayloadLength)}
+	}
+	if int(h.PayloadLength) > max {
+		return frameError{
+			fmt.Sprintf("payload length %d exceeds maximum %d", h.PayloadLength, max)}
+	}
+	return nil
+}
+
+// helpers ====================================================================
+
+// appendHeaderContext encodes a header followed by the context that is
+// present when the header has the NonDefaultContext flag set
+func appendHeaderContext(dst []byte, h *Header, context *OctetString) (
+	[]byte, error) {
+
+	dst, err := h.AppendBinary(dst)
+	if err != nil {
+		return nil, err
+	}
+	if (h.Flags & NonDefaultContext) != 0 {
+		if context == nil {
+			return nil, fmt.Errorf("non-default context flag set without context")
+		}
+		return context.AppendBinary(dst)
+	}
+	return dst, nil
+}
+
+// contextSize is the encoded size of a context, nothing for the default
+// context
+func contextSize(context *OctetString) int32 {
+	if context == nil {
+		return 0
+	}
+	return int32(context.WireSize())
+}
+
+// varBindsSize is the encoded size of vbs
+func varBindsSize(vbs []VarBind) int32 {
+	n := 0
+	for _, vb := range vbs {
+		n += vb.WireSize()
+	}
+	return int32(n)
+}
+
+// unmarshalHeaderContext decodes a header and its optional context, returning
+// buf bounded to the PDU and the number of bytes consumed
+func unmarshalHeaderContext(buf []byte, h *Header, context **OctetString) (
+	[]byte, int, error) {
+
 	i := 0
-	n, err := m.Header.UnmarshalBinary(buf)
+	n, err := h.UnmarshalBinary(buf)
 	if err != nil {
-		return i, nil
+		return nil, i, err
 	}
 	i += n
 
-	if (m.Header.Flags & NonDefaultContext) != 0 {
-		m.Context = &OctetString{}
-		n, err = m.Context.UnmarshalBinary(buf[i:])
+	buf, err = pduBytes(buf, h)
+	if err != nil {
+		return nil, i, err
+	}
+
+	*context = nil
+	if (h.Flags & NonDefaultContext) != 0 {
+		*context = &OctetString{}
+		n, err = (*context).UnmarshalBinary(buf[i:])
 		if err != nil {
-			return i, nil
+			return nil, i, err
 		}
 		i += n
 	}
+	return buf, i, nil
+}
+
+func appendVarBindList(dst []byte, vbs []VarBind) ([]byte, error) {
+	var err error
+	for _, v := range vbs {
+		dst, err = v.AppendBinary(dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
 
-	for i < int(m.Header.PayloadLength) {
+// unmarshalVarBindList decodes varbinds until buf is exhausted
+func unmarshalVarBindList(buf []byte) ([]VarBind, int, error) {
+	var vbs []VarBind
+	i := 0
+	for i < len(buf) {
 		var vb VarBind
-		n, err = vb.UnmarshalBinary(buf[i:])
+		n, err := vb.UnmarshalBinary(buf[i:])
 		if err != nil {
-			return i, nil
+			return vbs, i, err
 		}
 		i += n
-		m.VarBindList = append(m.VarBindList, vb)
+		vbs = append(vbs, vb)
 	}
-	return i, nil
+	return vbs, i, nil
 }
 
-// helpers ====================================================================
-func netMarshal(w io.Writer, data interface{}) error {
-	return binary.Write(w, binary.BigEndian, data)
+func appendSearchRangeList(dst []byte, srs []SearchRange) ([]byte, error) {
+	var err error
+	for _, sr := range srs {
+		dst, err = appendAll(dst, &sr.Start, &sr.End)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
 }
 
-func netMarshalMany(w io.Writer, items ...interface{}) error {
-	for _, x := range items {
-		err := netMarshal(w, x)
+// unmarshalSearchRangeList decodes search ranges until buf is exhausted
+func unmarshalSearchRangeList(buf []byte) ([]SearchRange, int, error) {
+	var srs []SearchRange
+	i := 0
+	for i < len(buf) {
+		var sr SearchRange
+		n, err := sr.Start.UnmarshalBinary(buf[i:])
 		if err != nil {
-			return err
+			return srs, i, err
 		}
+		i += n
+		n, err = sr.End.UnmarshalBinary(buf[i:])
+		if err != nil {
+			return srs, i, err
+		}
+		i += n
+		srs = append(srs, sr)
+	}
+	return srs, i, nil
+}
+
+// need returns ErrTruncated unless buf holds at least n bytes
+func need(buf []byte, n int) error {
+	if len(buf) < n {
+		return fmt.Errorf("%w: need %d bytes, have %d", ErrTruncated, n, len(buf))
 	}
 	return nil
 }
 
+// pduBytes bounds buf to the PDU described by the header h
+func pduBytes(buf []byte, h *Header) ([]byte, error) {
+	if h.PayloadLength < 0 {
+		return nil, fmt.Errorf("negative payload length %d", h.PayloadLength)
+	}
+	n := HeaderSize + int(h.PayloadLength)
+	if err := need(buf, n); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
 func netUnmarshal(r *bytes.Reader, data interface{}) (int, error) {
 	before := r.Len()
 	err := binary.Read(r, binary.BigEndian, data)
@@ -960,23 +1889,47 @@ func netUnmarshalMany(r *bytes.Reader, items ...interface{}) (int, error) {
 	return n, nil
 }
 
-func marshalToBuf(buf *bytes.Buffer, m Message) (int, error) {
-	b, err := m.MarshalBinary()
-	if err != nil {
-		return 0, err
-	}
-	n, err := buf.Write(b)
-	return n, err
-}
-
-func marshalToBufs(buf *bytes.Buffer, ms ...Message) (int, error) {
-	n := 0
+func appendAll(dst []byte, ms ...Message) ([]byte, error) {
+	var err error
 	for _, m := range ms {
-		m, err := marshalToBuf(buf, m)
+		dst, err = m.AppendBinary(dst)
 		if err != nil {
-			return n, err
+			return nil, err
 		}
-		n += m
 	}
-	return n, nil
+	return dst, nil
+}
+
+// buffer pooling .............................................................
+
+// maxPooledBuffer is the largest buffer that will be returned to the pool,
+// anything bigger is left for the garbage collector
+const maxPooledBuffer = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// putBuffer returns a buffer to the pool, the buffer must not be used after
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(b)
+}
+
+// releaseBuffer returns the backing array of buf to the pool
+func releaseBuffer(buf []byte) {
+	b := buf[:0]
+	putBuffer(&b)
 }
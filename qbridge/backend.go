@@ -0,0 +1,111 @@
+package main
+
+// This file contains the backend the agent reads and changes the bridge
+// through, which is netlink unless replaced, e.g. by a fake in tests
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"github.com/rcgoodfellow/netlink"
+)
+
+// Backend is the part of netlink the agent uses
+type Backend interface {
+	GetBridgeVlanInfo() ([]*netlink.BridgeVlanInfo, error)
+	GetBridgeLinkInfo() ([]*netlink.BridgeLinkInfo, error)
+	BridgeVlanAdd(vid uint, index int, bflags, vflags uint) error
+	BridgeVlanDel(vid uint, index int, bflags, vflags uint) error
+	LinkList() ([]netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkByName(name string) (netlink.Link, error)
+	NeighList(linkIndex, family int) ([]netlink.Neigh, error)
+	LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error
+}
+
+// the backend in use
+var nl Backend = kernel{}
+
+// kernel is the backend of the running kernel, over netlink
+type kernel struct{}
+
+func (kernel) GetBridgeVlanInfo() ([]*netlink.BridgeVlanInfo, error) {
+	return netlink.GetBridgeVlanInfo()
+}
+
+func (kernel) GetBridgeLinkInfo() ([]*netlink.BridgeLinkInfo, error) {
+	return netlink.GetBridgeLinkInfo()
+}
+
+func (kernel) BridgeVlanAdd(vid uint, index int, bflags, vflags uint) error {
+	return netlink.BridgeVlanAdd(vid, index, bflags, vflags)
+}
+
+func (kernel) BridgeVlanDel(vid uint, index int, bflags, vflags uint) error {
+	return netlink.BridgeVlanDel(vid, index, bflags, vflags)
+}
+
+func (kernel) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+func (kernel) LinkByIndex(index int) (netlink.Link, error) {
+	return netlink.LinkByIndex(index)
+}
+
+func (kernel) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+func (kernel) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	return netlink.NeighList(linkIndex, family)
+}
+
+func (kernel) LinkSubscribe(ch chan<- netlink.LinkUpdate,
+	done <-chan struct{}) error {
+	return netlink.LinkSubscribe(ch, done)
+}
+
+// snapshot is a backend that dumps the vlans and links of bridges once, and
+// answers every later dump from the first. The tables generated from it are
+// then read from the same state of the bridge, which is only dumped once
+// however many tables there are.
+type snapshot struct {
+	Backend
+	vinfo []*netlink.BridgeVlanInfo
+	linfo []*netlink.BridgeLinkInfo
+	links []netlink.Link
+}
+
+func (s *snapshot) GetBridgeVlanInfo() ([]*netlink.BridgeVlanInfo, error) {
+	if s.vinfo == nil {
+		vinfo, err := s.Backend.GetBridgeVlanInfo()
+		if err != nil {
+			return nil, err
+		}
+		s.vinfo = vinfo
+	}
+	return s.vinfo, nil
+}
+
+func (s *snapshot) GetBridgeLinkInfo() ([]*netlink.BridgeLinkInfo, error) {
+	if s.linfo == nil {
+		linfo, err := s.Backend.GetBridgeLinkInfo()
+		if err != nil {
+			return nil, err
+		}
+		s.linfo = linfo
+	}
+	return s.linfo, nil
+}
+
+func (s *snapshot) LinkList() ([]netlink.Link, error) {
+	if s.links == nil {
+		links, err := s.Backend.LinkList()
+		if err != nil {
+			return nil, err
+		}
+		s.links = links
+	}
+	return s.links, nil
+}
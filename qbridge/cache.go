@@ -0,0 +1,151 @@
+package main
+
+// This file contains the table cache, which keeps the generated table until
+// netlink reports a change to the links of the bridge
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/netlink"
+	"log"
+	"sync"
+	"time"
+)
+
+// the fdb changes as addresses are learned and age out, which is not reported
+// as a link change, so the fdb is read again when it is this old
+const fdb_max_age = 5 * time.Second
+
+// without a subscription to link changes the vlans are read again when they
+// are this old, so that a walk is not answered from a new table each request
+const unwatched_max_age = time.Second
+
+// tableCache holds the generated table for as long as it is current. The
+// tables of the vlans and the fdb are kept apart, as the fdb goes out of date
+// with age while the vlans only go out of date when the bridge changes. The
+// version is bumped by every change netlink reports, vlans read at an older
+// version are read again when next asked for. Until the subscription to link
+// changes is made the vlans go out of date with age as well.
+type tableCache struct {
+	mtx     sync.Mutex
+	table   agx.VarBindList //the vlans and the fdb, merged
+	vlans   agx.VarBindList
+	fdb     agx.VarBindList
+	version uint64
+	built   uint64
+	at      time.Time //when the vlans were read
+	fdbAt   time.Time
+	live    bool
+}
+
+var cache = &tableCache{version: 1}
+
+// Returns the table, regenerating the parts of it that are out of date
+func (c *tableCache) get() agx.VarBindList {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	vlans := c.built != c.version ||
+		!c.live && time.Since(c.at) > unwatched_max_age
+	fdb := time.Since(c.fdbAt) > fdb_max_age
+	if !vlans && !fdb {
+		return c.table
+	}
+
+	//the tables are generated from one dump of the bridge
+	b := &snapshot{Backend: nl}
+	if vlans {
+		c.vlans = generateVlanTables(b)
+		c.built = c.version
+		c.at = time.Now()
+	}
+	if fdb {
+		c.fdb = generateFdbTable(b)
+		c.fdbAt = time.Now()
+	}
+	c.table = merge(c.vlans, c.fdb)
+	return c.table
+}
+
+// Marks the table out of date
+func (c *tableCache) invalidate() {
+	c.mtx.Lock()
+	c.version++
+	c.mtx.Unlock()
+}
+
+func (c *tableCache) setLive(live bool) {
+	c.mtx.Lock()
+	c.live = live
+	c.version++
+	c.mtx.Unlock()
+}
+
+// Merges two tables that are in order into one
+func merge(a, b agx.VarBindList) agx.VarBindList {
+
+	table := make(agx.VarBindList, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].Name.LessThan(a[0].Name) {
+			table = append(table, b[0])
+			b = b[1:]
+		} else {
+			table = append(table, a[0])
+			a = a[1:]
+		}
+	}
+	table = append(table, a...)
+	return append(table, b...)
+}
+
+// Subscribes to link changes, which include changes to the vlans of bridge
+// ports, invalidating the cache on changes to the bridge and its ports and
+// notifying changes of the ports until done is closed. Should the subscription be lost the cache goes back
+// to reading the vlans again once they are old.
+func watchLinks(done <-chan struct{}) error {
+
+	updates := make(chan netlink.LinkUpdate)
+	err := nl.LinkSubscribe(updates, done)
+	if err != nil {
+		return err
+	}
+	cache.setLive(true)
+
+	go func() {
+		for u := range updates {
+			if !bridgeLink(u.Link) {
+				continue
+			}
+			log.Printf("[cache] link %d changed", u.Attrs().Index)
+			cache.invalidate()
+			linkChanged(u.Link)
+		}
+		cache.setLive(false)
+		select {
+		case <-done:
+		default:
+			log.Printf("[cache] lost link subscription, reading vlans by age")
+		}
+	}()
+
+	return nil
+}
+
+// Returns whether l is the bridge being served or one of its ports. A link the
+// agent has as a port counts as well, so that leaving the bridge is seen.
+func bridgeLink(l netlink.Link) bool {
+
+	a := l.Attrs()
+	if isPort(a.Name) && onBridge(a.MasterIndex) {
+		return true
+	}
+	if a.Index == bridgeIdx || bridgeIdx == 0 && l.Type() == "bridge" {
+		return true
+	}
+	notifier.mtx.Lock()
+	_, known := notifier.up[a.Index]
+	notifier.mtx.Unlock()
+	return known
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/netlink"
+	"sort"
+)
+
+// fakeBackend is a bridge held in memory
+type fakeBackend struct {
+	links   []netlink.Link
+	masters map[int]int             //bridge of each port
+	vlans   map[int]map[uint16]uint //flags of each vlan, by link
+	neighs  []netlink.Neigh
+}
+
+type fakeLink struct {
+	netlink.LinkAttrs
+	kind string
+}
+
+func (l *fakeLink) Attrs() *netlink.LinkAttrs { return &l.LinkAttrs }
+func (l *fakeLink) Type() string              { return l.kind }
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		masters: make(map[int]int),
+		vlans:   make(map[int]map[uint16]uint),
+	}
+}
+
+// addBridge adds a bridge with ports, numbering links from index
+func (f *fakeBackend) addBridge(name string, index int, ports ...string) {
+	f.links = append(f.links, &fakeLink{
+		LinkAttrs: netlink.LinkAttrs{Index: index, Name: name},
+		kind:      "bridge",
+	})
+	for i, p := range ports {
+		port := index + i + 1
+		f.links = append(f.links, &fakeLink{
+			LinkAttrs: netlink.LinkAttrs{Index: port, Name: p, MasterIndex: index},
+			kind:      "device",
+		})
+		f.masters[port] = index
+	}
+}
+
+func (f *fakeBackend) GetBridgeVlanInfo() ([]*netlink.BridgeVlanInfo, error) {
+	var result []*netlink.BridgeVlanInfo
+	for index, vlans := range f.vlans {
+		info := &netlink.BridgeVlanInfo{Index: index}
+		for vid, flags := range vlans {
+			info.Vlans = append(info.Vlans, &netlink.VlanInfo{
+				Vid:      vid,
+				Flags:    uint16(flags),
+				Pvid:     flags&netlink.BRIDGE_VLAN_INFO_PVID != 0,
+				Untagged: flags&netlink.BRIDGE_VLAN_INFO_UNTAGGED != 0,
+			})
+		}
+		sort.Slice(info.Vlans, func(i, j int) bool {
+			return info.Vlans[i].Vid < info.Vlans[j].Vid
+		})
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Index < result[j].Index
+	})
+	return result, nil
+}
+
+func (f *fakeBackend) GetBridgeLinkInfo() ([]*netlink.BridgeLinkInfo, error) {
+	var result []*netlink.BridgeLinkInfo
+	for port, bridge := range f.masters {
+		result = append(result, &netlink.BridgeLinkInfo{
+			Index: int32(port), Master: int32(bridge)})
+	}
+	return result, nil
+}
+
+func (f *fakeBackend) BridgeVlanAdd(vid uint, index int, bflags,
+	vflags uint) error {
+
+	if f.vlans[index] == nil {
+		f.vlans[index] = make(map[uint16]uint)
+	}
+	//a link has a single pvid
+	if vflags&netlink.BRIDGE_VLAN_INFO_PVID != 0 {
+		for v := range f.vlans[index] {
+			f.vlans[index][v] &^= netlink.BRIDGE_VLAN_INFO_PVID
+		}
+	}
+	f.vlans[index][uint16(vid)] = vflags
+	return nil
+}
+
+func (f *fakeBackend) BridgeVlanDel(vid uint, index int, bflags,
+	vflags uint) error {
+
+	if _, ok := f.vlans[index][uint16(vid)]; !ok {
+		return fmt.Errorf("vlan %d is not on link %d", vid, index)
+	}
+	delete(f.vlans[index], uint16(vid))
+	if len(f.vlans[index]) == 0 {
+		delete(f.vlans, index)
+	}
+	return nil
+}
+
+func (f *fakeBackend) LinkList() ([]netlink.Link, error) {
+	return f.links, nil
+}
+
+func (f *fakeBackend) LinkByIndex(index int) (netlink.Link, error) {
+	for _, l := range f.links {
+		if l.Attrs().Index == index {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no link %d", index)
+}
+
+func (f *fakeBackend) LinkByName(name string) (netlink.Link, error) {
+	for _, l := range f.links {
+		if l.Attrs().Name == name {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no link %s", name)
+}
+
+func (f *fakeBackend) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	return f.neighs, nil
+}
+
+func (f *fakeBackend) LinkSubscribe(ch chan<- netlink.LinkUpdate,
+	done <-chan struct{}) error {
+	return fmt.Errorf("link changes are not reported")
+}
@@ -0,0 +1,133 @@
+package main
+
+// This file contains the forwarding database tables, dot1qFdbTable and
+// dot1qTpFdbTable, which are generated from the fdb of the kernel bridge
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/mibs"
+	"github.com/rcgoodfellow/netlink"
+	"log"
+	"syscall"
+)
+
+// transparent forwarding
+const (
+	qf_dynamic_count = mibs.Dot1qFdbDynamicCount
+	qtp_fdb_port     = mibs.Dot1qTpFdbPort
+	qtp_fdb_status   = mibs.Dot1qTpFdbStatus
+)
+
+// the fdb of a bridge that is not vlan aware has no vlan, its entries are
+// put in the fdb of the default vlan
+const default_fid = 1
+
+// Generates the 'Fdb' and 'Tp Fdb' Tables. The kernel learns addresses
+// independently for each vlan, so fdb ids are vlan ids.
+func generateFdbTable(b Backend) agx.VarBindList {
+	table := make(map[string]*agx.VarBind)
+
+	bridges, err := physicalBridgeVlanInfo(b)
+	if err != nil {
+		log.Printf("[fdb] error reading bridge ports: %v", err)
+		return nil
+	}
+	neighs, err := b.NeighList(0, syscall.AF_BRIDGE)
+	if err != nil {
+		log.Printf("[fdb] error reading fdb: %v", err)
+		return nil
+	}
+
+	//ports are numbered by their position on the bridge, as in
+	//dot1dBasePortTable
+	ports := make(map[int]int)
+	for bridge_index, bridge := range bridges {
+		ports[bridge.Index] = bridge_index + 1
+	}
+
+	dynamic := make(map[int]uint32)
+	for _, n := range neighs {
+
+		//entries that are only in the hardware of a port are not forwarded on
+		//by the bridge
+		if n.Flags&netlink.NTF_MASTER == 0 || len(n.HardwareAddr) != 6 {
+			continue
+		}
+		port, ok := ports[n.LinkIndex]
+		if !ok {
+			continue
+		}
+		fid := n.Vlan
+		if fid == 0 {
+			fid = default_fid
+		}
+
+		//the same address may be reported for a port more than once
+		index := fmt.Sprintf("%d", fid)
+		for _, b := range n.HardwareAddr {
+			index += fmt.Sprintf(".%d", b)
+		}
+		port_tag := fmt.Sprintf("%s.%s", qtp_fdb_port, index)
+		if _, ok := table[port_tag]; ok {
+			continue
+		}
+		status := fdbStatus(n.State)
+
+		port_oid, _ := agx.NewSubtree(port_tag)
+		table[port_tag] = &agx.VarBind{
+			Type: agx.IntegerT,
+			Name: *port_oid,
+			Data: agx.Integer(port),
+		}
+		status_tag := fmt.Sprintf("%s.%s", qtp_fdb_status, index)
+		status_oid, _ := agx.NewSubtree(status_tag)
+		table[status_tag] = &agx.VarBind{
+			Type: agx.IntegerT,
+			Name: *status_oid,
+			Data: agx.Integer(status),
+		}
+
+		if _, ok := dynamic[fid]; !ok {
+			dynamic[fid] = 0
+		}
+		if status == mibs.Dot1qTpFdbStatusLearned {
+			dynamic[fid]++
+		}
+	}
+
+	for fid, count := range dynamic {
+		count_tag := fmt.Sprintf("%s.%d", qf_dynamic_count, fid)
+		count_oid, _ := agx.NewSubtree(count_tag)
+		table[count_tag] = &agx.VarBind{
+			Type: agx.Counter32T,
+			Name: *count_oid,
+			Data: agx.Counter32(count),
+		}
+	}
+
+	result := make(agx.VarBindList, 0, len(table))
+	for _, e := range table {
+		result = append(result, *e)
+	}
+	result.Sort()
+	return result
+}
+
+// Translates the neighbor state of an fdb entry into its dot1qTpFdbStatus
+func fdbStatus(state int) int {
+	switch {
+	//the addresses of the ports themselves
+	case state&netlink.NUD_PERMANENT != 0:
+		return mibs.Dot1qTpFdbStatusSelf
+	//added by 'bridge fdb add ... static'
+	case state&netlink.NUD_NOARP != 0:
+		return mibs.Dot1qTpFdbStatusMgmt
+	case state&(netlink.NUD_REACHABLE|netlink.NUD_STALE) != 0:
+		return mibs.Dot1qTpFdbStatusLearned
+	}
+	return mibs.Dot1qTpFdbStatusOther
+}
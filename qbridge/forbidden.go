@@ -0,0 +1,89 @@
+package main
+
+// This file contains the forbidden egress ports of vlans, which the kernel has
+// no notion of, so they are kept by the agent and enforced on egress sets
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"log"
+)
+
+// the forbidden egress ports of each vlan, by vlan id
+var forbidden = make(map[int][]byte)
+
+// Stages setting the forbidden egress ports of a vlan. A port that is a
+// member of the vlan may not be forbidden, it must be taken out first. The
+// vlan must have a row, forbidding ports does not create one.
+func setForbidden(vid int, ports []byte, sessionId uint32) agx.TestSetResult {
+
+	members, ok := vlanMembers(vid)
+	if !ok {
+		log.Printf("[test-set] vid=%d has no row", vid)
+		return agx.TestSetNoCreation
+	}
+	if overlap(ports, members) {
+		log.Printf("[test-set] vid=%d forbidding member ports", vid)
+		return agx.TestSetInconsistentValue
+	}
+
+	ports = append([]byte(nil), ports...)
+	stage(sessionId, func() error {
+		log.Printf("setting forbidden = %v", ports)
+		forbidden[vid] = ports
+		return nil
+	})
+	return agx.TestSetNoError
+}
+
+// Checks that none of the ports of a vlan are forbidden egress ports
+func checkForbidden(vid int, ports []byte) agx.TestSetResult {
+
+	if overlap(ports, forbidden[vid]) {
+		log.Printf("[test-set] vid=%d adding forbidden ports", vid)
+		return agx.TestSetInconsistentValue
+	}
+	return agx.TestSetNoError
+}
+
+// Returns the ports that are members of a vlan, tagged or untagged, and
+// whether the vlan has a row at all
+func vlanMembers(vid int) ([]byte, bool) {
+
+	table := cache.get()
+	status, _ := agx.NewSubtree(fmt.Sprintf("%s.%d", qvs_status, vid))
+	if _, ok := table.Get(*status); !ok {
+		return nil, false
+	}
+
+	var members []byte
+	for _, column := range []string{qvs_egress, qvs_untagged} {
+		oid, _ := agx.NewSubtree(fmt.Sprintf("%s.%d", column, vid))
+		vb, ok := table.Get(*oid)
+		if !ok {
+			continue
+		}
+		ports, _ := vb.OctetString()
+		for len(members) < len(ports) {
+			members = append(members, 0)
+		}
+		for i := range ports {
+			members[i] |= ports[i]
+		}
+	}
+	return members, true
+}
+
+// Returns whether any port is in both port lists
+func overlap(a, b []byte) bool {
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i]&b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+// This file contains the names of vlans, which the kernel has no notion of,
+// so names set by managers are kept in a row store that outlives the agent
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// dot1qVlanStaticName is a SnmpAdminString of at most 32 octets
+const max_name_length = 32
+
+// the names of vlans, by vlan id, and the store they are kept in
+var names = make(map[int]string)
+var nameStore agx.RowStore
+
+// Opens the store of vlan names at path and loads the names in it
+func loadNames(path string) error {
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	store, err := agx.OpenFileRowStore(path)
+	if err != nil {
+		return err
+	}
+	rows, err := store.LoadRows(nameEntry())
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		name, ok := r.Columns[qvs_name_suffix]
+		if len(r.Index) != 1 || !ok {
+			continue
+		}
+		s, _ := name.OctetString()
+		names[int(r.Index[0])] = string(s)
+	}
+	nameStore = store
+	return nil
+}
+
+// Returns the name of a vlan, which is v<vid> unless set
+func vlanName(vid int) string {
+
+	name, ok := names[vid]
+	if !ok {
+		return fmt.Sprintf("v%d", vid)
+	}
+	return name
+}
+
+// Stages setting the name of a vlan
+func setName(vid int, name []byte, sessionId uint32) agx.TestSetResult {
+
+	if len(name) > max_name_length {
+		return agx.TestSetWrongLength
+	}
+
+	n := string(name)
+	stage(sessionId, func() error {
+		log.Printf("setting name vid=%d name=%s", vid, n)
+		return saveName(vid, &n)
+	})
+	return agx.TestSetNoError
+}
+
+// Saves the name of a vlan, removing it if name is nil
+func saveName(vid int, name *string) error {
+
+	if nameStore != nil {
+		var err error
+		if name == nil {
+			err = nameStore.DeleteRow(nameEntry(), []uint32{uint32(vid)})
+		} else {
+			name_oid, _ :=
+				agx.NewSubtree(fmt.Sprintf("%s.%d", qvs_name, vid))
+			err = nameStore.SaveRow(nameEntry(), agx.TableRow{
+				Index: []uint32{uint32(vid)},
+				Columns: map[uint32]agx.VarBind{
+					qvs_name_suffix: *agx.OctetStringVarBind(
+						*name_oid, []byte(*name)),
+				},
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if name == nil {
+		delete(names, vid)
+	} else {
+		names[vid] = *name
+	}
+	return nil
+}
+
+// Returns the entry the names are kept under in the store
+func nameEntry() agx.Subtree {
+	s, _ := agx.NewSubtree(qvs)
+	return *s
+}
@@ -0,0 +1,98 @@
+package main
+
+// This file contains the notifications of the agent. The links netlink reports
+// changes to are followed, and a linkUp or linkDown is sent through the master
+// when a port of the bridge comes up or goes down. The kernel does not report
+// changes of the spanning tree root as link changes, so newRoot and
+// topologyChange are not sent.
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/mibs"
+	"github.com/rcgoodfellow/netlink"
+	"log"
+	"net"
+	"sync"
+)
+
+// notifier sends notifications through the session with the master, while
+// there is one, and keeps whether each port was last seen up, by link index
+var notifier = struct {
+	mtx  sync.Mutex
+	send func(trap string, vbs ...agx.VarBind) error
+	up   map[int]bool
+}{up: make(map[int]bool)}
+
+// Sets how notifications are sent, nil drops them
+func setNotifier(send func(trap string, vbs ...agx.VarBind) error) {
+	notifier.mtx.Lock()
+	notifier.send = send
+	notifier.mtx.Unlock()
+}
+
+// Records whether each port is up, so that only changes are notified
+func loadLinkState() error {
+
+	links, err := nl.LinkList()
+	if err != nil {
+		return err
+	}
+
+	notifier.mtx.Lock()
+	defer notifier.mtx.Unlock()
+	for _, l := range links {
+		a := l.Attrs()
+		if isPort(a.Name) && onBridge(a.MasterIndex) {
+			notifier.up[a.Index] = a.OperState == netlink.OperUp
+		}
+	}
+	return nil
+}
+
+// Sends linkUp or linkDown when a port of the bridge has come up or gone
+// down since it was last seen. Ports that are new to the agent are recorded
+// without notifying.
+func linkChanged(l netlink.Link) {
+
+	a := l.Attrs()
+	if !isPort(a.Name) || !onBridge(a.MasterIndex) {
+		return
+	}
+	up := a.OperState == netlink.OperUp
+
+	notifier.mtx.Lock()
+	was, known := notifier.up[a.Index]
+	notifier.up[a.Index] = up
+	send := notifier.send
+	notifier.mtx.Unlock()
+
+	if !known || was == up || send == nil {
+		return
+	}
+
+	trap, name, oper := mibs.LinkDown, "linkDown", mibs.IfStatusDown
+	if up {
+		trap, name, oper = mibs.LinkUp, "linkUp", mibs.IfStatusUp
+	}
+	admin := mibs.IfStatusDown
+	if a.Flags&net.FlagUp != 0 {
+		admin = mibs.IfStatusUp
+	}
+
+	ifindex, _ := agx.NewSubtree(mibs.Instance(mibs.IfIndex, uint32(a.Index)))
+	ifadmin, _ := agx.NewSubtree(mibs.Instance(mibs.IfAdminStatus, uint32(a.Index)))
+	ifoper, _ := agx.NewSubtree(mibs.Instance(mibs.IfOperStatus, uint32(a.Index)))
+
+	log.Printf("[notify] %s port=%s", name, a.Name)
+	err := send(trap,
+		agx.IntegerVarBind(*ifindex, int32(a.Index)),
+		agx.IntegerVarBind(*ifadmin, int32(admin)),
+		agx.IntegerVarBind(*ifoper, int32(oper)),
+	)
+	if err != nil {
+		log.Printf("[notify] error sending %s: %v", name, err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+// This file contains the port table, dot1dBasePortTable, which has a row for
+// each port of the bridge
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"log"
+)
+
+// Generates the 'Base Port' Table. Ports are numbered from 1 by their position
+// on the bridge, the numbering the port lists of the vlan tables use.
+func generatePortTable(b Backend) agx.VarBindList {
+	var table agx.VarBindList
+
+	bridges, err := physicalBridgeVlanInfo(b)
+	if err != nil {
+		log.Printf("[ports] error reading bridge ports: %v", err)
+		return nil
+	}
+
+	//each port is its own circuit, which is said with the null oid
+	circuit, _ := agx.NewSubtree("0.0")
+
+	for bridge_index, bridge := range bridges {
+		port := bridge_index + 1
+
+		port_oid, _ := agx.NewSubtree(fmt.Sprintf("%s.%d", db_port, port))
+		table = append(table, agx.VarBind{
+			Type: agx.IntegerT,
+			Name: *port_oid,
+			Data: agx.Integer(port),
+		})
+
+		index_oid, _ := agx.NewSubtree(fmt.Sprintf("%s.%d", db_port_index, port))
+		table = append(table, agx.VarBind{
+			Type: agx.IntegerT,
+			Name: *index_oid,
+			Data: agx.Integer(bridge.Index),
+		})
+
+		circuit_oid, _ :=
+			agx.NewSubtree(fmt.Sprintf("%s.%d", db_port_circuit, port))
+		table = append(table, agx.VarBind{
+			Type: agx.ObjectIdentifierT,
+			Name: *circuit_oid,
+			Data: agx.Oid{Subtree: *circuit},
+		})
+	}
+
+	return table
+}
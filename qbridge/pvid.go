@@ -0,0 +1,110 @@
+package main
+
+// This file contains the port vlan table, dot1qPortVlanTable, of which the
+// pvid of each port is served and may be set
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/mibs"
+	"github.com/rcgoodfellow/netlink"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// port vlan
+const (
+	qpv_pvid = mibs.Dot1qPvid
+)
+
+// Generates the 'Port Vlan' Table. The pvid of a port is the vlan the kernel
+// has flagged BRIDGE_VLAN_INFO_PVID on it, ports without one drop untagged
+// frames and have no pvid to show.
+func generatePvidTable(b Backend) agx.VarBindList {
+	var table agx.VarBindList
+
+	bridges, err := physicalBridgeVlanInfo(b)
+	if err != nil {
+		log.Printf("[pvid] error reading bridge ports: %v", err)
+		return nil
+	}
+
+	for bridge_index, bridge := range bridges {
+		vlan := pvid(bridge)
+		if vlan == nil {
+			continue
+		}
+		pvid_oid, _ :=
+			agx.NewSubtree(fmt.Sprintf("%s.%d", qpv_pvid, bridge_index+1))
+		table = append(table, agx.VarBind{
+			Type: agx.Gauge32T,
+			Name: *pvid_oid,
+			Data: agx.Gauge32(vlan.Vid),
+		})
+	}
+
+	return table
+}
+
+// Stages setting the pvid of a port. The kernel keeps a single pvid for each
+// port, so flagging the new vlan unflags the old one. The port becomes a
+// member of the vlan if it is not one already.
+func setPvid(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+
+	log.Printf("[test-set] oid::%s session=%d", vb.Name.String(), sessionId)
+
+	index := strings.TrimPrefix(vb.Name.String(), qpv_pvid+".")
+	port, err := strconv.Atoi(index)
+	if err != nil {
+		log.Printf("[test-set] error parsing oid=%s", vb.Name.String())
+		return agx.TestSetNoCreation
+	}
+
+	vid, ok := vb.Data.(agx.Gauge32)
+	if !ok {
+		log.Printf("[test-set] error setting pvid: varbind must be a gauge")
+		return agx.TestSetWrongType
+	}
+	if vid < 1 || vid > max_vlanid {
+		return agx.TestSetWrongValue
+	}
+
+	bridges, err := physicalBridgeVlanInfo(nl)
+	if err != nil {
+		log.Printf("[test-set] error reading bridge ports: %v", err)
+		return agx.TestSetGenError
+	}
+	if port < 1 || port > len(bridges) {
+		return agx.TestSetNoCreation
+	}
+	bridge := bridges[port-1]
+
+	//keep the vlan untagged on the port if it is already
+	vinfo_flags := uint(netlink.BRIDGE_VLAN_INFO_PVID)
+	for _, vlan := range bridge.Vlans {
+		if int(vlan.Vid) == int(vid) && vlan.Untagged {
+			vinfo_flags |= netlink.BRIDGE_VLAN_INFO_UNTAGGED
+		}
+	}
+
+	stage(sessionId, func() error {
+		log.Printf("setting pvid port=%d vid=%d", port, vid)
+		return nl.BridgeVlanAdd(uint(vid), bridge.Index, 0, vinfo_flags)
+	})
+
+	return agx.TestSetNoError
+}
+
+// Returns the vlan that is the pvid of bridge, if there is one
+func pvid(bridge *netlink.BridgeVlanInfo) *netlink.VlanInfo {
+	for _, vlan := range bridge.Vlans {
+		if vlan.Pvid {
+			return vlan
+		}
+	}
+	return nil
+}
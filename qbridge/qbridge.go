@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/mibs"
 	"github.com/rcgoodfellow/netlink"
 	"io"
 	"log"
 	"math"
 	"os"
-	"sort"
+	"os/signal"
+	"path"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 /*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
@@ -21,28 +27,32 @@ import (
 
 // top level objects
 const (
-	qbridge  = "1.3.6.1.2.1.17"
-	d_base   = qbridge + ".1"
-	q_base   = qbridge + ".7.1.1"
-	q_tp     = qbridge + ".7.1.2"
-	q_static = qbridge + ".7.1.3"
-	q_vlan   = qbridge + ".7.1.4"
+	qbridge  = mibs.Dot1dBridge
+	d_base   = mibs.Dot1dBase
+	q_base   = mibs.Dot1qBase
+	q_tp     = mibs.Dot1qTp
+	q_static = mibs.Dot1qStatic
+	q_vlan   = mibs.Dot1qVlan
 )
 
 // bridge-base
 const (
-	db_ports      = d_base + ".4"
-	db_numports   = d_base + ".2.0"
-	db_port_index = db_ports + ".1.2"
+	db_ports        = mibs.Dot1dBasePortTable
+	db_address      = mibs.Dot1dBaseBridgeAddress + ".0"
+	db_numports     = mibs.Dot1dBaseNumPorts + ".0"
+	db_type         = mibs.Dot1dBaseType + ".0"
+	db_port         = mibs.Dot1dBasePort
+	db_port_index   = mibs.Dot1dBasePortIfIndex
+	db_port_circuit = mibs.Dot1dBasePortCircuit
 )
 
 // qbridge-base
 const (
-	qb_version        = q_base + ".1.0"
-	qb_maxvlanid      = q_base + ".2.0"
-	qb_supportedvlans = q_base + ".3.0"
-	qb_numvlans       = q_base + ".4.0"
-	qb_gvrp           = q_base + ".5.0"
+	qb_version        = mibs.Dot1qVlanVersionNumber + ".0"
+	qb_maxvlanid      = mibs.Dot1qMaxVlanId + ".0"
+	qb_supportedvlans = mibs.Dot1qMaxSupportedVlans + ".0"
+	qb_numvlans       = mibs.Dot1qNumVlans + ".0"
+	qb_gvrp           = mibs.Dot1qGvrpStatus + ".0"
 )
 
 // vlan static
@@ -54,12 +64,12 @@ const (
 	qvs_status_suffix           = 5
 )
 const (
-	qvs                  = q_vlan + ".3.1"
-	qvs_name             = qvs + ".1"
-	qvs_egress           = qvs + ".2"
-	qvs_forbidden_egress = qvs + ".3"
-	qvs_untagged         = qvs + ".4"
-	qvs_status           = qvs + ".5"
+	qvs                  = mibs.Dot1qVlanStaticEntry
+	qvs_name             = mibs.Dot1qVlanStaticName
+	qvs_egress           = mibs.Dot1qVlanStaticEgressPorts
+	qvs_forbidden_egress = mibs.Dot1qVlanForbiddenEgressPorts
+	qvs_untagged         = mibs.Dot1qVlanStaticUntaggedPorts
+	qvs_status           = mibs.Dot1qVlanStaticRowStatus
 )
 
 /*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
@@ -72,7 +82,16 @@ const (
 	vlan_version        = 1
 	max_vlanid          = 4094
 	max_supported_vlans = 4094
-	gvrp_status         = 2
+	//the linux bridge implements neither gvrp nor mvrp, which the kernel only
+	//runs on 802.1Q vlan devices, so gvrp is disabled and cannot be enabled
+	gvrp_status = 2
+)
+
+const (
+	//how long to wait before opening a session the master agent refused
+	reconnect_interval = 5 * time.Second
+	//how long sets underway are given to finish when shutting down
+	shutdown_timeout = 5 * time.Second
 )
 
 /*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
@@ -87,14 +106,8 @@ type VlanTableEntry struct {
 }
 type VlanTable map[int]*VlanTableEntry
 
-type QVSTable []*agx.VarBind
-
-func (t QVSTable) Len() int           { return len(t) }
-func (t QVSTable) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
-func (t QVSTable) Less(i, j int) bool { return t[i].Name.LessThan(t[j].Name) }
-
-var qtable QVSTable
-var swptable []int
+var portPatterns = []string{"swp*"}
+var bridgeName string
 var bridgeIdx int
 var vtable map[int][]uint16
 
@@ -118,30 +131,111 @@ func main() {
 	mw := io.MultiWriter(os.Stdout, logfile)
 	log.SetOutput(mw)
 
-	qbridge_subtree, _ := agx.NewSubtree(qbridge)
+	flag.StringVar(&bridgeName, "bridge", "",
+		"bridge to serve, in the context named after it, when a host has several")
+	ports := flag.String("ports", "swp*",
+		"comma separated shell patterns or names of the interfaces vlans are "+
+			"set on, e.g. eth*,enp*,bond0")
+	namesPath := flag.String("names", "/var/lib/qbridge/names.json",
+		"file the names of vlans are kept in")
+	flag.Parse()
+	portPatterns = strings.Split(*ports, ",")
+	for _, pattern := range portPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Fatalf("bad port pattern %s: %v", pattern, err)
+		}
+	}
+	if bridgeName != "" {
+		bridge, err := nl.LinkByName(bridgeName)
+		if err != nil {
+			log.Fatalf("failed to find bridge %s: %v", bridgeName, err)
+		}
+		bridgeIdx = bridge.Attrs().Index
+		log.SetPrefix(fmt.Sprintf("[%s] ", bridgeName))
+	}
+
+	err = loadNames(*namesPath)
+	if err != nil {
+		log.Printf("failed to load vlan names, names will not be kept: %v", err)
+	}
 
-	qtable = generateQVSTable()
-	swptable = generateSWPTable()
 	vtable = make(map[int][]uint16)
 	generateVtable()
 
-	id, descr := "1.2.3.4.7", "qbridge-agent"
-	c, err := agx.Connect(&id, &descr)
+	err = loadLinkState()
 	if err != nil {
-		log.Fatalf("connection failed %v", err)
+		log.Printf("failed to read link state: %v", err)
 	}
-	defer c.Disconnect()
 
-	err = c.Register(qbridge)
+	//the table is only regenerated when the bridge changes
+	done := make(chan struct{})
+	defer close(done)
+	err = watchLinks(done)
 	if err != nil {
-		log.Fatalf("agent registration failed %v", err)
+		log.Printf("failed to subscribe to link changes: %v", err)
 	}
-	defer func() {
-		err = c.Unregister(qbridge)
+
+	//shut down cleanly on SIGTERM and SIGINT
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		s := <-sigs
+		log.Printf("received %v, shutting down", s)
+		stop()
+	}()
+
+	//the session is opened again whenever the master agent restarts
+	for ctx.Err() == nil {
+
+		c, err := agx.ConnectWithRetry(ctx, "1.2.3.4.7",
+			agx.WithDescription("qbridge-agent"),
+			agx.WithAudit(func(r agx.AuditRecord) {
+				log.Printf("[audit] %v", r)
+			}))
 		if err != nil {
-			log.Fatalf("agent registration failed %v", err)
+			if ctx.Err() == nil {
+				log.Printf("connection failed %v", err)
+				time.Sleep(reconnect_interval)
+			}
+			continue
 		}
-	}()
+
+		err = serve(c)
+		if err != nil {
+			log.Printf("agent registration failed %v", err)
+			c.Disconnect()
+			time.Sleep(reconnect_interval)
+			continue
+		}
+		setNotifier(c.Notify)
+
+		select {
+		case <-c.Done():
+			log.Printf("session closed, reconnecting")
+		case <-ctx.Done():
+			//unregisters and closes the session once sets underway are done
+			sctx, cancel :=
+				context.WithTimeout(context.Background(), shutdown_timeout)
+			err = c.Shutdown(sctx)
+			cancel()
+			if err != nil {
+				log.Printf("shutdown failed %v", err)
+			}
+		}
+		setNotifier(nil)
+	}
+
+	log.Printf("exiting")
+	logfile.Sync()
+}
+
+// Installs the handlers of the agent on c and registers the bridge, which if
+// picked by name is served in the context of the same name
+func serve(c *agx.Connection) error {
+
+	qbridge_subtree, _ := agx.NewSubtree(qbridge)
 
 	//Vlan Base +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
@@ -182,8 +276,31 @@ func main() {
 
 	})
 
+	c.OnGet(db_address, func(oid agx.Subtree) agx.VarBind {
+		//the address of the bridge is that of the bridge device
+		index, err := bridgeIndex()
+		if err != nil {
+			log.Printf("[dbridge][get] error finding bridge: %v", err)
+			return agx.NoSuchObjectVarBind(oid)
+		}
+		bridge, err := nl.LinkByIndex(index)
+		if err != nil {
+			log.Printf("[dbridge][get] error reading bridge: %v", err)
+			return agx.NoSuchObjectVarBind(oid)
+		}
+		address := bridge.Attrs().HardwareAddr
+		log.Printf("[dbridge][get] address=%s", address)
+		return *agx.OctetStringVarBind(oid, address)
+	})
+
+	c.OnGet(db_type, func(oid agx.Subtree) agx.VarBind {
+		//linux bridges are transparent bridges
+		return agx.IntegerVarBind(oid, mibs.Dot1dBaseTypeTransparentOnly)
+	})
+
 	c.OnGet(db_numports, func(oid agx.Subtree) agx.VarBind {
-		bridges, _ := netlink.GetBridgeVlanInfo()
+		//the ports counted are the rows of dot1dBasePortTable
+		bridges, _ := physicalBridgeVlanInfo(nl)
 		bridge_size := len(bridges)
 		log.Printf("[dbridge][get] bridge_size=%d", bridge_size)
 		return agx.IntegerVarBind(oid, int32(bridge_size))
@@ -193,29 +310,37 @@ func main() {
 
 	c.OnGetSubtree(qbridge, func(oid agx.Subtree, next bool) agx.VarBind {
 
-		qtable = generateQVSTable()
+		//the table is not rebuilt while it is current, so the varbinds of a
+		//bulk request or walk are bound from the same table
+		table := cache.get()
 
-		if len(qtable) == 0 {
+		if len(table) == 0 {
 			log.Printf("vlan table is empty")
 			return agx.EndOfMibViewVarBind(oid)
 		}
 
 		if oid.HasPrefix(*qbridge_subtree) {
-			entry := findEntry(oid, next)
-			if entry == nil {
+			var entry agx.VarBind
+			var ok bool
+			if next {
+				entry, ok = table.NextAfter(oid)
+			} else {
+				entry, ok = table.Get(oid)
+			}
+			if !ok {
 				return agx.EndOfMibViewVarBind(oid)
 			} else {
-				return *entry
+				return entry
 			}
 		} else {
 			log.Printf("[qvs]top level requested - returning first vlan entry name")
-			return *qtable[0]
+			return table[0]
 		}
 
 	})
 
-	//TODO we are doing the actual setting here, should be in commit-set
-	c.OnTestSet(qvs, func(vb agx.VarBind, sessionId int) agx.TestSetResult {
+	//changes are staged here and made to the bridge in commit-set
+	c.OnTestSet(qvs, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
 
 		log.Printf("[test-set] oid::%s session=%d", vb.Name.String(), sessionId)
 
@@ -234,12 +359,16 @@ func main() {
 					"[test-set] error setting egress: varbind must be an octet string")
 				return agx.TestSetWrongType
 			}
-			log.Printf("setting egress = %v", s)
-			err = setVlans(vid, s, false)
-			if err != nil {
-				log.Printf("error setting egress vlans: %v", err)
-				return agx.TestSetGenError
+			if len(s.Octets) < portListLength() {
+				return agx.TestSetWrongLength
 			}
+			if r := checkForbidden(vid, s.Octets); r != agx.TestSetNoError {
+				return r
+			}
+			stage(sessionId, func() error {
+				log.Printf("setting egress = %v", s)
+				return setVlans(vid, s, false)
+			})
 
 		} else if table == qvs_untagged_suffix {
 
@@ -250,20 +379,52 @@ func main() {
 					"[test-set] error setting access: varbind must be an octet string")
 				return agx.TestSetWrongType
 			}
-			log.Printf("setting access = %v", s)
-			err = setVlans(vid, s, true)
-			if err != nil {
-				log.Printf("error setting access vlans: %v", err)
-				return agx.TestSetGenError
+			if len(s.Octets) < portListLength() {
+				return agx.TestSetWrongLength
+			}
+			if r := checkForbidden(vid, s.Octets); r != agx.TestSetNoError {
+				return r
+			}
+			stage(sessionId, func() error {
+				log.Printf("setting access = %v", s)
+				return setVlans(vid, s, true)
+			})
+
+		} else if table == qvs_name_suffix {
+
+			log.Printf("[test-set] name vid=%d", vid)
+			s, ok := vb.Data.(agx.OctetString)
+			if !ok {
+				log.Printf(
+					"[test-set] error setting name: varbind must be an octet string")
+				return agx.TestSetWrongType
+			}
+			return setName(vid, s.Octets, sessionId)
+
+		} else if table == qvs_forbidden_egress_suffix {
+
+			log.Printf("[test-set] forbidden egress vid=%d", vid)
+			s, ok := vb.Data.(agx.OctetString)
+			if !ok {
+				log.Printf(
+					"[test-set] error setting forbidden egress: varbind must be an octet string")
+				return agx.TestSetWrongType
+			}
+			if len(s.Octets) < portListLength() {
+				return agx.TestSetWrongLength
 			}
+			return setForbidden(vid, s.Octets, sessionId)
 
 		} else if table == qvs_status_suffix {
 
 			log.Printf("[test-set] status vid=%d", vid)
-			bridge_flags := uint(netlink.BRIDGE_FLAGS_SELF)
-			vinfo_flags := uint(0)
-			netlink.BridgeVlanAdd(
-				uint(vid), bridgeIdx, bridge_flags, vinfo_flags)
+			status, ok := vb.Data.(agx.Integer)
+			if !ok {
+				log.Printf(
+					"[test-set] error setting status: varbind must be an integer")
+				return agx.TestSetWrongType
+			}
+			return setVlanStatus(vid, int(status), sessionId)
 
 		} else {
 			log.Print("[test-set] noting to set")
@@ -274,24 +435,18 @@ func main() {
 
 	})
 
-	c.OnCommitSet(func(sessionId int) agx.CommitSetResult {
-
-		log.Printf("[commit-set] session=%d", sessionId)
+	c.OnTestSet(qpv_pvid, setPvid)
 
-		return agx.CommitSetNoError
+	c.OnCommitSet(commit)
+	c.OnRawPDU(agx.UndoSetPDU, undo)
+	c.OnCleanupSet(cleanup)
 
+	return c.RegisterWith(agx.Registration{
+		Subtree:  qbridge,
+		Context:  agx.Context(bridgeName),
+		Priority: agx.BasePriority,
+		Timeout:  agx.ConnectionTimeout,
 	})
-
-	c.OnCleanupSet(func(sessionId int) {
-
-		log.Printf("[cleanup-set] session=%d", sessionId)
-
-	})
-
-	//wait for connection to close
-	log.Printf("waiting for close event")
-	<-c.Closed
-	log.Printf("test finished")
 }
 
 func parseOid(oid string) (int, int, error) {
@@ -316,51 +471,10 @@ func parseOid(oid string) (int, int, error) {
 
 // Helpers ====================================================================
 
-func findEntry(oid agx.Subtree, next bool) *agx.VarBind {
-
-	//binary search for the variable we are looking for
-	//it's the smallest value greater than the target oid
-	i := sort.Search(
-		len(qtable),
-		func(i int) bool { return qtable[i].Name.GreaterThanEq(oid) },
-	)
-
-	//binary search found nothing
-	if i == -1 || len(qtable) <= i {
-		//log.Printf("findEntry oid=%s next=%v not found", oid.String(), next)
-		return nil
-	}
-	if !next {
-		if qtable[i].Name.Eq(oid) {
-			//log.Printf("findEntry returning !next=%s", qtable[i].Name.String())
-			return qtable[i]
-		} else {
-			return nil
-		}
-	} else {
-
-		if qtable[i].Name.Eq(oid) {
-			if i < len(qtable)-1 {
-				//log.Printf("findEntry returning next=%s", qtable[i+1].Name.String())
-				return qtable[i+1]
-			} else {
-				return nil
-			}
-		} else {
-			//log.Printf("findEntry returning next=%s", qtable[i].Name.String())
-			return qtable[i]
-		}
-
-	}
-
-	//log.Printf("findEntry oid=%s next=%v i=%d not found", oid.String(), next, i)
-	return nil
-}
-
 //Genertes a table keyed by vlan number
 func generateVlanTable() VlanTable {
 	//bridges, _ := netlink.GetBridgeVlanInfo()
-	bridges, _ := physicalBridgeVlanInfo()
+	bridges, _ := physicalBridgeVlanInfo(nl)
 	table := make(VlanTable)
 	for _, bridge := range bridges {
 		for _, vlan := range bridge.Vlans {
@@ -380,36 +494,28 @@ func generateVlanTable() VlanTable {
 	return table
 }
 
-func generateSWPTable() []int {
+// Returns the ports of the bridge in the order they are numbered, by their
+// position in the list, with the vlans of each. Every table and port list of
+// the agent numbers ports this way. The ports are the links whose names match
+// a port pattern that are members of the bridge being served, a port without
+// vlans is listed without them.
+func physicalBridgeVlanInfo(b Backend) ([]*netlink.BridgeVlanInfo, error) {
 
-	var result []int
-
-	links, err := netlink.LinkList()
+	links, err := b.LinkList()
 	if err != nil {
-		log.Printf("fail to get list of physical links")
-		return nil
-	}
-
-	for _, l := range links {
-		if strings.HasPrefix(l.Attrs().Name, "swp") {
-			result = append(result, l.Attrs().Index)
-		}
+		return nil, err
 	}
 
-	log.Printf("SWP: %#v", result)
-
-	return result
-
-}
-
-func physicalBridgeVlanInfo() ([]*netlink.BridgeVlanInfo, error) {
-
-	vinfo, err := netlink.GetBridgeVlanInfo()
+	vinfo, err := b.GetBridgeVlanInfo()
 	if err != nil {
 		return nil, err
 	}
+	vinfo_lookup := make(map[int]*netlink.BridgeVlanInfo)
+	for _, x := range vinfo {
+		vinfo_lookup[x.Index] = x
+	}
 
-	linfo, err := netlink.GetBridgeLinkInfo()
+	linfo, err := b.GetBridgeLinkInfo()
 	if err != nil {
 		return nil, err
 	}
@@ -419,89 +525,101 @@ func physicalBridgeVlanInfo() ([]*netlink.BridgeVlanInfo, error) {
 	}
 
 	var result []*netlink.BridgeVlanInfo
-	for _, v := range vinfo {
-		_, ok := linfo_lookup[int(v.Index)]
-		if ok {
-			result = append(result, v)
+	for _, l := range links {
+		index := l.Attrs().Index
+		x, ok := linfo_lookup[index]
+		if !ok || x.Master == x.Index || !onBridge(int(x.Master)) ||
+			!isPort(l.Attrs().Name) {
+			continue
+		}
+		v, ok := vinfo_lookup[index]
+		if !ok {
+			v = &netlink.BridgeVlanInfo{Index: index}
 		}
+		result = append(result, v)
 	}
 	return result, nil
 }
 
+// isPort returns whether the interface named name matches one of the port
+// patterns
+func isPort(name string) bool {
+	for _, pattern := range portPatterns {
+		//patterns are checked when they are given
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// onBridge returns whether a port whose master is the link with index master
+// is on the bridge being served. Every bridge is served when none is named.
+func onBridge(master int) bool {
+	return bridgeIdx == 0 || master == bridgeIdx
+}
+
 //Generates the 'Vlan Static' Table
-func generateQVSTable() QVSTable {
+func generateQVSTable(b Backend) agx.VarBindList {
 	table := make(map[string]*agx.VarBind)
 
 	//bridges, _ := netlink.GetBridgeVlanInfo()
-	bridges, _ := physicalBridgeVlanInfo()
+	bridges, _ := physicalBridgeVlanInfo(b)
 
 	vtable_length := int(math.Ceil(float64(len(bridges)) / 8))
+	members := make(map[int]vlanPorts)
 	for bridge_index, bridge := range bridges {
 
-		bindex_tag := fmt.Sprintf("%s.%d", db_port_index, bridge_index+1)
-		bindex_oid, _ := agx.NewSubtree(bindex_tag)
-		table[bindex_tag] = &agx.VarBind{
-			Type: agx.IntegerT,
-			Name: *bindex_oid,
-			Data: int32(bridge.Index),
-		}
-
 		for _, vlan := range bridge.Vlans {
 
-			//bridge_index := bridge.Index
-
-			//generate the name, egress and access oid tags for the current vlan
-			name_tag := fmt.Sprintf("%s.%d", qvs_name, vlan.Vid)
-			name_oid, _ := agx.NewSubtree(name_tag)
-
-			egress_tag := fmt.Sprintf("%s.%d", qvs_egress, vlan.Vid)
-			egress_oid, _ := agx.NewSubtree(egress_tag)
-
-			access_tag := fmt.Sprintf("%s.%d", qvs_untagged, vlan.Vid)
-			access_oid, _ := agx.NewSubtree(access_tag)
-
-			//log.Printf("VLAN vid=%d bid=%d", vlan.Vid, bridge_index+1)
-
-			//each vlan gets a name
-			entry := &agx.VarBind{
-				Type: agx.OctetStringT,
-				Name: *name_oid,
-				Data: *agx.NewOctetString([]byte(fmt.Sprintf("v%d", vlan.Vid))),
-			}
-			table[name_tag] = entry
-
-			//ensure the vlan has access and egress tables
-			ok := false
-			entry, ok = table[egress_tag]
-			if !ok {
-				entry =
-					agx.OctetStringVarBind(*egress_oid, make([]byte, vtable_length))
-				table[egress_tag] = entry
-			}
-			entry, ok = table[access_tag]
+			//each vlan gets a name and egress and access tables, made when
+			//the first port of the vlan is seen
+			vid := int(vlan.Vid)
+			ports, ok := members[vid]
 			if !ok {
-				entry =
-					agx.OctetStringVarBind(*access_oid, make([]byte, vtable_length))
-				table[access_tag] = entry
+				ports = addVlanEntries(table, vid, vtable_length)
+				members[vid] = ports
 			}
 
 			//set the egress and access tables for each vlan
 			if vlan.Untagged {
-				entry, _ = table[access_tag]
-				SetPort(bridge_index, entry.Data.(agx.OctetString).Octets[:])
+				SetPort(bridge_index, ports.access)
 			} else {
-				entry, _ = table[egress_tag]
-				SetPort(bridge_index, entry.Data.(agx.OctetString).Octets[:])
+				SetPort(bridge_index, ports.egress)
 			}
 		}
 	}
 
+	//every vlan has an active row, including those created on the bridge
+	//that no port is a member of yet
+	vlans, _ := bridgeVlans(b)
+	for vid := range vlans {
+
+		if _, ok := members[vid]; !ok {
+			addVlanEntries(table, vid, vtable_length)
+		}
+
+		forbidden_tag := fmt.Sprintf("%s.%d", qvs_forbidden_egress, vid)
+		forbidden_oid, _ := agx.NewSubtree(forbidden_tag)
+		ports := make([]byte, vtable_length)
+		copy(ports, forbidden[vid])
+		table[forbidden_tag] = agx.OctetStringVarBind(*forbidden_oid, ports)
+
+		status_tag := fmt.Sprintf("%s.%d", qvs_status, vid)
+		status_oid, _ := agx.NewSubtree(status_tag)
+		table[status_tag] = &agx.VarBind{
+			Type: agx.IntegerT,
+			Name: *status_oid,
+			Data: agx.Integer(mibs.RowStatusActive),
+		}
+	}
+
 	//translate the unordered table created above into an ordered_table
-	ordered_table := make(QVSTable, 0, len(table))
+	ordered_table := make(agx.VarBindList, 0, len(table))
 	for _, e := range table {
-		ordered_table = append(ordered_table, e)
+		ordered_table = append(ordered_table, *e)
 	}
-	sort.Sort(ordered_table)
+	ordered_table.Sort()
 
 	/*
 		for _, e := range ordered_table {
@@ -511,8 +629,59 @@ func generateQVSTable() QVSTable {
 	return ordered_table
 }
 
+// the egress and access port lists of a vlan
+type vlanPorts struct {
+	egress, access []byte
+}
+
+// Adds the name, egress and access entries of a vlan to a table, returning the
+// port lists of the entries for the ports of the vlan to be set in
+func addVlanEntries(table map[string]*agx.VarBind, vid, length int) vlanPorts {
+
+	name_tag := fmt.Sprintf("%s.%d", qvs_name, vid)
+	name_oid, _ := agx.NewSubtree(name_tag)
+	table[name_tag] = &agx.VarBind{
+		Type: agx.OctetStringT,
+		Name: *name_oid,
+		Data: *agx.NewOctetString([]byte(vlanName(vid))),
+	}
+
+	egress_tag := fmt.Sprintf("%s.%d", qvs_egress, vid)
+	egress_oid, _ := agx.NewSubtree(egress_tag)
+	egress := agx.OctetStringVarBind(*egress_oid, make([]byte, length))
+	table[egress_tag] = egress
+
+	access_tag := fmt.Sprintf("%s.%d", qvs_untagged, vid)
+	access_oid, _ := agx.NewSubtree(access_tag)
+	access := agx.OctetStringVarBind(*access_oid, make([]byte, length))
+	table[access_tag] = access
+
+	//the octets of the entries are set in place
+	var ports vlanPorts
+	ports.egress, _ = egress.OctetString()
+	ports.access, _ = access.OctetString()
+	return ports
+}
+
+// Generates the variables of every table served under the bridge mib, in order
+func generateTable() agx.VarBindList {
+	b := &snapshot{Backend: nl}
+	return merge(generateVlanTables(b), generateFdbTable(b))
+}
+
+// Generates the variables of the tables that only change with the links of the
+// bridge, the ports, the vlans and the pvids of the ports, in order
+func generateVlanTables(b Backend) agx.VarBindList {
+	ports := generatePortTable(b)
+	ports.Sort()
+	pvids := generatePvidTable(b)
+	pvids.Sort()
+	return merge(merge(ports, generateQVSTable(b)), pvids)
+}
+
+// Records the untagged vlans of each port, by the position of the port
 func generateVtable() {
-	bridges, _ := netlink.GetBridgeVlanInfo()
+	bridges, _ := physicalBridgeVlanInfo(nl)
 
 	//initialize vlan property maps
 	for _, bridge := range bridges {
@@ -542,13 +711,18 @@ func setVlans(vid int, table agx.OctetString, access bool) error {
 			netlink.BRIDGE_VLAN_INFO_EGRESS
 	}
 
-	_, ok := vtable[vid]
-	if !ok {
-		vtable[vid] = make([]uint16, len(swptable))
+	ports, err := physicalBridgeVlanInfo(nl)
+	if err != nil {
+		return err
+	}
+	//ports may have come since the flags of the vlan were recorded
+	for len(vtable[vid]) < len(ports) {
+		vtable[vid] = append(vtable[vid], 0)
 	}
 
-	for i := 0; i < len(swptable); i++ {
-		if IsPortSet(i, table.Octets) {
+	for i, port := range ports {
+		//ports that have come since the set was tested are left out of it
+		if i/8 < len(table.Octets) && IsPortSet(i, table.Octets) {
 
 			log.Printf("vlan-set vid=%d ifx=%d access=%v", vid, i, access)
 			vtable[vid][i] |= vinfo_flags
@@ -566,11 +740,11 @@ func setVlans(vid int, table agx.OctetString, access bool) error {
 		if vtable[vid][i] != 0 {
 			//TODO check if the interface is up otherwise this will log a
 			//'not supported' which is harmelss, but annoying in logs
-			err = netlink.BridgeVlanAdd(
-				uint(vid), swptable[i], bridge_flags, uint(vtable[vid][i]))
+			err = nl.BridgeVlanAdd(
+				uint(vid), port.Index, bridge_flags, uint(vtable[vid][i]))
 		} else {
-			err = netlink.BridgeVlanDel(
-				uint(vid), swptable[i], bridge_flags, uint(vtable[vid][i]))
+			err = nl.BridgeVlanDel(
+				uint(vid), port.Index, bridge_flags, uint(vtable[vid][i]))
 		}
 		if err != nil {
 			log.Println(err)
@@ -580,6 +754,13 @@ func setVlans(vid int, table agx.OctetString, access bool) error {
 	return nil
 }
 
+// portListLength returns the number of octets a port list must have to hold a
+// bit for each of the ports vlans are set on
+func portListLength() int {
+	ports, _ := physicalBridgeVlanInfo(nl)
+	return (len(ports) + 7) / 8
+}
+
 // IsPortSet returns whether or not the port at index i is set within the
 // object ports which is an snmp style portlist data structure. For the
 // details of this structure see RFC 2674 in the Textual Conventions section.
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/mibs"
+	"github.com/rcgoodfellow/netlink"
+	"net"
+	"sort"
+	"testing"
+)
+
+// useFake has the agent serve a bridge br0 with ports swp1 and swp2, on which
+// vlan 100 is untagged and the pvid of swp1 and tagged on swp2
+func useFake(t *testing.T) *fakeBackend {
+	f := newFakeBackend()
+	f.addBridge("br0", 10, "swp1", "swp2")
+	f.BridgeVlanAdd(100, 10, netlink.BRIDGE_FLAGS_SELF, 0)
+	f.BridgeVlanAdd(100, 11, 0,
+		netlink.BRIDGE_VLAN_INFO_PVID|netlink.BRIDGE_VLAN_INFO_UNTAGGED)
+	f.BridgeVlanAdd(100, 12, 0, 0)
+	mac, _ := net.ParseMAC("00:00:00:00:00:01")
+	f.neighs = []netlink.Neigh{{
+		LinkIndex:    12,
+		Flags:        netlink.NTF_MASTER,
+		State:        netlink.NUD_REACHABLE,
+		HardwareAddr: mac,
+		Vlan:         100,
+	}}
+
+	nl = f
+	bridgeIdx = 0
+	vtable = make(map[int][]uint16)
+	forbidden = make(map[int][]byte)
+	names = make(map[int]string)
+	nameStore = nil
+	cache = &tableCache{version: 1}
+	notifier.up = make(map[int]bool)
+	setNotifier(nil)
+	return f
+}
+
+func find(t *testing.T, table agx.VarBindList, oid string) *agx.VarBind {
+	s, err := agx.NewSubtree(oid)
+	if err != nil {
+		t.Fatalf("bad oid %s: %v", oid, err)
+	}
+	for i := range table {
+		if table[i].Name.Eq(*s) {
+			return &table[i]
+		}
+	}
+	return nil
+}
+
+func TestTables(t *testing.T) {
+	useFake(t)
+	table := generateTable()
+	if !sort.IsSorted(table) {
+		t.Errorf("table is not in order")
+	}
+
+	expect := []struct {
+		oid  string
+		data agx.Value
+	}{
+		{mibs.Dot1dBasePortIfIndex + ".2", agx.Integer(12)},
+		{mibs.Dot1qPvid + ".1", agx.Gauge32(100)},
+		{mibs.Dot1qVlanStaticName + ".100", *agx.NewOctetString([]byte("v100"))},
+		{mibs.Dot1qVlanStaticUntaggedPorts + ".100",
+			*agx.NewOctetString([]byte{0x80})},
+		{mibs.Dot1qVlanStaticEgressPorts + ".100",
+			*agx.NewOctetString([]byte{0x40})},
+		{mibs.Dot1qVlanStaticRowStatus + ".100",
+			agx.Integer(mibs.RowStatusActive)},
+		{mibs.Dot1qTpFdbPort + ".100.0.0.0.0.0.1", agx.Integer(2)},
+		{mibs.Dot1qTpFdbStatus + ".100.0.0.0.0.0.1",
+			agx.Integer(mibs.Dot1qTpFdbStatusLearned)},
+	}
+	for _, x := range expect {
+		vb := find(t, table, x.oid)
+		if vb == nil {
+			t.Errorf("%s missing", x.oid)
+			continue
+		}
+		if vb.Data.String() != x.data.String() {
+			t.Errorf("%s is %v, expected %v", x.oid, vb.Data, x.data)
+		}
+	}
+	if vb := find(t, table, mibs.Dot1qPvid+".2"); vb != nil {
+		t.Errorf("port without a pvid has %v", vb)
+	}
+}
+
+func TestPortNumbering(t *testing.T) {
+	useFake(t)
+	//bond0 is on the bridge but is not a port, swp2 is port 2
+	f := newFakeBackend()
+	f.addBridge("br0", 10, "swp1", "bond0", "swp2")
+	f.BridgeVlanAdd(100, 10, netlink.BRIDGE_FLAGS_SELF, 0)
+	f.BridgeVlanAdd(100, 12, 0,
+		netlink.BRIDGE_VLAN_INFO_PVID|netlink.BRIDGE_VLAN_INFO_UNTAGGED)
+	f.BridgeVlanAdd(100, 13, 0, 0)
+	nl = f
+
+	table := generateTable()
+	expect := []struct {
+		oid  string
+		data agx.Value
+	}{
+		{mibs.Dot1dBasePortIfIndex + ".1", agx.Integer(11)},
+		{mibs.Dot1dBasePortIfIndex + ".2", agx.Integer(13)},
+		{mibs.Dot1qVlanStaticEgressPorts + ".100",
+			*agx.NewOctetString([]byte{0x40})},
+		{mibs.Dot1qVlanStaticUntaggedPorts + ".100",
+			*agx.NewOctetString([]byte{0x00})},
+	}
+	for _, x := range expect {
+		vb := find(t, table, x.oid)
+		if vb == nil {
+			t.Errorf("%s missing", x.oid)
+			continue
+		}
+		if vb.Data.String() != x.data.String() {
+			t.Errorf("%s is %v, expected %v", x.oid, vb.Data, x.data)
+		}
+	}
+	if vb := find(t, table, mibs.Dot1dBasePortIfIndex+".3"); vb != nil {
+		t.Errorf("link that is not a port has %v", vb)
+	}
+	if vb := find(t, table, mibs.Dot1qPvid+".2"); vb != nil {
+		t.Errorf("pvid of bond0 served as that of swp2 %v", vb)
+	}
+
+	generateVtable()
+	if len(vtable[100]) != 2 {
+		t.Errorf("vtable of vlan 100 has %d ports", len(vtable[100]))
+	}
+
+	//the bits of a set are those of a get
+	err := setVlans(100, *agx.NewOctetString([]byte{0xc0}), false)
+	if err != nil {
+		t.Fatalf("setting egress failed %v", err)
+	}
+	if _, ok := f.vlans[11][100]; !ok {
+		t.Errorf("vlan 100 not added to swp1")
+	}
+	if _, ok := f.vlans[13][100]; !ok {
+		t.Errorf("vlan 100 taken off swp2")
+	}
+	if flags := f.vlans[12][100]; flags != netlink.BRIDGE_VLAN_INFO_PVID|
+		netlink.BRIDGE_VLAN_INFO_UNTAGGED {
+		t.Errorf("vlan 100 of bond0 changed to %d", flags)
+	}
+}
+
+func TestSetTransaction(t *testing.T) {
+	f := useFake(t)
+
+	r := setVlanStatus(100, mibs.RowStatusCreateAndGo, 1)
+	if r != agx.TestSetInconsistentValue {
+		t.Errorf("creating an existing vlan returned %d", r)
+	}
+	r = setVlanStatus(200, mibs.RowStatusCreateAndGo, 1)
+	if r != agx.TestSetNoError {
+		t.Fatalf("creating a vlan returned %d", r)
+	}
+	if _, ok := f.vlans[10][200]; ok {
+		t.Errorf("vlan created in test-set")
+	}
+
+	if r := commit(1); r != agx.CommitSetNoError {
+		t.Fatalf("commit returned %d", r)
+	}
+	if _, ok := f.vlans[10][200]; !ok {
+		t.Errorf("vlan not created in commit-set")
+	}
+	if vb := find(t, cache.get(), mibs.Dot1qVlanStaticRowStatus+".200"); vb == nil {
+		t.Errorf("created vlan has no row")
+	}
+
+	buf, err := undo(agx.Header{Type: agx.UndoSetPDU, SessionId: 1}, nil)
+	if err != nil {
+		t.Fatalf("undo failed %v", err)
+	}
+	p := &agx.ResponsePayload{}
+	if _, err := p.UnmarshalBinary(buf); err != nil || p.Error != 0 {
+		t.Errorf("undo returned %v %v", p, err)
+	}
+	if _, ok := f.vlans[10][200]; ok {
+		t.Errorf("vlan not removed by undo-set")
+	}
+	if _, ok := f.vlans[11][100]; !ok {
+		t.Errorf("undo-set removed vlans that were there before")
+	}
+	cleanup(1)
+}
+
+func TestRestoreNewLinks(t *testing.T) {
+	f := useFake(t)
+
+	state, err := saveVlanState()
+	if err != nil {
+		t.Fatalf("saving vlan state failed %v", err)
+	}
+	//a port that comes after the state was saved keeps its vlans
+	f.links = append(f.links, &fakeLink{
+		LinkAttrs: netlink.LinkAttrs{Index: 13, Name: "swp3", MasterIndex: 10},
+		kind:      "device",
+	})
+	f.masters[13] = 10
+	f.BridgeVlanAdd(100, 13, 0, 0)
+	f.BridgeVlanDel(100, 12, 0, 0)
+
+	if err := restoreVlanState(state); err != nil {
+		t.Fatalf("restoring vlan state failed %v", err)
+	}
+	if _, ok := f.vlans[12][100]; !ok {
+		t.Errorf("vlan of swp2 not restored")
+	}
+	if _, ok := f.vlans[13][100]; !ok {
+		t.Errorf("vlan of new port swp3 removed")
+	}
+}
+
+func TestForbidden(t *testing.T) {
+	useFake(t)
+	defer cleanup(1)
+
+	if r := setForbidden(100, []byte{0x80}, 1); r != agx.TestSetInconsistentValue {
+		t.Errorf("forbidding a member port returned %d", r)
+	}
+	if r := setForbidden(300, []byte{0x80}, 1); r != agx.TestSetNoCreation {
+		t.Errorf("forbidding ports of a vlan without a row returned %d", r)
+	}
+	if r := setForbidden(100, []byte{0x00}, 1); r != agx.TestSetNoError {
+		t.Errorf("forbidding no ports returned %d", r)
+	}
+}
+
+func TestLinkNotifications(t *testing.T) {
+	f := useFake(t)
+	swp1 := f.links[1].(*fakeLink)
+	swp1.OperState = netlink.OperUp
+	swp1.Flags = net.FlagUp
+	if err := loadLinkState(); err != nil {
+		t.Fatalf("error reading link state: %v", err)
+	}
+
+	var traps []string
+	var sent []agx.VarBind
+	setNotifier(func(trap string, vbs ...agx.VarBind) error {
+		traps = append(traps, trap)
+		sent = vbs
+		return nil
+	})
+
+	//an update that does not change the state of a port is not notified
+	linkChanged(swp1)
+	f.links[0].Attrs().OperState = netlink.OperDown
+	linkChanged(f.links[0])
+	if len(traps) != 0 {
+		t.Fatalf("unexpected notifications %v", traps)
+	}
+
+	swp1.OperState = netlink.OperLowerLayerDown
+	linkChanged(swp1)
+	swp1.OperState = netlink.OperUp
+	linkChanged(swp1)
+	if len(traps) != 2 || traps[0] != mibs.LinkDown || traps[1] != mibs.LinkUp {
+		t.Fatalf("expected linkDown then linkUp, sent %v", traps)
+	}
+	expect := map[string]agx.Value{
+		mibs.IfIndex + ".11":       agx.Integer(11),
+		mibs.IfAdminStatus + ".11": agx.Integer(mibs.IfStatusUp),
+		mibs.IfOperStatus + ".11":  agx.Integer(mibs.IfStatusUp),
+	}
+	if len(sent) != len(expect) {
+		t.Fatalf("linkUp sent with %v", sent)
+	}
+	for _, vb := range sent {
+		if expect[vb.Name.String()] != vb.Data {
+			t.Errorf("unexpected varbind %v", vb)
+		}
+	}
+}
+
+func TestBridgeLink(t *testing.T) {
+	f := useFake(t)
+	eth0 := &fakeLink{LinkAttrs: netlink.LinkAttrs{Index: 2, Name: "eth0"}}
+	if bridgeLink(eth0) {
+		t.Errorf("link off the bridge invalidates the cache")
+	}
+	if !bridgeLink(f.links[0]) || !bridgeLink(f.links[1]) {
+		t.Errorf("changes to the bridge or its ports are not seen")
+	}
+	//a port leaving the bridge is a change to the bridge
+	if err := loadLinkState(); err != nil {
+		t.Fatalf("error reading link state: %v", err)
+	}
+	f.links[2].Attrs().MasterIndex = 0
+	if !bridgeLink(f.links[2]) {
+		t.Errorf("port leaving the bridge is not seen")
+	}
+}
+
+// useLargeFake has the agent serve a bridge with 48 ports, each a tagged
+// member of vlans 1 to 4000 and an untagged member of one of them
+func useLargeFake(t testing.TB) {
+	f := newFakeBackend()
+	var ports []string
+	for i := 1; i <= 48; i++ {
+		ports = append(ports, fmt.Sprintf("swp%d", i))
+	}
+	f.addBridge("br0", 1000, ports...)
+	for vid := uint(1); vid <= 4000; vid++ {
+		f.BridgeVlanAdd(vid, 1000, netlink.BRIDGE_FLAGS_SELF, 0)
+		for port := 1001; port <= 1048; port++ {
+			flags := uint(0)
+			if int(vid) == port-1000 {
+				flags = netlink.BRIDGE_VLAN_INFO_PVID |
+					netlink.BRIDGE_VLAN_INFO_UNTAGGED
+			}
+			f.BridgeVlanAdd(vid, port, 0, flags)
+		}
+	}
+
+	nl = f
+	bridgeIdx = 0
+	vtable = make(map[int][]uint16)
+	forbidden = make(map[int][]byte)
+	names = make(map[int]string)
+	nameStore = nil
+	cache = &tableCache{version: 1, live: true}
+}
+
+// walk binds every variable of the table as a getnext walk of the handler
+// does, returning how many there are
+func walk(t testing.TB) int {
+	oid, _ := agx.NewSubtree(qbridge)
+	n := 0
+	for {
+		vb, ok := cache.get().NextAfter(*oid)
+		if !ok {
+			return n
+		}
+		if !oid.LessThan(vb.Name) {
+			t.Fatalf("walk went from %s back to %s", oid, vb.Name)
+		}
+		oid = &vb.Name
+		n++
+	}
+}
+
+func TestLargeWalk(t *testing.T) {
+	useLargeFake(t)
+
+	//three columns for each port, a name, egress, untagged, forbidden and
+	//status entry for each vlan, and the pvids of the ports
+	expect := 48*3 + 4000*5 + 48
+	if n := walk(t); n != expect {
+		t.Errorf("walked %d variables, expected %d", n, expect)
+	}
+	if cache.built != cache.version {
+		t.Errorf("table out of date after walk")
+	}
+
+	untagged := find(t, cache.get(), mibs.Dot1qVlanStaticUntaggedPorts+".9")
+	ports, _ := untagged.OctetString()
+	if len(ports) != 6 || ports[1] != 0x80 {
+		t.Errorf("untagged ports of vlan 9 are %x", ports)
+	}
+}
+
+func BenchmarkWalk(b *testing.B) {
+	useLargeFake(b)
+	cache.get()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		walk(b)
+	}
+}
+
+func BenchmarkGenerateTable(b *testing.B) {
+	useLargeFake(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.invalidate()
+		cache.get()
+	}
+}
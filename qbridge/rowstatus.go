@@ -0,0 +1,180 @@
+package main
+
+// This file contains the creation and destruction of vlans through
+// dot1qVlanStaticRowStatus
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/mibs"
+	"github.com/rcgoodfellow/netlink"
+	"log"
+)
+
+// Stages setting the row status of a vlan. Vlans are created on the bridge
+// itself, which gives them a row before any port is a member, and destroyed
+// on the bridge and every port. Rows are always active, as there is nothing
+// to configure before the kernel can use a vlan, so createAndWait is not
+// supported.
+func setVlanStatus(vid, status int, sessionId uint32) agx.TestSetResult {
+
+	if vid < 1 || vid > max_vlanid {
+		return agx.TestSetNoCreation
+	}
+
+	vlans, err := bridgeVlans(nl)
+	if err != nil {
+		log.Printf("[status] error reading bridge vlans: %v", err)
+		return agx.TestSetGenError
+	}
+	ports, exists := vlans[vid]
+
+	switch status {
+
+	case mibs.RowStatusActive:
+		if !exists {
+			return agx.TestSetInconsistentValue
+		}
+		return agx.TestSetNoError
+
+	case mibs.RowStatusCreateAndGo:
+		if exists {
+			return agx.TestSetInconsistentValue
+		}
+		bridge, err := bridgeIndex()
+		if err != nil {
+			log.Printf("[status] error finding bridge: %v", err)
+			return agx.TestSetGenError
+		}
+		stage(sessionId, func() error {
+			log.Printf("vlan-create vid=%d", vid)
+			return nl.BridgeVlanAdd(
+				uint(vid), bridge, uint(netlink.BRIDGE_FLAGS_SELF), 0)
+		})
+		return agx.TestSetNoError
+
+	case mibs.RowStatusDestroy:
+		if !exists {
+			//destroying a row that does not exist is not an error
+			return agx.TestSetNoError
+		}
+		stage(sessionId, func() error {
+			log.Printf("vlan-destroy vid=%d", vid)
+			for _, p := range ports {
+				err := nl.BridgeVlanDel(uint(vid), p.Index, p.Flags, 0)
+				if err != nil {
+					return err
+				}
+			}
+			delete(vtable, vid)
+			delete(forbidden, vid)
+			return saveName(vid, nil)
+		})
+		return agx.TestSetNoError
+
+	case mibs.RowStatusCreateAndWait, mibs.RowStatusNotInService:
+		return agx.TestSetWrongValue
+
+	}
+
+	//notReady may not be set, nor anything that is not a row status
+	return agx.TestSetWrongValue
+}
+
+// vlanMember is a link a vlan is on, flags are the bridge flags it is
+// addressed by
+type vlanMember struct {
+	Index int
+	Flags uint
+}
+
+// Returns the links each vlan is on, by vlan id, bridges included
+func bridgeVlans(b Backend) (map[int][]vlanMember, error) {
+
+	vinfo, err := bridgeVlanInfo(b)
+	if err != nil {
+		return nil, err
+	}
+	bridges, err := bridgeIndices(b)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[int][]vlanMember)
+	for _, v := range vinfo {
+		m := vlanMember{Index: v.Index}
+		if bridges[v.Index] {
+			m.Flags = netlink.BRIDGE_FLAGS_SELF
+		}
+		for _, vlan := range v.Vlans {
+			result[int(vlan.Vid)] = append(result[int(vlan.Vid)], m)
+		}
+	}
+	return result, nil
+}
+
+// Returns the vlans of the links of the bridge being served, the bridge itself
+// included
+func bridgeVlanInfo(b Backend) ([]*netlink.BridgeVlanInfo, error) {
+
+	vinfo, err := b.GetBridgeVlanInfo()
+	if err != nil {
+		return nil, err
+	}
+	if bridgeIdx == 0 {
+		return vinfo, nil
+	}
+	ports, err := physicalBridgeVlanInfo(b)
+	if err != nil {
+		return nil, err
+	}
+
+	members := map[int]bool{bridgeIdx: true}
+	for _, p := range ports {
+		members[p.Index] = true
+	}
+	var result []*netlink.BridgeVlanInfo
+	for _, v := range vinfo {
+		if members[v.Index] {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+// Returns the index of the bridge the ports are on, the one being served if
+// there is one
+func bridgeIndex() (int, error) {
+
+	if bridgeIdx != 0 {
+		return bridgeIdx, nil
+	}
+
+	bridges, err := bridgeIndices(nl)
+	if err != nil {
+		return 0, err
+	}
+	for index := range bridges {
+		return index, nil
+	}
+	return 0, fmt.Errorf("no bridge has ports")
+}
+
+// Returns the indices of the bridges that have ports
+func bridgeIndices(b Backend) (map[int]bool, error) {
+
+	linfo, err := b.GetBridgeLinkInfo()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int]bool)
+	for _, x := range linfo {
+		if x.Master != 0 && x.Master != x.Index {
+			result[int(x.Master)] = true
+		}
+	}
+	return result, nil
+}
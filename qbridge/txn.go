@@ -0,0 +1,230 @@
+package main
+
+// This file contains the set transactions of the agent. Test-set handlers
+// only check and stage changes to the bridge, which are made by commit-set
+// and can be taken back by undo-set.
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/netlink"
+	"log"
+	"sync"
+)
+
+// vlanState is the vlan membership of the bridge before a commit, along with
+// what the agent keeps of vlans, which an undo restores
+type vlanState struct {
+	links     []*netlink.BridgeVlanInfo
+	vtable    map[int][]uint16
+	forbidden map[int][]byte
+	names     map[int]string
+}
+
+// changes staged by test-set, and the state they were committed over, by
+// session. Handlers may run on several workers at once, so both are guarded
+// by txnMtx.
+var staged = make(map[uint32][]func() error)
+var committed = make(map[uint32]*vlanState)
+var txnMtx sync.Mutex
+
+// Stages a change to be made to the bridge when the set is committed
+func stage(sessionId uint32, f func() error) {
+	txnMtx.Lock()
+	defer txnMtx.Unlock()
+	staged[sessionId] = append(staged[sessionId], f)
+}
+
+// Returns the changes staged for the session
+func stagedFor(sessionId uint32) []func() error {
+	txnMtx.Lock()
+	defer txnMtx.Unlock()
+	return staged[sessionId]
+}
+
+// Makes the changes staged for the session. Should one fail, those already
+// made are taken back before failing the commit.
+func commit(sessionId uint32) agx.CommitSetResult {
+
+	log.Printf("[commit-set] session=%d", sessionId)
+
+	state, err := saveVlanState()
+	if err != nil {
+		log.Printf("[commit-set] error saving vlan state: %v", err)
+		return agx.CommitSetCommitFailed
+	}
+	txnMtx.Lock()
+	committed[sessionId] = state
+	txnMtx.Unlock()
+
+	for _, f := range stagedFor(sessionId) {
+		err := f()
+		if err != nil {
+			log.Printf("[commit-set] error: %v", err)
+			err = restoreVlanState(state)
+			if err != nil {
+				log.Printf("[commit-set] error taking back changes: %v", err)
+			}
+			return agx.CommitSetCommitFailed
+		}
+	}
+	cache.invalidate()
+
+	return agx.CommitSetNoError
+}
+
+// Answers an undo-set, which the library leaves to a raw handler, by
+// restoring the vlan membership the session committed over
+func undo(h agx.Header, pdu []byte) ([]byte, error) {
+
+	log.Printf("[undo-set] session=%d", h.SessionId)
+
+	code := int16(agx.ResponseNoError)
+	txnMtx.Lock()
+	state, ok := committed[h.SessionId]
+	txnMtx.Unlock()
+	if ok {
+		err := restoreVlanState(state)
+		if err != nil {
+			log.Printf("[undo-set] error: %v", err)
+			code = agx.ResponseUndoFailed
+		}
+	}
+
+	buf, err := agx.NewResponse(h).SetError(code, 0).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return buf[agx.HeaderSize:], nil
+}
+
+func cleanup(sessionId uint32) {
+
+	log.Printf("[cleanup-set] session=%d", sessionId)
+
+	txnMtx.Lock()
+	delete(staged, sessionId)
+	delete(committed, sessionId)
+	txnMtx.Unlock()
+
+}
+
+// Saves the vlan membership of every bridge and bridge port
+func saveVlanState() (*vlanState, error) {
+
+	links, err := bridgeVlanInfo(nl)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &vlanState{
+		links:     links,
+		vtable:    make(map[int][]uint16),
+		forbidden: make(map[int][]byte),
+		names:     make(map[int]string),
+	}
+	for vid, flags := range vtable {
+		state.vtable[vid] = append([]uint16(nil), flags...)
+	}
+	for vid, ports := range forbidden {
+		state.forbidden[vid] = ports
+	}
+	for vid, name := range names {
+		state.names[vid] = name
+	}
+	return state, nil
+}
+
+// Restores saved vlan membership, adding the vlans links have lost or whose
+// flags have changed, and removing those they have gained. Only the links of
+// the saved state are restored, links that have come since are left be.
+func restoreVlanState(state *vlanState) error {
+
+	links, err := bridgeVlanInfo(nl)
+	if err != nil {
+		return err
+	}
+	bridges, err := bridgeIndices(nl)
+	if err != nil {
+		return err
+	}
+
+	now := make(map[int]map[uint16]uint)
+	for _, l := range links {
+		now[l.Index] = vlanFlags(l)
+	}
+
+	var failed []error
+	for _, l := range state.links {
+		index := l.Index
+		then := vlanFlags(l)
+		vlans := now[index]
+		bridge_flags := uint(0)
+		if bridges[index] {
+			bridge_flags = netlink.BRIDGE_FLAGS_SELF
+		}
+		for vid, flags := range then {
+			current, ok := vlans[vid]
+			if ok && current == flags {
+				continue
+			}
+			err := nl.BridgeVlanAdd(uint(vid), index, bridge_flags, flags)
+			if err != nil {
+				failed = append(failed, err)
+			}
+		}
+		for vid, flags := range vlans {
+			if _, ok := then[vid]; ok {
+				continue
+			}
+			err := nl.BridgeVlanDel(uint(vid), index, bridge_flags, flags)
+			if err != nil {
+				failed = append(failed, err)
+			}
+		}
+	}
+
+	vtable = state.vtable
+	forbidden = state.forbidden
+	for vid := range names {
+		if _, ok := state.names[vid]; !ok {
+			if err := saveName(vid, nil); err != nil {
+				failed = append(failed, err)
+			}
+		}
+	}
+	for vid, name := range state.names {
+		if names[vid] != name {
+			name := name
+			if err := saveName(vid, &name); err != nil {
+				failed = append(failed, err)
+			}
+		}
+	}
+	cache.invalidate()
+	if len(failed) > 0 {
+		return fmt.Errorf("%d changes not taken back, first error: %v",
+			len(failed), failed[0])
+	}
+	return nil
+}
+
+// Returns the flags each vlan of a link has, by vlan id
+func vlanFlags(l *netlink.BridgeVlanInfo) map[uint16]uint {
+
+	result := make(map[uint16]uint)
+	for _, vlan := range l.Vlans {
+		flags := uint(0)
+		if vlan.Pvid {
+			flags |= netlink.BRIDGE_VLAN_INFO_PVID
+		}
+		if vlan.Untagged {
+			flags |= netlink.BRIDGE_VLAN_INFO_UNTAGGED
+		}
+		result[vlan.Vid] = flags
+	}
+	return result
+}
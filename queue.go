@@ -0,0 +1,140 @@
+package agx
+
+// This file contains the queue PDUs are sent to the master agent through
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"io"
+)
+
+// QueuePolicy decides what becomes of a PDU sent while the send queue is full
+type QueuePolicy int
+
+const (
+	//QueueBlock waits for room in the queue
+	QueueBlock QueuePolicy = iota
+
+	//QueueDropNotifications drops notifications and waits for room for
+	//anything else
+	QueueDropNotifications
+
+	//QueueClose closes the session, as a master that falls that far behind is
+	//taken to be stuck
+	QueueClose
+)
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case QueueBlock:
+		return "block"
+	case QueueDropNotifications:
+		return "drop-notifications"
+	case QueueClose:
+		return "close"
+	}
+	return fmt.Sprintf("QueuePolicy(%d)", int(p))
+}
+
+// WithSendQueue sends PDUs to the master agent through a queue of up to size
+// PDUs that is written out on a goroutine of its own, so that a master agent
+// that reads slowly does not hold up the handling of requests until the queue
+// is full. What happens then is decided by policy.
+func WithSendQueue(size int, policy QueuePolicy) Option {
+	return func(c *Connection) {
+		c.queue = &sendQueue{
+			policy: policy,
+			ch:     make(chan queued, size),
+			stop:   make(chan struct{}),
+		}
+	}
+}
+
+// sendQueue holds encoded PDUs on their way to the master agent
+type sendQueue struct {
+	policy QueuePolicy
+	ch     chan queued
+	stop   chan struct{}
+}
+
+// queued is an encoded PDU, sent is signalled with the result of writing it
+// if not nil
+type queued struct {
+	buf  []byte
+	sent chan error
+}
+
+// write writes out queued PDUs to w until the queue is stopped or writing
+// fails, which closes the session
+func (q *sendQueue) write(c *Connection, w io.Writer) {
+	for {
+		select {
+		case x := <-q.ch:
+			_, err := w.Write(x.buf)
+			if x.sent != nil {
+				x.sent <- err
+			}
+			if err != nil {
+				c.logf("[queue] error sending message: %v", err)
+				c.setClosed(fmt.Errorf("error sending message: %v", err))
+				c.hangUp()
+				return
+			}
+			c.touch()
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// stopQueue stops the send queue of c, if it has one
+func (c *Connection) stopQueue() {
+	if c.queue != nil {
+		close(c.queue.stop)
+	}
+}
+
+// send queues the encoded PDU buf of type t as the policy of the queue
+// decides, waiting until it has been written if wait is set
+func (q *sendQueue) send(c *Connection, t PDUType, buf []byte,
+	wait bool) error {
+
+	x := queued{buf: buf}
+	if wait {
+		x.sent = make(chan error, 1)
+	}
+
+	select {
+	case q.ch <- x:
+	case <-q.stop:
+		return io.EOF
+	default:
+		switch {
+		case q.policy == QueueClose:
+			c.logf("[queue] send queue full, closing session")
+			c.setClosed(fmt.Errorf("send queue full"))
+			c.hangUp()
+			return fmt.Errorf("send queue full, session closed")
+		case q.policy == QueueDropNotifications && t == NotifyPDU:
+			c.logf("[queue] send queue full, dropping notification")
+			return fmt.Errorf("send queue full, notification dropped")
+		}
+		select {
+		case q.ch <- x:
+		case <-q.stop:
+			return io.EOF
+		}
+	}
+
+	if !wait {
+		return nil
+	}
+	select {
+	case err := <-x.sent:
+		return err
+	case <-q.stop:
+		return io.EOF
+	}
+}
@@ -0,0 +1,122 @@
+package agx
+
+// This file contains rate limiting of get requests from the master agent
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"time"
+)
+
+// RateLimit is a token bucket allowing Rate requests a second on average, in
+// bursts of up to Burst requests
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// bucket holds the tokens left of a RateLimit
+type bucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(l RateLimit) *bucket {
+	return &bucket{limit: l, tokens: float64(l.Burst)}
+}
+
+// take takes a token from the bucket if one is left at now
+func (b *bucket) take(now time.Time) bool {
+	if b.last.IsZero() {
+		b.last = now
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// subtreeLimit is the bucket of a rate limited subtree
+type subtreeLimit struct {
+	root   Subtree
+	bucket *bucket
+}
+
+// WithRateLimit limits the get, getnext and getbulk requests of the session
+// to l. Requests over the limit are answered with genErr without reaching the
+// handlers, protecting expensive backends from aggressive pollers.
+func WithRateLimit(l RateLimit) Option {
+	return func(c *Connection) {
+		c.rate = newBucket(l)
+	}
+}
+
+// LimitSubtree limits the get, getnext and getbulk requests for variables
+// beneath oid to l, in addition to any limit of the session. A request takes
+// a single token from the bucket of each limited subtree its varbinds start
+// in, the most specific one if limited subtrees overlap. A zero l removes the
+// limit.
+func (c *Connection) LimitSubtree(oid string, l RateLimit) error {
+	root, err := NewSubtree(oid)
+	if err != nil {
+		return fmt.Errorf("bad oid %s: %v", oid, err)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for i, x := range c.limits {
+		if x.root.Compare(*root) == 0 {
+			c.limits = append(c.limits[:i], c.limits[i+1:]...)
+			break
+		}
+	}
+	if l != (RateLimit{}) {
+		c.limits = append(c.limits, subtreeLimit{*root, newBucket(l)})
+	}
+	return nil
+}
+
+// checkRate takes tokens for a get request for oids, returning genErr and the
+// 1 based index of the first oid over the limit of its subtree, genErr and 0
+// if the session is over its limit, or ResponseNoError
+func (c *Connection) checkRate(oids []Subtree) (int16, int16) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := c.clock.Now()
+	if c.rate != nil && !c.rate.take(now) {
+		return ResponseGenErr, 0
+	}
+	if len(c.limits) == 0 {
+		return ResponseNoError, 0
+	}
+
+	taken := make(map[*bucket]bool)
+	for i, oid := range oids {
+		var limit *subtreeLimit
+		for j, x := range c.limits {
+			if oid.HasPrefix(x.root) &&
+				(limit == nil || x.root.HasPrefix(limit.root)) {
+				limit = &c.limits[j]
+			}
+		}
+		if limit == nil || taken[limit.bucket] {
+			continue
+		}
+		if !limit.bucket.take(now) {
+			return ResponseGenErr, int16(i + 1)
+		}
+		taken[limit.bucket] = true
+	}
+	return ResponseNoError, 0
+}
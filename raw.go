@@ -0,0 +1,103 @@
+package agx
+
+// This file contains hooks that take over the handling of PDUs from the
+// library
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+)
+
+// RawPDUHandler handles a PDU in place of the library. It is called with the
+// header of the PDU and the PDU as received, header included, which is only
+// valid for the duration of the call. The returned bytes are sent back as the
+// payload of the response to the PDU, starting with its sysUpTime field, or
+// no response is sent if they are nil. A returned error is logged and answered
+// with a processing error.
+type RawPDUHandler func(h Header, pdu []byte) ([]byte, error)
+
+// OnRawPDU has f handle PDUs of type t from the master agent instead of the
+// library, e.g. to implement PDU types the library does not. The response is
+// framed and sent on the session like any other. Passing a nil f hands the
+// PDU type back to the library. Responses from the master agent are always
+// handled by the library.
+func (c *Connection) OnRawPDU(t PDUType, f RawPDUHandler) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if f == nil {
+		delete(c.raw, t)
+		return
+	}
+	if c.raw == nil {
+		c.raw = make(map[PDUType]RawPDUHandler)
+	}
+	c.raw[t] = f
+}
+
+// rawHandler returns the raw handler for PDUs of type t, if there is one
+func (c *Connection) rawHandler(t PDUType) RawPDUHandler {
+	if t == ResponsePDU {
+		return nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.raw[t]
+}
+
+// handleRaw answers the PDU with header h in buf using f
+func handleRaw(c *Connection, h *Header, buf []byte, f RawPDUHandler) {
+	payload, err := f(*h, buf)
+	if err != nil {
+		c.logf("[rootMH] raw handler for %v: %v", h, err)
+		sendResponse(c, h, ResponseProcessingError)
+		return
+	}
+	if payload == nil {
+		return
+	}
+
+	r := NewResponse(*h).Header
+	r.SessionId = c.sessionId
+	err = sendMsg(&rawMessage{Header: r, Payload: payload}, c)
+	if err != nil {
+		c.logf("[rootMH] error responding to %v: %v", h, err)
+	}
+}
+
+// rawMessage is a PDU whose payload is already encoded
+type rawMessage struct {
+	Header  Header
+	Payload []byte
+}
+
+func (m rawMessage) MarshalBinary() ([]byte, error) {
+	return m.AppendBinary(nil)
+}
+
+func (m rawMessage) AppendBinary(dst []byte) ([]byte, error) {
+	if len(m.Payload)%4 != 0 {
+		return nil, fmt.Errorf("payload length %d is not a multiple of 4",
+			len(m.Payload))
+	}
+	dst, err := m.Header.AppendBinary(dst)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, m.Payload...), nil
+}
+
+func (m *rawMessage) UnmarshalBinary(buf []byte) (int, error) {
+	n, err := m.Header.UnmarshalBinary(buf)
+	if err != nil {
+		return n, err
+	}
+	buf, err = pduBytes(buf, &m.Header)
+	if err != nil {
+		return n, err
+	}
+	m.Payload = append([]byte{}, buf[n:]...)
+	return len(buf), nil
+}
@@ -0,0 +1,333 @@
+package agx
+
+// This file contains the recording of sessions with the master agent and the
+// replay of recordings against a dispatcher, for regression testing agents
+// with traffic captured in production
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * Recording
+ *
+ * A recording is a sequence of records, each a direction byte, three reserved
+ * bytes and the time of the record in nanoseconds since the unix epoch as a
+ * big endian int64, followed by the PDU as it was sent or received.
+ *----------------------------------------------------------------------------*/
+
+const (
+	recordRecv byte = iota
+	recordSend
+)
+
+const recordHeaderSize = 12
+
+// Recorder writes every PDU sent to and received from the master agent to a
+// recording. Writes are serialized, and the first error writing stops the
+// recording.
+type Recorder struct {
+	mtx sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewRecorder returns a recorder writing the recording to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: w}
+}
+
+// WithRecorder records the session with the master agent with r
+func WithRecorder(r *Recorder) Option {
+	return func(c *Connection) {
+		c.recorder = r
+	}
+}
+
+// Err returns the error that stopped the recording, if any
+func (r *Recorder) Err() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(dir byte, t time.Time, buf []byte) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.err != nil {
+		return
+	}
+
+	rec := make([]byte, recordHeaderSize, recordHeaderSize+len(buf))
+	rec[0] = dir
+	binary.BigEndian.PutUint64(rec[4:], uint64(t.UnixNano()))
+	rec = append(rec, buf...)
+	if _, err := r.w.Write(rec); err != nil {
+		r.err = fmt.Errorf("error writing recording: %v", err)
+	}
+}
+
+// recordWriter records each write made through it, WriteMessage writes a PDU
+// in a single call so each write is one PDU. PDUs are recorded before they are
+// written, so a response is in the recording by the time the master has it.
+type recordWriter struct {
+	c *Connection
+	w io.Writer
+}
+
+func (rw recordWriter) Write(p []byte) (int, error) {
+	rw.c.recorder.record(recordSend, rw.c.clock.Now(), p)
+	return rw.w.Write(p)
+}
+
+// Record is a PDU of a recording
+type Record struct {
+	Time time.Time
+	//Sent is set for PDUs sent to the master agent, and clear for those
+	//received from it
+	Sent bool
+	PDU  []byte
+}
+
+// Message decodes the PDU of the record
+func (r Record) Message() (Message, error) {
+	return ParsePDU(r.PDU)
+}
+
+// ReadRecording reads the records of the recording read from r. A recording
+// cut short while a record was written ends with io.ErrUnexpectedEOF, along
+// with the records before it.
+func ReadRecording(r io.Reader) ([]Record, error) {
+	var recs []Record
+	for {
+		var rh [recordHeaderSize]byte
+		_, err := io.ReadFull(r, rh[:])
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return recs, err
+		}
+		if rh[0] != recordRecv && rh[0] != recordSend {
+			return recs, fmt.Errorf("bad record direction %d", rh[0])
+		}
+
+		_, buf, err := readFrame(r, nil, DefaultMaxPayloadLength)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return recs, err
+		}
+		recs = append(recs, Record{
+			Time: time.Unix(0, int64(binary.BigEndian.Uint64(rh[4:]))),
+			Sent: rh[0] == recordSend,
+			PDU:  buf,
+		})
+	}
+}
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * Replay
+ *----------------------------------------------------------------------------*/
+
+// ReplayTimeout is how long Replay waits for the response to a request
+var ReplayTimeout = 5 * time.Second
+
+// Replayed is a request of a recording along with the response recorded for
+// it and the response it got when replayed, either of which is nil if there
+// was none
+type Replayed struct {
+	Request  Message
+	Recorded *Response
+	Replayed *Response
+}
+
+// Matches reports whether the replayed response carries the same error,
+// index and varbinds as the recorded one
+func (x Replayed) Matches() bool {
+	if x.Recorded == nil || x.Replayed == nil {
+		return x.Recorded == x.Replayed
+	}
+	a, b := x.Recorded, x.Replayed
+	if a.Error != b.Error || a.Index != b.Index ||
+		len(a.VarBindList) != len(b.VarBindList) {
+		return false
+	}
+	for i := range a.VarBindList {
+		if a.VarBindList[i].String() != b.VarBindList[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// replayed are the requests of the master agent a recording is replayed with
+var replayed = map[PDUType]bool{
+	GetPDU: true, GetNextPDU: true, GetBulkPDU: true, TestSetPDU: true,
+	CommitSetPDU: true, UndoSetPDU: true, CleanupSetPDU: true,
+}
+
+// Replay feeds the requests received from the master agent in the recording
+// read from r to a session served by the handlers of d, set up with opts as
+// the recorded session was. Each request is returned with the response
+// recorded for it and the one it got when replayed.
+func Replay(r io.Reader, d *Dispatcher, opts ...Option) ([]Replayed, error) {
+	recs, err := ReadRecording(r)
+	if err != nil {
+		return nil, err
+	}
+
+	//the requests of the recording along with the responses given to them
+	var results []Replayed
+	var requests []Record
+	pending := make(map[uint32]int)
+	for _, rec := range recs {
+		t := PDUType(rec.PDU[1])
+		switch {
+		case !rec.Sent && replayed[t]:
+			m, err := rec.Message()
+			if err != nil {
+				return nil, err
+			}
+			pending[headerOf(rec.PDU).PacketId] = len(results)
+			results = append(results, Replayed{Request: m})
+			requests = append(requests, rec)
+		case rec.Sent && t == ResponsePDU:
+			m, err := rec.Message()
+			if err != nil {
+				return nil, err
+			}
+			resp := m.(*Response)
+			if i, ok := pending[resp.Header.PacketId]; ok {
+				results[i].Recorded = resp
+				delete(pending, resp.Header.PacketId)
+			}
+		}
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	in, stop := make(chan Message), make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(in)
+		for {
+			m, err := ReadMessage(server)
+			if err != nil {
+				return
+			}
+			select {
+			case in <- m:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	c, err := replaySession(client, in, server, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Install(d.Handlers()); err != nil {
+		return nil, err
+	}
+	for _, x := range d.declaredSyntaxes() {
+		c.declareSyntax(x)
+	}
+
+	for i, rec := range requests {
+		h := headerOf(rec.PDU)
+
+		//the request is sent as recorded on the session it is replayed on
+		buf := append([]byte(nil), rec.PDU...)
+		binary.BigEndian.PutUint32(buf[4:], c.sessionId)
+		if _, err := server.Write(buf); err != nil {
+			return results[:i], fmt.Errorf("error replaying %v: %v",
+				results[i].Request, err)
+		}
+
+		//cleanup set is not answered
+		if h.Type != CleanupSetPDU {
+			results[i].Replayed, err = replayResponse(in, h.PacketId)
+			if err != nil {
+				return results[:i], fmt.Errorf("error replaying %v: %v",
+					results[i].Request, err)
+			}
+		}
+	}
+	return results, nil
+}
+
+// replaySession opens a session on conn, answering the open as the master
+// agent at the other end of the pipe
+func replaySession(conn net.Conn, in chan Message, master io.Writer,
+	opts []Option) (*Connection, error) {
+
+	type result struct {
+		c   *Connection
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		id, descr := "1.3.6.1.4.1.47", "agx replay"
+		c, err := NewConnection(conn, &id, &descr, opts...)
+		done <- result{c, err}
+	}()
+
+	select {
+	case m, ok := <-in:
+		open, isOpen := m.(*OpenMessage)
+		if !ok || !isOpen {
+			conn.Close()
+			return nil, fmt.Errorf("replay session did not open")
+		}
+		resp := NewResponse(open.Header)
+		resp.Header.SessionId = 1
+		if _, err := WriteMessage(master, resp); err != nil {
+			return nil, fmt.Errorf("error opening replay session: %v", err)
+		}
+	case <-time.After(ReplayTimeout):
+		conn.Close()
+		return nil, fmt.Errorf("timed out opening replay session")
+	}
+
+	r := <-done
+	if r.err != nil {
+		return nil, fmt.Errorf("error opening replay session: %v", r.err)
+	}
+	return r.c, nil
+}
+
+// replayResponse waits for the response with packet id packet
+func replayResponse(in chan Message, packet uint32) (*Response, error) {
+	timeout := time.After(ReplayTimeout)
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return nil, fmt.Errorf("replay session closed")
+			}
+			if r, ok := m.(*Response); ok && r.Header.PacketId == packet {
+				return r, nil
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("timed out waiting for response")
+		}
+	}
+}
+
+// headerOf decodes the header of the PDU buf, which has been framed already
+func headerOf(buf []byte) Header {
+	var h Header
+	h.UnmarshalBinary(buf)
+	return h
+}
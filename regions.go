@@ -0,0 +1,145 @@
+package agx
+
+// This file contains the locks that keep handlers for the same region of the
+// mib from running concurrently
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// regions serializes the handlers of a Dispatcher. Handlers installed beneath
+// the same registered subtree are never called concurrently, even when
+// requests are handled on a pool of workers, so a handler may keep mutable
+// state for its region without further synchronization. Handlers outside any
+// registered subtree are serialized with the other handlers for the same oid.
+// Commit-set and cleanup-set handlers, which may touch any region, run while
+// no other handler does. A handler must not make requests of the Dispatcher
+// that calls it, as the lock for its region is held while it runs.
+//
+// The zero value holds no regions.
+type regions struct {
+	mtx sync.Mutex
+
+	//registered subtrees, ordered by oid
+	roots []*region
+
+	//locks of handlers outside any registered subtree, keyed by oid
+	own map[string]*sync.Mutex
+}
+
+type region struct {
+	root    Subtree
+	timeout time.Duration //zero for the timeout of the session
+	refs    int
+	mtx     sync.Mutex
+}
+
+// add serializes the handlers beneath root, a region may be added more than
+// once and is kept until it is removed as often. The timeout is that of the
+// latest registration of the region.
+func (rs *regions) add(root Subtree, timeout time.Duration) {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	i := sort.Search(len(rs.roots), func(i int) bool {
+		return rs.roots[i].root.Compare(root) >= 0
+	})
+	if i < len(rs.roots) && rs.roots[i].root.Compare(root) == 0 {
+		rs.roots[i].refs++
+		rs.roots[i].timeout = timeout
+		return
+	}
+	rs.roots = append(rs.roots, nil)
+	copy(rs.roots[i+1:], rs.roots[i:])
+	rs.roots[i] = &region{root: root, timeout: timeout, refs: 1}
+}
+
+// remove undoes an add of root
+func (rs *regions) remove(root Subtree) {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	for i, r := range rs.roots {
+		if r.root.Compare(root) == 0 {
+			r.refs--
+			if r.refs == 0 {
+				rs.roots = append(rs.roots[:i], rs.roots[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// lock locks and returns the lock serializing the handler h
+func (rs *regions) lock(h *HandlerBundle) *sync.Mutex {
+	rs.mtx.Lock()
+	var m *sync.Mutex
+	for _, r := range rs.roots {
+		//the roots are ordered so later matches are more specific
+		if h.Subtree.HasPrefix(r.root) {
+			m = &r.mtx
+		}
+	}
+	if m == nil {
+		if rs.own == nil {
+			rs.own = make(map[string]*sync.Mutex)
+		}
+		m = rs.own[h.Oid]
+		if m == nil {
+			m = &sync.Mutex{}
+			rs.own[h.Oid] = m
+		}
+	}
+	rs.mtx.Unlock()
+
+	m.Lock()
+	return m
+}
+
+// timeout returns the timeout of the region the handler h is in, zero if it
+// is in none or the region has the timeout of the session
+func (rs *regions) timeout(h *HandlerBundle) time.Duration {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+
+	var timeout time.Duration
+	for _, r := range rs.roots {
+		if h.Subtree.HasPrefix(r.root) {
+			timeout = r.timeout
+		}
+	}
+	return timeout
+}
+
+// lockAll locks every region, returning a func that unlocks them again
+func (rs *regions) lockAll() func() {
+	rs.mtx.Lock()
+	var ms []*sync.Mutex
+	for _, r := range rs.roots {
+		ms = append(ms, &r.mtx)
+	}
+	own := make([]string, 0, len(rs.own))
+	for oid := range rs.own {
+		own = append(own, oid)
+	}
+	//always locked in the same order so lockAll never deadlocks with itself
+	sort.Strings(own)
+	for _, oid := range own {
+		ms = append(ms, rs.own[oid])
+	}
+	rs.mtx.Unlock()
+
+	for _, m := range ms {
+		m.Lock()
+	}
+	return func() {
+		for _, m := range ms {
+			m.Unlock()
+		}
+	}
+}
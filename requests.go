@@ -0,0 +1,122 @@
+package agx
+
+// This file contains the correlation of responses from the master agent with
+// the requests the subagent sent it. Every request is sent with a packet id
+// of its own, so any number of them may await a response at once, whatever
+// else the master sends in between.
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"context"
+	"time"
+)
+
+// request is a PDU sent to the master agent awaiting its response
+type request struct {
+	tid  uint32
+	sent time.Time
+	what string //what the request was about, for logging
+	ch   chan *Response
+}
+
+// send numbers the request m, whose header is h, with the next packet id and
+// sends it to the master agent. The response is delivered on the returned
+// channel, which is closed without one should the session end first.
+func (c *Connection) send(m Message, h *Header, what string) (
+	<-chan *Response, error) {
+
+	r := &request{
+		tid:  h.TransactionId,
+		what: what,
+		ch:   make(chan *Response, 1),
+	}
+
+	c.mtx.Lock()
+	if c.err != nil {
+		c.mtx.Unlock()
+		close(r.ch)
+		return r.ch, c.err
+	}
+	h.PacketId = c.client.nextPacketId()
+	h.SessionId = c.sessionId
+	r.sent = c.clock.Now()
+	if c.pending == nil {
+		c.pending = make(map[uint32]*request)
+	}
+	c.pending[h.PacketId] = r
+	c.mtx.Unlock()
+
+	err := sendMsg(m, c)
+	if err != nil {
+		//the session may have ended and abandoned the request already
+		c.mtx.Lock()
+		_, ok := c.pending[h.PacketId]
+		delete(c.pending, h.PacketId)
+		c.mtx.Unlock()
+		if ok {
+			close(r.ch)
+		}
+		return r.ch, err
+	}
+	return r.ch, nil
+}
+
+// deliver hands the response in buf to the request it answers, which is
+// returned, or nil if no request awaits it
+func (c *Connection) deliver(h *Header, buf []byte) *request {
+	c.mtx.Lock()
+	r, ok := c.pending[h.PacketId]
+	if !ok || r.tid != h.TransactionId {
+		c.mtx.Unlock()
+		return nil
+	}
+	delete(c.pending, h.PacketId)
+	c.mtx.Unlock()
+
+	resp := &Response{}
+	_, err := resp.UnmarshalBinary(buf)
+	if err != nil {
+		c.logf("[rootMH] error reading response to %s: %v", r.what, err)
+		close(r.ch)
+		return r
+	}
+	r.ch <- resp
+	close(r.ch)
+	return r
+}
+
+// await waits for the answer to a request, returning the MasterError the
+// master answered with, if any. Should the context be done first its error is
+// returned, and should the session end first, the error it ended with.
+func (c *Connection) await(ctx context.Context, answer <-chan *Response) error {
+	select {
+	case r, ok := <-answer:
+		if !ok {
+			if err := c.Err(); err != nil {
+				return err
+			}
+			return ErrConnectionLost
+		}
+		if r.Error != ResponseNoError {
+			return MasterError(r.Error)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// abandon closes the channels of every request still awaiting a response,
+// once the session has ended
+func (c *Connection) abandon() {
+	c.mtx.Lock()
+	pending := c.pending
+	c.pending = nil
+	c.mtx.Unlock()
+
+	for _, r := range pending {
+		close(r.ch)
+	}
+}
@@ -0,0 +1,170 @@
+package agx
+
+// This file contains the persistence of table rows, so that rows created or
+// changed by sets survive the agent restarting
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// RowStore holds the rows of tables, which are told apart by the oid of their
+// entry
+type RowStore interface {
+	//SaveRow saves r, replacing any saved row with the same index
+	SaveRow(entry Subtree, r TableRow) error
+	//DeleteRow removes the saved row with index, if there is one
+	DeleteRow(entry Subtree, index []uint32) error
+	//LoadRows returns the saved rows
+	LoadRows(entry Subtree) ([]TableRow, error)
+}
+
+// FileRowStore is a RowStore keeping the rows of every table in a JSON file,
+// which is rewritten whole on each change
+type FileRowStore struct {
+	path string
+
+	mtx    sync.Mutex
+	tables map[string]map[string]TableRow //by entry and index key
+}
+
+// OpenFileRowStore opens the row store in the file at path, which is created
+// on the first change if it does not exist
+func OpenFileRowStore(path string) (*FileRowStore, error) {
+	s := &FileRowStore{
+		path:   path,
+		tables: make(map[string]map[string]TableRow),
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading row store: %v", err)
+	}
+	var tables map[string][]jsonRow
+	if err := json.Unmarshal(buf, &tables); err != nil {
+		return nil, fmt.Errorf("error decoding row store: %v", err)
+	}
+	for entry, rows := range tables {
+		t := make(map[string]TableRow)
+		for _, r := range rows {
+			t[indexKey(r.Index)] = TableRow{Index: r.Index, Columns: r.Columns}
+		}
+		s.tables[entry] = t
+	}
+	return s, nil
+}
+
+func (s *FileRowStore) SaveRow(entry Subtree, r TableRow) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	t, ok := s.tables[entry.String()]
+	if !ok {
+		t = make(map[string]TableRow)
+		s.tables[entry.String()] = t
+	}
+	key := indexKey(r.Index)
+	old, existed := t[key]
+	t[key] = r
+	if err := s.write(); err != nil {
+		if existed {
+			t[key] = old
+		} else {
+			delete(t, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *FileRowStore) DeleteRow(entry Subtree, index []uint32) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	t := s.tables[entry.String()]
+	key := indexKey(index)
+	old, ok := t[key]
+	if !ok {
+		return nil
+	}
+	delete(t, key)
+	if err := s.write(); err != nil {
+		t[key] = old
+		return err
+	}
+	return nil
+}
+
+func (s *FileRowStore) LoadRows(entry Subtree) ([]TableRow, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var rows []TableRow
+	for _, r := range s.tables[entry.String()] {
+		rows = append(rows, r)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return compareIndex(rows[i].Index, rows[j].Index) < 0
+	})
+	return rows, nil
+}
+
+// jsonRow is the JSON schema of a saved row, the columns are named by the
+// instances they hold
+type jsonRow struct {
+	Index   []uint32           `json:"index"`
+	Columns map[uint32]VarBind `json:"columns"`
+}
+
+// write replaces the file with the rows of every table, s must be locked
+func (s *FileRowStore) write() error {
+	tables := make(map[string][]jsonRow)
+	for entry, t := range s.tables {
+		prefix, err := NewSubtree(entry)
+		if err != nil {
+			return err
+		}
+		rows := []jsonRow{}
+		for _, r := range t {
+			j := jsonRow{Index: r.Index, Columns: make(map[uint32]VarBind)}
+			for c, vb := range r.Columns {
+				ids := append(append(prefix.Identifiers(), c), r.Index...)
+				name, err := NewSubtreeFromIdentifiers(ids)
+				if err != nil {
+					return err
+				}
+				vb.Name = *name
+				j.Columns[c] = vb
+			}
+			rows = append(rows, j)
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			return compareIndex(rows[i].Index, rows[j].Index) < 0
+		})
+		tables[entry] = rows
+	}
+
+	buf, err := json.MarshalIndent(tables, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding row store: %v", err)
+	}
+	//the old file stays whole until the new one is complete
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return fmt.Errorf("error writing row store: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("error writing row store: %v", err)
+	}
+	return nil
+}
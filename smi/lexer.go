@@ -0,0 +1,118 @@
+package smi
+
+// This file contains the tokenizer of MIB modules
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	line int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of file"
+	}
+	return fmt.Sprintf("%q on line %d", t.text, t.line)
+}
+
+// lex splits a MIB module into tokens, dropping comments. A comment runs from
+// -- to the end of the line or to the next --.
+func lex(src string) ([]token, error) {
+	var toks []token
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f':
+			i++
+		case strings.HasPrefix(src[i:], "--"):
+			i += 2
+			for i < len(src) && src[i] != '\n' {
+				if strings.HasPrefix(src[i:], "--") {
+					i += 2
+					break
+				}
+				i++
+			}
+		case c == '"':
+			start, startLine := i+1, line
+			i++
+			for i < len(src) && src[i] != '"' {
+				if src[i] == '\n' {
+					line++
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string on line %d", startLine)
+			}
+			toks = append(toks, token{tokString, src[start:i], startLine})
+			i++
+		case c == '\'':
+			//binary and hex strings, e.g. '0F'H
+			start := i
+			i++
+			for i < len(src) && src[i] != '\'' {
+				i++
+			}
+			i++
+			if i < len(src) && (src[i] == 'H' || src[i] == 'h' ||
+				src[i] == 'B' || src[i] == 'b') {
+				i++
+			}
+			toks = append(toks, token{tokString, src[start:i], line})
+		case strings.HasPrefix(src[i:], "::="):
+			toks = append(toks, token{tokPunct, "::=", line})
+			i += 3
+		case strings.HasPrefix(src[i:], ".."):
+			toks = append(toks, token{tokPunct, "..", line})
+			i += 2
+		case strings.ContainsRune("{}(),;|[]", rune(c)):
+			toks = append(toks, token{tokPunct, string(c), line})
+			i++
+		case c == '-' || unicode.IsDigit(rune(c)):
+			start := i
+			i++
+			for i < len(src) && unicode.IsDigit(rune(src[i])) {
+				i++
+			}
+			toks = append(toks, token{tokNumber, src[start:i], line})
+		case unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(src) && (unicode.IsLetter(rune(src[i])) ||
+				unicode.IsDigit(rune(src[i])) || src[i] == '-' || src[i] == '_') {
+				//identifiers may not contain or end in a comment
+				if strings.HasPrefix(src[i:], "--") {
+					break
+				}
+				i++
+			}
+			toks = append(toks, token{tokIdent, src[start:i], line})
+		default:
+			return nil, fmt.Errorf("unexpected %q on line %d", c, line)
+		}
+	}
+	return toks, nil
+}
@@ -0,0 +1,886 @@
+// Package smi parses the MIB modules that define managed objects (RFC2578,
+// RFC2579), resolving the object identifiers and syntaxes of the objects they
+// define. It understands enough of SMIv2 to generate agents and to resolve
+// object names, constructs it does not need are skipped.
+package smi
+
+// This file contains the MIB module parser
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * Definitions
+ *----------------------------------------------------------------------------*/
+
+// Kind is the kind of definition a node comes from
+type Kind int
+
+const (
+	KindIdentifier   Kind = iota //OBJECT IDENTIFIER, MODULE-IDENTITY, ...
+	KindScalar                   //OBJECT-TYPE of a scalar
+	KindTable                    //OBJECT-TYPE of a table, SEQUENCE OF an entry
+	KindEntry                    //OBJECT-TYPE of a table entry
+	KindColumn                   //OBJECT-TYPE of a column of an entry
+	KindNotification             //NOTIFICATION-TYPE
+	KindGroup                    //OBJECT-GROUP, NOTIFICATION-GROUP, ...
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindIdentifier:
+		return "identifier"
+	case KindScalar:
+		return "scalar"
+	case KindTable:
+		return "table"
+	case KindEntry:
+		return "entry"
+	case KindColumn:
+		return "column"
+	case KindNotification:
+		return "notification"
+	case KindGroup:
+		return "group"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// Module is a parsed MIB module
+type Module struct {
+	Name string
+	//Imports maps imported symbols to the modules they are imported from
+	Imports map[string]string
+	//Nodes are the nodes defined by the module in order of definition
+	Nodes []*Node
+	//Types are the textual conventions and types defined by the module
+	Types map[string]*Syntax
+}
+
+// Node is an object identifier defined by a module
+type Node struct {
+	Name   string
+	Module string
+	Kind   Kind
+	//Oid is the resolved object identifier, nil until resolved
+	Oid []uint32
+
+	//OBJECT-TYPE clauses
+	Syntax      *Syntax
+	Access      string
+	Index       []string
+	Implied     bool //the last index is IMPLIED
+	Augments    string
+	Description string
+
+	//NOTIFICATION-TYPE and group members
+	Objects []string
+
+	//the value of the node as written, a parent name followed by arcs
+	parent string
+	arcs   []uint32
+}
+
+// OidString returns the dotted form of the oid of n
+func (n *Node) OidString() string {
+	var ids []string
+	for _, x := range n.Oid {
+		ids = append(ids, strconv.FormatUint(uint64(x), 10))
+	}
+	return strings.Join(ids, ".")
+}
+
+// Syntax is the syntax of an object or a type
+type Syntax struct {
+	//Type is the type as written, e.g. DisplayString or OCTET STRING
+	Type string
+	//Base is the SMI base type Type resolves to through textual conventions,
+	//one of INTEGER, Integer32, Unsigned32, Gauge32, Counter32, Counter64,
+	//TimeTicks, OCTET STRING, OBJECT IDENTIFIER, IpAddress, Opaque, BITS, or
+	//empty when it could not be resolved
+	Base string
+	//Entry is the entry type of a SEQUENCE OF
+	Entry string
+	//Enums are the named numbers of enumerated INTEGER and BITS types
+	Enums []NamedNumber
+	//Ranges restrict values, or their sizes when Size is set
+	Ranges []Range
+	Size   bool
+}
+
+// NamedNumber is a label of an enumeration or bit
+type NamedNumber struct {
+	Name  string
+	Value int64
+}
+
+// Range is an inclusive range of values
+type Range struct {
+	Min, Max int64
+}
+
+// base types of SMIv2 and SMIv1
+var baseTypes = map[string]bool{
+	"INTEGER": true, "Integer32": true, "Unsigned32": true, "Gauge32": true,
+	"Counter32": true, "Counter64": true, "TimeTicks": true,
+	"OCTET STRING": true, "OBJECT IDENTIFIER": true, "IpAddress": true,
+	"Opaque": true, "BITS": true,
+}
+
+var typeAliases = map[string]string{
+	"Counter":          "Counter32",
+	"Gauge":            "Gauge32",
+	"NetworkAddress":   "IpAddress",
+	"DisplayString":    "OCTET STRING",
+	"PhysAddress":      "OCTET STRING",
+	"MacAddress":       "OCTET STRING",
+	"DateAndTime":      "OCTET STRING",
+	"TAddress":         "OCTET STRING",
+	"SnmpAdminString":  "OCTET STRING",
+	"TruthValue":       "INTEGER",
+	"TestAndIncr":      "INTEGER",
+	"RowStatus":        "INTEGER",
+	"StorageType":      "INTEGER",
+	"TimeInterval":     "INTEGER",
+	"InterfaceIndex":   "Integer32",
+	"TimeStamp":        "TimeTicks",
+	"AutonomousType":   "OBJECT IDENTIFIER",
+	"InstancePointer":  "OBJECT IDENTIFIER",
+	"VariablePointer":  "OBJECT IDENTIFIER",
+	"RowPointer":       "OBJECT IDENTIFIER",
+	"TDomain":          "OBJECT IDENTIFIER",
+	"ObjectIdentifier": "OBJECT IDENTIFIER",
+}
+
+// well known nodes defined by modules that are rarely at hand
+var roots = map[string][]uint32{
+	"ccitt":           {0},
+	"iso":             {1},
+	"joint-iso-ccitt": {2},
+	"org":             {1, 3},
+	"dod":             {1, 3, 6},
+	"internet":        {1, 3, 6, 1},
+	"directory":       {1, 3, 6, 1, 1},
+	"mgmt":            {1, 3, 6, 1, 2},
+	"mib-2":           {1, 3, 6, 1, 2, 1},
+	"system":          {1, 3, 6, 1, 2, 1, 1},
+	"interfaces":      {1, 3, 6, 1, 2, 1, 2},
+	"transmission":    {1, 3, 6, 1, 2, 1, 10},
+	"snmp":            {1, 3, 6, 1, 2, 1, 11},
+	"dot1dBridge":     {1, 3, 6, 1, 2, 1, 17},
+	"experimental":    {1, 3, 6, 1, 3},
+	"private":         {1, 3, 6, 1, 4},
+	"enterprises":     {1, 3, 6, 1, 4, 1},
+	"security":        {1, 3, 6, 1, 5},
+	"snmpV2":          {1, 3, 6, 1, 6},
+	"snmpDomains":     {1, 3, 6, 1, 6, 1},
+	"snmpProxys":      {1, 3, 6, 1, 6, 2},
+	"snmpModules":     {1, 3, 6, 1, 6, 3},
+}
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ * Parser
+ *----------------------------------------------------------------------------*/
+
+// Parser collects the definitions of the modules it parses, so that the
+// modules may refer to each other
+type Parser struct {
+	Modules []*Module
+	nodes   map[string]*Node
+}
+
+// NewParser returns a parser that knows only the well known roots of the
+// registration tree
+func NewParser() *Parser {
+	return &Parser{nodes: make(map[string]*Node)}
+}
+
+// ParseFile parses the modules in the file at path
+func (p *Parser) ParseFile(path string) ([]*Module, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ms, err := p.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return ms, nil
+}
+
+// Parse parses the modules read from r, a file may hold several modules
+func (p *Parser) Parse(r io.Reader) ([]*Module, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	toks, err := lex(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &stream{toks: toks}
+	var ms []*Module
+	for s.peek().kind != tokEOF {
+		m, err := p.module(s)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+		p.Modules = append(p.Modules, m)
+		for _, n := range m.Nodes {
+			if _, ok := p.nodes[n.Name]; !ok {
+				p.nodes[n.Name] = n
+			}
+		}
+	}
+	return ms, nil
+}
+
+// Node returns the node named name, which is resolved if Resolve has been
+// called
+func (p *Parser) Node(name string) *Node {
+	return p.nodes[name]
+}
+
+// Lookup returns the resolved oid of the node named name, which may be
+// qualified by its module as in IF-MIB::ifIndex. It is an agx.NameResolver,
+// so agx.SetNameResolver(p.Lookup) lets agx.NewSubtree parse names defined
+// by the modules of p.
+func (p *Parser) Lookup(name string) ([]uint32, bool) {
+	var n *Node
+	if i := strings.Index(name, "::"); i >= 0 {
+		m := p.Module(name[:i])
+		if m == nil {
+			return nil, false
+		}
+		for _, x := range m.Nodes {
+			if x.Name == name[i+2:] {
+				n = x
+			}
+		}
+	} else if r, ok := roots[name]; ok {
+		return append([]uint32{}, r...), true
+	} else {
+		n = p.nodes[name]
+	}
+	if n == nil || n.Oid == nil {
+		return nil, false
+	}
+	return append([]uint32{}, n.Oid...), true
+}
+
+// Module returns the module named name
+func (p *Parser) Module(name string) *Module {
+	for _, m := range p.Modules {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// Resolve resolves the object identifiers of every node and the base types of
+// every syntax. Nodes under parents that are not defined by any parsed module
+// are left unresolved and reported in the returned error.
+func (p *Parser) Resolve() error {
+	var unresolved []string
+	for _, m := range p.Modules {
+		for _, n := range m.Nodes {
+			if p.resolve(n, 0) == nil {
+				unresolved = append(unresolved, n.Name)
+			}
+			if n.Syntax != nil {
+				p.resolveSyntax(m, n.Syntax, 0)
+			}
+		}
+		for _, t := range m.Types {
+			p.resolveSyntax(m, t, 0)
+		}
+		p.classify(m)
+	}
+	if len(unresolved) > 0 {
+		sort.Strings(unresolved)
+		return fmt.Errorf("unresolved object identifiers: %s",
+			strings.Join(unresolved, ", "))
+	}
+	return nil
+}
+
+func (p *Parser) resolve(n *Node, depth int) []uint32 {
+	if n.Oid != nil {
+		return n.Oid
+	}
+	if depth > 128 {
+		return nil
+	}
+	var base []uint32
+	if n.parent != "" {
+		if r, ok := roots[n.parent]; ok {
+			base = r
+		} else if parent, ok := p.nodes[n.parent]; ok {
+			base = p.resolve(parent, depth+1)
+		}
+		if base == nil {
+			return nil
+		}
+	}
+	n.Oid = append(append([]uint32{}, base...), n.arcs...)
+	return n.Oid
+}
+
+func (p *Parser) resolveSyntax(m *Module, s *Syntax, depth int) {
+	if s.Base != "" || s.Entry != "" || depth > 32 {
+		return
+	}
+	if baseTypes[s.Type] {
+		s.Base = s.Type
+		return
+	}
+	if t := p.lookupType(m, s.Type); t != nil && t != s {
+		p.resolveSyntax(m, t, depth+1)
+		s.Base = t.Base
+		if len(s.Enums) == 0 {
+			s.Enums = t.Enums
+		}
+		if len(s.Ranges) == 0 {
+			s.Ranges, s.Size = t.Ranges, t.Size
+		}
+		return
+	}
+	if a, ok := typeAliases[s.Type]; ok {
+		s.Base = a
+		if s.Type == "TruthValue" && len(s.Enums) == 0 {
+			s.Enums = []NamedNumber{{"true", 1}, {"false", 2}}
+		}
+	}
+}
+
+// lookupType finds the definition of the type name as seen from module m
+func (p *Parser) lookupType(m *Module, name string) *Syntax {
+	if t, ok := m.Types[name]; ok {
+		return t
+	}
+	if from, ok := m.Imports[name]; ok {
+		if im := p.Module(from); im != nil {
+			return im.Types[name]
+		}
+	}
+	for _, om := range p.Modules {
+		if t, ok := om.Types[name]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// classify tells scalars, tables, entries and columns apart
+func (p *Parser) classify(m *Module) {
+	for _, n := range m.Nodes {
+		if n.Kind != KindScalar {
+			continue
+		}
+		switch {
+		case n.Syntax != nil && n.Syntax.Entry != "":
+			n.Kind = KindTable
+		case len(n.Index) > 0 || n.Augments != "":
+			n.Kind = KindEntry
+		}
+	}
+	for _, n := range m.Nodes {
+		if n.Kind != KindScalar {
+			continue
+		}
+		if parent, ok := p.nodes[n.parent]; ok && parent.Kind == KindEntry &&
+			len(n.arcs) == 1 {
+			n.Kind = KindColumn
+		}
+	}
+}
+
+// module parses Name DEFINITIONS ::= BEGIN ... END
+func (p *Parser) module(s *stream) (*Module, error) {
+	name := s.next()
+	if name.kind != tokIdent {
+		return nil, fmt.Errorf("expected module name, got %v", name)
+	}
+	m := &Module{
+		Name:    name.text,
+		Imports: make(map[string]string),
+		Types:   make(map[string]*Syntax),
+	}
+	//DEFINITIONS may be preceded by a module oid and followed by tagging
+	if err := s.skipPast("BEGIN"); err != nil {
+		return nil, err
+	}
+
+	for {
+		t := s.peek()
+		switch {
+		case t.kind == tokEOF:
+			return nil, fmt.Errorf("module %s has no END", m.Name)
+		case t.text == "END":
+			s.next()
+			return m, nil
+		case t.text == "IMPORTS":
+			s.next()
+			p.imports(s, m)
+		case t.text == "EXPORTS":
+			s.skipPast(";")
+		case t.kind == tokIdent:
+			if err := p.assignment(s, m); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %v", t)
+		}
+	}
+}
+
+func (p *Parser) imports(s *stream, m *Module) {
+	var syms []string
+	for {
+		t := s.next()
+		switch {
+		case t.kind == tokEOF || t.text == ";":
+			return
+		case t.text == "FROM":
+			from := s.next().text
+			for _, sym := range syms {
+				m.Imports[sym] = from
+			}
+			syms = nil
+		case t.kind == tokIdent:
+			syms = append(syms, t.text)
+		}
+	}
+}
+
+// assignment parses a value or type assignment
+func (p *Parser) assignment(s *stream, m *Module) error {
+	name := s.next()
+	t := s.peek()
+
+	switch {
+	case t.text == "MACRO":
+		return s.skipPast("END")
+
+	case t.text == "::=":
+		//type assignment
+		s.next()
+		if s.peek().text == "TEXTUAL-CONVENTION" {
+			syn, err := p.textualConvention(s)
+			if err != nil {
+				return err
+			}
+			m.Types[name.text] = syn
+			return nil
+		}
+		syn, err := p.syntax(s)
+		if err != nil {
+			return fmt.Errorf("type %s: %v", name.text, err)
+		}
+		m.Types[name.text] = syn
+		return nil
+
+	case t.text == "OBJECT":
+		//name OBJECT IDENTIFIER ::= { ... }
+		s.next()
+		if err := s.expect("IDENTIFIER"); err != nil {
+			return err
+		}
+		if err := s.expect("::="); err != nil {
+			return err
+		}
+		n := &Node{Name: name.text, Module: m.Name, Kind: KindIdentifier}
+		if err := p.oidValue(s, n); err != nil {
+			return fmt.Errorf("%s: %v", name.text, err)
+		}
+		m.Nodes = append(m.Nodes, n)
+		return nil
+
+	case t.text == "TRAP-TYPE":
+		//SMIv1 traps are numbered rather than placed in the tree
+		return s.skipPast("::=", func() { s.next() })
+
+	case t.kind == tokIdent:
+		macro := s.next().text
+		n := &Node{Name: name.text, Module: m.Name}
+		switch macro {
+		case "OBJECT-TYPE":
+			n.Kind = KindScalar
+		case "NOTIFICATION-TYPE":
+			n.Kind = KindNotification
+		case "OBJECT-GROUP", "NOTIFICATION-GROUP", "MODULE-COMPLIANCE",
+			"AGENT-CAPABILITIES":
+			n.Kind = KindGroup
+		default:
+			n.Kind = KindIdentifier
+		}
+		if err := p.clauses(s, n); err != nil {
+			return fmt.Errorf("%s: %v", name.text, err)
+		}
+		if err := p.oidValue(s, n); err != nil {
+			return fmt.Errorf("%s: %v", name.text, err)
+		}
+		m.Nodes = append(m.Nodes, n)
+		return nil
+	}
+	return fmt.Errorf("unexpected %v after %s", t, name.text)
+}
+
+// clauses parses the clauses of a macro invocation up to and including ::=
+func (p *Parser) clauses(s *stream, n *Node) error {
+	for {
+		t := s.next()
+		switch t.text {
+		case "::=":
+			return nil
+		case "SYNTAX":
+			syn, err := p.syntax(s)
+			if err != nil {
+				return err
+			}
+			if n.Syntax == nil {
+				n.Syntax = syn
+			}
+		case "MAX-ACCESS", "ACCESS":
+			n.Access = s.next().text
+		case "DESCRIPTION":
+			n.Description = s.next().text
+		case "INDEX":
+			names, implied, err := p.nameList(s)
+			if err != nil {
+				return err
+			}
+			n.Index, n.Implied = names, implied
+		case "AUGMENTS":
+			names, _, err := p.nameList(s)
+			if err != nil {
+				return err
+			}
+			if len(names) > 0 {
+				n.Augments = names[0]
+			}
+		case "OBJECTS", "NOTIFICATIONS":
+			names, _, err := p.nameList(s)
+			if err != nil {
+				return err
+			}
+			n.Objects = names
+		case "{":
+			//DEFVAL, VARIATION and other braced values
+			if err := s.skipBraces(); err != nil {
+				return err
+			}
+		}
+		if t.kind == tokEOF {
+			return fmt.Errorf("unexpected end of file")
+		}
+	}
+}
+
+// textualConvention parses TEXTUAL-CONVENTION clauses through its SYNTAX
+func (p *Parser) textualConvention(s *stream) (*Syntax, error) {
+	s.next()
+	for {
+		t := s.next()
+		switch {
+		case t.kind == tokEOF:
+			return nil, fmt.Errorf("textual convention without syntax")
+		case t.text == "SYNTAX":
+			return p.syntax(s)
+		}
+	}
+}
+
+// syntax parses a type with its optional enumeration and constraints
+func (p *Parser) syntax(s *stream) (*Syntax, error) {
+	t := s.next()
+	syn := &Syntax{Type: t.text}
+	switch t.text {
+	case "OCTET":
+		if err := s.expect("STRING"); err != nil {
+			return nil, err
+		}
+		syn.Type = "OCTET STRING"
+	case "OBJECT":
+		if err := s.expect("IDENTIFIER"); err != nil {
+			return nil, err
+		}
+		syn.Type = "OBJECT IDENTIFIER"
+	case "SEQUENCE":
+		if s.peek().text == "OF" {
+			s.next()
+			syn.Entry = s.next().text
+			syn.Type = "SEQUENCE OF " + syn.Entry
+			return syn, nil
+		}
+		//the column list of an entry type
+		if err := s.expect("{"); err != nil {
+			return nil, err
+		}
+		return syn, s.skipBraces()
+	case "CHOICE":
+		if err := s.expect("{"); err != nil {
+			return nil, err
+		}
+		return syn, s.skipBraces()
+	case "[":
+		//tagged types, e.g. [APPLICATION 4] IMPLICIT OCTET STRING
+		if err := s.skipPast("]"); err != nil {
+			return nil, err
+		}
+		if s.peek().text == "IMPLICIT" || s.peek().text == "EXPLICIT" {
+			s.next()
+		}
+		return p.syntax(s)
+	}
+	if t.kind != tokIdent {
+		return nil, fmt.Errorf("expected a type, got %v", t)
+	}
+
+	if s.peek().text == "{" {
+		s.next()
+		enums, err := p.namedNumbers(s)
+		if err != nil {
+			return nil, err
+		}
+		syn.Enums = enums
+	}
+	if s.peek().text == "(" {
+		s.next()
+		if err := p.constraint(s, syn); err != nil {
+			return nil, err
+		}
+	}
+	return syn, nil
+}
+
+// namedNumbers parses a(1), b(2) }
+func (p *Parser) namedNumbers(s *stream) ([]NamedNumber, error) {
+	var nns []NamedNumber
+	for {
+		t := s.next()
+		switch {
+		case t.text == "}":
+			return nns, nil
+		case t.text == ",":
+		case t.kind == tokIdent:
+			if err := s.expect("("); err != nil {
+				return nil, err
+			}
+			v, err := strconv.ParseInt(s.next().text, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad value of %s: %v", t.text, err)
+			}
+			if err := s.expect(")"); err != nil {
+				return nil, err
+			}
+			nns = append(nns, NamedNumber{t.text, v})
+		default:
+			return nil, fmt.Errorf("unexpected %v in named numbers", t)
+		}
+	}
+}
+
+// constraint parses a value or size constraint after its opening paren
+func (p *Parser) constraint(s *stream, syn *Syntax) error {
+	if s.peek().text == "SIZE" {
+		s.next()
+		syn.Size = true
+		if err := s.expect("("); err != nil {
+			return err
+		}
+		if err := p.constraint(s, syn); err != nil {
+			return err
+		}
+		return s.expect(")")
+	}
+	for {
+		lo := s.next()
+		min, err := parseNumber(lo.text)
+		if err != nil {
+			return fmt.Errorf("bad range bound %v", lo)
+		}
+		max := min
+		if s.peek().text == ".." {
+			s.next()
+			hi := s.next()
+			if max, err = parseNumber(hi.text); err != nil {
+				return fmt.Errorf("bad range bound %v", hi)
+			}
+		}
+		syn.Ranges = append(syn.Ranges, Range{min, max})
+		switch t := s.next(); t.text {
+		case "|":
+		case ")":
+			return nil
+		default:
+			return fmt.Errorf("unexpected %v in constraint", t)
+		}
+	}
+}
+
+// parseNumber parses decimal, hex ('ff'h) and binary ('1010'b) numbers
+func parseNumber(s string) (int64, error) {
+	if strings.HasPrefix(s, "'") && len(s) > 2 {
+		base := 16
+		if strings.HasSuffix(strings.ToLower(s), "b") {
+			base = 2
+		}
+		digits := s[1:strings.LastIndex(s, "'")]
+		if digits == "" {
+			return 0, nil
+		}
+		x, err := strconv.ParseUint(digits, base, 64)
+		return int64(x), err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// nameList parses { [IMPLIED] a, b }
+func (p *Parser) nameList(s *stream) ([]string, bool, error) {
+	if err := s.expect("{"); err != nil {
+		return nil, false, err
+	}
+	var names []string
+	implied := false
+	for {
+		t := s.next()
+		switch {
+		case t.text == "}":
+			return names, implied, nil
+		case t.text == ",":
+		case t.text == "IMPLIED":
+			implied = true
+		case t.kind == tokIdent:
+			names = append(names, t.text)
+		default:
+			return nil, false, fmt.Errorf("unexpected %v in list", t)
+		}
+	}
+}
+
+// oidValue parses { parent arc ... }, arcs may be written name(number)
+func (p *Parser) oidValue(s *stream, n *Node) error {
+	if err := s.expect("{"); err != nil {
+		return err
+	}
+	first := true
+	for {
+		t := s.next()
+		switch {
+		case t.text == "}":
+			if first {
+				return fmt.Errorf("empty object identifier")
+			}
+			return nil
+		case t.kind == tokNumber:
+			x, err := strconv.ParseUint(t.text, 10, 32)
+			if err != nil {
+				return fmt.Errorf("bad arc %v", t)
+			}
+			n.arcs = append(n.arcs, uint32(x))
+		case t.kind == tokIdent:
+			if s.peek().text == "(" {
+				s.next()
+				x, err := strconv.ParseUint(s.next().text, 10, 32)
+				if err != nil {
+					return fmt.Errorf("bad arc of %v", t)
+				}
+				if err := s.expect(")"); err != nil {
+					return err
+				}
+				if first {
+					n.arcs = append(n.arcs, uint32(x))
+					if r, ok := roots[t.text]; ok && len(r) == 1 {
+						n.arcs = nil
+						n.parent = t.text
+					}
+				} else {
+					n.arcs = append(n.arcs, uint32(x))
+				}
+			} else if first {
+				n.parent = t.text
+			} else {
+				return fmt.Errorf("unexpected %v in object identifier", t)
+			}
+		default:
+			return fmt.Errorf("unexpected %v in object identifier", t)
+		}
+		first = false
+	}
+}
+
+// token stream ...............................................................
+
+type stream struct {
+	toks []token
+	pos  int
+}
+
+func (s *stream) peek() token {
+	if s.pos >= len(s.toks) {
+		return token{kind: tokEOF}
+	}
+	return s.toks[s.pos]
+}
+
+func (s *stream) next() token {
+	t := s.peek()
+	if s.pos < len(s.toks) {
+		s.pos++
+	}
+	return t
+}
+
+func (s *stream) expect(text string) error {
+	if t := s.next(); t.text != text {
+		return fmt.Errorf("expected %q, got %v", text, t)
+	}
+	return nil
+}
+
+// skipPast skips up to and including text, then runs any of after
+func (s *stream) skipPast(text string, after ...func()) error {
+	for {
+		t := s.next()
+		if t.kind == tokEOF {
+			return fmt.Errorf("expected %q before end of file", text)
+		}
+		if t.text == text {
+			for _, f := range after {
+				f()
+			}
+			return nil
+		}
+	}
+}
+
+// skipBraces skips to the brace closing one that has been consumed
+func (s *stream) skipBraces() error {
+	depth := 1
+	for depth > 0 {
+		t := s.next()
+		switch {
+		case t.kind == tokEOF:
+			return fmt.Errorf("unbalanced braces")
+		case t.text == "{":
+			depth++
+		case t.text == "}":
+			depth--
+		}
+	}
+	return nil
+}
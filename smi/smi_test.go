@@ -0,0 +1,153 @@
+package smi_test
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/smi"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	p := smi.NewParser()
+	ms, err := p.ParseFile("testdata/AGX-TEST-MIB.txt")
+	if err != nil {
+		t.Fatalf("error parsing module %v", err)
+	}
+	if len(ms) != 1 || ms[0].Name != "AGX-TEST-MIB" {
+		t.Fatalf("parsed modules %v", ms)
+	}
+	if err := p.Resolve(); err != nil {
+		t.Fatalf("error resolving module %v", err)
+	}
+	if ms[0].Imports["Counter64"] != "SNMPv2-SMI" {
+		t.Errorf("imports %v", ms[0].Imports)
+	}
+
+	expect := []struct {
+		name, oid string
+		kind      smi.Kind
+		base      string
+	}{
+		{"agxTestMIB", "1.3.6.1.4.1.47", smi.KindIdentifier, ""},
+		{"agxTestName", "1.3.6.1.4.1.47.1.1", smi.KindScalar, "OCTET STRING"},
+		{"agxTestEnabled", "1.3.6.1.4.1.47.1.2", smi.KindScalar, "INTEGER"},
+		{"agxTestPortTable", "1.3.6.1.4.1.47.1.3", smi.KindTable, ""},
+		{"agxTestPortEntry", "1.3.6.1.4.1.47.1.3.1", smi.KindEntry, ""},
+		{"agxTestPortSpeed", "1.3.6.1.4.1.47.1.3.1.3", smi.KindColumn, "Unsigned32"},
+		{"agxTestPortOctets", "1.3.6.1.4.1.47.1.3.1.5", smi.KindColumn, "Counter64"},
+		{"agxTestPortDown", "1.3.6.1.4.1.47.2", smi.KindNotification, ""},
+		{"agxTestGroup", "1.3.6.1.4.1.47.3.1", smi.KindGroup, ""},
+	}
+	for _, x := range expect {
+		n := p.Node(x.name)
+		if n == nil {
+			t.Errorf("%s not found", x.name)
+			continue
+		}
+		if n.OidString() != x.oid || n.Kind != x.kind {
+			t.Errorf("%s is %s %s, expected %s %s",
+				x.name, n.Kind, n.OidString(), x.kind, x.oid)
+		}
+		if x.base != "" && (n.Syntax == nil || n.Syntax.Base != x.base) {
+			t.Errorf("%s has syntax %+v, expected base %s", x.name, n.Syntax, x.base)
+		}
+	}
+
+	entry := p.Node("agxTestPortEntry")
+	if !reflect.DeepEqual(entry.Index, []string{"agxTestPortIndex", "agxTestPortName"}) ||
+		!entry.Implied {
+		t.Errorf("entry index %v implied=%v", entry.Index, entry.Implied)
+	}
+
+	speed := p.Node("agxTestPortSpeed").Syntax
+	if !reflect.DeepEqual(speed.Ranges, []smi.Range{{10, 10}, {100, 100}, {1000, 100000}}) {
+		t.Errorf("speed ranges %v", speed.Ranges)
+	}
+	name := p.Node("agxTestName")
+	if !name.Syntax.Size || !reflect.DeepEqual(name.Syntax.Ranges, []smi.Range{{0, 255}}) ||
+		name.Access != "read-write" {
+		t.Errorf("name %+v %+v", name, name.Syntax)
+	}
+	state := p.Node("agxTestPortState").Syntax
+	if !reflect.DeepEqual(state.Enums,
+		[]smi.NamedNumber{{"up", 1}, {"down", 2}, {"testing", 3}}) {
+		t.Errorf("state enums %v", state.Enums)
+	}
+	if objs := p.Node("agxTestPortDown").Objects; !reflect.DeepEqual(objs,
+		[]string{"agxTestPortState"}) {
+		t.Errorf("notification objects %v", objs)
+	}
+
+	if oid, ok := p.Lookup("AGX-TEST-MIB::agxTestPortName"); !ok ||
+		!reflect.DeepEqual(oid, []uint32{1, 3, 6, 1, 4, 1, 47, 1, 3, 1, 2}) {
+		t.Errorf("lookup returned %v %v", oid, ok)
+	}
+	if _, ok := p.Lookup("IF-MIB::ifIndex"); ok {
+		t.Errorf("lookup found a node of an unparsed module")
+	}
+
+	//undefined parents are reported
+	if _, err := p.Parse(strings.NewReader("X DEFINITIONS ::= BEGIN " +
+		"x OBJECT IDENTIFIER ::= { nowhere 1 } END")); err != nil {
+		t.Fatalf("error parsing module %v", err)
+	}
+	if err := p.Resolve(); err == nil {
+		t.Errorf("no error resolving an undefined parent")
+	}
+}
+
+func TestValidator(t *testing.T) {
+	p := smi.NewParser()
+	if _, err := p.ParseFile("testdata/AGX-TEST-MIB.txt"); err != nil {
+		t.Fatalf("error parsing module %v", err)
+	}
+	if err := p.Resolve(); err != nil {
+		t.Fatalf("error resolving module %v", err)
+	}
+	name, err := agx.NewSubtree("1.3.6.1.4.1.47.1.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []struct {
+		object string
+		vb     agx.VarBind
+		result agx.TestSetResult
+	}{
+		{"agxTestPortState", agx.IntegerVarBind(*name, 2), agx.TestSetNoError},
+		{"agxTestPortState", agx.IntegerVarBind(*name, 4), agx.TestSetWrongValue},
+		{"agxTestPortState", agx.Gauge32VarBind(*name, 2), agx.TestSetWrongType},
+		{"agxTestEnabled", agx.IntegerVarBind(*name, 0), agx.TestSetWrongValue},
+		{"agxTestPortIndex", agx.IntegerVarBind(*name, 4096), agx.TestSetNoError},
+		{"agxTestPortIndex", agx.IntegerVarBind(*name, 0), agx.TestSetWrongValue},
+		{"agxTestPortSpeed", agx.Gauge32VarBind(*name, 100), agx.TestSetNoError},
+		{"agxTestPortSpeed", agx.Gauge32VarBind(*name, 50), agx.TestSetWrongValue},
+		{"agxTestName", *agx.OctetStringVarBind(*name, []byte("muffin")), agx.TestSetNoError},
+		{"agxTestPortName", *agx.OctetStringVarBind(*name, nil), agx.TestSetWrongLength},
+		{"agxTestPortName", agx.IntegerVarBind(*name, 1), agx.TestSetWrongType},
+	}
+	for _, x := range expect {
+		v := p.Node(x.object).Syntax.Validator()
+		if v == nil {
+			t.Errorf("no validator for %s", x.object)
+			continue
+		}
+		if r := v(x.vb); r != x.result {
+			t.Errorf("%s of %v is %d, expected %d", x.object, x.vb, r, x.result)
+		}
+	}
+	if p.Node("agxTestPortOctets").Syntax.Validator() != nil {
+		t.Errorf("validator for a counter")
+	}
+
+	syntax, ok := p.Node("agxTestPortName").Syntax.AgxSyntax()
+	if !ok || !reflect.DeepEqual(syntax,
+		agx.Syntax{Type: agx.OctetStringT, Sizes: []agx.Range{{Min: 1, Max: 32}}}) {
+		t.Errorf("agxTestPortName declared as %+v %v", syntax, ok)
+	}
+	if syntax, ok := p.Node("agxTestPortSpeed").Syntax.AgxSyntax(); !ok ||
+		syntax.Type != agx.Gauge32T || syntax.Sizes != nil {
+		t.Errorf("agxTestPortSpeed declared as %+v %v", syntax, ok)
+	}
+}
@@ -0,0 +1,84 @@
+package smi
+
+// This file contains the validation of values set against the syntax of the
+// objects of a module
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"github.com/rcgoodfellow/agx"
+)
+
+// Validator returns the agx.Validator checking values set against s: the
+// enumeration or ranges of INTEGER and Integer32 types, the ranges of
+// Unsigned32 and Gauge32 types, and the sizes of OCTET STRING types. Other
+// syntaxes are not validated and nil is returned.
+func (s *Syntax) Validator() agx.Validator {
+	if s == nil {
+		return nil
+	}
+	ranges := make([]agx.Range, len(s.Ranges))
+	for i, r := range s.Ranges {
+		ranges[i] = agx.Range{Min: r.Min, Max: r.Max}
+	}
+
+	switch s.Base {
+	case "INTEGER", "Integer32":
+		if len(s.Enums) > 0 {
+			values := make([]int32, len(s.Enums))
+			for i, e := range s.Enums {
+				values[i] = int32(e.Value)
+			}
+			return agx.EnumValidator(values...)
+		}
+		return agx.Integer32Validator(ranges...)
+	case "Unsigned32", "Gauge32":
+		return agx.Unsigned32Validator(ranges...)
+	case "OCTET STRING":
+		if !s.Size {
+			return agx.OctetStringValidator()
+		}
+		return agx.OctetStringValidator(ranges...)
+	}
+	return nil
+}
+
+// AgxSyntax returns the agx.Syntax variables of syntax s are declared with,
+// and false if the base type of s is not known
+func (s *Syntax) AgxSyntax() (agx.Syntax, bool) {
+	if s == nil {
+		return agx.Syntax{}, false
+	}
+	var t int16
+	switch s.Base {
+	case "INTEGER", "Integer32":
+		t = agx.IntegerT
+	case "Unsigned32", "Gauge32":
+		t = agx.Gauge32T
+	case "Counter32":
+		t = agx.Counter32T
+	case "Counter64":
+		t = agx.Counter64T
+	case "TimeTicks":
+		t = agx.TimeTicksT
+	case "OCTET STRING", "BITS":
+		t = agx.OctetStringT
+	case "OBJECT IDENTIFIER":
+		t = agx.ObjectIdentifierT
+	case "IpAddress":
+		t = agx.IpAddressT
+	case "Opaque":
+		t = agx.OpaqueT
+	default:
+		return agx.Syntax{}, false
+	}
+
+	syntax := agx.Syntax{Type: t}
+	if t == agx.OctetStringT && s.Size {
+		for _, r := range s.Ranges {
+			syntax.Sizes = append(syntax.Sizes, agx.Range{Min: r.Min, Max: r.Max})
+		}
+	}
+	return syntax, true
+}
@@ -0,0 +1,71 @@
+package agx
+
+// This file contains snapshots of the registrations and handlers of a
+// connection, so that a session can be set up again without repeating the
+// setup of the application
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+)
+
+// Snapshot holds the active registrations and installed handlers of a
+// connection. Snapshots serialize, e.g. with encoding/json, but only the oids
+// and types of the handlers are kept, the handlers themselves can only be
+// restored from a snapshot taken within the same process.
+type Snapshot struct {
+	Registrations []string       `json:"registrations"`
+	Handlers      HandlerBundles `json:"handlers"`
+}
+
+// Snapshot returns the active registrations and installed handlers of c
+func (c *Connection) Snapshot() *Snapshot {
+	c.mtx.Lock()
+	regs := make([]string, 0, len(c.subtrees))
+	for _, r := range c.subtrees {
+		regs = append(regs, r.Subtree)
+	}
+	c.mtx.Unlock()
+
+	return &Snapshot{
+		Registrations: regs,
+		Handlers:      c.Handlers(),
+	}
+}
+
+// Restore sets c up as described by s, e.g. after reconnecting or failing
+// over to another master agent. Handlers carried by s are installed and then
+// every registration of s is registered. Handlers of a snapshot that has been
+// serialized are not carried by it and must already be installed, nothing is
+// registered if any are missing.
+func (c *Connection) Restore(s *Snapshot) error {
+	var carried HandlerBundles
+	for _, h := range s.Handlers {
+		if h.Handler != nil {
+			carried = append(carried, h)
+		}
+	}
+	if err := c.Install(carried); err != nil {
+		return err
+	}
+
+	installed := make(map[string]bool)
+	for _, h := range c.Handlers() {
+		installed[fmt.Sprintf("%v %s", h.Type, h.Oid)] = true
+	}
+	for _, h := range s.Handlers {
+		if !installed[fmt.Sprintf("%v %s", h.Type, h.Oid)] {
+			return fmt.Errorf("snapshot %v handler for %q is not installed",
+				h.Type, h.Oid)
+		}
+	}
+
+	for _, oid := range s.Registrations {
+		if err := c.Register(oid); err != nil {
+			return fmt.Errorf("error restoring registration %s: %v", oid, err)
+		}
+	}
+	return nil
+}
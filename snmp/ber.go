@@ -0,0 +1,440 @@
+package snmp
+
+// This file contains the BER encoding of SNMPv2c messages (RFC3416, X.690)
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"net"
+)
+
+// Version2c is the version number carried by SNMPv2c messages
+const Version2c = 1
+
+// PDU types
+const (
+	GetRequest     byte = 0xa0
+	GetNextRequest byte = 0xa1
+	Response       byte = 0xa2
+	SetRequest     byte = 0xa3
+	GetBulkRequest byte = 0xa5
+)
+
+// error status (RFC3416~3)
+const (
+	NoError             = 0
+	TooBig              = 1
+	GenErr              = 5
+	NoAccess            = 6
+	WrongType           = 7
+	NotWritable         = 17
+	CommitFailed        = 14
+	ResourceUnavailable = 13
+)
+
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+)
+
+// ErrMalformed is returned when decoding a message that is not valid BER
+var ErrMalformed = errors.New("malformed ber")
+
+// Message is an SNMPv2c message. The value types of the varbinds follow the
+// agx conventions, and their type numbers are the BER tags of the values as
+// AgentX shares them with SNMP.
+type Message struct {
+	Version     int
+	Community   string
+	Type        byte
+	RequestId   int32
+	ErrorStatus int //non-repeaters for GetBulkRequest
+	ErrorIndex  int //max-repetitions for GetBulkRequest
+	VarBinds    []agx.VarBind
+}
+
+func (m *Message) MarshalBinary() ([]byte, error) {
+	var vbs []byte
+	for _, vb := range m.VarBinds {
+		b, err := EncodeVarBind(vb)
+		if err != nil {
+			return nil, err
+		}
+		vbs = append(vbs, b...)
+	}
+
+	var pdu []byte
+	pdu = appendTLV(pdu, tagInteger, encodeInt(int64(m.RequestId)))
+	pdu = appendTLV(pdu, tagInteger, encodeInt(int64(m.ErrorStatus)))
+	pdu = appendTLV(pdu, tagInteger, encodeInt(int64(m.ErrorIndex)))
+	pdu = appendTLV(pdu, tagSequence, vbs)
+
+	var msg []byte
+	msg = appendTLV(msg, tagInteger, encodeInt(int64(m.Version)))
+	msg = appendTLV(msg, tagOctetString, []byte(m.Community))
+	msg = appendTLV(msg, m.Type, pdu)
+
+	return appendTLV(nil, tagSequence, msg), nil
+}
+
+func (m *Message) UnmarshalBinary(buf []byte) error {
+	msg, err := expect(&buf, tagSequence)
+	if err != nil {
+		return err
+	}
+
+	version, err := expectInt(&msg)
+	if err != nil {
+		return err
+	}
+	m.Version = int(version)
+	community, err := expect(&msg, tagOctetString)
+	if err != nil {
+		return err
+	}
+	m.Community = string(community)
+
+	var pdu []byte
+	m.Type, pdu, err = next(&msg)
+	if err != nil {
+		return err
+	}
+
+	var x [3]int64
+	for i := range x {
+		x[i], err = expectInt(&pdu)
+		if err != nil {
+			return err
+		}
+	}
+	m.RequestId, m.ErrorStatus, m.ErrorIndex = int32(x[0]), int(x[1]), int(x[2])
+
+	vbs, err := expect(&pdu, tagSequence)
+	if err != nil {
+		return err
+	}
+	m.VarBinds = nil
+	for len(vbs) > 0 {
+		vb, err := decodeVarBind(&vbs)
+		if err != nil {
+			return err
+		}
+		m.VarBinds = append(m.VarBinds, vb)
+	}
+	return nil
+}
+
+// EncodeVarBind returns the BER encoding of vb as found in a varbind list
+func EncodeVarBind(vb agx.VarBind) ([]byte, error) {
+	v, err := EncodeValue(vb)
+	if err != nil {
+		return nil, err
+	}
+	b := appendTLV(nil, tagOID, encodeOID(vb.Name))
+	b = append(b, v...)
+	return appendTLV(nil, tagSequence, b), nil
+}
+
+// EncodeValue returns the BER encoding of the value of vb
+func EncodeValue(vb agx.VarBind) ([]byte, error) {
+	var content []byte
+	bad := func() ([]byte, error) {
+		return nil, fmt.Errorf("varbind %v of type %d has %T data",
+			vb.Name, vb.Type, vb.Data)
+	}
+
+	ok := true
+	switch vb.Type {
+	case agx.IntegerT:
+		var x int32
+		x, ok = vb.Int32()
+		content = encodeInt(int64(x))
+	case agx.OctetStringT, agx.OpaqueT:
+		content, ok = vb.OctetString()
+	case agx.NullT, agx.NoSuchObjectT, agx.NoSuchInstanceT, agx.EndOfMibViewT:
+		ok = vb.Data == nil
+	case agx.ObjectIdentifierT:
+		var x agx.Subtree
+		x, ok = vb.OID()
+		content = encodeOID(x)
+	case agx.IpAddressT:
+		var x net.IP
+		x, ok = vb.IP()
+		content = x.To4()
+		ok = ok && content != nil
+	case agx.Counter32T, agx.Gauge32T, agx.TimeTicksT:
+		var x uint32
+		x, ok = vb.Uint32()
+		content = encodeUint(uint64(x))
+	case agx.Counter64T:
+		var x uint64
+		x, ok = vb.Uint64()
+		content = encodeUint(x)
+	default:
+		return nil, fmt.Errorf("unknown varbind type %d", vb.Type)
+	}
+	if !ok || (vb.Data != nil && vb.Data.Type() != vb.Type) {
+		return bad()
+	}
+
+	return appendTLV(nil, byte(vb.Type), content), nil
+}
+
+// DecodeValue decodes the BER encoded value in buf as the value of a varbind
+// named name
+func DecodeValue(name agx.Subtree, buf []byte) (agx.VarBind, error) {
+	tag, content, err := next(&buf)
+	if err != nil {
+		return agx.VarBind{}, err
+	}
+	return decodeValue(name, tag, content)
+}
+
+func decodeVarBind(buf *[]byte) (agx.VarBind, error) {
+	seq, err := expect(buf, tagSequence)
+	if err != nil {
+		return agx.VarBind{}, err
+	}
+	oid, err := expect(&seq, tagOID)
+	if err != nil {
+		return agx.VarBind{}, err
+	}
+	name, err := decodeOID(oid)
+	if err != nil {
+		return agx.VarBind{}, err
+	}
+	tag, content, err := next(&seq)
+	if err != nil {
+		return agx.VarBind{}, err
+	}
+	return decodeValue(name, tag, content)
+}
+
+func decodeValue(name agx.Subtree, tag byte, content []byte) (
+	agx.VarBind, error) {
+
+	vb := agx.VarBind{Type: int16(tag), Name: name}
+	switch int16(tag) {
+	case agx.IntegerT:
+		x, err := decodeInt(content)
+		if err != nil {
+			return vb, err
+		}
+		vb.Data = agx.Integer(x)
+	case agx.OctetStringT:
+		vb.Data = *agx.NewOctetString(content)
+	case agx.OpaqueT:
+		vb.Data = agx.NewOpaque(content)
+	case agx.NullT, agx.NoSuchObjectT, agx.NoSuchInstanceT, agx.EndOfMibViewT:
+	case agx.ObjectIdentifierT:
+		x, err := decodeOID(content)
+		if err != nil {
+			return vb, err
+		}
+		vb.Data = agx.Oid{Subtree: x}
+	case agx.IpAddressT:
+		if len(content) != net.IPv4len {
+			return vb, fmt.Errorf("%w: ip address of length %d",
+				ErrMalformed, len(content))
+		}
+		vb.Data = agx.IpAddress(append([]byte{}, content...))
+	case agx.Counter32T, agx.Gauge32T, agx.TimeTicksT:
+		x, err := decodeUint(content, 4)
+		if err != nil {
+			return vb, err
+		}
+		switch int16(tag) {
+		case agx.Counter32T:
+			vb.Data = agx.Counter32(x)
+		case agx.Gauge32T:
+			vb.Data = agx.Gauge32(x)
+		default:
+			vb.Data = agx.TimeTicks(x)
+		}
+	case agx.Counter64T:
+		x, err := decodeUint(content, 8)
+		if err != nil {
+			return vb, err
+		}
+		vb.Data = agx.Counter64(x)
+	default:
+		return vb, fmt.Errorf("unknown value type %#x", tag)
+	}
+	return vb, nil
+}
+
+// helpers ====================================================================
+
+func appendTLV(dst []byte, tag byte, content []byte) []byte {
+	dst = append(dst, tag)
+	n := len(content)
+	switch {
+	case n < 0x80:
+		dst = append(dst, byte(n))
+	case n <= 0xff:
+		dst = append(dst, 0x81, byte(n))
+	case n <= 0xffff:
+		dst = append(dst, 0x82, byte(n>>8), byte(n))
+	default:
+		dst = append(dst, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(dst, content...)
+}
+
+// next splits the first TLV off of buf, returning its tag and content
+func next(buf *[]byte) (byte, []byte, error) {
+	b := *buf
+	if len(b) < 2 {
+		return 0, nil, ErrMalformed
+	}
+	tag, n, i := b[0], int(b[1]), 2
+	if n&0x80 != 0 {
+		nb := n & 0x7f
+		if nb == 0 || nb > 4 || len(b) < 2+nb {
+			return 0, nil, ErrMalformed
+		}
+		n = 0
+		for _, x := range b[2 : 2+nb] {
+			n = n<<8 | int(x)
+		}
+		i += nb
+	}
+	if n < 0 || n > len(b)-i {
+		return 0, nil, ErrMalformed
+	}
+	*buf = b[i+n:]
+	return tag, b[i : i+n], nil
+}
+
+func expect(buf *[]byte, tag byte) ([]byte, error) {
+	t, content, err := next(buf)
+	if err != nil {
+		return nil, err
+	}
+	if t != tag {
+		return nil, fmt.Errorf("%w: expected tag %#x, found %#x",
+			ErrMalformed, tag, t)
+	}
+	return content, nil
+}
+
+func expectInt(buf *[]byte) (int64, error) {
+	content, err := expect(buf, tagInteger)
+	if err != nil {
+		return 0, err
+	}
+	return decodeInt(content)
+}
+
+func encodeInt(x int64) []byte {
+	b := []byte{byte(x)}
+	for x >= 0x80 || x < -0x80 {
+		x >>= 8
+		b = append([]byte{byte(x)}, b...)
+	}
+	return b
+}
+
+func decodeInt(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, fmt.Errorf("%w: integer of length %d", ErrMalformed, len(b))
+	}
+	x := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		x = x<<8 | int64(c)
+	}
+	return x, nil
+}
+
+func encodeUint(x uint64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(x)}, b...)
+		x >>= 8
+		if x == 0 {
+			break
+		}
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+// decodeUint decodes an unsigned value that fits in size bytes
+func decodeUint(b []byte, size int) (uint64, error) {
+	if len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	if len(b) == 0 || len(b) > size {
+		return 0, fmt.Errorf("%w: unsigned of length %d", ErrMalformed, len(b))
+	}
+	var x uint64
+	for _, c := range b {
+		x = x<<8 | uint64(c)
+	}
+	return x, nil
+}
+
+func encodeOID(s agx.Subtree) []byte {
+	ids := s.Identifiers()
+	//the first two arcs share a byte, the null oid is sent as 0.0
+	for len(ids) < 2 {
+		ids = append(ids, 0)
+	}
+	b := appendBase128(nil, 40*ids[0]+ids[1])
+	for _, x := range ids[2:] {
+		b = appendBase128(b, x)
+	}
+	return b
+}
+
+func appendBase128(dst []byte, x uint32) []byte {
+	var tmp [5]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(x & 0x7f)
+	for x >>= 7; x > 0; x >>= 7 {
+		i--
+		tmp[i] = byte(x&0x7f) | 0x80
+	}
+	return append(dst, tmp[i:]...)
+}
+
+func decodeOID(b []byte) (agx.Subtree, error) {
+	var ids []uint32
+	var x uint64
+	for i, c := range b {
+		x = x<<7 | uint64(c&0x7f)
+		if x > 0xffffffff {
+			return agx.Subtree{}, fmt.Errorf("%w: oid arc overflows", ErrMalformed)
+		}
+		if c&0x80 != 0 {
+			if i == len(b)-1 {
+				return agx.Subtree{}, fmt.Errorf("%w: truncated oid", ErrMalformed)
+			}
+			continue
+		}
+		if len(ids) == 0 {
+			first := uint32(x / 40)
+			if first > 2 {
+				first = 2
+			}
+			ids = append(ids, first, uint32(x)-40*first)
+		} else {
+			ids = append(ids, uint32(x))
+		}
+		x = 0
+	}
+	s, err := agx.NewSubtreeFromIdentifiers(ids)
+	if err != nil {
+		return agx.Subtree{}, err
+	}
+	return *s, nil
+}
@@ -0,0 +1,261 @@
+// Package snmp serves the handlers of an agx.Dispatcher directly over
+// SNMPv2c, for running an agent without a master agent in front of it.
+package snmp
+
+// This file contains the SNMPv2c agent
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"log"
+	"net"
+	"sync"
+)
+
+const (
+	DefaultMaxMessageSize = 1472 //largest response that fits an ethernet frame
+	maxRequestSize        = 65507
+)
+
+// SessionId is passed to set handlers for sets made over SNMP, as there is no
+// AgentX session
+const SessionId = 0
+
+// Agent answers the requests of a Server. Set returns the error status and 1
+// based index of the transaction. An error fails the request with genErr.
+type Agent interface {
+	Get(oids ...agx.Subtree) ([]agx.VarBind, error)
+	GetNext(oids ...agx.Subtree) ([]agx.VarBind, error)
+	GetBulk(nonRepeaters, maxRepetitions int, oids []agx.Subtree) (
+		[]agx.VarBind, error)
+	Set(vbs ...agx.VarBind) (int, int, error)
+}
+
+// Server answers SNMPv2c get, getnext, getbulk and set requests from the
+// handlers of a Dispatcher. Requests are answered one at a time, so handlers
+// see the same serialized dispatch they do under a Connection.
+type Server struct {
+	//Dispatcher holds the handlers requests are answered with
+	Dispatcher *agx.Dispatcher
+	//Agent, when set, answers requests in place of Dispatcher
+	Agent Agent
+	//Community is required of get requests
+	Community string
+	//WriteCommunity is required of set requests, sets are refused when empty
+	WriteCommunity string
+	//MaxMessageSize bounds the size of responses
+	MaxMessageSize int
+
+	mtx  sync.Mutex
+	conn net.PacketConn
+}
+
+// NewServer returns a read only server answering requests with community from
+// the handlers of d
+func NewServer(d *agx.Dispatcher, community string) *Server {
+	return &Server{
+		Dispatcher:     d,
+		Community:      community,
+		MaxMessageSize: DefaultMaxMessageSize,
+	}
+}
+
+// ListenAndServe listens on the udp address addr, e.g. ":161", and serves
+// requests until the server is closed
+func (s *Server) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(pc)
+}
+
+// Serve answers requests arriving on pc until the server is closed, which
+// returns nil, or pc fails
+func (s *Server) Serve(pc net.PacketConn) error {
+	s.mtx.Lock()
+	s.conn = pc
+	s.mtx.Unlock()
+
+	buf := make([]byte, maxRequestSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			s.mtx.Lock()
+			closed := s.conn == nil
+			s.mtx.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		out := s.handle(buf[:n])
+		if out == nil {
+			continue
+		}
+		if _, err := pc.WriteTo(out, addr); err != nil {
+			log.Printf("[snmp] error responding to %v: %v", addr, err)
+		}
+	}
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	pc := s.conn
+	s.conn = nil
+	s.mtx.Unlock()
+
+	if pc == nil {
+		return nil
+	}
+	return pc.Close()
+}
+
+// handle returns the encoded response to a request, or nil if the request is
+// to be dropped
+func (s *Server) handle(buf []byte) []byte {
+	var req Message
+	if err := req.UnmarshalBinary(buf); err != nil {
+		log.Printf("[snmp] dropping undecodable request: %v", err)
+		return nil
+	}
+	if req.Version != Version2c {
+		log.Printf("[snmp] dropping version %d request", req.Version)
+		return nil
+	}
+	if req.Community != s.Community &&
+		(req.Type != SetRequest || req.Community != s.WriteCommunity) {
+		log.Printf("[snmp] dropping request with unknown community")
+		return nil
+	}
+
+	r := Message{
+		Version:   req.Version,
+		Community: req.Community,
+		Type:      Response,
+		RequestId: req.RequestId,
+	}
+
+	a := s.Agent
+	if a == nil {
+		a = dispatcher{s.Dispatcher}
+	}
+	var oids []agx.Subtree
+	for _, vb := range req.VarBinds {
+		oids = append(oids, vb.Name)
+	}
+
+	var err error
+	switch req.Type {
+	case GetRequest:
+		r.VarBinds, err = a.Get(oids...)
+	case GetNextRequest:
+		r.VarBinds, err = a.GetNext(oids...)
+	case GetBulkRequest:
+		r.VarBinds, err = a.GetBulk(req.ErrorStatus, req.ErrorIndex, oids)
+	case SetRequest:
+		r.VarBinds = req.VarBinds
+		if s.WriteCommunity == "" || req.Community != s.WriteCommunity {
+			r.ErrorStatus, r.ErrorIndex = NoAccess, 1
+			break
+		}
+		r.ErrorStatus, r.ErrorIndex, err = a.Set(req.VarBinds...)
+	default:
+		log.Printf("[snmp] dropping pdu type %#x", req.Type)
+		return nil
+	}
+	if err != nil {
+		log.Printf("[snmp] error answering request: %v", err)
+		r.ErrorStatus, r.ErrorIndex = GenErr, 0
+		r.VarBinds = req.VarBinds
+	}
+
+	return s.encode(&r, &req)
+}
+
+// dispatcher answers requests from the handlers of a Dispatcher
+type dispatcher struct {
+	d *agx.Dispatcher
+}
+
+// Get binds oids for a get request, which unlike AgentX only binds exact
+// matches
+func (x dispatcher) Get(oids ...agx.Subtree) ([]agx.VarBind, error) {
+	vbs, _, err := x.d.BindAll(oids)
+	if err != nil {
+		return nil, err
+	}
+	for i, oid := range oids {
+		if vbs[i].Type == agx.EndOfMibViewT || vbs[i].Name.Compare(oid) != 0 {
+			vbs[i] = agx.NoSuchObjectVarBind(oid)
+		}
+	}
+	return vbs, nil
+}
+
+func (x dispatcher) GetNext(oids ...agx.Subtree) ([]agx.VarBind, error) {
+	var vbs []agx.VarBind
+	for _, oid := range oids {
+		vb, err := x.d.Bind(oid, true)
+		if err != nil {
+			return nil, err
+		}
+		vbs = append(vbs, vb)
+	}
+	return vbs, nil
+}
+
+func (x dispatcher) GetBulk(nonRepeaters, maxRepetitions int,
+	oids []agx.Subtree) ([]agx.VarBind, error) {
+
+	return x.d.GetBulk(nonRepeaters, maxRepetitions, oids), nil
+}
+
+// Set runs a set transaction, there is no undo so a failed commit is reported
+// as such
+func (x dispatcher) Set(vbs ...agx.VarBind) (int, int, error) {
+	d := x.d
+	result, index := d.TestSet(vbs, SessionId)
+	if result != agx.TestSetNoError {
+		d.CleanupSet(SessionId)
+		return int(result), index, nil
+	}
+	if d.CommitSet(SessionId) != agx.CommitSetNoError {
+		d.CleanupSet(SessionId)
+		return CommitFailed, 0, nil
+	}
+	d.CleanupSet(SessionId)
+	return NoError, 0, nil
+}
+
+// encode marshals the response r to req, trimming getbulk results or failing
+// with tooBig to stay within the maximum message size
+func (s *Server) encode(r, req *Message) []byte {
+	for {
+		out, err := r.MarshalBinary()
+		if err != nil {
+			log.Printf("[snmp] error encoding response: %v", err)
+			r.ErrorStatus, r.ErrorIndex = GenErr, 0
+			r.VarBinds = req.VarBinds
+			out, err = r.MarshalBinary()
+			if err != nil {
+				return nil
+			}
+		}
+		if len(out) <= s.MaxMessageSize {
+			return out
+		}
+		if req.Type == GetBulkRequest && len(r.VarBinds) > 0 {
+			r.VarBinds = r.VarBinds[:len(r.VarBinds)-1]
+			continue
+		}
+		r.ErrorStatus, r.ErrorIndex = TooBig, 0
+		r.VarBinds = nil
+		out, _ = r.MarshalBinary()
+		return out
+	}
+}
@@ -0,0 +1,184 @@
+package snmp_test
+
+import (
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/snmp"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const sysName = "1.3.6.1.2.1.1.5.0"
+
+func TestMessageRoundTrip(t *testing.T) {
+	n, err := agx.NewSubtreeFromIdentifiers(
+		[]uint32{1, 3, 6, 1, 2, 1, 2, 2, 1, 10, 4294967295})
+	if err != nil {
+		t.Fatalf("error creating subtree %v", err)
+	}
+	name := *n
+	vbs := []agx.VarBind{
+		agx.IntegerVarBind(name, -129),
+		*agx.OctetStringVarBind(name, []byte("muffin")),
+		{Type: agx.ObjectIdentifierT, Name: name, Data: agx.Oid{Subtree: subtree(t, "1.3.6.1.4.1")}},
+		{Type: agx.IpAddressT, Name: name, Data: agx.IpAddress{10, 0, 0, 47}},
+		{Type: agx.Counter32T, Name: name, Data: agx.Counter32(0xffffffff)},
+		{Type: agx.TimeTicksT, Name: name, Data: agx.TimeTicks(47)},
+		{Type: agx.Counter64T, Name: name, Data: agx.Counter64(1) << 63},
+		agx.EndOfMibViewVarBind(name),
+	}
+	a := &snmp.Message{
+		Version:   snmp.Version2c,
+		Community: "public",
+		Type:      snmp.Response,
+		RequestId: 1 << 30,
+		VarBinds:  vbs,
+	}
+	buf, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error marshalling message %v", err)
+	}
+	b := &snmp.Message{}
+	if err := b.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("error unmarshalling message %v", err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("messages are not equal\n%v\n%v", a, b)
+	}
+
+	for i := 1; i < len(buf); i++ {
+		if err := b.UnmarshalBinary(buf[:i]); err == nil {
+			t.Fatalf("no error unmarshalling %d of %d bytes", i, len(buf))
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	d := &agx.Dispatcher{}
+	d.OnGet(sysName, func(oid agx.Subtree) agx.VarBind {
+		return *agx.OctetStringVarBind(oid, []byte("muffin"))
+	})
+	ifs := "1.3.6.1.2.1.2.2.1.1"
+	for i := 1; i <= 3; i++ {
+		d.OnGet(fmt.Sprintf("%s.%d", ifs, i), func(oid agx.Subtree) agx.VarBind {
+			return agx.IntegerVarBind(oid, int32(oid.Identifiers()[10]))
+		})
+	}
+	var mtx sync.Mutex
+	var set []agx.VarBind
+	d.OnTestSet(sysName, func(vb agx.VarBind, sessionId uint32) agx.TestSetResult {
+		mtx.Lock()
+		defer mtx.Unlock()
+		set = append(set, vb)
+		return agx.TestSetNoError
+	})
+
+	s := snmp.NewServer(d, "public")
+	s.WriteCommunity = "private"
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening %v", err)
+	}
+	go s.Serve(pc)
+	defer s.Close()
+
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("error dialing %v", err)
+	}
+	defer client.Close()
+
+	request := func(community string, typ byte, a, b int, oids ...string) *snmp.Message {
+		t.Helper()
+		m := &snmp.Message{
+			Version: snmp.Version2c, Community: community, Type: typ,
+			RequestId: 47, ErrorStatus: a, ErrorIndex: b,
+		}
+		for _, oid := range oids {
+			m.VarBinds = append(m.VarBinds,
+				agx.VarBind{Type: agx.NullT, Name: subtree(t, oid)})
+		}
+		return exchange(t, client, m)
+	}
+
+	r := request("public", snmp.GetRequest, 0, 0, sysName, sysName+".1")
+	expect := []agx.VarBind{
+		*agx.OctetStringVarBind(subtree(t, sysName), []byte("muffin")),
+		agx.NoSuchObjectVarBind(subtree(t, sysName+".1")),
+	}
+	if r == nil || !reflect.DeepEqual(r.VarBinds, expect) {
+		t.Errorf("get returned %v", r)
+	}
+
+	r = request("public", snmp.GetNextRequest, 0, 0, ifs)
+	if r == nil || len(r.VarBinds) != 1 || r.VarBinds[0].Data != agx.Integer(1) {
+		t.Errorf("getnext returned %v", r)
+	}
+
+	r = request("public", snmp.GetBulkRequest, 1, 4, "1.3.6.1.2.1.1", ifs)
+	if r == nil || len(r.VarBinds) != 5 {
+		t.Fatalf("getbulk returned %v", r)
+	}
+	if r.VarBinds[0].Name.String() != sysName ||
+		r.VarBinds[1].Data != agx.Integer(1) || r.VarBinds[3].Data != agx.Integer(3) ||
+		r.VarBinds[4].Type != agx.EndOfMibViewT {
+		t.Errorf("getbulk returned %v", r.VarBinds)
+	}
+
+	//sets need the write community
+	vb := *agx.OctetStringVarBind(subtree(t, sysName), []byte("pirate"))
+	m := &snmp.Message{Version: snmp.Version2c, Community: "public",
+		Type: snmp.SetRequest, RequestId: 48, VarBinds: []agx.VarBind{vb}}
+	r = exchange(t, client, m)
+	if r == nil || r.ErrorStatus != snmp.NoAccess {
+		t.Errorf("read community set returned %v", r)
+	}
+	m.Community = "private"
+	r = exchange(t, client, m)
+	mtx.Lock()
+	defer mtx.Unlock()
+	if r == nil || r.ErrorStatus != snmp.NoError ||
+		!reflect.DeepEqual(set, []agx.VarBind{vb}) {
+		t.Errorf("set returned %v, handled %v", r, set)
+	}
+
+	//unknown communities are ignored
+	if r := request("pirates", snmp.GetRequest, 0, 0, sysName); r != nil {
+		t.Errorf("unknown community answered with %v", r)
+	}
+}
+
+func exchange(t *testing.T, conn net.Conn, m *snmp.Message) *snmp.Message {
+	t.Helper()
+	buf, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error marshalling request %v", err)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatalf("error sending request %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	in := make([]byte, 65536)
+	n, err := conn.Read(in)
+	if err != nil {
+		return nil
+	}
+	r := &snmp.Message{}
+	if err := r.UnmarshalBinary(in[:n]); err != nil {
+		t.Fatalf("error unmarshalling response %v", err)
+	}
+	return r
+}
+
+func subtree(t *testing.T, oid string) agx.Subtree {
+	t.Helper()
+	s, err := agx.NewSubtree(oid)
+	if err != nil {
+		t.Fatalf("bad oid %s: %v", oid, err)
+	}
+	return *s
+}
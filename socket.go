@@ -0,0 +1,142 @@
+package agx
+
+// This file contains the discovery of the master agent socket
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// SocketEnv names the environment variable that, when set, holds the address
+// of the master agent in place of MasterSocket, as for net-snmp subagents
+const SocketEnv = "AGENTX_SOCKET"
+
+// SnmpdConf is where the net-snmp master agent is configured, its
+// agentXSocket directive is used when SocketEnv is not set
+const SnmpdConf = "/etc/snmp/snmpd.conf"
+
+// ParseSocket parses the address of a master agent into the network and
+// address it is dialed at. Accepted are a path to a unix socket, unix:///path
+// or unix:/path, and tcp://host:port or tcp:host:port.
+func ParseSocket(s string) (network, address string, err error) {
+	if strings.HasPrefix(s, "/") {
+		return "unix", s, nil
+	}
+
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("bad agentx socket %q", s)
+	}
+	scheme, rest := strings.ToLower(s[:i]), s[i+1:]
+
+	//url form, scheme://...
+	if strings.HasPrefix(rest, "//") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", "", fmt.Errorf("bad agentx socket %q: %v", s, err)
+		}
+		switch scheme {
+		case "unix":
+			if u.Host != "" || u.Path == "" {
+				return "", "", fmt.Errorf("bad agentx socket %q", s)
+			}
+			return "unix", u.Path, nil
+		case "tcp":
+			if u.Host == "" || (u.Path != "" && u.Path != "/") {
+				return "", "", fmt.Errorf("bad agentx socket %q", s)
+			}
+			return "tcp", u.Host, nil
+		}
+		return "", "", fmt.Errorf("unsupported agentx socket %q", s)
+	}
+
+	//net-snmp form, scheme:...
+	switch scheme {
+	case "unix":
+		if rest == "" {
+			return "", "", fmt.Errorf("bad agentx socket %q", s)
+		}
+		return "unix", rest, nil
+	case "tcp":
+		if rest == "" {
+			return "", "", fmt.Errorf("bad agentx socket %q", s)
+		}
+		return "tcp", rest, nil
+	}
+	return "", "", fmt.Errorf("unsupported agentx socket %q", s)
+}
+
+// WithSocket connects to the master agent at the address s, in any of the
+// forms accepted by ParseSocket. A bad address fails the connection.
+func WithSocket(s string) Option {
+	return func(c *Connection) {
+		c.network, c.address, c.socketErr = ParseSocket(s)
+	}
+}
+
+// SnmpdSocket returns the address given by the agentXSocket directive of the
+// snmpd configuration file at path, or "" if it has none. Where the
+// directive lists several addresses the first is returned.
+func SnmpdSocket(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	socket := ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "agentXSocket") {
+			continue
+		}
+		//later directives override earlier ones
+		socket = strings.Split(fields[1], ",")[0]
+	}
+	if err := sc.Err(); err != nil {
+		return "", fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return socket, nil
+}
+
+// WithSnmpdConf connects to the master agent at the agentXSocket of the snmpd
+// configuration file at path, or at MasterSocket if it has none. A file that
+// cannot be read fails the connection.
+func WithSnmpdConf(path string) Option {
+	return func(c *Connection) {
+		s, err := SnmpdSocket(path)
+		if err != nil {
+			c.socketErr = err
+			return
+		}
+		c.snmpdSocket(s)
+	}
+}
+
+// snmpdSocket sets c up to dial the agentXSocket s, or MasterSocket if there
+// is none
+func (c *Connection) snmpdSocket(s string) {
+	if s == "" {
+		WithSocketPath(MasterSocket)(c)
+		return
+	}
+	WithSocket(s)(c)
+}
+
+// defaultSocket sets c up to dial the master agent named by SocketEnv, or by
+// the snmpd configuration if it can be read, or the well known agentx socket
+func (c *Connection) defaultSocket() {
+	if s := os.Getenv(SocketEnv); s != "" {
+		WithSocket(s)(c)
+		return
+	}
+	s, _ := SnmpdSocket(SnmpdConf)
+	c.snmpdSocket(s)
+}
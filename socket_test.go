@@ -0,0 +1,104 @@
+package agx_test
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"github.com/rcgoodfellow/agx/agxtest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSocket(t *testing.T) {
+	tests := []struct {
+		s, network, address string
+	}{
+		{"/var/agentx/master", "unix", "/var/agentx/master"},
+		{"unix:///var/agentx/master", "unix", "/var/agentx/master"},
+		{"unix:/var/agentx/master", "unix", "/var/agentx/master"},
+		{"tcp://localhost:705", "tcp", "localhost:705"},
+		{"tcp:localhost:705", "tcp", "localhost:705"},
+		{"TCP://[::1]:705", "tcp", "[::1]:705"},
+	}
+	for _, x := range tests {
+		network, address, err := agx.ParseSocket(x.s)
+		if err != nil {
+			t.Errorf("error parsing %s: %v", x.s, err)
+			continue
+		}
+		if network != x.network || address != x.address {
+			t.Errorf("%s parsed as %s %s", x.s, network, address)
+		}
+	}
+
+	for _, s := range []string{"", "master", "udp:localhost:705", "unix:",
+		"tcp://", "unix://host/path", "tcp://localhost:705/x"} {
+		if _, _, err := agx.ParseSocket(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestSocketEnv(t *testing.T) {
+	m, err := agxtest.NewMockMaster()
+	if err != nil {
+		t.Fatalf("mock master failed %v", err)
+	}
+	defer m.Close()
+
+	t.Setenv(agx.SocketEnv, "unix://"+m.Path)
+	c, err := agx.Connect("1.2.3.4.7")
+	if err != nil {
+		t.Fatalf("connection at %s failed %v", agx.SocketEnv, err)
+	}
+	c.Disconnect()
+	<-c.Done()
+
+	//a bad address fails the connection, unless replaced
+	t.Setenv(agx.SocketEnv, "carrier-pigeon:coop")
+	if _, err := agx.Connect("1.2.3.4.7"); err == nil {
+		t.Errorf("expected error connecting to bad socket")
+	}
+	c, err = agx.Connect("1.2.3.4.7", agx.WithSocketPath(m.Path))
+	if err != nil {
+		t.Fatalf("connection failed %v", err)
+	}
+	c.Disconnect()
+	<-c.Done()
+}
+
+func TestSnmpdSocket(t *testing.T) {
+	m, err := agxtest.NewMockMaster()
+	if err != nil {
+		t.Fatalf("mock master failed %v", err)
+	}
+	defer m.Close()
+
+	conf := filepath.Join(t.TempDir(), "snmpd.conf")
+	err = os.WriteFile(conf, []byte(
+		"# agentXSocket /not/this/one\n"+
+			"master agentx\n"+
+			"agentXSocket tcp:localhost:705\n"+
+			"agentxsocket "+m.Path+",tcp:localhost:705\n"), 0644)
+	if err != nil {
+		t.Fatalf("error writing config %v", err)
+	}
+	s, err := agx.SnmpdSocket(conf)
+	if err != nil || s != m.Path {
+		t.Errorf("found socket %q %v, expected %s", s, err, m.Path)
+	}
+
+	c, err := agx.Connect("1.2.3.4.7", agx.WithSnmpdConf(conf))
+	if err != nil {
+		t.Fatalf("connection failed %v", err)
+	}
+	c.Disconnect()
+	<-c.Done()
+
+	if s, err := agx.SnmpdSocket(conf + ".missing"); err == nil {
+		t.Errorf("expected error reading missing config, got %q", s)
+	}
+	_, err = agx.Connect("1.2.3.4.7", agx.WithSnmpdConf(conf+".missing"))
+	if err == nil {
+		t.Errorf("expected error connecting with missing config")
+	}
+}
@@ -0,0 +1,137 @@
+package agx
+
+// This file contains span instrumentation of request handling, so slow walks
+// and set transactions can be followed through the subagent by a tracing
+// system
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"context"
+)
+
+// SpanTracer starts the spans that the handling of requests from the master
+// agent is recorded in. Adapters to tracing systems implement it, e.g.
+// agxotel for OpenTelemetry, so the core library depends on none of them.
+type SpanTracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a unit of work started by a SpanTracer
+type Span interface {
+	SetAttribute(key string, value interface{})
+	SetError(err error)
+	End()
+}
+
+// WithSpanTracer records the handling of requests from the master agent in
+// spans started by t. Each request PDU gets a span, with a child span for
+// each of its varbinds. The phases of a set transaction are children of a
+// span covering the whole transaction, which ends when it is cleaned up.
+func WithSpanTracer(t SpanTracer) Option {
+	return func(c *Connection) {
+		c.spans = t
+	}
+}
+
+// span names and attributes
+const (
+	spanTransaction = "agentx set transaction"
+	spanVarBind     = "agentx varbind"
+
+	attrSessionId     = "agentx.session_id"
+	attrTransactionId = "agentx.transaction_id"
+	attrPacketId      = "agentx.packet_id"
+	attrVarBinds      = "agentx.varbinds"
+	attrOid           = "agentx.oid"
+	attrBound         = "agentx.bound"
+	attrType          = "agentx.type"
+	attrError         = "agentx.error"
+	attrIndex         = "agentx.index"
+)
+
+type spanKey struct{}
+
+// startSpan starts a span named name as a child of the span in ctx, the new
+// span can be recovered from the returned context with spanFrom
+func (c *Connection) startSpan(ctx context.Context, name string) (
+	context.Context, Span) {
+
+	if c.spans == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, s := c.spans.Start(ctx, name)
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// spanFrom returns the span started in ctx by startSpan
+func spanFrom(ctx context.Context) Span {
+	if s, ok := ctx.Value(spanKey{}).(Span); ok {
+		return s
+	}
+	return noopSpan{}
+}
+
+// pduSpan starts the span for handling the request h. Test-set starts the
+// span of a new transaction, and the later phases of the transaction are
+// recorded under it.
+func (c *Connection) pduSpan(h *Header) (context.Context, Span) {
+	ctx := context.Background()
+	if c.spans == nil {
+		return ctx, noopSpan{}
+	}
+
+	switch h.Type {
+	case TestSetPDU:
+		tctx, ts := c.startSpan(ctx, spanTransaction)
+		ts.SetAttribute(attrSessionId, int(h.SessionId))
+		ts.SetAttribute(attrTransactionId, int(h.TransactionId))
+		ctx = tctx
+		c.mtx.Lock()
+		c.transactions[h.TransactionId] = transaction{ctx: tctx, span: ts}
+		c.mtx.Unlock()
+	case CommitSetPDU, UndoSetPDU, CleanupSetPDU:
+		c.mtx.Lock()
+		if t, ok := c.transactions[h.TransactionId]; ok && t.ctx != nil {
+			ctx = t.ctx
+		}
+		c.mtx.Unlock()
+	}
+
+	ctx, s := c.startSpan(ctx, "agentx "+h.Type.String())
+	s.SetAttribute(attrSessionId, int(h.SessionId))
+	s.SetAttribute(attrTransactionId, int(h.TransactionId))
+	s.SetAttribute(attrPacketId, int(h.PacketId))
+	return ctx, s
+}
+
+// endTransaction removes a set transaction once it has been cleaned up,
+// ending its span
+func (c *Connection) endTransaction(tid uint32) {
+	c.mtx.Lock()
+	t := c.transactions[tid]
+	delete(c.transactions, tid)
+	c.mtx.Unlock()
+	c.signalIdle()
+
+	if t.span != nil {
+		t.span.End()
+	}
+}
+
+// recordResponse records the outcome of a request in the span in ctx
+func recordResponse(ctx context.Context, r *Response) {
+	s := spanFrom(ctx)
+	s.SetAttribute(attrVarBinds, len(r.VarBindList))
+	if r.Error != ResponseNoError {
+		s.SetAttribute(attrError, errorName(r.Error))
+		s.SetAttribute(attrIndex, int(r.Index))
+	}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) SetError(err error)                         {}
+func (noopSpan) End()                                       {}
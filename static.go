@@ -0,0 +1,157 @@
+package agx
+
+// This file contains the static data provider, which serves the variables of
+// a subtree from a file that is reloaded when it changes
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StaticFile serves the variables of a subtree from a JSON file holding an
+// array of varbinds, as encoded by VarBind.MarshalJSON. Read only regions of
+// the mib can then be maintained without rebuilding the agent. The file is
+// read again by Reload, which Watch and ReloadOnSignal call when the file
+// changes or is said to have changed. Should a reload fail the variables
+// already loaded go on being served.
+type StaticFile struct {
+	//Root is the subtree the variables are served under
+	Root Subtree
+	//Path is the file the variables are read from
+	Path string
+
+	mtx     sync.Mutex
+	vars    []VarBind //sorted
+	modTime time.Time
+}
+
+// LoadStaticFile reads the variables under root from the file at path
+func LoadStaticFile(root, path string) (*StaticFile, error) {
+	s, err := NewSubtree(root)
+	if err != nil {
+		return nil, err
+	}
+	f := &StaticFile{Root: *s, Path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Attach installs the handler of the file in d. The root, or a subtree
+// containing it, must still be registered with the master agent.
+func (f *StaticFile) Attach(d *Dispatcher) {
+	d.OnGetSubtree(f.Root.String(), f.Handle)
+}
+
+// Handle is the get-subtree handler of the file
+func (f *StaticFile) Handle(oid Subtree, next bool) VarBind {
+	f.mtx.Lock()
+	vars := f.vars
+	f.mtx.Unlock()
+	return searchVars(vars, oid, next)
+}
+
+// Reload reads the file again. Every variable must be under the root, and
+// none may appear twice.
+func (f *StaticFile) Reload() error {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", f.Path, err)
+	}
+	buf, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", f.Path, err)
+	}
+	var vars []VarBind
+	if err := json.Unmarshal(buf, &vars); err != nil {
+		return fmt.Errorf("error decoding %s: %v", f.Path, err)
+	}
+
+	sort.Slice(vars, func(i, j int) bool {
+		return vars[i].Name.LessThan(vars[j].Name)
+	})
+	for i, vb := range vars {
+		if !vb.Name.HasPrefix(f.Root) {
+			return fmt.Errorf("%s: %s is not under %s", f.Path, vb.Name, f.Root)
+		}
+		if i > 0 && vars[i-1].Name.Eq(vb.Name) {
+			return fmt.Errorf("%s: %s appears more than once", f.Path, vb.Name)
+		}
+	}
+
+	f.mtx.Lock()
+	f.vars = vars
+	f.modTime = info.ModTime()
+	f.mtx.Unlock()
+	return nil
+}
+
+// Watch reloads the file whenever its modification time changes, checking
+// every interval until ctx is done
+func (f *StaticFile) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		info, err := os.Stat(f.Path)
+		if err != nil {
+			continue
+		}
+		f.mtx.Lock()
+		changed := !info.ModTime().Equal(f.modTime)
+		f.mtx.Unlock()
+		if changed {
+			f.reload()
+		}
+	}
+}
+
+// ReloadOnSignal reloads the file whenever one of sigs, e.g. syscall.SIGHUP,
+// is received, until the returned function is called
+func (f *StaticFile) ReloadOnSignal(sigs ...os.Signal) func() {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+	go func() {
+		for {
+			select {
+			case <-ch:
+				f.reload()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+// reload reloads the file in the background, where errors can only be logged
+func (f *StaticFile) reload() {
+	if err := f.Reload(); err != nil {
+		log.Printf("[static] keeping the variables loaded before: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package agx
+
+// This file contains per handler call counts and latencies, for finding the
+// parts of a mib that are slow or heavily polled
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"sort"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the handler latency histogram, calls
+// slower than the last bound are counted in a final unbounded bucket
+var LatencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// HandlerStats are the calls made to a handler since it was first called
+type HandlerStats struct {
+	Oid   string
+	Type  HandlerType
+	Calls uint64
+	Total time.Duration
+	Max   time.Duration
+	//Buckets counts calls by latency, Buckets[i] counts calls that took at
+	//most LatencyBuckets[i] and more than LatencyBuckets[i-1]. The last bucket
+	//counts calls slower than every bound.
+	Buckets []uint64
+}
+
+// Mean returns the average latency of the handler
+func (s HandlerStats) Mean() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Calls)
+}
+
+type handlerKey struct {
+	oid string
+	t   HandlerType
+}
+
+// Stats returns the statistics of every handler that has been called, ordered
+// by oid
+func (d *Dispatcher) Stats() []HandlerStats {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	stats := make([]HandlerStats, 0, len(d.stats))
+	for _, s := range d.stats {
+		c := *s
+		c.Buckets = append([]uint64{}, s.Buckets...)
+		stats = append(stats, c)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := newHandlerBundle(stats[i].Oid, stats[i].Type, nil),
+			newHandlerBundle(stats[j].Oid, stats[j].Type, nil)
+		if cmp := a.Subtree.Compare(b.Subtree); cmp != 0 {
+			return cmp < 0
+		}
+		return stats[i].Type < stats[j].Type
+	})
+	return stats
+}
+
+// ResetStats discards the statistics gathered so far
+func (d *Dispatcher) ResetStats() {
+	d.mtx.Lock()
+	d.stats = nil
+	d.mtx.Unlock()
+}
+
+// record counts a call to the handler h that took dt
+func (d *Dispatcher) record(h *HandlerBundle, dt time.Duration) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.stats == nil {
+		d.stats = make(map[handlerKey]*HandlerStats)
+	}
+	k := handlerKey{h.Oid, h.Type}
+	s, ok := d.stats[k]
+	if !ok {
+		s = &HandlerStats{
+			Oid:     h.Oid,
+			Type:    h.Type,
+			Buckets: make([]uint64, len(LatencyBuckets)+1),
+		}
+		d.stats[k] = s
+	}
+
+	s.Calls++
+	s.Total += dt
+	if dt > s.Max {
+		s.Max = dt
+	}
+	i := sort.Search(len(LatencyBuckets), func(i int) bool {
+		return dt <= LatencyBuckets[i]
+	})
+	if i >= len(s.Buckets) {
+		//the bounds changed after the handler was first called
+		i = len(s.Buckets) - 1
+	}
+	s.Buckets[i]++
+}
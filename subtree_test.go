@@ -0,0 +1,163 @@
+package agx_test
+
+import (
+	"encoding/asn1"
+	"github.com/rcgoodfellow/agx"
+	"math"
+	"testing"
+)
+
+func TestSubtreeCompare(t *testing.T) {
+
+	tests := []struct {
+		a, b string
+		cmp  int
+	}{
+		{"1.3.6.1.2.1.17", "1.3.6.1.2.1.17", 0},
+		{"1.3.6.1.2.1.2", "1.3.6.1.2.1.17", -1},
+		{"1.3.6.1.2.1.17", "1.3.6.1.2.1.2.2.1", 1},
+		{"1.3.6.1.2.1", "1.3.6.1.2.1.1", -1},
+		{"1.3.6.1.2.1.1.9", "1.3.6.1.2.1.10", -1},
+		{"1.3.6.1.4.1.2147483647", "1.3.6.1.4.1.1", 1},
+	}
+
+	for _, x := range tests {
+		a, b := subtree(t, x.a), subtree(t, x.b)
+		if cmp := a.Compare(b); cmp != x.cmp {
+			t.Errorf("compare %s %s = %d expected %d", x.a, x.b, cmp, x.cmp)
+		}
+		if a.LessThan(b) != (x.cmp < 0) || a.GreaterThan(b) != (x.cmp > 0) ||
+			a.Eq(b) != (x.cmp == 0) {
+			t.Errorf("comparison methods disagree with compare %s %s", x.a, x.b)
+		}
+	}
+
+}
+
+func TestSubtreeHasPrefix(t *testing.T) {
+
+	tests := []struct {
+		s, p   string
+		prefix bool
+	}{
+		{"1.3.6.1.2.1.17.7.1", "1.3.6.1.2.1.17", true},
+		{"1.3.6.1.2.1.17", "1.3.6.1.2.1.17", true},
+		{"1.3.6.1.2.1.17.7.1", "1.3.6.1.2.1.1", false},
+		{"1.3.6.1.2.1", "1.3.6.1.2.1.17", false},
+	}
+
+	for _, x := range tests {
+		s, p := subtree(t, x.s), subtree(t, x.p)
+		if s.HasPrefix(p) != x.prefix {
+			t.Errorf("%s has prefix %s expected %v", x.s, x.p, x.prefix)
+		}
+	}
+
+}
+
+func TestSubtreePrefixExpansion(t *testing.T) {
+
+	//1.3.6.1.2.1.17 with the internet prefix compressed (RFC2741~5.1)
+	compressed := agx.Subtree{
+		NSubid:         2,
+		Prefix:         2,
+		SubIdentifiers: []int32{1, 17},
+	}
+	expanded := subtree(t, "1.3.6.1.2.1.17")
+
+	if !compressed.Eq(expanded) {
+		t.Errorf("%s != %s", compressed.String(), expanded.String())
+	}
+	if !subtree(t, "1.3.6.1.2.1.17.7").HasPrefix(compressed) {
+		t.Errorf("compressed prefix not recognized")
+	}
+
+}
+
+func TestSubtreeASN1(t *testing.T) {
+
+	//prefixes are expanded, and the oid survives encoding/asn1
+	compressed := agx.Subtree{
+		NSubid:         3,
+		Prefix:         4,
+		SubIdentifiers: []int32{1, 47, -1},
+	}
+	oid := compressed.ToASN1()
+	expect := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 47, math.MaxUint32}
+	if !oid.Equal(expect) {
+		t.Errorf("converted to %v, expected %v", oid, expect)
+	}
+	buf, err := asn1.Marshal(subtree(t, "1.3.6.1.2.1.17").ToASN1())
+	if err != nil {
+		t.Fatalf("error marshalling oid %v", err)
+	}
+	var decoded asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(buf, &decoded); err != nil {
+		t.Fatalf("error unmarshalling oid %v", err)
+	}
+
+	var s agx.Subtree
+	if err := s.FromASN1(decoded); err != nil {
+		t.Fatalf("conversion failed %v", err)
+	}
+	if s.String() != "1.3.6.1.2.1.17" || !s.Eq(subtree(t, "1.3.6.1.2.1.17")) {
+		t.Errorf("converted to %v", s)
+	}
+	if err := s.FromASN1(oid); err != nil || !s.Eq(compressed) {
+		t.Errorf("converted to %v %v, expected %v", s, err, compressed)
+	}
+
+	for _, bad := range []asn1.ObjectIdentifier{{1, 3, -1},
+		{1, 3, math.MaxUint32 + 1}, make(asn1.ObjectIdentifier, 129)} {
+		if err := s.FromASN1(bad); err == nil {
+			t.Errorf("converted bad oid %v", bad)
+		}
+	}
+}
+
+func subtree(t *testing.T, oid string) agx.Subtree {
+	s, err := agx.NewSubtree(oid)
+	if err != nil {
+		t.Fatalf("bad oid %s: %v", oid, err)
+	}
+	return *s
+}
+
+func TestNewSubtree(t *testing.T) {
+
+	valid := map[string]string{
+		"1.3.6.1.2.1.17":         "1.3.6.1.2.1.17",
+		".1.3.6.1.2.1.17":        "1.3.6.1.2.1.17",
+		"1.3.6.1.4.1.4294967295": "1.3.6.1.4.1.4294967295",
+		"ifIndex.3":              "1.3.6.1.2.1.2.2.1.1.3",
+		".ifIndex":               "1.3.6.1.2.1.2.2.1.1",
+	}
+	invalid := []string{
+		"", ".", "1..3", "1.3.", "1.3.6.1.4.1.4294967296", "1.3.x", "ifDescr.1",
+	}
+
+	agx.SetNameResolver(func(name string) ([]uint32, bool) {
+		if name == "ifIndex" {
+			return []uint32{1, 3, 6, 1, 2, 1, 2, 2, 1, 1}, true
+		}
+		return nil, false
+	})
+	defer agx.SetNameResolver(nil)
+
+	for oid, expect := range valid {
+		s, err := agx.NewSubtree(oid)
+		if err != nil {
+			t.Errorf("error parsing %q: %v", oid, err)
+			continue
+		}
+		if s.String() != expect {
+			t.Errorf("%q parsed as %s, expected %s", oid, s.String(), expect)
+		}
+	}
+	for _, oid := range invalid {
+		if s, err := agx.NewSubtree(oid); err == nil {
+			t.Errorf("%q parsed as %s", oid, s.String())
+		}
+	}
+
+}
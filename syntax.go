@@ -0,0 +1,130 @@
+package agx
+
+// This file contains the syntax variables are declared with, which sets are
+// checked against before reaching the test-set handlers
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Syntax is the type of the variables of an object, and the lengths their
+// values may have when it is an octet string type, e.g. for
+// SYNTAX DisplayString (SIZE (0..255))
+//
+//	Syntax{Type: OctetStringT, Sizes: []Range{{0, 255}}}
+type Syntax struct {
+	Type  int16
+	Sizes []Range
+}
+
+// check returns the test-set error v fails s with, or TestSetNoError
+func (s Syntax) check(v VarBind) TestSetResult {
+	if v.Type != s.Type {
+		return TestSetWrongType
+	}
+	if len(s.Sizes) == 0 {
+		return TestSetNoError
+	}
+	x, ok := v.OctetString()
+	if !ok {
+		return TestSetWrongType
+	}
+	if !inRanges(int64(len(x)), s.Sizes) {
+		return TestSetWrongLength
+	}
+	return TestSetNoError
+}
+
+// declaredSyntax is a syntax and the object it is declared for
+type declaredSyntax struct {
+	root   Subtree
+	syntax Syntax
+}
+
+// DeclareSyntax declares the syntax of the variables at or beneath oid, a
+// scalar or a column of a table. Sets of variables that do not match the
+// syntax declared for the longest prefix of their name fail with wrongType or
+// wrongLength without reaching the test-set handlers.
+func (d *Dispatcher) DeclareSyntax(oid string, s Syntax) error {
+	root, err := NewSubtree(oid)
+	if err != nil {
+		return fmt.Errorf("bad oid %s: %v", oid, err)
+	}
+
+	d.declareSyntax(declaredSyntax{*root, s})
+	return nil
+}
+
+// declareSyntax declares x.syntax for x.root
+func (d *Dispatcher) declareSyntax(x declaredSyntax) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.removeSyntax(x.root)
+	d.syntaxes = append(d.syntaxes, x)
+	sort.Slice(d.syntaxes, func(i, j int) bool {
+		return d.syntaxes[i].root.LessThan(d.syntaxes[j].root)
+	})
+}
+
+// declaredSyntaxes returns a copy of the syntaxes declared with d
+func (d *Dispatcher) declaredSyntaxes() []declaredSyntax {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return append([]declaredSyntax(nil), d.syntaxes...)
+}
+
+// RemoveSyntax removes the syntax declared for oid
+func (d *Dispatcher) RemoveSyntax(oid string) error {
+	root, err := NewSubtree(oid)
+	if err != nil {
+		return fmt.Errorf("bad oid %s: %v", oid, err)
+	}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.removeSyntax(*root)
+	return nil
+}
+
+// removeSyntax removes the syntax declared for root, d must be locked
+func (d *Dispatcher) removeSyntax(root Subtree) {
+	for i, x := range d.syntaxes {
+		if x.root.Compare(root) == 0 {
+			d.syntaxes = append(d.syntaxes[:i], d.syntaxes[i+1:]...)
+			return
+		}
+	}
+}
+
+// CheckSyntax checks vars against the syntaxes declared for them, returning
+// the first failure along with the 1 based index of the variable that failed,
+// which is zero on success. Variables without a declared syntax pass.
+func (d *Dispatcher) CheckSyntax(vars []VarBind) (TestSetResult, int) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if len(d.syntaxes) == 0 {
+		return TestSetNoError, 0
+	}
+	for i, v := range vars {
+		var syntax *Syntax
+		for j, x := range d.syntaxes {
+			//sorted so later matches are more specific
+			if v.Name.HasPrefix(x.root) {
+				syntax = &d.syntaxes[j].syntax
+			}
+		}
+		if syntax == nil {
+			continue
+		}
+		if r := syntax.check(v); r != TestSetNoError {
+			return r, i + 1
+		}
+	}
+	return TestSetNoError, 0
+}
@@ -0,0 +1,273 @@
+package agx
+
+// This file contains the table engine, which serves conceptual tables
+// (RFC2578~7.1.12) from rows held in memory
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TableRow is a row of a table. Columns holds the value of each column of the
+// row by column number, the names of the varbinds are ignored.
+type TableRow struct {
+	Index   []uint32
+	Columns map[uint32]VarBind
+}
+
+// Table serves the rows of a conceptual table. Rows are either maintained by
+// the application through SetRow and DeleteRow, or loaded on demand by Load.
+type Table struct {
+	//Entry is the oid of the table entry, e.g. ifEntry 1.3.6.1.2.1.2.2.1
+	Entry Subtree
+	//Load, when set, is called for the rows of the table whenever they are
+	//older than CacheTime, so a walk of the table sees a single snapshot
+	Load      func() []TableRow
+	CacheTime time.Duration
+	//Store, when set, saves the rows changed by CommitRow and CommitDelete,
+	//which Restore loads again when the agent restarts
+	Store RowStore
+
+	mtx    sync.Mutex
+	rows   map[string]TableRow
+	vars   []VarBind //sorted, rebuilt when nil
+	loaded time.Time
+}
+
+// DefaultTableCacheTime is the CacheTime of tables returned by NewTable
+const DefaultTableCacheTime = time.Second
+
+// NewTable returns an empty table with the entry oid entry
+func NewTable(entry string) (*Table, error) {
+	s, err := NewSubtree(entry)
+	if err != nil {
+		return nil, err
+	}
+	return &Table{Entry: *s, CacheTime: DefaultTableCacheTime}, nil
+}
+
+// SetRow adds a row to the table, replacing any row with the same index
+func (t *Table) SetRow(r TableRow) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.rows == nil {
+		t.rows = make(map[string]TableRow)
+	}
+	t.rows[indexKey(r.Index)] = r
+	t.vars = nil
+}
+
+// DeleteRow removes the row with index from the table
+func (t *Table) DeleteRow(index []uint32) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	delete(t.rows, indexKey(index))
+	t.vars = nil
+}
+
+// CommitRow adds a row to the table as SetRow does, once it has been saved to
+// the Store. It is meant for the commit-set handlers of rows created or
+// changed by sets, which fail when the row cannot be saved.
+func (t *Table) CommitRow(r TableRow) error {
+	if t.Store != nil {
+		if err := t.Store.SaveRow(t.Entry, r); err != nil {
+			return err
+		}
+	}
+	t.SetRow(r)
+	return nil
+}
+
+// CommitDelete removes the row with index from the table and the Store
+func (t *Table) CommitDelete(index []uint32) error {
+	if t.Store != nil {
+		if err := t.Store.DeleteRow(t.Entry, index); err != nil {
+			return err
+		}
+	}
+	t.DeleteRow(index)
+	return nil
+}
+
+// Restore adds the rows saved in the Store to the table
+func (t *Table) Restore() error {
+	if t.Store == nil {
+		return nil
+	}
+	rows, err := t.Store.LoadRows(t.Entry)
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		t.SetRow(r)
+	}
+	return nil
+}
+
+// Row returns the row with index
+func (t *Table) Row(index []uint32) (TableRow, bool) {
+	t.refresh()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	r, ok := t.rows[indexKey(index)]
+	return r, ok
+}
+
+// Rows returns every row of the table
+func (t *Table) Rows() []TableRow {
+	t.refresh()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	rows := make([]TableRow, 0, len(t.rows))
+	for _, r := range t.rows {
+		rows = append(rows, r)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return compareIndex(rows[i].Index, rows[j].Index) < 0
+	})
+	return rows
+}
+
+// Attach installs the handler of the table in d. The entry, or a subtree
+// containing it, must still be registered with the master agent.
+func (t *Table) Attach(d *Dispatcher) {
+	d.OnGetSubtree(t.Entry.String(), t.Handle)
+}
+
+// Handle is the get-subtree handler of the table
+func (t *Table) Handle(oid Subtree, next bool) VarBind {
+	return searchVars(t.sorted(), oid, next)
+}
+
+// searchVars binds oid, or the variable following it when next is set, from
+// vars sorted in lexicographic order
+func searchVars(vars []VarBind, oid Subtree, next bool) VarBind {
+	i := sort.Search(len(vars), func(i int) bool {
+		return vars[i].Name.GreaterThanEq(oid)
+	})
+	if i < len(vars) && vars[i].Name.Eq(oid) {
+		if !next {
+			return vars[i]
+		}
+		i++
+	} else if !next {
+		return EndOfMibViewVarBind(oid)
+	}
+	if i >= len(vars) {
+		return EndOfMibViewVarBind(oid)
+	}
+	return vars[i]
+}
+
+// refresh loads the rows of the table if they are stale
+func (t *Table) refresh() {
+	if t.Load == nil {
+		return
+	}
+	t.mtx.Lock()
+	stale := t.rows == nil || time.Since(t.loaded) >= t.CacheTime
+	t.mtx.Unlock()
+	if !stale {
+		return
+	}
+
+	rows := t.Load()
+	t.mtx.Lock()
+	t.rows = make(map[string]TableRow, len(rows))
+	for _, r := range rows {
+		t.rows[indexKey(r.Index)] = r
+	}
+	t.vars = nil
+	t.loaded = time.Now()
+	t.mtx.Unlock()
+}
+
+// sorted returns the variables of the table in lexicographic order
+func (t *Table) sorted() []VarBind {
+	t.refresh()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.vars != nil {
+		return t.vars
+	}
+	entry := t.Entry.Identifiers()
+	vars := []VarBind{}
+	for _, r := range t.rows {
+		for c, v := range r.Columns {
+			ids := append(append(append([]uint32{}, entry...), c), r.Index...)
+			name, err := NewSubtreeFromIdentifiers(ids)
+			if err != nil {
+				continue
+			}
+			v.Name = *name
+			vars = append(vars, v)
+		}
+	}
+	sort.Slice(vars, func(i, j int) bool {
+		return vars[i].Name.LessThan(vars[j].Name)
+	})
+	t.vars = vars
+	return vars
+}
+
+// indices ....................................................................
+
+// IntegerIndex is the index of a row indexed by an integer
+func IntegerIndex(x uint32) []uint32 {
+	return []uint32{x}
+}
+
+// StringIndex is the index of a row indexed by a variable length string,
+// which is prefixed by its length unless implied (RFC2578~7.7)
+func StringIndex(s []byte, implied bool) []uint32 {
+	var index []uint32
+	if !implied {
+		index = append(index, uint32(len(s)))
+	}
+	for _, b := range s {
+		index = append(index, uint32(b))
+	}
+	return index
+}
+
+// OidIndex is the index of a row indexed by an object identifier, which is
+// prefixed by its length unless implied
+func OidIndex(oid Subtree, implied bool) []uint32 {
+	ids := oid.Identifiers()
+	if implied {
+		return ids
+	}
+	return append([]uint32{uint32(len(ids))}, ids...)
+}
+
+// IpAddressIndex is the index of a row indexed by an ipv4 address
+func IpAddressIndex(ip net.IP) []uint32 {
+	var index []uint32
+	for _, b := range ip.To4() {
+		index = append(index, uint32(b))
+	}
+	return index
+}
+
+func indexKey(index []uint32) string {
+	return fmt.Sprint(index)
+}
+
+func compareIndex(a, b []uint32) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
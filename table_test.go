@@ -0,0 +1,180 @@
+package agx_test
+
+import (
+	"context"
+	"github.com/rcgoodfellow/agx"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTable(t *testing.T) {
+	const entry = "1.3.6.1.2.1.2.2.1"
+	tbl, err := agx.NewTable(entry)
+	if err != nil {
+		t.Fatalf("error creating table %v", err)
+	}
+	for _, i := range []uint32{10, 2} {
+		tbl.SetRow(agx.TableRow{
+			Index: agx.IntegerIndex(i),
+			Columns: map[uint32]agx.VarBind{
+				1: {Type: agx.IntegerT, Data: agx.Integer(i)},
+				2: *agx.OctetStringVarBind(agx.Subtree{}, []byte("eth")),
+			},
+		})
+	}
+	d := &agx.Dispatcher{}
+	tbl.Attach(d)
+
+	var walk []string
+	oid := subtree(t, "1.3.6.1.2.1.2")
+	for {
+		vb := d.GetNext(oid)
+		if vb.Type == agx.EndOfMibViewT {
+			break
+		}
+		walk = append(walk, vb.String())
+		oid = vb.Name
+	}
+	expect := []string{
+		entry + ".1.2 = INTEGER: 2",
+		entry + ".1.10 = INTEGER: 10",
+		entry + ".2.2 = STRING: \"eth\"",
+		entry + ".2.10 = STRING: \"eth\"",
+	}
+	if len(walk) != len(expect) {
+		t.Fatalf("walked %v, expected %v", walk, expect)
+	}
+	for i := range expect {
+		if walk[i] != expect[i] {
+			t.Errorf("walked %s, expected %s", walk[i], expect[i])
+		}
+	}
+
+	tbl.DeleteRow(agx.IntegerIndex(2))
+	if vb := d.Get(subtree(t, entry+".1.2")); vb.Type != agx.EndOfMibViewT {
+		t.Errorf("deleted row returned %v", vb)
+	}
+	if rows := tbl.Rows(); len(rows) != 1 || rows[0].Index[0] != 10 {
+		t.Errorf("rows after delete %v", rows)
+	}
+
+	if idx := agx.StringIndex([]byte("ab"), false); len(idx) != 3 || idx[0] != 2 {
+		t.Errorf("string index %v", idx)
+	}
+}
+
+func TestTableStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rows.json")
+
+	const entry = "1.3.6.1.2.1.17.7.1.4.3.1"
+	open := func() *agx.Table {
+		t.Helper()
+		store, err := agx.OpenFileRowStore(path)
+		if err != nil {
+			t.Fatalf("error opening row store %v", err)
+		}
+		tbl, err := agx.NewTable(entry)
+		if err != nil {
+			t.Fatalf("error creating table %v", err)
+		}
+		tbl.Store = store
+		if err := tbl.Restore(); err != nil {
+			t.Fatalf("error restoring rows %v", err)
+		}
+		return tbl
+	}
+
+	tbl := open()
+	for _, vid := range []uint32{47, 74} {
+		err := tbl.CommitRow(agx.TableRow{
+			Index: agx.IntegerIndex(vid),
+			Columns: map[uint32]agx.VarBind{
+				1: *agx.OctetStringVarBind(agx.Subtree{}, []byte("muffin")),
+				5: agx.IntegerVarBind(agx.Subtree{}, 1),
+			},
+		})
+		if err != nil {
+			t.Fatalf("error committing row %v", err)
+		}
+	}
+	if err := tbl.CommitDelete(agx.IntegerIndex(47)); err != nil {
+		t.Fatalf("error deleting row %v", err)
+	}
+	//rows set directly are not saved
+	tbl.SetRow(agx.TableRow{Index: agx.IntegerIndex(1)})
+
+	rows := open().Rows()
+	if len(rows) != 1 || rows[0].Index[0] != 74 ||
+		rows[0].Columns[5].Data != agx.Integer(1) {
+		t.Errorf("restored %v", rows)
+	}
+	if s, _ := rows[0].Columns[1].OctetString(); string(s) != "muffin" {
+		t.Errorf("restored %v", rows[0].Columns)
+	}
+}
+
+func TestStaticFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "system.json")
+
+	const system = "1.3.6.1.2.1.1"
+	write := func(content string) {
+		t.Helper()
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`[
+		{"oid": "1.3.6.1.2.1.1.5.0", "type": "STRING", "value": "muffin"},
+		{"oid": "1.3.6.1.2.1.1.1.0", "type": "STRING", "value": "agx"}
+	]`)
+	f, err := agx.LoadStaticFile(system, path)
+	if err != nil {
+		t.Fatalf("error loading %v", err)
+	}
+	d := &agx.Dispatcher{}
+	f.Attach(d)
+
+	vb := d.GetNext(subtree(t, system))
+	if s, _ := vb.OctetString(); vb.Name.String() != system+".1.0" ||
+		string(s) != "agx" {
+		t.Errorf("getnext returned %v", vb)
+	}
+
+	//a bad file leaves the variables as they were
+	write(`[{"oid": "1.3.6.1.2.1.2.1.0", "type": "INTEGER", "value": 1}]`)
+	if err := f.Reload(); err == nil {
+		t.Errorf("reloaded variable outside of the root")
+	}
+	write(`[{"oid": "1.3.6.1.2.1.1.5.0", "type": "STRING", "value": "pirate"}]`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go f.Watch(ctx, 10*time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		vb = d.Get(subtree(t, system+".5.0"))
+		if s, _ := vb.OctetString(); string(s) == "pirate" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s, _ := vb.OctetString(); string(s) != "pirate" {
+		t.Errorf("watched file returned %v", vb)
+	}
+	if vb := d.Get(subtree(t, system+".1.0")); vb.Type != agx.EndOfMibViewT {
+		t.Errorf("removed variable returned %v", vb)
+	}
+}
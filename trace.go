@@ -0,0 +1,77 @@
+package agx
+
+// This file contains wire tracing, which logs the PDUs exchanged with the
+// master agent for debugging interoperability problems
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// TraceMode selects how traced PDUs are written
+type TraceMode int
+
+const (
+	TracePretty TraceMode = 1 << iota //one line decoded summary of each PDU
+	TraceHex                          //hex dump of each PDU as sent on the wire
+)
+
+// WithTrace writes every PDU sent to and received from the master agent to w,
+// each preceded by a timestamp and its direction. Writes to w are serialized.
+func WithTrace(w io.Writer, mode TraceMode) Option {
+	return func(c *Connection) {
+		c.tracer = &tracer{w: w, mode: mode}
+	}
+}
+
+const (
+	traceSend = "send"
+	traceRecv = "recv"
+)
+
+type tracer struct {
+	mtx  sync.Mutex
+	w    io.Writer
+	mode TraceMode
+}
+
+func (t *tracer) trace(dir string, buf []byte) {
+	s := time.Now().Format("2006-01-02T15:04:05.000000Z07:00") + " " + dir
+	if t.mode&TracePretty != 0 {
+		m, err := ParsePDU(buf)
+		if err != nil {
+			s += fmt.Sprintf(" undecodable pdu: %v", err)
+		} else {
+			s += fmt.Sprintf(" %v", m)
+		}
+	}
+	s += "\n"
+	if t.mode&TraceHex != 0 {
+		s += hex.Dump(buf)
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	io.WriteString(t.w, s)
+}
+
+// traceWriter traces each write made through it, WriteMessage writes a PDU in
+// a single call so each write is one PDU
+type traceWriter struct {
+	t *tracer
+	w io.Writer
+}
+
+func (tw traceWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	if n > 0 {
+		tw.t.trace(traceSend, p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,112 @@
+package agx
+
+// This file contains the validation of values being set against the ranges,
+// sizes and enumerations objects are declared with
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+// Range is an inclusive range of values, or of the lengths of octet strings
+type Range struct {
+	Min, Max int64
+}
+
+// Validator checks the value a variable is being set to, returning the
+// test-set error the value fails with or TestSetNoError
+type Validator func(v VarBind) TestSetResult
+
+// inRanges reports whether x lies in one of ranges, any x does if there are
+// none
+func inRanges(x int64, ranges []Range) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if x >= r.Min && x <= r.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// Integer32Validator accepts INTEGER values within one of ranges, as for
+// SYNTAX Integer32 (1..10 | 20..30). Other types are wrongType and values
+// outside the ranges wrongValue.
+func Integer32Validator(ranges ...Range) Validator {
+	return func(v VarBind) TestSetResult {
+		x, ok := v.Int32()
+		if !ok || v.Type != IntegerT {
+			return TestSetWrongType
+		}
+		if !inRanges(int64(x), ranges) {
+			return TestSetWrongValue
+		}
+		return TestSetNoError
+	}
+}
+
+// Unsigned32Validator accepts Unsigned32 values within one of ranges, which
+// share their tag with Gauge32 on the wire. Other types are wrongType and
+// values outside the ranges wrongValue.
+func Unsigned32Validator(ranges ...Range) Validator {
+	return func(v VarBind) TestSetResult {
+		x, ok := v.Uint32()
+		if !ok || v.Type != Gauge32T {
+			return TestSetWrongType
+		}
+		if !inRanges(int64(x), ranges) {
+			return TestSetWrongValue
+		}
+		return TestSetNoError
+	}
+}
+
+// EnumValidator accepts INTEGER values that are one of values, as for
+// SYNTAX INTEGER { up(1), down(2) }. Other types are wrongType and other
+// values wrongValue.
+func EnumValidator(values ...int32) Validator {
+	return func(v VarBind) TestSetResult {
+		x, ok := v.Int32()
+		if !ok || v.Type != IntegerT {
+			return TestSetWrongType
+		}
+		for _, y := range values {
+			if x == y {
+				return TestSetNoError
+			}
+		}
+		return TestSetWrongValue
+	}
+}
+
+// OctetStringValidator accepts OCTET STRING values with a length within one
+// of sizes, as for SYNTAX OCTET STRING (SIZE (0..255)). Other types are
+// wrongType and other lengths wrongLength.
+func OctetStringValidator(sizes ...Range) Validator {
+	return func(v VarBind) TestSetResult {
+		x, ok := v.OctetString()
+		if !ok || v.Type != OctetStringT {
+			return TestSetWrongType
+		}
+		if !inRanges(int64(len(x)), sizes) {
+			return TestSetWrongLength
+		}
+		return TestSetNoError
+	}
+}
+
+// TestSet returns a test-set handler that validates values with v before
+// handing them to f, or accepts them if f is nil, e.g.
+//
+//	c.OnTestSet(oid, agx.EnumValidator(1, 2).TestSet(nil))
+func (v Validator) TestSet(f TestSetHandler) TestSetHandler {
+	return func(vb VarBind, sessionId uint32) TestSetResult {
+		if r := v(vb); r != TestSetNoError {
+			return r
+		}
+		if f == nil {
+			return TestSetNoError
+		}
+		return f(vb, sessionId)
+	}
+}
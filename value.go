@@ -0,0 +1,258 @@
+package agx
+
+// This file contains the values variables are bound to (RFC2741~5.4) and typed
+// accessors for them
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+)
+
+// Value is the value of a variable. Each varbind type other than Null and the
+// exceptions, which have no value, has a Value type that knows its encoding.
+type Value interface {
+	//Type returns the varbind type of the value, e.g. IntegerT
+	Type() int16
+	WireSize() int
+	AppendBinary(dst []byte) ([]byte, error)
+	String() string
+}
+
+type (
+	Integer   int32
+	Counter32 uint32
+	Gauge32   uint32
+	TimeTicks uint32
+	Counter64 uint64
+	//Opaque holds the octets of an opaque value, encoded as an octet string
+	Opaque struct{ OctetString }
+	//Oid is an object identifier value
+	Oid struct{ Subtree }
+	//IpAddress holds an IPv4 address, which is all an IpAddress may hold
+	IpAddress net.IP
+)
+
+func (Integer) Type() int16     { return IntegerT }
+func (Counter32) Type() int16   { return Counter32T }
+func (Gauge32) Type() int16     { return Gauge32T }
+func (TimeTicks) Type() int16   { return TimeTicksT }
+func (Counter64) Type() int16   { return Counter64T }
+func (OctetString) Type() int16 { return OctetStringT }
+func (Opaque) Type() int16      { return OpaqueT }
+func (Oid) Type() int16         { return ObjectIdentifierT }
+func (IpAddress) Type() int16   { return IpAddressT }
+
+func (Integer) WireSize() int   { return 4 }
+func (Counter32) WireSize() int { return 4 }
+func (Gauge32) WireSize() int   { return 4 }
+func (TimeTicks) WireSize() int { return 4 }
+func (Counter64) WireSize() int { return 8 }
+func (IpAddress) WireSize() int { return 4 + net.IPv4len }
+
+func (x Integer) AppendBinary(dst []byte) ([]byte, error) {
+	return binary.BigEndian.AppendUint32(dst, uint32(x)), nil
+}
+
+func (x Counter32) AppendBinary(dst []byte) ([]byte, error) {
+	return binary.BigEndian.AppendUint32(dst, uint32(x)), nil
+}
+
+func (x Gauge32) AppendBinary(dst []byte) ([]byte, error) {
+	return binary.BigEndian.AppendUint32(dst, uint32(x)), nil
+}
+
+func (x TimeTicks) AppendBinary(dst []byte) ([]byte, error) {
+	return binary.BigEndian.AppendUint32(dst, uint32(x)), nil
+}
+
+func (x Counter64) AppendBinary(dst []byte) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(dst, uint64(x)), nil
+}
+
+func (x IpAddress) AppendBinary(dst []byte) ([]byte, error) {
+	ip := net.IP(x).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("ip address %v is not ipv4", net.IP(x))
+	}
+	return OctetString{OctetStringLength: net.IPv4len, Octets: ip}.AppendBinary(dst)
+}
+
+func (x Integer) String() string   { return strconv.FormatInt(int64(x), 10) }
+func (x Counter32) String() string { return strconv.FormatUint(uint64(x), 10) }
+func (x Gauge32) String() string   { return strconv.FormatUint(uint64(x), 10) }
+func (x TimeTicks) String() string { return strconv.FormatUint(uint64(x), 10) }
+func (x Counter64) String() string { return strconv.FormatUint(uint64(x), 10) }
+func (x IpAddress) String() string { return net.IP(x).String() }
+
+// NewOpaque returns an opaque value holding a copy of b
+func NewOpaque(b []byte) Opaque {
+	return Opaque{*NewOctetString(b)}
+}
+
+// net-snmp carries floats and doubles in opaque values, BER encoded with an
+// extension tag of their own and holding the IEEE 754 value in network order
+const (
+	opaqueTag1   = 0x9f
+	opaqueFloat  = 0x78
+	opaqueDouble = 0x79
+)
+
+// NewOpaqueFloat returns an opaque value holding x as net-snmp encodes floats
+func NewOpaqueFloat(x float32) Opaque {
+	b := []byte{opaqueTag1, opaqueFloat, 4}
+	return NewOpaque(binary.BigEndian.AppendUint32(b, math.Float32bits(x)))
+}
+
+// NewOpaqueDouble returns an opaque value holding x as net-snmp encodes
+// doubles
+func NewOpaqueDouble(x float64) Opaque {
+	b := []byte{opaqueTag1, opaqueDouble, 8}
+	return NewOpaque(binary.BigEndian.AppendUint64(b, math.Float64bits(x)))
+}
+
+// float returns the float or double held by o, its size in bits, and whether
+// o holds one
+func (o Opaque) float() (float64, int, bool) {
+	b := o.Bytes()
+	if len(b) < 3 || b[0] != opaqueTag1 {
+		return 0, 0, false
+	}
+	switch {
+	case b[1] == opaqueFloat && b[2] == 4 && len(b) == 7:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b[3:]))),
+			32, true
+	case b[1] == opaqueDouble && b[2] == 8 && len(b) == 11:
+		return math.Float64frombits(binary.BigEndian.Uint64(b[3:])), 64, true
+	}
+	return 0, 0, false
+}
+
+// decodeValue decodes a value of type t from the start of buf, returning the
+// number of bytes decoded
+func decodeValue(t int16, buf []byte) (Value, int, error) {
+	switch t {
+	case IntegerT, Counter32T, Gauge32T, TimeTicksT:
+		if err := need(buf, 4); err != nil {
+			return nil, 0, err
+		}
+		x := binary.BigEndian.Uint32(buf)
+		switch t {
+		case IntegerT:
+			return Integer(x), 4, nil
+		case Counter32T:
+			return Counter32(x), 4, nil
+		case Gauge32T:
+			return Gauge32(x), 4, nil
+		}
+		return TimeTicks(x), 4, nil
+	case Counter64T:
+		if err := need(buf, 8); err != nil {
+			return nil, 0, err
+		}
+		return Counter64(binary.BigEndian.Uint64(buf)), 8, nil
+	case OctetStringT, OpaqueT, IpAddressT:
+		var x OctetString
+		n, err := x.UnmarshalBinary(buf)
+		if err != nil {
+			return nil, n, err
+		}
+		switch t {
+		case OpaqueT:
+			return Opaque{x}, n, nil
+		case IpAddressT:
+			if x.OctetStringLength != net.IPv4len {
+				return nil, n, fmt.Errorf("ip address of length %d",
+					x.OctetStringLength)
+			}
+			return IpAddress(x.Octets[:net.IPv4len]), n, nil
+		}
+		return x, n, nil
+	case ObjectIdentifierT:
+		var x Subtree
+		n, err := x.UnmarshalBinary(buf)
+		if err != nil {
+			return nil, n, err
+		}
+		return Oid{x}, n, nil
+	case NullT, NoSuchObjectT, NoSuchInstanceT, EndOfMibViewT:
+		return nil, 0, nil
+	}
+	return nil, 0, fmt.Errorf("unknown varbind type %d", t)
+}
+
+// accessors ..................................................................
+
+// Int32 returns the value of an Integer variable
+func (v VarBind) Int32() (int32, bool) {
+	x, ok := v.Data.(Integer)
+	return int32(x), ok
+}
+
+// Uint32 returns the value of a Counter32, Gauge32 or TimeTicks variable
+func (v VarBind) Uint32() (uint32, bool) {
+	switch x := v.Data.(type) {
+	case Counter32:
+		return uint32(x), true
+	case Gauge32:
+		return uint32(x), true
+	case TimeTicks:
+		return uint32(x), true
+	}
+	return 0, false
+}
+
+// Uint64 returns the value of a Counter64 variable
+func (v VarBind) Uint64() (uint64, bool) {
+	x, ok := v.Data.(Counter64)
+	return uint64(x), ok
+}
+
+// OctetString returns the octets of an OctetString or Opaque variable
+func (v VarBind) OctetString() ([]byte, bool) {
+	switch x := v.Data.(type) {
+	case OctetString:
+		return x.Bytes(), true
+	case Opaque:
+		return x.Bytes(), true
+	}
+	return nil, false
+}
+
+// Float returns the value of an Opaque variable holding a net-snmp float
+func (v VarBind) Float() (float32, bool) {
+	x, ok := v.Data.(Opaque)
+	if !ok {
+		return 0, false
+	}
+	f, bits, ok := x.float()
+	return float32(f), ok && bits == 32
+}
+
+// Double returns the value of an Opaque variable holding a net-snmp double,
+// or a float, which a double holds exactly
+func (v VarBind) Double() (float64, bool) {
+	x, ok := v.Data.(Opaque)
+	if !ok {
+		return 0, false
+	}
+	f, _, ok := x.float()
+	return f, ok
+}
+
+// OID returns the value of an ObjectIdentifier variable
+func (v VarBind) OID() (Subtree, bool) {
+	x, ok := v.Data.(Oid)
+	return x.Subtree, ok
+}
+
+// IP returns the value of an IpAddress variable
+func (v VarBind) IP() (net.IP, bool) {
+	x, ok := v.Data.(IpAddress)
+	return net.IP(x), ok
+}
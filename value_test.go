@@ -0,0 +1,164 @@
+package agx_test
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestValueAccessors(t *testing.T) {
+	name := subtree(t, "1.3.6.1.2.1.1.5.0")
+
+	i := agx.IntegerVarBind(name, -47)
+	if x, ok := i.Int32(); !ok || x != -47 {
+		t.Errorf("Int32 of %v returned %v %v", i, x, ok)
+	}
+	if _, ok := i.Uint32(); ok {
+		t.Errorf("Uint32 of %v succeeded", i)
+	}
+
+	g := agx.Gauge32VarBind(name, 47)
+	if x, ok := g.Uint32(); !ok || x != 47 {
+		t.Errorf("Uint32 of %v returned %v %v", g, x, ok)
+	}
+	if _, ok := g.Int32(); ok {
+		t.Errorf("Int32 of %v succeeded", g)
+	}
+
+	c := agx.VarBind{Type: agx.Counter64T, Name: name, Data: agx.Counter64(1) << 40}
+	if x, ok := c.Uint64(); !ok || x != 1<<40 {
+		t.Errorf("Uint64 of %v returned %v %v", c, x, ok)
+	}
+
+	s := *agx.OctetStringVarBind(name, []byte("muffin"))
+	if x, ok := s.OctetString(); !ok || string(x) != "muffin" {
+		t.Errorf("OctetString of %v returned %q %v", s, x, ok)
+	}
+
+	o := agx.VarBind{Type: agx.ObjectIdentifierT, Name: name, Data: agx.Oid{Subtree: name}}
+	if x, ok := o.OID(); !ok || !x.Eq(name) {
+		t.Errorf("OID of %v returned %v %v", o, x, ok)
+	}
+
+	ip := agx.VarBind{Type: agx.IpAddressT, Name: name, Data: agx.IpAddress{10, 0, 0, 47}}
+	if x, ok := ip.IP(); !ok || !reflect.DeepEqual(x, net.IP{10, 0, 0, 47}) {
+		t.Errorf("IP of %v returned %v %v", ip, x, ok)
+	}
+
+	//data inconsistent with the type is refused
+	bad := agx.VarBind{Type: agx.IntegerT, Name: name, Data: agx.Gauge32(47)}
+	if _, ok := bad.Int32(); ok {
+		t.Errorf("Int32 of %v succeeded", bad)
+	}
+	if _, err := bad.MarshalBinary(); err == nil {
+		t.Errorf("no error marshalling %v", bad)
+	}
+	if vb := agx.NewVarBind(name, agx.Gauge32(47)); vb.Type != agx.Gauge32T {
+		t.Errorf("NewVarBind returned %v", vb)
+	}
+	if _, ok := agx.NoSuchObjectVarBind(name).OctetString(); ok {
+		t.Errorf("OctetString of noSuchObject succeeded")
+	}
+}
+
+func TestOpaqueFloat(t *testing.T) {
+	name := subtree(t, "1.3.6.1.4.1.2021.13.16.2.1.3.1")
+
+	//as encoded by net-snmp for 21.5 and -0.25
+	f := agx.FloatVarBind(name, 21.5)
+	if b, _ := f.OctetString(); !reflect.DeepEqual(b,
+		[]byte{0x9f, 0x78, 0x04, 0x41, 0xac, 0x00, 0x00}) {
+		t.Errorf("float encoded as % x", b)
+	}
+	d := agx.DoubleVarBind(name, -0.25)
+	if b, _ := d.OctetString(); !reflect.DeepEqual(b,
+		[]byte{0x9f, 0x79, 0x08, 0xbf, 0xd0, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("double encoded as % x", b)
+	}
+
+	//values survive the wire
+	for _, vb := range []agx.VarBind{f, d} {
+		buf, err := vb.MarshalBinary()
+		if err != nil {
+			t.Fatalf("error marshalling %v: %v", vb, err)
+		}
+		var x agx.VarBind
+		if _, err := x.UnmarshalBinary(buf); err != nil {
+			t.Fatalf("error unmarshalling %v: %v", vb, err)
+		}
+		if !reflect.DeepEqual(x, vb) {
+			t.Errorf("%v unmarshalled as %v", vb, x)
+		}
+	}
+
+	if x, ok := f.Float(); !ok || x != 21.5 {
+		t.Errorf("Float of %v returned %v %v", f, x, ok)
+	}
+	if x, ok := f.Double(); !ok || x != 21.5 {
+		t.Errorf("Double of %v returned %v %v", f, x, ok)
+	}
+	if x, ok := d.Double(); !ok || x != -0.25 {
+		t.Errorf("Double of %v returned %v %v", d, x, ok)
+	}
+	if _, ok := d.Float(); ok {
+		t.Errorf("Float of double %v succeeded", d)
+	}
+	other := agx.NewVarBind(name, agx.NewOpaque([]byte{0x9f, 0x78, 0x04}))
+	if _, ok := other.Double(); ok {
+		t.Errorf("Double of %v succeeded", other)
+	}
+}
+
+func TestBits(t *testing.T) {
+	name := subtree(t, "1.3.6.1.2.1.2.2.1.99.1")
+
+	//bit 0 is the high bit of the first octet
+	b := agx.NewBits(0, 9)
+	if !reflect.DeepEqual([]byte(b), []byte{0x80, 0x40}) {
+		t.Errorf("bits 0 and 9 encoded as % x", []byte(b))
+	}
+	if !b.Test(9) || b.Test(1) || b.Test(100) {
+		t.Errorf("wrong bits of %v", b)
+	}
+	b.Clear(0)
+	if b.Test(0) || len(b) != 2 {
+		t.Errorf("bit 0 not cleared from % x", []byte(b))
+	}
+
+	vb := agx.BitsVarBind(name, agx.NewBits(3, 17))
+	if x, ok := vb.Bits(); !ok || !reflect.DeepEqual(x.Positions(), []int{3, 17}) {
+		t.Errorf("Bits of %v returned %v %v", vb, x, ok)
+	}
+	if _, ok := agx.IntegerVarBind(name, 1).Bits(); ok {
+		t.Errorf("Bits of an integer succeeded")
+	}
+
+	names := agx.BitNames{"up": 0, "down": 1, "testing": 10}
+	nb, err := names.Bits("down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//as long as the highest named bit
+	if !reflect.DeepEqual([]byte(nb), []byte{0x40, 0x00}) {
+		t.Errorf("down encoded as % x", []byte(nb))
+	}
+	if err := names.Set(&nb, "testing"); err != nil {
+		t.Fatal(err)
+	}
+	if x, err := names.Test(nb, "testing"); !x || err != nil {
+		t.Errorf("testing not set in %v: %v", nb, err)
+	}
+	if !reflect.DeepEqual(names.Names(nb), []string{"down", "testing"}) {
+		t.Errorf("names of %v are %v", nb, names.Names(nb))
+	}
+	if err := names.Clear(nb, "down"); err != nil {
+		t.Fatal(err)
+	}
+	if err := names.Set(&nb, "sideways"); err == nil {
+		t.Errorf("unknown bit set")
+	}
+	if _, err := names.Bits("sideways"); err == nil {
+		t.Errorf("unknown bit accepted")
+	}
+}
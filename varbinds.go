@@ -0,0 +1,69 @@
+package agx
+
+// This file contains lists of varbinds kept in oid order, for agents that
+// serve a view of the mib they build ahead of requests
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"sort"
+)
+
+// VarBindList is a list of varbinds, which once sorted by name can answer get
+// and getnext requests from a view of the mib built ahead of them
+type VarBindList []VarBind
+
+func (l VarBindList) Len() int           { return len(l) }
+func (l VarBindList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l VarBindList) Less(i, j int) bool { return l[i].Name.LessThan(l[j].Name) }
+
+// Sort sorts the varbinds by name
+func (l VarBindList) Sort() {
+	sort.Sort(l)
+}
+
+// SearchOID returns the index of the first varbind not before oid in the
+// sorted list, and whether it is named oid. The index is the length of the
+// list when every varbind comes before oid.
+func (l VarBindList) SearchOID(oid Subtree) (int, bool) {
+	i := sort.Search(len(l), func(i int) bool {
+		return l[i].Name.GreaterThanEq(oid)
+	})
+	return i, i < len(l) && l[i].Name.Eq(oid)
+}
+
+// Get returns the varbind named oid in the sorted list
+func (l VarBindList) Get(oid Subtree) (VarBind, bool) {
+	i, ok := l.SearchOID(oid)
+	if !ok {
+		return VarBind{}, false
+	}
+	return l[i], true
+}
+
+// NextAfter returns the first varbind following oid in the sorted list, as a
+// getnext binds it. There is none once oid is at or past the last varbind.
+func (l VarBindList) NextAfter(oid Subtree) (VarBind, bool) {
+	i, ok := l.SearchOID(oid)
+	if ok {
+		i++
+	}
+	if i >= len(l) {
+		return VarBind{}, false
+	}
+	return l[i], true
+}
+
+// InsertSorted inserts vb into the sorted list in order, replacing the
+// varbind of the same name if there is one
+func (l *VarBindList) InsertSorted(vb VarBind) {
+	i, ok := l.SearchOID(vb.Name)
+	if ok {
+		(*l)[i] = vb
+		return
+	}
+	*l = append(*l, VarBind{})
+	copy((*l)[i+1:], (*l)[i:])
+	(*l)[i] = vb
+}
@@ -0,0 +1,65 @@
+package agx_test
+
+import (
+	"github.com/rcgoodfellow/agx"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestVarBindList(t *testing.T) {
+
+	var l agx.VarBindList
+	for i, x := range []string{"1.3.6.1.2.1.10", "1.3.6.1.2.1.2.1",
+		"1.3.6.1.2.1.9", "1.3.6.1.2.1.2"} {
+		l = append(l, agx.IntegerVarBind(subtree(t, x), int32(i)))
+	}
+	l.Sort()
+	if !sort.IsSorted(l) {
+		t.Fatalf("list not sorted %v", l)
+	}
+
+	//inserting keeps the order, and replaces a varbind of the same name
+	l.InsertSorted(agx.IntegerVarBind(subtree(t, "1.3.6.1.2.1.3"), 4))
+	l.InsertSorted(agx.IntegerVarBind(subtree(t, "1.3.6.1.2.1.9"), 5))
+	l.InsertSorted(agx.IntegerVarBind(subtree(t, "1.3.6.1.2.1.11"), 6))
+	l.InsertSorted(agx.IntegerVarBind(subtree(t, "1.3.6.1.2.1.1"), 7))
+	var names []string
+	for _, vb := range l {
+		names = append(names, vb.Name.String())
+	}
+	expect := []string{"1.3.6.1.2.1.1", "1.3.6.1.2.1.2", "1.3.6.1.2.1.2.1",
+		"1.3.6.1.2.1.3", "1.3.6.1.2.1.9", "1.3.6.1.2.1.10", "1.3.6.1.2.1.11"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("inserted %v, expected %v", names, expect)
+	}
+	if vb, ok := l.Get(subtree(t, "1.3.6.1.2.1.9")); !ok || vb.Data != agx.Integer(5) {
+		t.Errorf("replaced varbind is %v", vb)
+	}
+
+	tests := []struct {
+		oid   string
+		index int
+		found bool
+		next  string
+	}{
+		{"1.3.6.1.2.1", 0, false, "1.3.6.1.2.1.1"},
+		{"1.3.6.1.2.1.2", 1, true, "1.3.6.1.2.1.2.1"},
+		{"1.3.6.1.2.1.2.0", 2, false, "1.3.6.1.2.1.2.1"},
+		{"1.3.6.1.2.1.4", 4, false, "1.3.6.1.2.1.9"},
+		{"1.3.6.1.2.1.11", 6, true, ""},
+		{"1.3.6.1.2.2", 7, false, ""},
+	}
+	for _, x := range tests {
+		oid := subtree(t, x.oid)
+		if i, ok := l.SearchOID(oid); i != x.index || ok != x.found {
+			t.Errorf("search %s = %d %v, expected %d %v", x.oid, i, ok,
+				x.index, x.found)
+		}
+		vb, ok := l.NextAfter(oid)
+		if ok != (x.next != "") || ok && vb.Name.String() != x.next {
+			t.Errorf("next after %s = %v %v, expected %q", x.oid, vb, ok,
+				x.next)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package agx
+
+// This file contains the watchdog, which keeps a handler that is stuck from
+// holding up the response to the master agent until the master times out
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrHandlerDeadline is the error of a variable whose handler overran its
+// deadline
+var ErrHandlerDeadline = errors.New("handler deadline exceeded")
+
+// WithHandlerDeadline gives get and test-set handlers a deadline of the
+// timeout of the registration they are beneath, or of the session, less
+// margin, leaving margin for the response to reach the master agent. A
+// request a handler overruns its deadline for is answered with a
+// processingError for the variable, rather than the whole session timing out
+// at the master.
+func WithHandlerDeadline(margin time.Duration) Option {
+	return func(c *Connection) {
+		c.deadlines = true
+		c.deadlineMargin = margin
+	}
+}
+
+// SetHandlerDeadline bounds how long get and test-set handlers may run. A
+// handler beneath a subtree registered with a timeout has that timeout less
+// margin, others have deadline. Handlers that overrun are logged and left to
+// finish in the background, the variable they were called for fails with
+// ErrHandlerDeadline. As the lock of its region is held until the handler
+// returns, handlers for the same region fail in the meantime too. A zero
+// deadline turns deadlines off.
+func (d *Dispatcher) SetHandlerDeadline(deadline, margin time.Duration) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.deadline, d.deadlineMargin = deadline, margin
+}
+
+// watch calls f, the call of the handler h, holding the lock of its region.
+// When f overruns the deadline of h watch fails with ErrHandlerDeadline, and
+// f runs on without the caller waiting for it.
+func (d *Dispatcher) watch(h *HandlerBundle, f func()) error {
+	limit := d.handlerDeadline(h)
+	if limit <= 0 {
+		defer d.regions.lock(h).Unlock()
+		f()
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer d.regions.lock(h).Unlock()
+		f()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-d.after(limit):
+		d.logf("[watchdog] %s handler for %s has not returned after %v",
+			h.Type, h.Oid, limit)
+		return ErrHandlerDeadline
+	}
+}
+
+// handlerDeadline returns the deadline of h, zero if it has none
+func (d *Dispatcher) handlerDeadline(h *HandlerBundle) time.Duration {
+	d.mtx.Lock()
+	deadline, margin := d.deadline, d.deadlineMargin
+	d.mtx.Unlock()
+	if deadline <= 0 {
+		return 0
+	}
+
+	if timeout := d.regions.timeout(h); timeout > 0 {
+		deadline = timeout - margin
+		if deadline <= 0 {
+			//the margin leaves nothing, the handler is at least tried
+			deadline = time.Millisecond
+		}
+	}
+	return deadline
+}
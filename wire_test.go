@@ -0,0 +1,111 @@
+package agx_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/rcgoodfellow/agx"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadFixture reads the PDU of the wire fixture testdata/wire/name.hex, hex
+// bytes with the rest of each line after a # taken as a comment
+func loadFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "wire", name+".hex"))
+	if err != nil {
+		t.Fatalf("error opening fixture %s: %v", name, err)
+	}
+	defer f.Close()
+
+	var buf []byte
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		b, err := hex.DecodeString(strings.Join(strings.Fields(line), ""))
+		if err != nil {
+			t.Fatalf("bad fixture %s: %v", name, err)
+		}
+		buf = append(buf, b...)
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatalf("error reading fixture %s: %v", name, err)
+	}
+	return buf
+}
+
+// the fixtures in the order of the session they make up, with what they
+// decode to
+var wireFixtures = []struct {
+	name   string
+	expect string
+}{
+	{"open",
+		"Open sid=0 tid=0 pid=1 timeout=0 id= descr=\"Net-SNMP AgentX sub-agent\""},
+	{"open-response",
+		"Response sid=10 tid=0 pid=1 uptime=4711 error=noError"},
+	{"register",
+		"Register sid=10 tid=0 pid=2 subtree=1.3.6.1.4.1.8072.2 priority=127 timeout=0"},
+	{"getnext",
+		"GetNext sid=10 tid=3 pid=5 ranges=[1.3.6.1.4.1.8072.2-1.3.6.1.4.1.8072.3]"},
+	{"getnext-response",
+		"Response sid=10 tid=3 pid=5 uptime=0 error=noError varbinds=[1.3.6.1.4.1.8072.2.1.0 = INTEGER: 47]"},
+	{"getbulk",
+		"GetBulk sid=10 tid=4 pid=6 non-repeaters=0 max-repetitions=10 ranges=[1.3.6.1.2.1.1]"},
+	{"testset",
+		"TestSet sid=10 tid=7 pid=8 varbinds=[1.3.6.1.4.1.8072.2.2.0 = STRING: \"muffin\"]"},
+	{"testset-response",
+		"Response sid=10 tid=7 pid=8 uptime=0 error=noError"},
+	{"commitset",
+		"CommitSet sid=10 tid=7 pid=9"},
+	{"cleanupset",
+		"CleanupSet sid=10 tid=7 pid=10"},
+	{"close",
+		"Close sid=10 tid=0 pid=3 reason=shutdown"},
+}
+
+func TestWireFixtures(t *testing.T) {
+	var session []byte
+	for _, x := range wireFixtures {
+		buf := loadFixture(t, x.name)
+		session = append(session, buf...)
+
+		m, err := agx.ParsePDU(buf)
+		if err != nil {
+			t.Errorf("error parsing %s: %v", x.name, err)
+			continue
+		}
+		if s := fmt.Sprint(m); s != x.expect {
+			t.Errorf("%s parsed as %s, expected %s", x.name, s, x.expect)
+		}
+
+		//encoding gives back the very same bytes
+		out, err := m.MarshalBinary()
+		if err != nil {
+			t.Errorf("error encoding %s: %v", x.name, err)
+			continue
+		}
+		if !bytes.Equal(out, buf) {
+			t.Errorf("%s encoded as\n%s\nexpected\n%s", x.name, hex.Dump(out),
+				hex.Dump(buf))
+		}
+	}
+
+	//the fixtures read back as a stream
+	r := bytes.NewReader(session)
+	for _, x := range wireFixtures {
+		if _, err := agx.ReadMessage(r); err != nil {
+			t.Fatalf("error reading %s from the session: %v", x.name, err)
+		}
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d bytes left over reading the session", r.Len())
+	}
+}
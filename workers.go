@@ -0,0 +1,96 @@
+package agx
+
+// This file contains the pool of workers that requests from the master agent
+// are handled on
+// ~~~
+// Copyright Ryan Goodfellow 2017 - All Rights Reserved
+// GPLv3
+
+import (
+	"sync"
+)
+
+// WithWorkers handles requests from the master agent on a pool of n workers
+// rather than on the goroutine that reads from the session, so that a slow
+// handler does not hold up every other request, or the responses to pings.
+// The phases of a set transaction are still handled one after the other in
+// the order they were received. At most n requests wait for a worker, after
+// that reading from the session waits too.
+func WithWorkers(n int) Option {
+	return func(c *Connection) {
+		if n > 0 {
+			c.workers = newPool(n)
+		}
+	}
+}
+
+// pool runs work on a fixed number of goroutines
+type pool struct {
+	work chan func()
+
+	//work queued behind the work being done for a set transaction, keyed by
+	//transaction id
+	mtx   sync.Mutex
+	lanes map[uint32][]func()
+}
+
+func newPool(n int) *pool {
+	p := &pool{
+		work:  make(chan func(), n),
+		lanes: make(map[uint32][]func()),
+	}
+	for i := 0; i < n; i++ {
+		go p.run()
+	}
+	return p
+}
+
+func (p *pool) run() {
+	for f := range p.work {
+		f()
+	}
+}
+
+// dispatch runs f for the request h on a worker, set phases of the same
+// transaction are run in order
+func (p *pool) dispatch(h *Header, f func()) {
+	switch h.Type {
+	case TestSetPDU, CommitSetPDU, UndoSetPDU, CleanupSetPDU:
+	default:
+		p.work <- f
+		return
+	}
+
+	p.mtx.Lock()
+	if q, ok := p.lanes[h.TransactionId]; ok {
+		p.lanes[h.TransactionId] = append(q, f)
+		p.mtx.Unlock()
+		return
+	}
+	p.lanes[h.TransactionId] = nil
+	p.mtx.Unlock()
+
+	p.work <- func() { p.drain(h.TransactionId, f) }
+}
+
+// drain runs f and then the work queued behind it for transaction tid
+func (p *pool) drain(tid uint32, f func()) {
+	for {
+		f()
+
+		p.mtx.Lock()
+		q := p.lanes[tid]
+		if len(q) == 0 {
+			delete(p.lanes, tid)
+			p.mtx.Unlock()
+			return
+		}
+		f, p.lanes[tid] = q[0], q[1:]
+		p.mtx.Unlock()
+	}
+}
+
+// stop ends the workers once the work already dispatched is done
+func (p *pool) stop() {
+	close(p.work)
+}